@@ -0,0 +1,241 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLogTimeout bounds a write to a log sink, so a stalled collector
+// delays the end of a session rather than blocking it forever.
+const accessLogTimeout = 5 * time.Second
+
+// SyslogRecorder is a SessionRecorder sending one RFC 5424 message per
+// session, with the record as structured data, to a syslog collector.
+type SyslogRecorder struct {
+	// Network is "udp", "tcp" or "unixgram". TCP messages use octet-counting
+	// framing (RFC 6587).
+	Network string
+	Address string
+	// Facility is the syslog facility code; zero is sent as user (1).
+	Facility int
+	// Hostname defaults to os.Hostname, AppName to "socks5".
+	Hostname string
+	AppName  string
+	// Redaction, if set, redacts the records before they are sent.
+	Redaction *Redaction
+
+	mu    sync.Mutex
+	conn  net.Conn
+	clock clock
+}
+
+// syslogEnterpriseID is the private enterprise number of the structured data
+// element, the one reserved for documentation by RFC 5424.
+const syslogEnterpriseID = "32473"
+
+// Record sends record, redialing once if the connection failed. Errors are logged.
+func (r *SyslogRecorder) Record(record SessionRecord) {
+	msg := r.format(r.Redaction.Record(record))
+	if r.Network == "tcp" {
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.write(msg)
+	if err != nil && r.conn != nil {
+		r.conn.Close()
+		r.conn = nil
+		err = r.write(msg)
+	}
+	if err != nil {
+		logSession(record.SessionID, "syslog error", err)
+	}
+}
+
+func (r *SyslogRecorder) write(msg string) error {
+	if r.conn == nil {
+		conn, err := net.DialTimeout(r.Network, r.Address, accessLogTimeout)
+		if err != nil {
+			return err
+		}
+		r.conn = conn
+	}
+	r.conn.SetWriteDeadline(time.Now().Add(accessLogTimeout))
+	_, err := r.conn.Write([]byte(msg))
+	return err
+}
+
+// Close closes the connection to the collector.
+func (r *SyslogRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		return nil
+	}
+	err := r.conn.Close()
+	r.conn = nil
+	return err
+}
+
+func (r *SyslogRecorder) format(record SessionRecord) string {
+	facility := r.Facility
+	if facility == 0 {
+		facility = 1
+	}
+	hostname := r.Hostname
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+	appName := r.AppName
+	if appName == "" {
+		appName = "socks5"
+	}
+	const severityInfo = 6
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d session [session@%s",
+		facility*8+severityInfo,
+		timeNow(r.clock).Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogHeader(hostname), syslogHeader(appName), os.Getpid(), syslogEnterpriseID)
+	for _, field := range recordFields(record) {
+		fmt.Fprintf(&b, ` %s="%s"`, field[0], syslogParamEscaper.Replace(field[1]))
+	}
+	b.WriteString("] ")
+	b.WriteString(recordMessage(record))
+	return b.String()
+}
+
+var syslogParamEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+
+// syslogHeader returns s as a header field: printable ASCII without spaces, or "-".
+func syslogHeader(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// JournalRecorder is a SessionRecorder sending one entry per session, with
+// the record as SOCKS5_* fields, to systemd-journald over its native protocol.
+type JournalRecorder struct {
+	// Socket defaults to /run/systemd/journal/socket.
+	Socket string
+	// Identifier is the SYSLOG_IDENTIFIER, "socks5" by default.
+	Identifier string
+	// Redaction, if set, redacts the records before they are sent.
+	Redaction *Redaction
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+const defaultJournalSocket = "/run/systemd/journal/socket"
+
+// Record sends record to the journal, reconnecting once if the socket
+// failed. Errors are logged.
+func (r *JournalRecorder) Record(record SessionRecord) {
+	record = r.Redaction.Record(record)
+	identifier := r.Identifier
+	if identifier == "" {
+		identifier = "socks5"
+	}
+	var b []byte
+	b = appendJournalField(b, "MESSAGE", recordMessage(record))
+	b = appendJournalField(b, "PRIORITY", "6")
+	b = appendJournalField(b, "SYSLOG_IDENTIFIER", identifier)
+	for _, field := range recordFields(record) {
+		b = appendJournalField(b, "SOCKS5_"+strings.ToUpper(field[0]), field[1])
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.write(b)
+	if err != nil && r.conn != nil {
+		r.conn.Close()
+		r.conn = nil
+		err = r.write(b)
+	}
+	if err != nil {
+		logSession(record.SessionID, "journal error", err)
+	}
+}
+
+func (r *JournalRecorder) write(b []byte) error {
+	if r.conn == nil {
+		socket := r.Socket
+		if socket == "" {
+			socket = defaultJournalSocket
+		}
+		conn, err := net.Dial("unixgram", socket)
+		if err != nil {
+			return err
+		}
+		r.conn = conn
+	}
+	r.conn.SetWriteDeadline(time.Now().Add(accessLogTimeout))
+	_, err := r.conn.Write(b)
+	return err
+}
+
+// Close closes the journal socket.
+func (r *JournalRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		return nil
+	}
+	err := r.conn.Close()
+	r.conn = nil
+	return err
+}
+
+// appendJournalField appends KEY=value, or the length-prefixed binary form
+// when value spans lines.
+func appendJournalField(b []byte, key, value string) []byte {
+	if !strings.Contains(value, "\n") {
+		return append(append(append(b, key...), '='), value+"\n"...)
+	}
+	b = append(append(b, key...), '\n')
+	n := uint64(len(value))
+	for i := 0; i < 8; i++ {
+		b = append(b, byte(n>>(8*i)))
+	}
+	return append(b, value+"\n"...)
+}
+
+// recordFields lists the fields of record in a stable order.
+func recordFields(record SessionRecord) [][2]string {
+	return [][2]string{
+		{"id", record.SessionID},
+		{"client", record.ClientAddr},
+		{"username", record.Username},
+		{"target", record.Target},
+		{"labels", strings.Join(record.Labels, ",")},
+		{"start", record.Start.UTC().Format(time.RFC3339Nano)},
+		{"duration", record.End.Sub(record.Start).String()},
+		{"sent", strconv.FormatInt(record.Sent, 10)},
+		{"received", strconv.FormatInt(record.Received, 10)},
+		{"termination", record.Termination.String()},
+	}
+}
+
+// recordMessage is the human-readable line of record.
+func recordMessage(record SessionRecord) string {
+	user := record.Username
+	if user == "" {
+		user = "-"
+	}
+	return fmt.Sprintf("%s %s -> %s sent %d received %d in %s (%s)",
+		user, record.ClientAddr, record.Target, record.Sent, record.Received,
+		record.End.Sub(record.Start).Round(time.Millisecond), record.Termination)
+}
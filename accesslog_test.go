@@ -0,0 +1,134 @@
+package socks5
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRecord() SessionRecord {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	return SessionRecord{
+		SessionID:   "s1",
+		ClientAddr:  "127.0.0.1:5000",
+		Username:    `al"ice]`,
+		Target:      "example.com:443",
+		Labels:      []string{"team=qa", "purpose=crawler"},
+		Start:       start,
+		End:         start.Add(1500 * time.Millisecond),
+		Sent:        10,
+		Received:    20,
+		Termination: TerminationTargetEOF,
+	}
+}
+
+func TestSyslogRecorderUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	recorder := SyslogRecorder{Network: "udp", Address: conn.LocalAddr().String(), Facility: 16, Hostname: "proxy host", clock: newFakeClock()}
+	defer recorder.Close()
+	recorder.Record(testRecord())
+
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(buf[:n])
+	for _, want := range []string{
+		"<134>1 ",
+		" proxyhost socks5 ",
+		` session [session@32473 id="s1" client="127.0.0.1:5000" username="al\"ice\]" target="example.com:443" labels="team=qa,purpose=crawler"`,
+		` duration="1.5s" sent="10" received="20" termination="target_eof"] al"ice] 127.0.0.1:5000 -> example.com:443 sent 10 received 20 in 1.5s (target_eof)`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("message %q should contain %q", got, want)
+		}
+	}
+}
+
+func TestSyslogRecorderTCPFraming(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	recorder := SyslogRecorder{Network: "tcp", Address: l.Addr().String()}
+	defer recorder.Close()
+	go func() {
+		recorder.Record(testRecord())
+		recorder.Record(testRecord())
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		length, err := r.ReadString(' ')
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+		if err != nil {
+			t.Fatalf("should get a length prefix but got %q", length)
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(r, msg); err != nil || !strings.HasPrefix(string(msg), "<14>1 ") {
+			t.Fatalf("should get a framed message but got %q, %v", msg, err)
+		}
+	}
+}
+
+func TestJournalRecorder(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "journal")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Skip("unixgram not supported:", err)
+	}
+	defer conn.Close()
+	recorder := JournalRecorder{Socket: socket}
+	defer recorder.Close()
+	recorder.Record(testRecord())
+
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(buf[:n])
+	for _, want := range []string{
+		"MESSAGE=al\"ice] 127.0.0.1:5000 -> example.com:443 sent 10 received 20 in 1.5s (target_eof)\n",
+		"PRIORITY=6\n",
+		"SYSLOG_IDENTIFIER=socks5\n",
+		"SOCKS5_ID=s1\n",
+		"SOCKS5_TARGET=example.com:443\n",
+		"SOCKS5_LABELS=team=qa,purpose=crawler\n",
+		"SOCKS5_RECEIVED=20\n",
+		"SOCKS5_TERMINATION=target_eof\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("entry %q should contain %q", got, want)
+		}
+	}
+}
+
+func TestAppendJournalFieldMultiline(t *testing.T) {
+	got := appendJournalField(nil, "MESSAGE", "a\nb")
+	want := "MESSAGE\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n"
+	if string(got) != want {
+		t.Fatalf("should get %q but got %q", want, got)
+	}
+}
@@ -0,0 +1,193 @@
+package socks5
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxAggregatePairs bounds the (user, target) pairs counted per interval;
+// further pairs are counted together under OtherUsers and OtherTargets.
+const maxAggregatePairs = 10000
+
+// OtherTargets is the AccessAggregate.Target of pairs past the tracking limit.
+const OtherTargets = "*"
+
+// SampledRecorder is a SessionRecorder for connection rates at which a
+// record per session costs too much. It passes only a sample of the
+// records on to Recorder, but counts every session in per-interval
+// aggregates per user and target.
+type SampledRecorder struct {
+	// Recorder receives the sampled records. It may be nil to keep only
+	// the aggregates.
+	Recorder SessionRecorder
+	// Rate is the fraction of records passed to Recorder, from 0 to 1.
+	// Records are picked evenly rather than at random, e.g. every tenth
+	// for 0.1.
+	Rate float64
+	// Interval is the period of the aggregates, one minute by default.
+	// Periods are aligned to the clock, e.g. on the minute.
+	Interval time.Duration
+	// Aggregate is called with the aggregates of each period once it has
+	// ended, busiest pair first. Nil logs them, one line per pair.
+	Aggregate func(aggregates []AccessAggregate)
+	// Redaction, if set, redacts the users and targets logged, like
+	// Config.LogRedaction does for the rest of the server log.
+	Redaction *Redaction
+
+	mu      sync.Mutex
+	seen    int64
+	sampled int64
+	start   time.Time
+	pairs   map[accessPair]*AccessAggregate
+	stop    chan struct{}
+	clock   clock
+}
+
+// AccessAggregate counts the sessions of a user to a target in a period.
+type AccessAggregate struct {
+	Start    time.Time
+	End      time.Time
+	Username string
+	Target   string
+	Sessions int64
+	Sent     int64
+	Received int64
+}
+
+type accessPair struct {
+	username string
+	target   string
+}
+
+func (r *SampledRecorder) interval() time.Duration {
+	if r.Interval <= 0 {
+		return time.Minute
+	}
+	return r.Interval
+}
+
+// Record counts record in the aggregate of its end time and passes it to
+// Recorder if it is sampled.
+func (r *SampledRecorder) Record(record SessionRecord) {
+	now := timeNow(r.clock)
+	r.mu.Lock()
+	due := r.rotate(now)
+	if r.stop == nil {
+		r.stop = make(chan struct{})
+		go r.flushEvery(r.stop)
+	}
+	pair := accessPair{username: record.Username, target: record.Target}
+	aggregate, ok := r.pairs[pair]
+	if !ok {
+		if len(r.pairs) >= maxAggregatePairs {
+			pair = accessPair{username: OtherUsers, target: OtherTargets}
+		}
+		if aggregate, ok = r.pairs[pair]; !ok {
+			aggregate = &AccessAggregate{Start: r.start, Username: pair.username, Target: pair.target}
+			r.pairs[pair] = aggregate
+		}
+	}
+	aggregate.Sessions++
+	aggregate.Sent += record.Sent
+	aggregate.Received += record.Received
+
+	// Sample evenly: pass the record whenever seen*Rate reaches a new integer
+	r.seen++
+	sample := int64(float64(r.seen)*r.Rate) > r.sampled
+	if sample {
+		r.sampled++
+	}
+	r.mu.Unlock()
+
+	r.emit(due)
+	if sample && r.Recorder != nil {
+		r.Recorder.Record(record)
+	}
+}
+
+// rotate starts the period of now if the current one has ended, returning
+// the aggregates of the ended period. r.mu must be held.
+func (r *SampledRecorder) rotate(now time.Time) []AccessAggregate {
+	start := now.Truncate(r.interval())
+	if r.pairs != nil && start.Equal(r.start) {
+		return nil
+	}
+	due := r.take(r.start.Add(r.interval()))
+	r.start = start
+	r.pairs = make(map[accessPair]*AccessAggregate)
+	return due
+}
+
+// take returns the aggregates of the current period, ending at end, and
+// clears them. r.mu must be held.
+func (r *SampledRecorder) take(end time.Time) []AccessAggregate {
+	aggregates := make([]AccessAggregate, 0, len(r.pairs))
+	for _, aggregate := range r.pairs {
+		aggregate.End = end
+		aggregates = append(aggregates, *aggregate)
+	}
+	r.pairs = make(map[accessPair]*AccessAggregate)
+	sort.Slice(aggregates, func(i, j int) bool {
+		a, b := aggregates[i], aggregates[j]
+		if a.Sessions != b.Sessions {
+			return a.Sessions > b.Sessions
+		}
+		return a.Username < b.Username || a.Username == b.Username && a.Target < b.Target
+	})
+	return aggregates
+}
+
+// flushEvery emits the aggregates of ended periods, also when no session
+// ends to trigger it, until stop is closed.
+func (r *SampledRecorder) flushEvery(stop chan struct{}) {
+	ticker := time.NewTicker(r.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		r.mu.Lock()
+		due := r.rotate(timeNow(r.clock))
+		r.mu.Unlock()
+		r.emit(due)
+	}
+}
+
+func (r *SampledRecorder) emit(aggregates []AccessAggregate) {
+	if len(aggregates) == 0 {
+		return
+	}
+	if r.Aggregate != nil {
+		r.Aggregate(aggregates)
+		return
+	}
+	for _, a := range aggregates {
+		user := r.Redaction.Username(a.Username)
+		if user == "" {
+			user = "-"
+		}
+		logPrintf("access %s -> %s sessions %d sent %d received %d in %s",
+			user, r.Redaction.Address(a.Target), a.Sessions, a.Sent, a.Received, a.Start.UTC().Format(time.RFC3339))
+	}
+}
+
+// Close emits the aggregates of the current period, up to now, and closes
+// Recorder if it is an io.Closer.
+func (r *SampledRecorder) Close() error {
+	r.mu.Lock()
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+	due := r.take(timeNow(r.clock))
+	r.mu.Unlock()
+	r.emit(due)
+	if closer, ok := r.Recorder.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package socks5
+
+import (
+	"bytes"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recorderSlice []SessionRecord
+
+func (r *recorderSlice) Record(record SessionRecord) { *r = append(*r, record) }
+
+func TestSampledRecorder(t *testing.T) {
+	clock := newFakeClock()
+	var sampled recorderSlice
+	var periods [][]AccessAggregate
+	r := SampledRecorder{
+		Recorder:  &sampled,
+		Rate:      0.25,
+		Aggregate: func(aggregates []AccessAggregate) { periods = append(periods, aggregates) },
+		clock:     clock,
+	}
+	defer r.Close()
+	for i := 0; i < 8; i++ {
+		target := "a.example:443"
+		if i%4 == 0 {
+			target = "b.example:443"
+		}
+		r.Record(SessionRecord{SessionID: string(rune('0' + i)), Username: "alice", Target: target, Sent: 10, Received: 100})
+	}
+	if len(sampled) != 2 || sampled[0].SessionID != "3" || sampled[1].SessionID != "7" {
+		t.Fatalf("should sample every fourth record but got %v", sampled)
+	}
+	if len(periods) != 0 {
+		t.Fatalf("should not emit before the period ended but got %v", periods)
+	}
+
+	start := clock.Now()
+	clock.Advance(time.Minute)
+	r.Record(SessionRecord{Username: "bob", Target: "c.example:80"})
+	want := []AccessAggregate{
+		{Start: start, End: start.Add(time.Minute), Username: "alice", Target: "a.example:443", Sessions: 6, Sent: 60, Received: 600},
+		{Start: start, End: start.Add(time.Minute), Username: "alice", Target: "b.example:443", Sessions: 2, Sent: 20, Received: 200},
+	}
+	if len(periods) != 1 || !reflect.DeepEqual(want, periods[0]) {
+		t.Fatalf("should emit aggregates %v but got %v", want, periods)
+	}
+
+	clock.Advance(10 * time.Second)
+	r.Close()
+	if len(periods) != 2 || len(periods[1]) != 1 || periods[1][0].Username != "bob" || !periods[1][0].End.Equal(clock.Now()) {
+		t.Fatalf("Close should emit the current period but got %v", periods)
+	}
+}
+
+func TestSampledRecorderRedaction(t *testing.T) {
+	FlushLogs()
+	var logged bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logged)
+	r := SampledRecorder{Redaction: &Redaction{HashUsernames: true, HostLabels: 2}, clock: newFakeClock()}
+	r.Record(SessionRecord{Username: "alice", Target: "secret.internal.example:443"})
+	r.Close()
+	FlushLogs()
+	if out := logged.String(); strings.Contains(out, "alice") || strings.Contains(out, "secret") || !strings.Contains(out, "*.internal.example:443") {
+		t.Fatalf("should log redacted aggregates but got %q", out)
+	}
+}
@@ -3,7 +3,6 @@ package socks5
 import (
 	"errors"
 	"io"
-	"log"
 )
 
 type ClientAuthMessage struct {
@@ -37,9 +36,17 @@ const (
 var (
 	ErrPasswordCheckerNotSet = errors.New("error password checker not set")
 	ErrPasswordAuthFailure   = errors.New("error authenticating username/password")
+	ErrCredentialsTooLong    = errors.New("username or password longer than 255 bytes")
+	ErrTooManyMethods        = errors.New("too many auth methods")
 )
 
 func NewClientAuthMessage(conn io.Reader) (*ClientAuthMessage, error) {
+	return readClientAuthMessage(conn, 255)
+}
+
+// readClientAuthMessage reads a greeting, rejecting one announcing more than
+// maxMethods methods before reading them.
+func readClientAuthMessage(conn io.Reader, maxMethods int) (*ClientAuthMessage, error) {
 	// +----+----------+----------+
 	// |VER | NMETHODS | METHODS  |
 	// +----+----------+----------+
@@ -55,22 +62,28 @@ func NewClientAuthMessage(conn io.Reader) (*ClientAuthMessage, error) {
 	buf := make([]byte, 2)
 	_, err := io.ReadFull(conn, buf)
 	if err != nil {
-		log.Println("error reading version and nMethods", err)
+		if !closedByPeer(err) {
+			logPrintln("error reading version and nMethods", err)
+		}
 		return nil, err
 	}
 
 	// Validate version
 	if buf[0] != SOCKS5Version {
-		log.Println("error version not supported", buf[0])
+		logPrintln("error version not supported", buf[0])
 		return nil, ErrVersionNotSupported
 	}
 
 	// Read methods
 	nmethods := buf[1]
+	if int(nmethods) > maxMethods {
+		logPrintln(ErrTooManyMethods, nmethods)
+		return nil, ErrTooManyMethods
+	}
 	buf = make([]byte, nmethods)
 	_, err = io.ReadFull(conn, buf)
 	if err != nil {
-		log.Println("error reading methods", err)
+		logPrintln("error reading methods", err)
 		return nil, err
 	}
 
@@ -92,29 +105,36 @@ func SendServerAuthMessage(conn io.Writer, method Method) error {
 	buf := []byte{SOCKS5Version, method}
 	_, err := conn.Write(buf)
 	if err != nil {
-		log.Println("send server auth message", buf, "error:", err)
+		logPrintln("send server auth message", buf, "error:", err)
 	}
 	return err
 }
 
 func NewClientPasswordMessage(conn io.Reader) (*ClientPasswordMessage, error) {
+	message, _, err := readClientPasswordMessage(conn, false)
+	return message, err
+}
+
+// readClientPasswordMessage reads a username/password sub-negotiation and
+// its VER, which may be any value with anyVersion.
+func readClientPasswordMessage(conn io.Reader, anyVersion bool) (*ClientPasswordMessage, byte, error) {
 	// Read version and username length
 	buf := make([]byte, 2)
 	if _, err := io.ReadFull(conn, buf); err != nil {
-		log.Println("error reading version and username length", err)
-		return nil, err
+		logPrintln("error reading version and username length", err)
+		return nil, 0, err
 	}
 	version, usernameLen := buf[0], buf[1]
-	if version != PasswordMethodVersion {
-		log.Println("error password method version not supported", version)
-		return nil, ErrMethodVersionNotSupported
+	if version != PasswordMethodVersion && !anyVersion {
+		logPrintln("error password method version not supported", version)
+		return nil, 0, ErrMethodVersionNotSupported
 	}
 
 	// Read username, password length
 	buf = make([]byte, usernameLen+1)
 	if _, err := io.ReadFull(conn, buf); err != nil {
-		log.Println("error reading username and password length", err)
-		return nil, err
+		logPrintln("error reading username and password length", err)
+		return nil, 0, err
 	}
 	username, passwordLen := string(buf[:len(buf)-1]), buf[len(buf)-1]
 
@@ -123,17 +143,81 @@ func NewClientPasswordMessage(conn io.Reader) (*ClientPasswordMessage, error) {
 		buf = make([]byte, passwordLen)
 	}
 	if _, err := io.ReadFull(conn, buf[:passwordLen]); err != nil {
-		log.Println("error reading password", err)
-		return nil, err
+		logPrintln("error reading password", err)
+		return nil, 0, err
 	}
 
 	return &ClientPasswordMessage{
 		Username: username,
 		Password: string(buf[:passwordLen]),
-	}, nil
+	}, version, nil
 }
 
 func WriteServerPasswordMessage(conn io.Writer, status byte) error {
-	_, err := conn.Write([]byte{PasswordMethodVersion, status})
+	return writeServerPasswordMessage(conn, PasswordMethodVersion, status)
+}
+
+func writeServerPasswordMessage(conn io.Writer, version, status byte) error {
+	_, err := conn.Write([]byte{version, status})
+	return err
+}
+
+func WriteClientAuthMessage(conn io.Writer, methods []Method) error {
+	// +----+----------+----------+
+	// |VER | NMETHODS | METHODS  |
+	// +----+----------+----------+
+	// | 1  |    1     | 1 to 255 |
+	// +----+----------+----------+
+	buf := make([]byte, 0, 2+len(methods))
+	buf = append(buf, SOCKS5Version, byte(len(methods)))
+	buf = append(buf, methods...)
+	_, err := conn.Write(buf)
+	if err != nil {
+		logPrintln("write client auth message error:", err)
+	}
+	return err
+}
+
+func NewServerAuthMessage(conn io.Reader) (Method, error) {
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		logPrintln("error reading server auth message", err)
+		return MethodNoAcceptable, err
+	}
+	if buf[0] != SOCKS5Version {
+		logPrintln("error version not supported", buf[0])
+		return MethodNoAcceptable, ErrVersionNotSupported
+	}
+	return buf[1], nil
+}
+
+func WriteClientPasswordMessage(conn io.Writer, username, password string) error {
+	// +----+------+----------+------+----------+
+	// |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+	// +----+------+----------+------+----------+
+	// | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+	// +----+------+----------+------+----------+
+	if len(username) > 255 || len(password) > 255 {
+		return ErrCredentialsTooLong
+	}
+	buf := make([]byte, 0, 3+len(username)+len(password))
+	buf = append(buf, PasswordMethodVersion, byte(len(username)))
+	buf = append(buf, username...)
+	buf = append(buf, byte(len(password)))
+	buf = append(buf, password...)
+	_, err := conn.Write(buf)
 	return err
 }
+
+func NewServerPasswordMessage(conn io.Reader) (byte, error) {
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		logPrintln("error reading server password message", err)
+		return PasswordAuthFailure, err
+	}
+	if buf[0] != PasswordMethodVersion {
+		logPrintln("error password method version not supported", buf[0])
+		return PasswordAuthFailure, ErrMethodVersionNotSupported
+	}
+	return buf[1], nil
+}
@@ -0,0 +1,115 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BanEvent describes a source banned by ScanGuard.
+type BanEvent struct {
+	IP string `json:"ip"`
+	// Reason names what the source kept failing, e.g. "invalid handshakes",
+	// "authentication failures" or "rule violations".
+	Reason   string        `json:"reason"`
+	Until    time.Time     `json:"until"`
+	Duration time.Duration `json:"-"`
+}
+
+// BanAction is notified of ScanGuard bans, so hosts can integrate with
+// external firewalls.
+type BanAction interface {
+	Ban(event BanEvent) error
+}
+
+// BanActionFunc adapts a function to BanAction.
+type BanActionFunc func(event BanEvent) error
+
+func (f BanActionFunc) Ban(event BanEvent) error {
+	return f(event)
+}
+
+// defaultBanActionTimeout bounds a command or webhook call without Timeout.
+const defaultBanActionTimeout = 10 * time.Second
+
+// ExecBanAction runs a command for each ban, e.g.
+// {"ipset", "add", "socks5-ban", "{ip}", "timeout", "{seconds}"}.
+// "{ip}", "{reason}" and "{seconds}" in Args are replaced with the banned
+// source, the reason and the ban duration in whole seconds. The command is
+// run directly, not through a shell.
+type ExecBanAction struct {
+	Command string
+	Args    []string
+	// Timeout kills the command, 10s by default.
+	Timeout time.Duration
+}
+
+func (a *ExecBanAction) Ban(event BanEvent) error {
+	replacer := strings.NewReplacer(
+		"{ip}", event.IP,
+		"{reason}", event.Reason,
+		"{seconds}", strconv.FormatInt(int64(event.Duration/time.Second), 10),
+	)
+	args := make([]string, len(a.Args))
+	for i, arg := range a.Args {
+		args[i] = replacer.Replace(arg)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutOr(a.Timeout))
+	defer cancel()
+	output, err := exec.CommandContext(ctx, a.Command, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", a.Command, err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+// WebhookBanAction POSTs each ban to URL as a JSON BanEvent
+// ({"ip", "reason", "until"}). Responses other than 2xx are errors.
+type WebhookBanAction struct {
+	URL string
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+	// Timeout bounds the request, 10s by default.
+	Timeout time.Duration
+}
+
+func (a *WebhookBanAction) Ban(event BanEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutOr(a.Timeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("ban webhook: %s", resp.Status)
+	}
+	return nil
+}
+
+func timeoutOr(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return defaultBanActionTimeout
+	}
+	return timeout
+}
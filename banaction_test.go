@@ -0,0 +1,65 @@
+package socks5
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecBanAction(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	out := filepath.Join(t.TempDir(), "ban")
+	action := ExecBanAction{Command: "sh", Args: []string{"-c", `echo "$1 $2 $3" > ` + out, "sh", "{ip}", "{seconds}", "{reason}"}}
+	if err := action.Ban(BanEvent{IP: "192.0.2.1", Reason: "rule violations", Duration: 90 * time.Second}); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	got, _ := os.ReadFile(out)
+	if strings.TrimSpace(string(got)) != "192.0.2.1 90 rule violations" {
+		t.Fatalf("unexpected command arguments %q", got)
+	}
+
+	failing := ExecBanAction{Command: "sh", Args: []string{"-c", "echo nope; exit 3"}}
+	if err := failing.Ban(BanEvent{}); err == nil || !strings.Contains(err.Error(), "nope") {
+		t.Fatalf("should get the command output in the error but got %v", err)
+	}
+}
+
+func TestWebhookBanAction(t *testing.T) {
+	events := make(chan BanEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event BanEvent
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&event) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		events <- event
+	}))
+	defer server.Close()
+
+	until := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	action := WebhookBanAction{URL: server.URL}
+	if err := action.Ban(BanEvent{IP: "192.0.2.1", Reason: "authentication failures", Until: until}); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if event := <-events; event.IP != "192.0.2.1" || event.Reason != "authentication failures" || !event.Until.Equal(until) {
+		t.Fatalf("unexpected webhook payload %+v", event)
+	}
+
+	if err := (&WebhookBanAction{URL: server.URL + "/x", Client: server.Client()}).Ban(BanEvent{}); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	<-events
+	rejecting := httptest.NewServer(http.NotFoundHandler())
+	defer rejecting.Close()
+	if err := (&WebhookBanAction{URL: rejecting.URL}).Ban(BanEvent{}); err == nil {
+		t.Fatalf("should get an error for a 404 response")
+	}
+}
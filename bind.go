@@ -0,0 +1,218 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBindAccepted = errors.New("BIND listener already accepted its connection")
+	ErrBindTimeout  = errors.New("no connection to BIND listener in time")
+)
+
+// defaultBindTimeout bounds waiting for the BIND peer when Config.DialTimeout is not set.
+const defaultBindTimeout = 2 * time.Minute
+
+// BindListener is the client side of a BIND request. Addr is the address the
+// proxy server listens on, to be passed to the peer (e.g. in an FTP PORT
+// command); Accept waits for the proxy to report the peer's connection.
+// A BIND accepts exactly one connection.
+type BindListener struct {
+	conn net.Conn
+	addr net.Addr
+
+	mu       sync.Mutex
+	accepted bool
+}
+
+// Bind connects to the proxy server and sends a BIND request for a connection
+// from expectedPeer (host:port; the server may use it to filter the peer).
+// ctx bounds connecting and the handshake up to the first reply.
+func (c *Client) Bind(ctx context.Context, expectedPeer string) (*BindListener, error) {
+	conn, err := c.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stop := watchContext(ctx, conn)
+	reply, err := c.handshake(ctx, conn, CmdBind, expectedPeer)
+	if err = stop(err); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &BindListener{conn: conn, addr: replyAddr(reply)}, nil
+}
+
+// Accept waits for the second BIND reply and returns the connection to the
+// peer, whose RemoteAddr is the peer address reported by the proxy.
+func (l *BindListener) Accept() (net.Conn, error) {
+	return l.AcceptContext(context.Background())
+}
+
+// AcceptContext is Accept bounded by ctx. If ctx ends first, the BIND is
+// abandoned and its connection to the proxy server closed.
+func (l *BindListener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.accepted {
+		return nil, ErrBindAccepted
+	}
+	l.accepted = true
+
+	stop := watchContext(ctx, l.conn)
+	reply, err := NewServerReplyMessage(l.conn)
+	if err = stop(err); err != nil {
+		l.conn.Close()
+		return nil, err
+	}
+	if reply.Reply != ReplySuccess {
+		l.conn.Close()
+		return nil, ErrRequestRejected
+	}
+	return &bindConn{Conn: l.conn, remote: replyAddr(reply)}, nil
+}
+
+// Close closes the connection to the proxy server, and with it an accepted connection.
+func (l *BindListener) Close() error {
+	return l.conn.Close()
+}
+
+// Addr returns the address the proxy server is listening on for the peer.
+func (l *BindListener) Addr() net.Addr {
+	return l.addr
+}
+
+// bindConn is the proxy connection relaying traffic of the accepted peer.
+type bindConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *bindConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *bindConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errCloseWriteNotSupported
+}
+
+// replyAddr converts the address of a server reply to a net.Addr.
+func replyAddr(reply *ServerReplyMessage) net.Addr {
+	if ip := net.ParseIP(reply.BindIP); ip != nil {
+		return &net.TCPAddr{IP: ip, Port: int(reply.Port)}
+	}
+	return domainAddr(net.JoinHostPort(reply.BindIP, strconv.Itoa(int(reply.Port))))
+}
+
+// domainAddr is a host:port address whose host is a domain name.
+type domainAddr string
+
+func (a domainAddr) Network() string { return "tcp" }
+func (a domainAddr) String() string  { return string(a) }
+
+// handleBind serves BIND. It listens for a single connection from the
+// request's target host, replying once with the listening address and again
+// with the peer's address when it connects, then relays.
+func (s *SOCKS5Server) handleBind(conn io.ReadWriter, message *ClientRequestMessage, authCtx *AuthContext) error {
+	config := s.sessionConfig(authCtx)
+	expected, err := s.bindPeerIPs(message)
+	if err != nil {
+		s.writeFailure(conn, message, authCtx, ReplyHostUnreachable)
+		logSession(authCtx.SessionID, "resolve BIND peer failure", config.LogRedaction.Host(message.TargetIP), config.LogRedaction.Error(err, message.TargetIP))
+		return err
+	}
+
+	var localIP net.IP
+	if c, ok := conn.(net.Conn); ok {
+		if addr, ok := c.LocalAddr().(*net.TCPAddr); ok {
+			localIP = addr.IP
+		}
+	}
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: localIP})
+	if err != nil {
+		s.writeFailure(conn, message, authCtx, ReplyServerFailure)
+		logSession(authCtx.SessionID, "listen BIND failure", err)
+		return err
+	}
+	defer listener.Close()
+	if err := s.writeReply(conn, bindReplyInfo(message, authCtx, listener.Addr())); err != nil {
+		return err
+	}
+
+	// Wait for the peer instead of the handshake deadline
+	if c, ok := conn.(net.Conn); ok {
+		c.SetDeadline(time.Time{})
+	}
+	timeout := config.DialTimeout
+	if timeout <= 0 {
+		timeout = defaultBindTimeout
+	}
+	listener.SetDeadline(time.Now().Add(timeout))
+	var peer *net.TCPConn
+	for peer == nil {
+		c, err := listener.AcceptTCP()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				err = ErrBindTimeout
+			}
+			s.writeFailure(conn, message, authCtx, ReplyTTLExpired)
+			logSession(authCtx.SessionID, "accept BIND peer failure", err)
+			return err
+		}
+		if !bindPeerAllowed(expected, c.RemoteAddr().(*net.TCPAddr).IP) {
+			logSession(authCtx.SessionID, "BIND rejected unexpected peer", config.LogRedaction.Address(c.RemoteAddr().String()))
+			c.Close()
+			continue
+		}
+		peer = c
+	}
+	if err := s.writeReply(conn, bindReplyInfo(message, authCtx, peer.RemoteAddr())); err != nil {
+		peer.Close()
+		return err
+	}
+	tally := &relayTally{today: todayUser(config, authCtx)}
+	defer s.stats.sessionStarted(authCtx)(tally)
+	err = s.forward(conn, peer, config, tally)
+	s.relayEnded(authCtx, tally)
+	return err
+}
+
+// bindPeerIPs returns the IPs the BIND peer may connect from; none allows any.
+func (s *SOCKS5Server) bindPeerIPs(message *ClientRequestMessage) ([]net.IP, error) {
+	if message.AddrType != TypeDomain {
+		ip := net.ParseIP(message.TargetIP)
+		if ip == nil || ip.IsUnspecified() {
+			return nil, nil
+		}
+		return []net.IP{ip}, nil
+	}
+	return net.LookupIP(message.TargetIP)
+}
+
+func bindPeerAllowed(expected []net.IP, ip net.IP) bool {
+	if len(expected) == 0 {
+		return true
+	}
+	for _, e := range expected {
+		if e.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func bindReplyInfo(message *ClientRequestMessage, authCtx *AuthContext, addr net.Addr) *ReplyInfo {
+	tcpAddr := addr.(*net.TCPAddr)
+	ip := tcpAddr.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &ReplyInfo{Request: message, Auth: authCtx, Reply: ReplySuccess, BindIP: ip, BindPort: uint16(tcpAddr.Port)}
+}
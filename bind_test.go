@@ -0,0 +1,134 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// bindProxy serves a single BIND request the way RFC 1928 describes: one
+// reply with the listening address, another once the peer has connected.
+func bindProxy(t *testing.T) string {
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { proxy.Close() })
+	go func() {
+		conn, err := proxy.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := NewClientAuthMessage(conn); err != nil {
+			return
+		}
+		SendServerAuthMessage(conn, MethodNoAuth)
+		message, err := NewClientRequestMessage(conn)
+		if err != nil || message.Cmd != CmdBind {
+			WriteRequestFailureMessage(conn, ReplyCommandNotSupported)
+			return
+		}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return
+		}
+		defer listener.Close()
+		addr := listener.Addr().(*net.TCPAddr)
+		WriteRequestSuccessMessage(conn, addr.IP, uint16(addr.Port))
+		peer, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer peer.Close()
+		peerAddr := peer.RemoteAddr().(*net.TCPAddr)
+		WriteRequestSuccessMessage(conn, peerAddr.IP, uint16(peerAddr.Port))
+		go io.Copy(peer, conn)
+		io.Copy(conn, peer)
+	}()
+	return proxy.Addr().String()
+}
+
+func TestClientBind(t *testing.T) {
+	client := Client{ProxyAddress: bindProxy(t)}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	listener, err := client.Bind(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	defer listener.Close()
+
+	peer, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if conn.RemoteAddr().String() != peer.LocalAddr().String() {
+		t.Fatalf("should report peer %s but got %s", peer.LocalAddr(), conn.RemoteAddr())
+	}
+	if _, err := listener.Accept(); err != ErrBindAccepted {
+		t.Fatalf("should get error %s but got %v", ErrBindAccepted, err)
+	}
+
+	peer.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("should relay ping but got %q, %v", buf, err)
+	}
+}
+
+func TestServerBind(t *testing.T) {
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth, EnableBind: true}}
+	address, _ := startServer(t, &server)
+	defer server.Shutdown(context.Background())
+
+	client := Client{ProxyAddress: address}
+	listener, err := client.Bind(context.Background(), "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	defer listener.Close()
+
+	peer, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if conn.RemoteAddr().String() != peer.LocalAddr().String() {
+		t.Fatalf("should report peer %s but got %s", peer.LocalAddr(), conn.RemoteAddr())
+	}
+
+	conn.Write([]byte("pong"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(peer, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("should relay pong but got %q, %v", buf, err)
+	}
+}
+
+func TestDisabledCommands(t *testing.T) {
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth}}
+	for _, cmd := range []Command{CmdBind, CmdUDP} {
+		var buf bytes.Buffer
+		buf.Write([]byte{SOCKS5Version, cmd, ReservedField, TypeIPv4, 127, 0, 0, 1, 0, 0})
+		if err := server.request(&buf, &AuthContext{}); err != ErrCommandNotSupported {
+			t.Fatalf("command %d: should get error %s but got %v", cmd, ErrCommandNotSupported, err)
+		}
+		want := []byte{SOCKS5Version, ReplyCommandNotSupported, ReservedField, TypeIPv4, 0, 0, 0, 0, 0, 0}
+		if got := buf.Bytes(); !bytes.Equal(want, got) {
+			t.Fatalf("command %d: should get message %v but got %v", cmd, want, got)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package socks5
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrDomainBlocked = errors.New("domain blocked by blocklist")
+
+// blocklistFetchTimeout bounds the download of a blocklist URL.
+const blocklistFetchTimeout = 30 * time.Second
+
+// DomainBlocklist refuses requests for the domains of blocklists, such as
+// the ad and malware lists published for DNS filters. Build it with
+// LoadDomainBlocklist.
+type DomainBlocklist struct {
+	sources []string
+	set     atomic.Pointer[domainSet]
+
+	mu   sync.Mutex
+	stop chan struct{}
+}
+
+// domainSet is a compiled blocklist. Names are looked up with each of their
+// parent domains, so matching costs a few map lookups whatever the size of
+// the list.
+type domainSet struct {
+	// blocked maps a listed domain to whether its subdomains are listed too.
+	blocked map[string]bool
+	// allowed holds the domains of exception rules, with their subdomains.
+	allowed map[string]struct{}
+}
+
+// LoadDomainBlocklist loads the blocklists of sources, file paths or
+// http(s) URLs, and reloads them every refresh, if not zero, until Close.
+// The format is told apart by line:
+//
+//   - hosts files: "0.0.0.0 ads.example.com", blocking the names listed;
+//   - adblock and AdGuard syntax: "||ads.example.com^", blocking the domain
+//     and its subdomains, and "@@||cdn.example.com^" exceptions; rules
+//     with paths, other options than $important, or cosmetic rules are
+//     skipped;
+//   - one domain per line, blocking that name.
+//
+// Lines starting with '#' or '!' are comments. When a refresh fails, the
+// domains loaded before are kept.
+func LoadDomainBlocklist(refresh time.Duration, sources ...string) (*DomainBlocklist, error) {
+	b := DomainBlocklist{sources: sources}
+	set, err := loadDomainSet(sources)
+	if err != nil {
+		return nil, err
+	}
+	b.set.Store(set)
+	if refresh > 0 {
+		b.stop = make(chan struct{})
+		go b.refreshEvery(refresh, b.stop)
+	}
+	return &b, nil
+}
+
+// Blocked reports whether requests for domain are refused.
+func (b *DomainBlocklist) Blocked(domain string) bool {
+	set := b.set.Load()
+	return set != nil && set.match(strings.ToLower(strings.TrimSuffix(domain, ".")))
+}
+
+// Len returns the number of domains blocked, not counting subdomains.
+func (b *DomainBlocklist) Len() int {
+	if set := b.set.Load(); set != nil {
+		return len(set.blocked)
+	}
+	return 0
+}
+
+// Close stops the refreshes, e.g. once ApplyConfig replaced the config
+// holding b.
+func (b *DomainBlocklist) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stop != nil {
+		close(b.stop)
+		b.stop = nil
+	}
+	return nil
+}
+
+func (b *DomainBlocklist) refreshEvery(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		set, err := loadDomainSet(b.sources)
+		if err != nil {
+			logPrintln("refresh domain blocklist failure:", err)
+			continue
+		}
+		b.set.Store(set)
+	}
+}
+
+func (d *domainSet) match(domain string) bool {
+	blocked := false
+	for name, exact := domain, true; ; exact = false {
+		if _, ok := d.allowed[name]; ok {
+			return false
+		}
+		if subdomains, ok := d.blocked[name]; ok && (exact || subdomains) {
+			blocked = true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return blocked
+		}
+		name = name[i+1:]
+	}
+}
+
+func loadDomainSet(sources []string) (*domainSet, error) {
+	set := domainSet{blocked: make(map[string]bool), allowed: make(map[string]struct{})}
+	for _, source := range sources {
+		if err := set.load(source); err != nil {
+			return nil, fmt.Errorf("domain blocklist %s: %w", source, err)
+		}
+	}
+	return &set, nil
+}
+
+// load adds the domains of the file or URL source.
+func (d *domainSet) load(source string) error {
+	var r io.ReadCloser
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		client := http.Client{Timeout: blocklistFetchTimeout}
+		resp, err := client.Get(source)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("HTTP status %s", resp.Status)
+		}
+		r = resp.Body
+	} else {
+		file, err := os.Open(source)
+		if err != nil {
+			return err
+		}
+		r = file
+	}
+	defer r.Close()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		d.addLine(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+// hostsLocalNames are the names of the local host that hosts files map.
+var hostsLocalNames = map[string]bool{
+	"localhost": true, "localhost.localdomain": true, "local": true, "broadcasthost": true,
+	"ip6-localhost": true, "ip6-loopback": true, "ip6-localnet": true, "ip6-mcastprefix": true,
+	"ip6-allnodes": true, "ip6-allrouters": true, "ip6-allhosts": true, "0.0.0.0": true,
+}
+
+func (d *domainSet) addLine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+		return
+	}
+	if strings.HasPrefix(line, "@@||") {
+		if domain, ok := adblockDomain(line[len("@@||"):]); ok {
+			d.allowed[domain] = struct{}{}
+		}
+		return
+	}
+	if strings.HasPrefix(line, "||") {
+		if domain, ok := adblockDomain(line[len("||"):]); ok {
+			d.blocked[domain] = true
+		}
+		return
+	}
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+		fields = fields[1:]
+	} else if len(fields) != 1 {
+		return
+	}
+	for _, name := range fields {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if !hostsLocalNames[name] && plainDomain(name) {
+			if _, ok := d.blocked[name]; !ok {
+				d.blocked[name] = false
+			}
+		}
+	}
+}
+
+// adblockDomain returns the domain of an adblock rule after its "||", if
+// the rule blocks whole domains.
+func adblockDomain(rule string) (string, bool) {
+	domain, options, ok := strings.Cut(rule, "^")
+	if !ok || (options != "" && options != "$important") {
+		return "", false
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	return domain, plainDomain(domain)
+}
+
+// plainDomain reports whether name is a domain without wildcards, paths or
+// ports.
+func plainDomain(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "/*:|^$@=") && strings.Trim(name, ".") == name
+}
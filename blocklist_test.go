@@ -0,0 +1,99 @@
+package socks5
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDomainBlocklist(t *testing.T) {
+	hosts := filepath.Join(t.TempDir(), "hosts")
+	os.WriteFile(hosts, []byte("# hosts\n127.0.0.1 localhost\n0.0.0.0 ads.example.com tracker.example.net # trackers\n"), 0o600)
+	adblock := "[Adblock Plus 2.0]\n! comment\n||malware.example^\n||example.org^$important\n@@||good.malware.example^\n||example.com/path^\n||third.example^$third-party\nexample.info\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, adblock)
+	}))
+	defer server.Close()
+
+	blocklist, err := LoadDomainBlocklist(0, hosts, server.URL)
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	defer blocklist.Close()
+	tests := map[string]bool{
+		"ads.example.com":          true,
+		"ADS.example.com.":         true,
+		"sub.ads.example.com":      false,
+		"example.com":              false,
+		"localhost":                false,
+		"tracker.example.net":      true,
+		"malware.example":          true,
+		"a.b.malware.example":      true,
+		"good.malware.example":     false,
+		"cdn.good.malware.example": false,
+		"www.example.org":          true,
+		"third.example":            false,
+		"example.info":             true,
+	}
+	for domain, want := range tests {
+		if got := blocklist.Blocked(domain); got != want {
+			t.Fatalf("%s: should get %v but got %v", domain, want, got)
+		}
+	}
+	if n := blocklist.Len(); n != 5 {
+		t.Fatalf("should block 5 domains but got %d", n)
+	}
+
+	if _, err := LoadDomainBlocklist(0, filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("should fail to load a missing file")
+	}
+}
+
+func TestDomainBlocklistRefresh(t *testing.T) {
+	var list atomic.Value
+	list.Store("||old.example^\n")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, list.Load())
+	}))
+	defer server.Close()
+	blocklist, err := LoadDomainBlocklist(10*time.Millisecond, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blocklist.Close()
+
+	list.Store("||new.example^\n")
+	for i := 0; i < 100 && !blocklist.Blocked("new.example"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !blocklist.Blocked("new.example") || blocklist.Blocked("old.example") {
+		t.Fatal("should block the domains of the refreshed list")
+	}
+}
+
+func TestDomainBlocklistRequest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	os.WriteFile(path, []byte("0.0.0.0 ads.example.com\n"), 0o600)
+	blocklist, err := LoadDomainBlocklist(0, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := SOCKS5Server{Config: &Config{DomainBlocklist: blocklist}}
+	var buf bytes.Buffer
+	WriteClientRequestMessage(&buf, CmdConnect, "ads.example.com", 443)
+	if err := server.request(&buf, &AuthContext{}); err != ErrDomainBlocked {
+		t.Fatalf("should get error %s but got %v", ErrDomainBlocked, err)
+	}
+	if got := buf.Bytes(); got[1] != ReplyConnectionNotAllowed {
+		t.Fatalf("should reply %d but got %d", ReplyConnectionNotAllowed, got[1])
+	}
+	if got := server.Stats().BlocklistRejections; got != 1 {
+		t.Fatalf("should count 1 rejection but got %d", got)
+	}
+}
@@ -0,0 +1,110 @@
+package socks5
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("destination circuit open after repeated dial failures")
+
+// CircuitBreaker fails requests fast with ReplyHostUnreachable for a
+// destination whose dials keep failing, instead of letting every client
+// wait out the dial timeout while a popular target is down.
+type CircuitBreaker struct {
+	// Threshold is the number of dial failures within Window, without a
+	// success in between, that opens the circuit for a destination.
+	Threshold int
+	Window    time.Duration
+	// Cooldown is how long an open circuit rejects requests. After it, one
+	// dial is let through; a failure reopens the circuit, a success closes it.
+	Cooldown time.Duration
+
+	mu           sync.Mutex
+	destinations map[string]*breakerRecord
+	clock        clock
+}
+
+type breakerRecord struct {
+	failures    int
+	windowStart time.Time
+	openUntil   time.Time
+	probing     bool
+}
+
+// maxBreakerRecords bounds the tracked destinations before stale ones are pruned.
+const maxBreakerRecords = 4096
+
+// allow reports whether a dial to address may be attempted.
+func (b *CircuitBreaker) allow(address string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	record, ok := b.destinations[address]
+	if !ok || record.openUntil.IsZero() {
+		return true
+	}
+	if timeNow(b.clock).Before(record.openUntil) || record.probing {
+		return false
+	}
+	// Half open, let a single dial probe the destination
+	record.probing = true
+	return true
+}
+
+// done records the outcome of a dial to address.
+func (b *CircuitBreaker) done(address string, success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if success {
+		delete(b.destinations, address)
+		return
+	}
+
+	now := timeNow(b.clock)
+	if b.destinations == nil {
+		b.destinations = make(map[string]*breakerRecord)
+	}
+	if len(b.destinations) >= maxBreakerRecords {
+		b.prune(now)
+	}
+	record, ok := b.destinations[address]
+	if !ok {
+		record = &breakerRecord{windowStart: now}
+		b.destinations[address] = record
+	}
+	if record.probing {
+		record.probing = false
+		record.openUntil = now.Add(b.Cooldown)
+		return
+	}
+	if now.Sub(record.windowStart) > b.Window {
+		record.failures = 0
+		record.windowStart = now
+	}
+	record.failures++
+	if b.Threshold > 0 && record.failures >= b.Threshold {
+		record.openUntil = now.Add(b.Cooldown)
+	}
+}
+
+func (b *CircuitBreaker) prune(now time.Time) {
+	for address, record := range b.destinations {
+		if now.Sub(record.windowStart) > b.Window && now.After(record.openUntil) && !record.probing {
+			delete(b.destinations, address)
+		}
+	}
+}
+
+// Open returns the destinations whose circuit is open and when it closes.
+func (b *CircuitBreaker) Open() map[string]time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := timeNow(b.clock)
+	open := make(map[string]time.Time)
+	for address, record := range b.destinations {
+		if now.Before(record.openUntil) {
+			open[address] = record.openUntil
+		}
+	}
+	return open
+}
@@ -0,0 +1,65 @@
+package socks5
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	clock := newFakeClock()
+	breaker := CircuitBreaker{Threshold: 2, Window: time.Minute, Cooldown: time.Minute, clock: clock}
+	const address = "192.0.2.1:80"
+
+	breaker.done(address, false)
+	if !breaker.allow(address) {
+		t.Fatalf("a single failure should not open the circuit")
+	}
+	breaker.done(address, false)
+	if breaker.allow(address) {
+		t.Fatalf("the circuit should open after %d failures", breaker.Threshold)
+	}
+	if _, ok := breaker.Open()[address]; !ok {
+		t.Fatalf("destination should be listed as open but got %v", breaker.Open())
+	}
+
+	// After the cooldown a single probe is let through; its failure reopens the circuit
+	clock.Advance(2 * time.Minute)
+	if !breaker.allow(address) || breaker.allow(address) {
+		t.Fatalf("exactly one probe should be allowed after the cooldown")
+	}
+	breaker.done(address, false)
+	if breaker.allow(address) {
+		t.Fatalf("a failed probe should reopen the circuit")
+	}
+
+	clock.Advance(2 * time.Minute)
+	breaker.allow(address)
+	breaker.done(address, true)
+	if !breaker.allow(address) || len(breaker.Open()) != 0 {
+		t.Fatalf("a successful probe should close the circuit")
+	}
+}
+
+func TestCircuitOpenReply(t *testing.T) {
+	breaker := CircuitBreaker{Threshold: 1, Window: time.Minute, Cooldown: time.Minute}
+	breaker.done("127.0.0.1:80", false)
+	server := SOCKS5Server{
+		Config: &Config{AuthMethod: MethodNoAuth, CircuitBreaker: &breaker},
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{SOCKS5Version, CmdConnect, ReservedField, TypeIPv4, 127, 0, 0, 1, 0x00, 0x50})
+	if err := server.request(&buf, &AuthContext{}); err != ErrCircuitOpen {
+		t.Fatalf("should get error %s but got %v", ErrCircuitOpen, err)
+	}
+
+	want := []byte{SOCKS5Version, ReplyHostUnreachable, ReservedField, TypeIPv4, 0, 0, 0, 0, 0, 0}
+	if got := buf.Bytes(); !reflect.DeepEqual(want, got) {
+		t.Fatalf("should get message %v but got %v", want, got)
+	}
+	if got := server.Stats().CircuitOpenRejections; got != 1 {
+		t.Fatalf("should count 1 rejection but got %d", got)
+	}
+}
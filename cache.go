@@ -0,0 +1,249 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPCache caches responses to idempotent plaintext HTTP GETs relayed
+// through the proxy. It only applies to sessions matching a Rule with
+// CacheHTTP set, and only to responses that are safe to share: 200 OK,
+// no cookies or credentials, and no Cache-Control directive forbidding it.
+type HTTPCache struct {
+	// MaxSize bounds the total size of cached responses in bytes.
+	MaxSize int64
+	// MaxEntrySize bounds a single cached response. Zero means MaxSize / 16.
+	MaxEntrySize int64
+	// TTL is the longest a response is served from cache. A smaller
+	// Cache-Control max-age from the origin takes precedence.
+	TTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List
+	size    int64
+	clock   clock
+}
+
+type cacheEntry struct {
+	key      string
+	response []byte
+	expires  time.Time
+}
+
+func (c *HTTPCache) maxEntrySize() int64 {
+	if c.MaxEntrySize > 0 {
+		return c.MaxEntrySize
+	}
+	return c.MaxSize / 16
+}
+
+func (c *HTTPCache) get(key string) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if timeNow(c.clock).After(entry.expires) {
+		c.remove(elem)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return entry.response
+}
+
+func (c *HTTPCache) put(key string, response []byte, ttl time.Duration) {
+	if int64(len(response)) > c.maxEntrySize() || ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, response: response, expires: timeNow(c.clock).Add(ttl)})
+	c.size += int64(len(response))
+	for c.size > c.MaxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *HTTPCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.response))
+}
+
+// cacheControl reports whether header allows shared caching, and its max-age if any.
+func cacheControl(header http.Header) (cacheable bool, maxAge time.Duration) {
+	maxAge = -1
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store", directive == "no-cache", directive == "private":
+			return false, 0
+		case strings.HasPrefix(directive, "max-age="):
+			if seconds, err := strconv.Atoi(directive[len("max-age="):]); err == nil {
+				maxAge = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return true, maxAge
+}
+
+func cacheableRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet || req.ContentLength != 0 {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" || req.Header.Get("Cookie") != "" || req.Header.Get("Range") != "" {
+		return false
+	}
+	cacheable, _ := cacheControl(req.Header)
+	return cacheable
+}
+
+// cacheTTL returns how long resp may be cached, or zero if it must not be.
+func (c *HTTPCache) cacheTTL(resp *http.Response) time.Duration {
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Set-Cookie") != "" {
+		return 0
+	}
+	if vary := resp.Header.Get("Vary"); vary != "" && !strings.EqualFold(vary, "Accept-Encoding") {
+		return 0
+	}
+	cacheable, maxAge := cacheControl(resp.Header)
+	if !cacheable {
+		return 0
+	}
+	if maxAge >= 0 && maxAge < c.TTL {
+		return maxAge
+	}
+	return c.TTL
+}
+
+// looksLikeHTTP reports whether the client stream starts with an HTTP request line.
+func looksLikeHTTP(r *bufio.Reader) bool {
+	for _, method := range []string{"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "OPTIONS ", "PATCH "} {
+		if b, err := r.Peek(len(method)); err == nil && string(b) == method {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardHTTP relays plaintext HTTP/1.x exchanges, answering cacheable GETs
+// from cache. Anything that is not plain HTTP, and upgraded connections,
+// fall back to the byte relay.
+func (s *SOCKS5Server) forwardHTTP(conn io.ReadWriter, targetConn io.ReadWriteCloser, host string, cache *HTTPCache, config *Config, sessionID string, tally *relayTally) error {
+	clientReader := bufio.NewReader(conn)
+	targetReader := bufio.NewReader(targetConn)
+	client := &readerConn{Reader: clientReader, conn: conn}
+	target := &readerConn{Reader: targetReader, conn: targetConn}
+	// end closes the target after an exchange failed on the client side if
+	// fromClient, or the target side otherwise.
+	end := func(err error, fromClient bool) error {
+		targetConn.Close()
+		tally.reason = relayTermination(err, fromClient)
+		return err
+	}
+
+	for {
+		if _, err := clientReader.Peek(1); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return end(err, true)
+		}
+		if !looksLikeHTTP(clientReader) {
+			return s.forward(client, target, config, tally)
+		}
+
+		req, err := http.ReadRequest(clientReader)
+		if err != nil {
+			return end(err, true)
+		}
+		// Virtual hosts share the target address, so the Host header tells
+		// their pages apart
+		key := host + "\x00" + strings.ToLower(req.Host) + req.URL.RequestURI() + "\x00" + req.Header.Get("Accept-Encoding")
+		cacheable := cacheableRequest(req)
+		if cacheable {
+			if response := cache.get(key); response != nil {
+				if redaction := config.LogRedaction; redaction != nil {
+					logSession(sessionID, "http cache hit", redaction.Address(host))
+				} else {
+					logSession(sessionID, "http cache hit", host, req.URL.RequestURI())
+				}
+				if _, err := conn.Write(response); err != nil {
+					return end(err, true)
+				}
+				continue
+			}
+		}
+
+		if _, ok := req.Header["User-Agent"]; !ok {
+			// Keep req.Write from adding Go's default User-Agent
+			req.Header["User-Agent"] = []string{""}
+		}
+		if err := req.Write(targetConn); err != nil {
+			return end(err, false)
+		}
+		resp, err := http.ReadResponse(targetReader, req)
+		if err != nil {
+			return end(err, false)
+		}
+		if err := s.writeHTTPResponse(conn, resp, key, cacheable, cache); err != nil {
+			return end(err, true)
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			return s.forward(client, target, config, tally)
+		}
+		if resp.Close || req.Close {
+			// Whoever asked to close the connection ended the session
+			return end(nil, req.Close)
+		}
+	}
+}
+
+func (s *SOCKS5Server) writeHTTPResponse(conn io.Writer, resp *http.Response, key string, cacheable bool, cache *HTTPCache) error {
+	defer resp.Body.Close()
+	ttl := time.Duration(0)
+	if cacheable {
+		ttl = cache.cacheTTL(resp)
+	}
+	if ttl <= 0 || resp.ContentLength > cache.maxEntrySize() {
+		return resp.Write(conn)
+	}
+
+	// Buffer the body up to the entry limit, stream it if it turns out larger
+	limit := cache.maxEntrySize()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > limit {
+		resp.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), resp.Body))
+		return resp.Write(conn)
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+	var buf bytes.Buffer
+	if err := resp.Write(&buf); err != nil {
+		return err
+	}
+	cache.put(key, buf.Bytes(), ttl)
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,136 @@
+package socks5
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPCache(t *testing.T) {
+	var hits atomic.Int64
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.URL.Path == "/private" {
+			w.Header().Set("Cache-Control", "private")
+		}
+		fmt.Fprint(w, "hello ", r.URL.Path)
+	}))
+	defer origin.Close()
+	originAddr := origin.Listener.Addr().(*net.TCPAddr)
+
+	server := SOCKS5Server{Config: &Config{
+		HTTPCache: &HTTPCache{MaxSize: 1 << 20, TTL: time.Minute},
+		Rules:     []Rule{{CacheHTTP: true}},
+	}}
+
+	get := func(path string) string {
+		return cachedGet(t, &server, originAddr, "http://example.com"+path)
+	}
+
+	for i := 0; i < 3; i++ {
+		if body := get("/public"); body != "hello /public" {
+			t.Fatalf("unexpected body %q", body)
+		}
+	}
+	if got := hits.Load(); got != 1 {
+		t.Fatalf("origin should be hit once but got %d", got)
+	}
+
+	for i := 0; i < 2; i++ {
+		if body := get("/private"); body != "hello /private" {
+			t.Fatalf("unexpected body %q", body)
+		}
+	}
+	if got := hits.Load(); got != 3 {
+		t.Fatalf("private responses should not be cached, origin hits %d", got)
+	}
+}
+
+func TestHTTPCacheVirtualHosts(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello ", r.Host)
+	}))
+	defer origin.Close()
+	originAddr := origin.Listener.Addr().(*net.TCPAddr)
+	server := SOCKS5Server{Config: &Config{
+		HTTPCache: &HTTPCache{MaxSize: 1 << 20, TTL: time.Minute},
+		Rules:     []Rule{{CacheHTTP: true}},
+	}}
+
+	for _, host := range []string{"a.example", "b.example", "A.EXAMPLE"} {
+		want := "hello " + host
+		if host == "A.EXAMPLE" {
+			// Cached from a.example, host names being case-insensitive
+			want = "hello a.example"
+		}
+		if body := cachedGet(t, &server, originAddr, "http://"+host+"/"); body != want {
+			t.Fatalf("should get %q but got %q", want, body)
+		}
+	}
+}
+
+// cachedGet GETs url through a CONNECT to origin on server.
+func cachedGet(t *testing.T, server *SOCKS5Server, origin *net.TCPAddr, url string) string {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		defer serverConn.Close()
+		server.request(serverConn, &AuthContext{})
+	}()
+
+	port := uint16(origin.Port)
+	clientConn.Write([]byte{SOCKS5Version, CmdConnect, ReservedField, TypeIPv4, 127, 0, 0, 1, byte(port >> 8), byte(port)})
+	if _, err := io.ReadFull(clientConn, make([]byte, 10)); err != nil {
+		t.Fatalf("should read reply but got %s", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	go req.Write(clientConn)
+	resp, err := http.ReadResponse(bufio.NewReader(clientConn), req)
+	if err != nil {
+		t.Fatalf("should read response but got %s", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestHTTPCacheEviction(t *testing.T) {
+	cache := HTTPCache{MaxSize: 10, MaxEntrySize: 6, TTL: time.Minute}
+	cache.put("a", []byte("aaaaa"), time.Minute)
+	cache.put("b", []byte("bbbbb"), time.Minute)
+	cache.get("a")
+	cache.put("c", []byte("ccccc"), time.Minute)
+
+	if cache.get("b") != nil {
+		t.Fatalf("least recently used entry should be evicted")
+	}
+	if cache.get("a") == nil || cache.get("c") == nil {
+		t.Fatalf("recent entries should be kept")
+	}
+	cache.put("d", []byte("ddddddd"), time.Minute)
+	if cache.get("d") != nil {
+		t.Fatalf("entries over MaxEntrySize should not be cached")
+	}
+}
+
+func TestHTTPCacheExpiry(t *testing.T) {
+	clock := newFakeClock()
+	cache := HTTPCache{MaxSize: 100, TTL: time.Minute, clock: clock}
+	cache.put("a", []byte("aaaaa"), time.Minute)
+	clock.Advance(59 * time.Second)
+	if cache.get("a") == nil {
+		t.Fatalf("entry should be cached before its TTL")
+	}
+	clock.Advance(2 * time.Second)
+	if cache.get("a") != nil || cache.size != 0 {
+		t.Fatalf("entry should expire after its TTL")
+	}
+}
@@ -0,0 +1,240 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type CaptureFormat int
+
+const (
+	// CaptureRaw writes records of direction (1 byte), Unix nanoseconds
+	// (8 bytes), length (4 bytes) and data, integers in big endian.
+	CaptureRaw CaptureFormat = iota
+	// CapturePCAP writes a pcap file of synthesized IPv4/TCP packets that
+	// Wireshark can follow as a TCP stream.
+	CapturePCAP
+)
+
+const (
+	CaptureClientToTarget byte = 0x00
+	CaptureTargetToClient byte = 0x01
+)
+
+// Capture mirrors the relayed bytes of sessions matching a Rule with Capture
+// set into one file per session, for troubleshooting protocols through the proxy.
+type Capture struct {
+	// Dir is where capture files are created.
+	Dir    string
+	Format CaptureFormat
+	// MaxBytes stops capturing a direction after this many bytes. Zero captures everything.
+	MaxBytes int64
+	// HeadersOnly stops capturing a direction after the first blank line
+	// ("\r\n\r\n"), i.e. after the headers of an HTTP-like protocol.
+	HeadersOnly bool
+}
+
+// captureFile is the capture of one session. Both relay directions write to it.
+type captureFile struct {
+	mu     sync.Mutex
+	file   *os.File
+	config *Capture
+	// Per direction state
+	written [2]int64
+	done    [2]bool
+	tail    [2][]byte
+	seq     [2]uint32
+	// Synthesized endpoints for pcap
+	addrs [2]net.IP
+	ports [2]uint16
+}
+
+func (c *Capture) open(sessionID string, clientAddr, targetAddr net.Addr) (*captureFile, error) {
+	ext := ".bin"
+	if c.Format == CapturePCAP {
+		ext = ".pcap"
+	}
+	file, err := os.Create(filepath.Join(c.Dir, sessionID+ext))
+	if err != nil {
+		return nil, err
+	}
+	cf := captureFile{file: file, config: c}
+	cf.addrs[0], cf.ports[0] = captureEndpoint(clientAddr, net.IP{0, 0, 0, 1})
+	cf.addrs[1], cf.ports[1] = captureEndpoint(targetAddr, net.IP{0, 0, 0, 2})
+	if c.Format == CapturePCAP {
+		// Global header: magic, version 2.4, thiszone, sigfigs, snaplen, LINKTYPE_RAW
+		header := make([]byte, 24)
+		binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+		binary.LittleEndian.PutUint16(header[4:], 2)
+		binary.LittleEndian.PutUint16(header[6:], 4)
+		binary.LittleEndian.PutUint32(header[16:], 65535)
+		binary.LittleEndian.PutUint32(header[20:], 101)
+		if _, err := file.Write(header); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return &cf, nil
+}
+
+func captureEndpoint(addr net.Addr, fallback net.IP) (net.IP, uint16) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return fallback, 0
+	}
+	ip := tcpAddr.IP.To4()
+	if ip == nil {
+		ip = fallback
+	}
+	return ip, uint16(tcpAddr.Port)
+}
+
+// writer returns the io.Writer for one direction. It never fails so that
+// a broken capture can't break the relay.
+func (cf *captureFile) writer(direction byte) io.Writer {
+	return captureWriter{cf, direction}
+}
+
+type captureWriter struct {
+	cf        *captureFile
+	direction byte
+}
+
+func (w captureWriter) Write(b []byte) (int, error) {
+	w.cf.write(w.direction, b)
+	return len(b), nil
+}
+
+func (cf *captureFile) write(direction byte, b []byte) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	if cf.done[direction] {
+		return
+	}
+
+	data := b
+	if max := cf.config.MaxBytes; max > 0 && cf.written[direction]+int64(len(data)) >= max {
+		data = data[:max-cf.written[direction]]
+		cf.done[direction] = true
+	}
+	if cf.config.HeadersOnly {
+		// Look for the blank line, including one split across reads
+		window := append(cf.tail[direction], data...)
+		if i := bytes.Index(window, []byte("\r\n\r\n")); i >= 0 {
+			data = data[:i+4-len(cf.tail[direction])]
+			cf.done[direction] = true
+		}
+		if len(window) > 3 {
+			window = window[len(window)-3:]
+		}
+		cf.tail[direction] = append([]byte(nil), window...)
+	}
+	if len(data) == 0 {
+		return
+	}
+	cf.written[direction] += int64(len(data))
+
+	var err error
+	if cf.config.Format == CapturePCAP {
+		err = cf.writePackets(direction, data)
+	} else {
+		header := make([]byte, 13)
+		header[0] = direction
+		binary.BigEndian.PutUint64(header[1:], uint64(time.Now().UnixNano()))
+		binary.BigEndian.PutUint32(header[9:], uint32(len(data)))
+		if _, err = cf.file.Write(header); err == nil {
+			_, err = cf.file.Write(data)
+		}
+	}
+	if err != nil {
+		logPrintln("capture write error", cf.file.Name(), err)
+		cf.done = [2]bool{true, true}
+	}
+}
+
+// writePackets writes data as IPv4/TCP segments from one endpoint to the other.
+func (cf *captureFile) writePackets(direction byte, data []byte) error {
+	const maxPayload = 65535 - 40
+	src, dst := direction, 1-direction
+	for len(data) > 0 {
+		payload := data
+		if len(payload) > maxPayload {
+			payload = payload[:maxPayload]
+		}
+		data = data[len(payload):]
+
+		packet := make([]byte, 40+len(payload))
+		// IPv4 header
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+		packet[8] = 64
+		packet[9] = 6
+		copy(packet[12:16], cf.addrs[src])
+		copy(packet[16:20], cf.addrs[dst])
+		binary.BigEndian.PutUint16(packet[10:], ipChecksum(packet[:20]))
+		// TCP header with PSH|ACK
+		binary.BigEndian.PutUint16(packet[20:], cf.ports[src])
+		binary.BigEndian.PutUint16(packet[22:], cf.ports[dst])
+		binary.BigEndian.PutUint32(packet[24:], cf.seq[src])
+		binary.BigEndian.PutUint32(packet[28:], cf.seq[dst])
+		packet[32] = 5 << 4
+		packet[33] = 0x18
+		binary.BigEndian.PutUint16(packet[34:], 65535)
+		copy(packet[40:], payload)
+		cf.seq[src] += uint32(len(payload))
+
+		now := time.Now()
+		record := make([]byte, 16)
+		binary.LittleEndian.PutUint32(record[0:], uint32(now.Unix()))
+		binary.LittleEndian.PutUint32(record[4:], uint32(now.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+		binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+		if _, err := cf.file.Write(record); err != nil {
+			return err
+		}
+		if _, err := cf.file.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ipChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(header[i])<<8 | uint32(header[i+1])
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+func (cf *captureFile) Close() error {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	return cf.file.Close()
+}
+
+// tapSession wraps both sides of a session so their reads are mirrored into a capture file.
+func (s *SOCKS5Server) tapSession(conn io.ReadWriter, targetConn net.Conn, capture *Capture, sessionID string) (io.ReadWriter, io.ReadWriteCloser, *captureFile) {
+	var clientAddr net.Addr
+	if c, ok := conn.(net.Conn); ok {
+		clientAddr = c.RemoteAddr()
+	}
+	name := time.Now().Format("20060102T150405") + "-" + sessionID
+	cf, err := capture.open(name, clientAddr, targetConn.RemoteAddr())
+	if err != nil {
+		logSession(sessionID, "open capture file error", err)
+		return conn, targetConn, nil
+	}
+	client := &readerConn{Reader: io.TeeReader(conn, cf.writer(CaptureClientToTarget)), conn: conn}
+	target := &readerConn{Reader: io.TeeReader(targetConn, cf.writer(CaptureTargetToClient)), conn: targetConn}
+	return client, target, cf
+}
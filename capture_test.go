@@ -0,0 +1,91 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCaptureRaw(t *testing.T) {
+	capture := Capture{Dir: t.TempDir(), Format: CaptureRaw, MaxBytes: 6}
+	cf, err := capture.open("session", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := cf.writer(CaptureClientToTarget)
+	w.Write([]byte("abcd"))
+	w.Write([]byte("efgh"))
+	w.Write([]byte("ijkl"))
+	cf.writer(CaptureTargetToClient).Write([]byte("xy"))
+	cf.Close()
+
+	data, err := os.ReadFile(filepath.Join(capture.Dir, "session.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for len(data) > 0 {
+		n := binary.BigEndian.Uint32(data[9:13])
+		got = append(got, string(data[0]+'0')+string(data[13:13+n]))
+		data = data[13+n:]
+	}
+	want := []string{"0abcd", "0ef", "1xy"}
+	if len(got) != len(want) {
+		t.Fatalf("should capture %v but got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("should capture %v but got %v", want, got)
+		}
+	}
+}
+
+func TestCaptureHeadersOnly(t *testing.T) {
+	capture := Capture{Dir: t.TempDir(), HeadersOnly: true}
+	cf, err := capture.open("session", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := cf.writer(CaptureClientToTarget)
+	w.Write([]byte("GET / HTTP/1.1\r\nHost: a\r\n\r"))
+	w.Write([]byte("\nbody"))
+	w.Write([]byte("more body"))
+	cf.Close()
+
+	data, _ := os.ReadFile(filepath.Join(capture.Dir, "session.bin"))
+	if len(data) != 13+26+13+1 || string(data[len(data)-1:]) != "\n" {
+		t.Fatalf("should capture up to the blank line but got %q", data)
+	}
+}
+
+func TestCapturePCAP(t *testing.T) {
+	capture := Capture{Dir: t.TempDir(), Format: CapturePCAP}
+	client := &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 50000}
+	target := &net.TCPAddr{IP: net.IP{93, 184, 216, 34}, Port: 80}
+	cf, err := capture.open("session", client, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf.writer(CaptureClientToTarget).Write([]byte("ping"))
+	cf.Close()
+
+	data, _ := os.ReadFile(filepath.Join(capture.Dir, "session.pcap"))
+	if len(data) != 24+16+40+4 {
+		t.Fatalf("unexpected pcap size %d", len(data))
+	}
+	if binary.LittleEndian.Uint32(data[0:]) != 0xa1b2c3d4 || binary.LittleEndian.Uint32(data[20:]) != 101 {
+		t.Fatalf("invalid pcap global header %v", data[:24])
+	}
+	packet := data[40:]
+	if !net.IP(packet[12:16]).Equal(client.IP) || !net.IP(packet[16:20]).Equal(target.IP) {
+		t.Fatalf("unexpected packet addresses %v -> %v", net.IP(packet[12:16]), net.IP(packet[16:20]))
+	}
+	if ipChecksum(packet[:20]) != 0 {
+		t.Fatalf("invalid IPv4 header checksum")
+	}
+	if binary.BigEndian.Uint16(packet[22:]) != 80 || string(packet[40:]) != "ping" {
+		t.Fatalf("unexpected TCP segment %v", packet[20:])
+	}
+}
@@ -0,0 +1,106 @@
+package socks5
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+)
+
+// CertField selects the part of a client certificate CertAuth takes the
+// username from.
+type CertField int
+
+const (
+	CertFieldNone CertField = iota
+	CertFieldCommonName
+	// CertFieldDNSName, CertFieldEmail and CertFieldURI take the first
+	// subject alternative name of their kind.
+	CertFieldDNSName
+	CertFieldEmail
+	CertFieldURI
+)
+
+// CertAuth authenticates clients by their TLS client certificate, for
+// machine-to-machine deployments. A client whose certificate maps to a
+// username skips SOCKS5 auth: the server picks MethodNoAuth and sets
+// AuthContext.Username. Other clients go through the usual method selection.
+// With RequirePassword, the certificate is a second factor instead.
+//
+// Config.TLSConfig must ask for client certificates: ClientAuth
+// VerifyClientCertIfGiven or RequireAndVerifyClientCert with ClientCAs to
+// map names, or RequireAnyClientCert for pins alone.
+type CertAuth struct {
+	// Pins maps the SPKIPin of a client certificate to a username. Pinned
+	// certificates need not be signed by a CA.
+	Pins map[string]string
+	// Field takes the username from certificates verified against
+	// ClientCAs. CertFieldNone only accepts pinned certificates.
+	Field CertField
+	// RequirePassword requires both factors, e.g. for jump proxies: the
+	// client must present a mapped certificate and then authenticate with
+	// MethodPassword as the same username. Clients lacking either get
+	// MethodNoAcceptable or a failed password check.
+	RequirePassword bool
+}
+
+// SPKIPin returns the base64 SHA-256 of the certificate's public key, as in
+// HPKP. It stays the same when a certificate is renewed with the same key.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Username returns the username for the client certificate of state.
+func (a *CertAuth) Username(state *tls.ConnectionState) (string, bool) {
+	if a == nil || state == nil || len(state.PeerCertificates) == 0 {
+		return "", false
+	}
+	leaf := state.PeerCertificates[0]
+	if username, ok := a.Pins[SPKIPin(leaf)]; ok {
+		return username, true
+	}
+	if len(state.VerifiedChains) == 0 {
+		return "", false
+	}
+	var username string
+	switch a.Field {
+	case CertFieldCommonName:
+		username = leaf.Subject.CommonName
+	case CertFieldDNSName:
+		if len(leaf.DNSNames) > 0 {
+			username = leaf.DNSNames[0]
+		}
+	case CertFieldEmail:
+		if len(leaf.EmailAddresses) > 0 {
+			username = leaf.EmailAddresses[0]
+		}
+	case CertFieldURI:
+		if len(leaf.URIs) > 0 {
+			username = leaf.URIs[0].String()
+		}
+	}
+	return username, username != ""
+}
+
+// certAuth authenticates conn by its client certificate, recording the
+// account of Config.Users, if set, in authCtx. With Config.Users the
+// account must exist and be enabled.
+func (s *SOCKS5Server) certAuth(conn io.ReadWriter, authCtx *AuthContext) bool {
+	config := s.sessionConfig(authCtx)
+	username, ok := config.CertAuth.Username(connTLSState(conn))
+	if !ok {
+		return false
+	}
+	if users := config.Users; users != nil {
+		user, ok := users.User(username)
+		if !ok || user.Disabled {
+			return false
+		}
+		authCtx.User = &user
+		authCtx.AddLabels(user.Labels...)
+	}
+	authCtx.Username = username
+	return true
+}
@@ -0,0 +1,184 @@
+package socks5
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCertAuthUsername(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, _ := url.Parse("spiffe://example.org/robot")
+	template := x509.Certificate{
+		SerialNumber:   big.NewInt(1),
+		Subject:        pkix.Name{CommonName: "alice"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		DNSNames:       []string{"robot.example.org"},
+		EmailAddresses: []string{"alice@example.org"},
+		URIs:           []*url.URL{uri},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unverified := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	verified := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+
+	tests := []struct {
+		auth  *CertAuth
+		state *tls.ConnectionState
+		want  string
+	}{
+		{&CertAuth{Pins: map[string]string{SPKIPin(cert): "pinned"}}, unverified, "pinned"},
+		{&CertAuth{Field: CertFieldCommonName}, unverified, ""},
+		{&CertAuth{Field: CertFieldCommonName}, verified, "alice"},
+		{&CertAuth{Field: CertFieldDNSName}, verified, "robot.example.org"},
+		{&CertAuth{Field: CertFieldEmail}, verified, "alice@example.org"},
+		{&CertAuth{Field: CertFieldURI}, verified, "spiffe://example.org/robot"},
+		{&CertAuth{}, verified, ""},
+		{&CertAuth{Field: CertFieldCommonName}, &tls.ConnectionState{}, ""},
+		{nil, verified, ""},
+	}
+	for i, test := range tests {
+		username, ok := test.auth.Username(test.state)
+		if username != test.want || ok != (test.want != "") {
+			t.Fatalf("case %d: should get %q but got %q, %v", i, test.want, username, ok)
+		}
+	}
+}
+
+func TestCertAuthHandshake(t *testing.T) {
+	serverTLS := selfSignedTLSConfig(t)
+	serverTLS.ClientAuth = tls.RequireAnyClientCert
+	clientCert := selfSignedTLSConfig(t).Certificates[0]
+	leaf, err := x509.ParseCertificate(clientCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, _ := NewUsers(nil)
+	if err := users.AddUser(User{Name: "robot", Labels: []string{"team=qa"}}, "unused"); err != nil {
+		t.Fatal(err)
+	}
+	server := SOCKS5Server{Config: &Config{
+		AuthMethod: MethodPassword,
+		Users:      users,
+		TLSConfig:  serverTLS,
+		CertAuth:   &CertAuth{Pins: map[string]string{SPKIPin(leaf): "robot"}},
+	}}
+
+	handshake := func(certs []tls.Certificate) (*AuthContext, []byte) {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		client := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true, Certificates: certs})
+		tlsServer := tls.Server(serverConn, serverTLS)
+
+		result := make(chan *AuthContext, 1)
+		go func() {
+			if tlsServer.Handshake() != nil {
+				result <- nil
+				return
+			}
+			authCtx, _ := server.auth(tlsServer, &Session{ID: "s1", config: server.Config})
+			result <- authCtx
+		}()
+		client.Write([]byte{SOCKS5Version, 1, byte(MethodNoAuth)})
+		reply := make([]byte, 2)
+		io.ReadFull(client, reply)
+		return <-result, reply
+	}
+
+	authCtx, reply := handshake([]tls.Certificate{clientCert})
+	if !reflect.DeepEqual(reply, []byte{SOCKS5Version, byte(MethodNoAuth)}) {
+		t.Fatalf("should select no auth but got %v", reply)
+	}
+	if authCtx == nil || authCtx.Username != "robot" || authCtx.User == nil || !reflect.DeepEqual(authCtx.Labels, []string{"team=qa"}) {
+		t.Fatalf("should authenticate robot but got %+v", authCtx)
+	}
+
+	// An unknown certificate falls back to password auth, which this client does not offer
+	otherCert := selfSignedTLSConfig(t).Certificates[0]
+	authCtx, reply = handshake([]tls.Certificate{otherCert})
+	if authCtx != nil || !reflect.DeepEqual(reply, []byte{SOCKS5Version, byte(MethodNoAcceptable)}) {
+		t.Fatalf("should reject the greeting but got %v, %+v", reply, authCtx)
+	}
+}
+
+func TestCertAuthRequirePassword(t *testing.T) {
+	serverTLS := selfSignedTLSConfig(t)
+	serverTLS.ClientAuth = tls.RequireAnyClientCert
+	clientCert := selfSignedTLSConfig(t).Certificates[0]
+	leaf, err := x509.ParseCertificate(clientCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := SOCKS5Server{Config: &Config{
+		AuthMethod:      MethodPassword,
+		PasswordChecker: func(username, password string) bool { return password == "secret" },
+		TLSConfig:       serverTLS,
+		CertAuth:        &CertAuth{Pins: map[string]string{SPKIPin(leaf): "robot"}, RequirePassword: true},
+	}}
+
+	handshake := func(cert tls.Certificate, methods []Method, username string) (*AuthContext, []byte) {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		client := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{cert}})
+		tlsServer := tls.Server(serverConn, serverTLS)
+
+		result := make(chan *AuthContext, 1)
+		go func() {
+			if tlsServer.Handshake() != nil {
+				result <- nil
+				return
+			}
+			authCtx, _ := server.auth(tlsServer, &Session{ID: "s1", config: server.Config})
+			result <- authCtx
+		}()
+		WriteClientAuthMessage(client, methods)
+		reply := make([]byte, 2)
+		io.ReadFull(client, reply)
+		if reply[1] == byte(MethodPassword) {
+			WriteClientPasswordMessage(client, username, "secret")
+			io.ReadFull(client, reply)
+		}
+		return <-result, reply
+	}
+
+	both := []Method{MethodNoAuth, MethodPassword}
+	authCtx, reply := handshake(clientCert, both, "robot")
+	if authCtx == nil || authCtx.Username != "robot" || reply[1] != PasswordAuthSuccess {
+		t.Fatalf("should authenticate robot with both factors but got %v, %+v", reply, authCtx)
+	}
+	// The certificate alone no longer skips auth
+	if authCtx, reply := handshake(clientCert, []Method{MethodNoAuth}, ""); authCtx != nil || reply[1] != byte(MethodNoAcceptable) {
+		t.Fatalf("should require a password but got %v, %+v", reply, authCtx)
+	}
+	// The password must be for the user of the certificate
+	if authCtx, reply := handshake(clientCert, both, "alice"); authCtx != nil || reply[1] != PasswordAuthFailure {
+		t.Fatalf("should reject another user but got %v, %+v", reply, authCtx)
+	}
+	// A password without a mapped certificate is not enough
+	otherCert := selfSignedTLSConfig(t).Certificates[0]
+	if authCtx, reply := handshake(otherCert, both, "robot"); authCtx != nil || reply[1] != byte(MethodNoAcceptable) {
+		t.Fatalf("should require a mapped certificate but got %v, %+v", reply, authCtx)
+	}
+}
@@ -0,0 +1,283 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrRequestRejected     = errors.New("request rejected by proxy server")
+	ErrNetworkNotSupported = errors.New("network not supported")
+)
+
+// Client connects to targets through a SOCKS5 proxy server.
+type Client struct {
+	// ProxyAddress is the host:port of the SOCKS5 server.
+	ProxyAddress string
+	// Username and Password are used for username/password authentication
+	// when Username is not empty.
+	Username string
+	Password string
+	// HMAC authenticates with MethodHMAC instead, proving knowledge of
+	// Password without sending it. Username/password auth is not offered.
+	HMAC bool
+	// Timeout bounds the TCP dial to the proxy server. Use DialContext to
+	// bound the whole operation including the handshake.
+	Timeout time.Duration
+	// KeepAlive is the TCP keep-alive period of connections to the proxy
+	// server, as net.Dialer.KeepAlive: zero uses the default of 15 seconds
+	// and a negative value disables keep-alive probes.
+	KeepAlive time.Duration
+	// Pool, if set, keeps spare proxy connections dialed ahead of time.
+	Pool *ProxyPool
+	// Control, if set, is the net.Dialer Control function used to dial the
+	// proxy server, e.g. to set socket options.
+	Control func(network, address string, c syscall.RawConn) error
+	// ResolveLocally resolves domain targets on the client and sends the
+	// IP address to the proxy (curl's socks5). By default the domain is sent
+	// as is and resolved by the proxy (curl's socks5h).
+	ResolveLocally bool
+	// DNSServer is the host:port of the DNS server Resolve queries through
+	// a UDP association when the proxy server does not support RESOLVE.
+	// Unset, Resolve only asks for RESOLVE.
+	DNSServer string
+	// UDPRetry controls re-establishing associations from ListenPacket
+	// when their control connection drops. By default they are not.
+	UDPRetry UDPRetryPolicy
+	// TLSConfig, if set, wraps connections to the proxy server in TLS, as
+	// served by Config.TLSConfig. ServerName defaults to the host of
+	// ProxyAddress and NextProtos to ALPNSOCKS5.
+	TLSConfig *tls.Config
+	// ProxyDialer, if set, dials the proxy server instead of a net.Dialer,
+	// which leaves KeepAlive and Control unused; Timeout still bounds the
+	// dial. Set it to the DialContext method of an *ssh.Client to reach
+	// the proxy server through an SSH jump host. UDP datagrams of
+	// ListenPacket are still sent to the proxy server directly.
+	ProxyDialer func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Dial connects to address through the proxy server. Only "tcp" networks are supported.
+func (c *Client) Dial(network, address string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to address through the proxy server. ctx bounds
+// dialing the proxy, resolving address with ResolveLocally and the
+// handshake; cancelling it once the connection is returned has no effect.
+func (c *Client) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, ErrNetworkNotSupported
+	}
+
+	var conn net.Conn
+	if c.Pool != nil {
+		conn = c.Pool.get()
+		go c.Pool.fill(c.dialProxy)
+	}
+	if conn == nil {
+		var err error
+		if conn, err = c.dialProxy(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.HandshakeContext(ctx, conn, address); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *Client) dialProxy(ctx context.Context) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if c.ProxyDialer != nil {
+		if c.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+			defer cancel()
+		}
+		conn, err = c.ProxyDialer(ctx, "tcp", c.ProxyAddress)
+	} else {
+		dialer := net.Dialer{Timeout: c.Timeout, KeepAlive: c.KeepAlive, Control: c.Control}
+		conn, err = dialer.DialContext(ctx, "tcp", c.ProxyAddress)
+	}
+	if err != nil || c.TLSConfig == nil {
+		return conn, err
+	}
+
+	config := c.TLSConfig.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(c.ProxyAddress)
+	}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{ALPNSOCKS5}
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Handshake negotiates auth and a CONNECT to target over conn, an already
+// established connection to the proxy server such as a TLS or WebSocket stream.
+// On success conn carries the relayed traffic to target. A deadline the
+// caller set on conn is left in place.
+func (c *Client) Handshake(conn net.Conn, target string) error {
+	return c.HandshakeContext(context.Background(), conn, target)
+}
+
+// HandshakeContext is Handshake bounded by ctx: its deadline applies to conn
+// during the handshake, and cancelling it interrupts the handshake. conn is
+// left without a deadline.
+func (c *Client) HandshakeContext(ctx context.Context, conn net.Conn, target string) error {
+	stop := watchContext(ctx, conn)
+	_, err := c.handshake(ctx, conn, CmdConnect, target)
+	return stop(err)
+}
+
+// watchContext applies the deadline of ctx to conn and interrupts conn when
+// ctx is cancelled, until the returned function is called with the result
+// of the exchange. That function clears the deadline of conn and returns the
+// error of ctx instead of err if ctx ended the exchange. A ctx that can
+// never end, such as context.Background, leaves conn untouched.
+func watchContext(ctx context.Context, conn net.Conn) func(err error) error {
+	deadline, hasDeadline := ctx.Deadline()
+	if ctx.Done() == nil {
+		return func(err error) error { return err }
+	}
+	if hasDeadline {
+		conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			// A deadline in the past fails pending and future I/O at once
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func(err error) error {
+		close(done)
+		<-stopped
+		conn.SetDeadline(time.Time{})
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// The conn deadline may pass just before ctx notices; a timeout
+		// from anywhere else is returned as is
+		var netErr net.Error
+		if hasDeadline && errors.As(err, &netErr) && netErr.Timeout() && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+		return err
+	}
+}
+
+func (c *Client) handshake(ctx context.Context, conn io.ReadWriter, cmd Command, address string) (*ServerReplyMessage, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	if c.ResolveLocally && net.ParseIP(host) == nil {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		host = addrs[0].IP.String()
+	}
+
+	if err := c.authenticate(conn); err != nil {
+		return nil, err
+	}
+	return c.request(conn, cmd, host, uint16(port), address)
+}
+
+// authenticate negotiates the auth method over conn and authenticates.
+func (c *Client) authenticate(conn io.ReadWriter) error {
+	// Negotiate auth method
+	methods := []Method{MethodNoAuth}
+	if c.Username != "" && c.HMAC {
+		methods = append(methods, MethodHMAC)
+	} else if c.Username != "" {
+		methods = append(methods, MethodPassword)
+	}
+	if err := WriteClientAuthMessage(conn, methods); err != nil {
+		return err
+	}
+	method, err := NewServerAuthMessage(conn)
+	if err != nil {
+		return err
+	}
+	switch method {
+	case MethodNoAuth:
+	case MethodPassword:
+		if c.Username == "" || c.HMAC {
+			return ErrNoAcceptableMethod
+		}
+		if err := WriteClientPasswordMessage(conn, c.Username, c.Password); err != nil {
+			return err
+		}
+		status, err := NewServerPasswordMessage(conn)
+		if err != nil {
+			return err
+		}
+		if status != PasswordAuthSuccess {
+			return ErrPasswordAuthFailure
+		}
+	case MethodHMAC:
+		if c.Username == "" || !c.HMAC {
+			return ErrNoAcceptableMethod
+		}
+		nonce, err := NewServerHMACChallenge(conn)
+		if err != nil {
+			return err
+		}
+		if err := WriteClientHMACMessage(conn, c.Username, hmacProof(c.Password, c.Username, nonce)); err != nil {
+			return err
+		}
+		status, err := NewServerPasswordMessage(conn)
+		if err != nil {
+			return err
+		}
+		if status != PasswordAuthSuccess {
+			return ErrPasswordAuthFailure
+		}
+	default:
+		return ErrNoAcceptableMethod
+	}
+	return nil
+}
+
+// request sends a request for host and port and reads the reply. address
+// is the target as given, for logging.
+func (c *Client) request(conn io.ReadWriter, cmd Command, host string, port uint16, address string) (*ServerReplyMessage, error) {
+	if err := WriteClientRequestMessage(conn, cmd, host, port); err != nil {
+		return nil, err
+	}
+	reply, err := NewServerReplyMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Reply != ReplySuccess {
+		logPrintln("proxy server rejected request", address, "reply:", ReplyName(reply.Reply))
+		return reply, ErrRequestRejected
+	}
+	return reply, nil
+}
@@ -0,0 +1,315 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestClientHandshake(t *testing.T) {
+	server := SOCKS5Server{
+		Config: &Config{
+			AuthMethod: MethodPassword,
+			PasswordChecker: func(username, password string) bool {
+				return username == "admin" && password == "123456"
+			},
+		},
+	}
+
+	t.Run("password auth and connect", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+
+		errc := make(chan error, 1)
+		go func() {
+			authCtx, err := server.auth(serverConn, &Session{config: server.Config})
+			if err != nil {
+				errc <- err
+				return
+			}
+			if authCtx.Username != "admin" {
+				t.Errorf("want username admin but got %s", authCtx.Username)
+			}
+			message, err := NewClientRequestMessage(serverConn)
+			if err != nil {
+				errc <- err
+				return
+			}
+			if message.TargetIP != "example.com" || message.Port != 80 {
+				t.Errorf("unexpected request %v", *message)
+			}
+			errc <- WriteRequestSuccessMessage(serverConn, net.IP{127, 0, 0, 1}, 1080)
+		}()
+
+		client := Client{Username: "admin", Password: "123456"}
+		reply, err := client.handshake(context.Background(), clientConn, CmdConnect, "example.com:80")
+		if err != nil {
+			t.Fatalf("should get error nil but got %s", err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("server error: %s", err)
+		}
+		if reply.BindIP != "127.0.0.1" || reply.Port != 1080 {
+			t.Fatalf("unexpected reply %v", *reply)
+		}
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+
+		go server.auth(serverConn, &Session{config: server.Config})
+
+		client := Client{Username: "admin", Password: "wrong"}
+		if _, err := client.handshake(context.Background(), clientConn, CmdConnect, "example.com:80"); err != ErrPasswordAuthFailure {
+			t.Fatalf("should get error %s but got %v", ErrPasswordAuthFailure, err)
+		}
+	})
+}
+
+func TestUpstreamCredentials(t *testing.T) {
+	upstream := Upstream{
+		Address:  "proxy:1080",
+		Username: "default",
+		Password: "default",
+		Credentials: map[string]UpstreamAccount{
+			"alice": {Username: "X", Password: "secret"},
+		},
+	}
+
+	if c := upstream.client("alice", 0); c.Username != "X" || c.Password != "secret" {
+		t.Fatalf("alice should map to upstream account X but got %s", c.Username)
+	}
+	if c := upstream.client("bob", 0); c.Username != "default" {
+		t.Fatalf("bob should use default account but got %s", c.Username)
+	}
+	if c := upstream.client("", 0); c.Username != "default" {
+		t.Fatalf("anonymous should use default account but got %s", c.Username)
+	}
+}
+
+func TestUpstreamFailover(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+
+	var alerted string
+	server := SOCKS5Server{Config: &Config{Upstream: &Upstream{
+		Address:    down.Addr().String(),
+		OnFailover: func(target string, err error) { alerted = target },
+	}}}
+	if _, err := server.dial(target.Addr().String(), &AuthContext{}, time.Second, 0, 0, nil, false); err == nil {
+		t.Fatal("should fail without failover")
+	}
+	if alerted != "" {
+		t.Fatalf("should not alert without failover but got %q", alerted)
+	}
+
+	conn, err := server.dial(target.Addr().String(), &AuthContext{}, time.Second, 0, 0, nil, true)
+	if err != nil {
+		t.Fatalf("should dial directly but got %s", err)
+	}
+	conn.Close()
+	if alerted != target.Addr().String() {
+		t.Fatalf("should alert for %s but got %q", target.Addr(), alerted)
+	}
+	if got := server.Stats().UpstreamFailovers; got != 1 {
+		t.Fatalf("should count 1 failover but got %d", got)
+	}
+	if upstreamDown(ErrRequestRejected) {
+		t.Fatal("a rejected request should not fail over")
+	}
+}
+
+func TestUpstreamDialContext(t *testing.T) {
+	server := SOCKS5Server{Config: &Config{Upstream: &Upstream{Address: silentProxy(t)}}}
+
+	if _, err := server.dial("example.com:80", &AuthContext{}, 50*time.Millisecond, 0, 0, nil, false); err != context.DeadlineExceeded {
+		t.Fatalf("should get error %s but got %v", context.DeadlineExceeded, err)
+	}
+
+	// Ending the session aborts the handshake with the upstream
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := server.dial("example.com:80", &AuthContext{ctx: ctx}, 0, 0, 0, nil, false); err != context.Canceled {
+		t.Fatalf("should get error %s but got %v", context.Canceled, err)
+	}
+}
+
+func TestClientResolveLocally(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth}}
+	got := make(chan *ClientRequestMessage, 1)
+	go func() {
+		defer close(got)
+		if _, err := server.auth(serverConn, &Session{config: server.Config}); err != nil {
+			return
+		}
+		message, err := NewClientRequestMessage(serverConn)
+		if err != nil {
+			return
+		}
+		got <- message
+		WriteRequestSuccessMessage(serverConn, net.IP{127, 0, 0, 1}, 1080)
+	}()
+
+	client := Client{ResolveLocally: true}
+	if _, err := client.handshake(context.Background(), clientConn, CmdConnect, "localhost:80"); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	message := <-got
+	if message == nil || message.AddrType == TypeDomain {
+		t.Fatalf("should send a resolved IP but got %+v", message)
+	}
+}
+
+func TestClientHandshakeOverExistingConn(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth}}
+	go func() {
+		if _, err := server.auth(serverConn, &Session{config: server.Config}); err != nil {
+			return
+		}
+		if _, err := NewClientRequestMessage(serverConn); err != nil {
+			return
+		}
+		WriteRequestSuccessMessage(serverConn, net.IP{127, 0, 0, 1}, 1080)
+		serverConn.Write([]byte("hello"))
+	}()
+
+	var client Client
+	if err := client.Handshake(clientConn, "example.com:443"); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(clientConn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("should relay data after handshake but got %q, %v", buf, err)
+	}
+}
+
+// silentProxy returns the address of a server accepting connections and
+// never answering.
+func silentProxy(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestClientContext(t *testing.T) {
+	client := Client{ProxyAddress: silentProxy(t)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.DialContext(ctx, "tcp", "example.com:80"); err != context.DeadlineExceeded {
+		t.Fatalf("should get error %s but got %v", context.DeadlineExceeded, err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := client.ListenPacket(ctx); err != context.Canceled {
+		t.Fatalf("should get error %s but got %v", context.Canceled, err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := client.Bind(ctx, "0.0.0.0:0"); err != context.Canceled {
+		t.Fatalf("should get error %s but got %v", context.Canceled, err)
+	}
+}
+
+func TestClientHandshakeContextClearsDeadline(t *testing.T) {
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth}}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go server.ServeConn(serverConn)
+
+	target := echoServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	var client Client
+	if err := client.HandshakeContext(ctx, clientConn, target); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	// The relayed connection outlives the handshake deadline
+	time.Sleep(300 * time.Millisecond)
+	clientConn.Write([]byte("ping"))
+	if _, err := io.ReadFull(clientConn, make([]byte, 4)); err != nil {
+		t.Fatalf("should relay after the handshake deadline but got %s", err)
+	}
+}
+
+func TestClientHandshakeKeepsDeadline(t *testing.T) {
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth}}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go server.ServeConn(serverConn)
+
+	target := echoServer(t)
+	clientConn.SetDeadline(time.Now().Add(200 * time.Millisecond))
+	var client Client
+	if err := client.Handshake(clientConn, target); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	_, err := clientConn.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("should get a timeout from the caller's deadline but got %v", err)
+	}
+}
+
+func TestClientHandshakeContextForeignTimeout(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	var client Client
+	done := make(chan error, 1)
+	go func() { done <- client.HandshakeContext(ctx, &timeoutConn{clientConn}, "example.com:80") }()
+	select {
+	case err := <-done:
+		if err != errTestTimeout {
+			t.Fatalf("should get error %s but got %v", errTestTimeout, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("should return at once on a timeout not caused by ctx")
+	}
+}
+
+var errTestTimeout = &net.OpError{Op: "write", Net: "tcp", Err: os.ErrDeadlineExceeded}
+
+// timeoutConn fails every write with a timeout of its own.
+type timeoutConn struct{ net.Conn }
+
+func (c *timeoutConn) Write(b []byte) (int, error) { return 0, errTestTimeout }
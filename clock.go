@@ -0,0 +1,94 @@
+package socks5
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/Doraemonkeys/socks5/internal/testhook"
+)
+
+func init() {
+	testhook.SetClock = func(server any, c testhook.Clock) { server.(*SOCKS5Server).setClock(c) }
+	testhook.SetRand = func(server any, r io.Reader) { server.(*SOCKS5Server).rand = r }
+}
+
+// clock tells the time for expiry decisions and runs the timers of
+// deadlines, lifetimes and pacing. Tests swap in a fake one to step
+// through windows, TTLs and timeouts without sleeping.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	// AfterFunc calls f in its own goroutine after d. stop cancels the
+	// call and reports whether it did so before f was called.
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+	Sleep(d time.Duration)
+}
+
+// timeNow returns the time from c, or the system time if c is nil.
+func timeNow(c clock) time.Time {
+	if c == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
+
+// timeAfter is time.After on c, or on the system clock if c is nil.
+func timeAfter(c clock, d time.Duration) <-chan time.Time {
+	if c == nil {
+		return time.After(d)
+	}
+	return c.After(d)
+}
+
+// timeAfterFunc is time.AfterFunc on c, or on the system clock if c is
+// nil, returning the Stop of the timer.
+func timeAfterFunc(c clock, d time.Duration, f func()) func() bool {
+	if c == nil {
+		return time.AfterFunc(d, f).Stop
+	}
+	return c.AfterFunc(d, f)
+}
+
+// timeSleep is time.Sleep on c, or on the system clock if c is nil.
+func timeSleep(c clock, d time.Duration) {
+	if c == nil {
+		time.Sleep(d)
+		return
+	}
+	c.Sleep(d)
+}
+
+// setClock makes c the clock of s and of the limiters pacing and queueing
+// its sessions.
+func (s *SOCKS5Server) setClock(c clock) {
+	s.clock = c
+	s.fairLimiter.clock = c
+	for i := range s.classLimiters {
+		s.classLimiters[i].clock = c
+	}
+	s.dialQueue.clock = c
+}
+
+// randSource supplies random bytes for session IDs and port selection.
+// It defaults to crypto/rand; tests use a fixed source.
+type randSource interface {
+	Read(b []byte) (int, error)
+}
+
+func randRead(r randSource, b []byte) {
+	if r == nil {
+		r = rand.Reader
+	}
+	if _, err := r.Read(b); err != nil {
+		panic(err)
+	}
+}
+
+// randIntn returns a number in [0, n).
+func randIntn(r randSource, n int) int {
+	b := make([]byte, 8)
+	randRead(r, b)
+	return int(binary.BigEndian.Uint64(b) % uint64(n))
+}
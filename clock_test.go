@@ -0,0 +1,115 @@
+package socks5
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when advanced, firing the timers
+// that come due.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// fakeTimer is a pending After or AfterFunc of a fakeClock.
+type fakeTimer struct {
+	when time.Time
+	f    func()
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.schedule(d, func(now time.Time) { ch <- now })
+	return ch
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) func() bool {
+	timer := c.schedule(d, func(time.Time) { go f() })
+	return func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for i, t := range c.timers {
+			if t == timer {
+				c.timers = append(c.timers[:i], c.timers[i+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+// schedule calls fire with the time once the clock reaches now+d.
+func (c *fakeClock) schedule(d time.Duration, fire func(now time.Time)) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	when := c.now.Add(d)
+	timer := &fakeTimer{when: when, f: func() { fire(when) }}
+	if d <= 0 {
+		timer.f()
+		return timer
+	}
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+// Advance moves the clock by d and fires the timers that come due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeTimer
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.when.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			due = append(due, t)
+		}
+	}
+	c.timers = pending
+	c.mu.Unlock()
+	for _, t := range due {
+		t.f()
+	}
+}
+
+// awaitTimers waits for n timers to be pending, as started by other
+// goroutines.
+func (c *fakeClock) awaitTimers(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < 5000; i++ {
+		c.mu.Lock()
+		pending := len(c.timers)
+		c.mu.Unlock()
+		if pending == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("should have %d pending timers", n)
+}
+
+// zeroRand is a randSource that only returns zeros.
+type zeroRand struct{}
+
+func (zeroRand) Read(b []byte) (int, error) {
+	copy(b, bytes.Repeat([]byte{0}, len(b)))
+	return len(b), nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Doraemonkeys/socks5"
+)
+
+// runCheck runs the check subcommand, probing a SOCKS5 server with a
+// CONNECT to a canary target for container liveness and readiness probes.
+// It prints each stage and fails if any did.
+func runCheck(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	address := flags.String("address", "127.0.0.1:1080", "host:port of the SOCKS5 server")
+	target := flags.String("target", "", "canary host:port the server should reach")
+	username := flags.String("user", "", "SOCKS5 username, with the password in SOCKS5_PASSWORD")
+	timeout := flags.Duration("timeout", 5*time.Second, "bound of the whole check")
+	jsonOutput := flags.Bool("json", false, "print the report as JSON")
+	flags.Parse(args)
+	if *target == "" {
+		return errors.New("check: -target is required")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	client := socks5.Client{ProxyAddress: *address, Username: *username, Password: os.Getenv("SOCKS5_PASSWORD")}
+	report := socks5.Probe(ctx, &client, *target)
+	if *jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(report)
+	} else {
+		for _, stage := range report.Stages {
+			result := "ok"
+			if stage.Error != "" {
+				result = stage.Error
+			}
+			fmt.Printf("%-8s %-10s %s\n", stage.Name, stage.Duration.Round(time.Microsecond), result)
+		}
+	}
+	if !report.OK {
+		return errors.New("check failed")
+	}
+	return nil
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Doraemonkeys/socks5"
+)
+
+// duration is a time.Duration written as a string ("5s") in the config file.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// fileConfig is the JSON config file of the daemon.
+type fileConfig struct {
+	// IP is an address or an interface name, e.g. "eth0".
+	IP   string `json:"ip"`
+	Port int    `json:"port"`
+	// Auth is "none", "password" or "hmac".
+	Auth  string            `json:"auth"`
+	Users map[string]string `json:"users"`
+
+	DialTimeout      duration `json:"dial_timeout"`
+	HandshakeTimeout duration `json:"handshake_timeout"`
+	RequestTimeout   duration `json:"request_timeout"`
+	IdleTimeout      duration `json:"idle_timeout"`
+	MaxConnsPerHost  int      `json:"max_conns_per_host"`
+	EnableUDP        bool     `json:"enable_udp"`
+	EnableBind       bool     `json:"enable_bind"`
+	// UDPAmplificationRatio caps replies to unconfirmed UDP clients.
+	UDPAmplificationRatio int `json:"udp_amplification_ratio"`
+	// UDPCloseOnUnreachable closes UDP associations whose only target is
+	// unreachable.
+	UDPCloseOnUnreachable bool `json:"udp_close_on_unreachable"`
+	// UDPBatchSize relays up to this many UDP datagrams per system call.
+	UDPBatchSize int `json:"udp_batch_size"`
+	// MaxUDPAssociationsPerUser caps the concurrent UDP associations of a
+	// user or client IP.
+	MaxUDPAssociationsPerUser int `json:"max_udp_associations_per_user"`
+	// UDPMaxLifetime closes UDP associations after this long.
+	UDPMaxLifetime duration `json:"udp_max_lifetime"`
+	// UDPMaxDatagrams closes UDP associations after this many datagrams.
+	UDPMaxDatagrams int64 `json:"udp_max_datagrams"`
+	// HandOffUDP moves UDP associations to the new process on SIGUSR2.
+	HandOffUDP bool `json:"hand_off_udp"`
+	// KeepIPv4Mapped presents ::ffff:a.b.c.d addresses as IPv6.
+	KeepIPv4Mapped bool `json:"keep_ipv4_mapped"`
+	// NAT64Prefix, e.g. "64:ff9b::/96", reaches IPv4 targets through NAT64.
+	NAT64Prefix string `json:"nat64_prefix"`
+	// BandwidthLimit caps total relay throughput in bytes per second, shared
+	// fairly between sessions.
+	BandwidthLimit int64 `json:"bandwidth_limit"`
+	// MaxConcurrentDials caps outbound dials in progress; up to
+	// DialQueueSize more requests wait for DialQueueTimeout.
+	MaxConcurrentDials int      `json:"max_concurrent_dials"`
+	DialQueueSize      int      `json:"dial_queue_size"`
+	DialQueueTimeout   duration `json:"dial_queue_timeout"`
+	// MaxMemory caps the approximate session buffer memory in bytes; new
+	// connections past it are refused, or idle sessions closed to make room
+	// after MemoryShedIdle.
+	MaxMemory      int64    `json:"max_memory"`
+	MemoryShedIdle duration `json:"memory_shed_idle"`
+	// FallbackAddress, if set, receives connections that are not SOCKS5,
+	// e.g. a web server to show scanners.
+	FallbackAddress string `json:"fallback_address"`
+	// SourceAllow and SourceDeny filter clients by source network (CIDR or
+	// IP) before the handshake.
+	SourceAllow []string `json:"source_allow"`
+	SourceDeny  []string `json:"source_deny"`
+	// Ban, if set, temporarily bans sources that keep failing.
+	Ban *banFileConfig `json:"ban"`
+	// Egress, if set, spreads sessions across several outbound links.
+	Egress *egressFileConfig `json:"egress"`
+	// Rules override settings for matching requests; the first match wins.
+	Rules []ruleFileConfig `json:"rules"`
+	// RequireSNIMatch closes TLS sessions whose server name differs from
+	// the requested domain.
+	RequireSNIMatch bool `json:"require_sni_match"`
+	// StrictRSV set to false tolerates requests with a non-zero RSV byte.
+	StrictRSV *bool `json:"strict_rsv"`
+	// DisallowPipelining drops clients that send ahead of the server's replies.
+	DisallowPipelining bool `json:"disallow_pipelining"`
+	// DebugHandshake logs the raw handshake bytes of every session in hex,
+	// passwords included, so it cannot be combined with LogRedaction.
+	DebugHandshake bool `json:"debug_handshake"`
+	// Quirks works around bugs of known clients.
+	Quirks socks5.Quirks `json:"quirks"`
+	// ParallelDial dials up to this many addresses of a domain at once.
+	ParallelDial int `json:"parallel_dial"`
+	// RejectDomainTargets refuses requests for domains, so clients must
+	// resolve names themselves.
+	RejectDomainTargets bool `json:"reject_domain_targets"`
+	// StatsFile, if set, keeps the session and byte counters across restarts.
+	StatsFile          string   `json:"stats_file"`
+	StatsFlushInterval duration `json:"stats_flush_interval"`
+	// Reputation, if set, refuses connections to IPs of a blocklist file.
+	Reputation *reputationFileConfig `json:"reputation"`
+	// DomainBlocklist, if set, refuses requests for the domains of hosts
+	// files or adblock lists.
+	DomainBlocklist *blocklistFileConfig `json:"domain_blocklist"`
+	// PortClassLimits caps interactive, web and bulk sessions separately.
+	PortClassLimits socks5.PortClassLimits `json:"port_class_limits"`
+	// Teardown maps termination reasons such as "shutdown" to how the
+	// sessions closed for them are ended.
+	Teardown map[socks5.TerminationReason]teardownFileConfig `json:"teardown"`
+	// ListenNetwork is "tcp", "tcp4" or "tcp6"; IPv6Only keeps IPv6
+	// listeners from taking IPv4 connections.
+	ListenNetwork string `json:"listen_network"`
+	IPv6Only      bool   `json:"ipv6_only"`
+	// Ident, if set, looks up client identities with IDENT (RFC 1413).
+	Ident *identFileConfig `json:"ident"`
+	// DrainTimeout bounds how long a graceful shutdown waits for sessions.
+	DrainTimeout duration `json:"drain_timeout"`
+	// LogRedaction, if set, redacts the server log.
+	LogRedaction *socks5.Redaction `json:"log_redaction"`
+	// AccessLog, if set, sends a record of every finished session to a log sink.
+	AccessLog *accessLogConfig `json:"access_log"`
+	// Plugins lists Go plugins (.so) loaded as policy or telemetry modules.
+	Plugins []string `json:"plugins"`
+	// Sinkhole, if set, stores what clients send in sessions of "sinkhole" rules.
+	Sinkhole *socks5.FileSinkhole `json:"sinkhole"`
+	// TLS, if set, accepts TLS-wrapped SOCKS5 next to plain text.
+	TLS *tlsFileConfig `json:"tls"`
+}
+
+// identFileConfig configures IDENT lookups.
+type identFileConfig struct {
+	Timeout duration `json:"timeout"`
+	Port    int      `json:"port"`
+}
+
+// reputationFileConfig configures IP reputation checks against a blocklist
+// file, reloaded with the config.
+type reputationFileConfig struct {
+	Blocklist   string   `json:"blocklist"`
+	CacheTTL    duration `json:"cache_ttl"`
+	MonitorOnly bool     `json:"monitor_only"`
+	FailClosed  bool     `json:"fail_closed"`
+}
+
+// blocklistFileConfig lists the files or URLs of domain blocklists.
+type blocklistFileConfig struct {
+	Sources []string `json:"sources"`
+	Refresh duration `json:"refresh"`
+}
+
+// accessLogConfig selects the access log sink.
+type accessLogConfig struct {
+	// Type is "syslog" or "journald".
+	Type string `json:"type"`
+	// Network ("udp", "tcp" or "unixgram"), Address and Facility configure syslog.
+	Network  string `json:"network"`
+	Address  string `json:"address"`
+	Facility int    `json:"facility"`
+	// Socket overrides the journald socket path.
+	Socket string `json:"socket"`
+	// Redaction, if set, redacts the access log.
+	Redaction *socks5.Redaction `json:"redaction"`
+	// SampleRate, if set, sends only this fraction of the records and logs
+	// per-minute aggregates per user and target instead.
+	SampleRate *float64 `json:"sample_rate"`
+}
+
+// recorder returns the access log recorder. Sampled aggregates go to the
+// server log, redacted by logRedaction.
+func (c *accessLogConfig) recorder(logRedaction *socks5.Redaction) (socks5.SessionRecorder, error) {
+	var recorder socks5.SessionRecorder
+	switch c.Type {
+	case "syslog":
+		if c.Network == "" {
+			c.Network = "udp"
+		}
+		recorder = &socks5.SyslogRecorder{Network: c.Network, Address: c.Address, Facility: c.Facility, Redaction: c.Redaction}
+	case "journald":
+		recorder = &socks5.JournalRecorder{Socket: c.Socket, Redaction: c.Redaction}
+	default:
+		return nil, errors.New("unknown access log type " + c.Type)
+	}
+	if c.SampleRate != nil {
+		if *c.SampleRate < 0 || *c.SampleRate > 1 {
+			return nil, fmt.Errorf("access log sample_rate %v is out of range 0-1", *c.SampleRate)
+		}
+		recorder = &socks5.SampledRecorder{Recorder: recorder, Rate: *c.SampleRate, Redaction: logRedaction}
+	}
+	return recorder, nil
+}
+
+// banFileConfig configures the scan guard and its ban actions. Bans are
+// forgotten on reload.
+type banFileConfig struct {
+	// Threshold failures within Window ban a source for Duration.
+	Threshold int      `json:"threshold"`
+	Window    duration `json:"window"`
+	Duration  duration `json:"duration"`
+	// AuthFailures and RuleViolations also count failed authentication and
+	// requests refused by policy next to invalid handshakes.
+	AuthFailures   bool `json:"auth_failures"`
+	RuleViolations bool `json:"rule_violations"`
+	// Exec, if set, is a command and arguments run on each ban, with
+	// "{ip}", "{reason}" and "{seconds}" replaced.
+	Exec []string `json:"exec"`
+	// Webhook, if set, receives each ban as a JSON POST.
+	Webhook string `json:"webhook"`
+}
+
+func (c *banFileConfig) scanGuard() *socks5.ScanGuard {
+	guard := socks5.ScanGuard{
+		Threshold:      c.Threshold,
+		Window:         time.Duration(c.Window),
+		BanDuration:    time.Duration(c.Duration),
+		AuthFailures:   c.AuthFailures,
+		RuleViolations: c.RuleViolations,
+	}
+	if len(c.Exec) > 0 {
+		guard.Actions = append(guard.Actions, &socks5.ExecBanAction{Command: c.Exec[0], Args: c.Exec[1:]})
+	}
+	if c.Webhook != "" {
+		guard.Actions = append(guard.Actions, &socks5.WebhookBanAction{URL: c.Webhook})
+	}
+	return &guard
+}
+
+// teardownFileConfig is a socks5.Teardown, with the linger as a duration
+// string.
+type teardownFileConfig struct {
+	Reset  bool     `json:"reset"`
+	Linger duration `json:"linger"`
+}
+
+// ruleFileConfig is a socks5.Rule in the config file.
+type ruleFileConfig struct {
+	Name string `json:"name"`
+	// Expr is a rule expression, e.g. `user == "guest" && time >= "18:00"`.
+	Expr        string          `json:"expr"`
+	Hosts       []string        `json:"hosts"`
+	Networks    []string        `json:"networks"`
+	Ports       []uint16        `json:"ports"`
+	Users       []string        `json:"users"`
+	Commands    socks5.Commands `json:"commands"`
+	Labels      []string        `json:"labels"`
+	Priority    int             `json:"priority"`
+	DialTimeout duration        `json:"dial_timeout"`
+	IdleTimeout duration        `json:"idle_timeout"`
+	// Action is "reject" or "sinkhole"; empty serves matching requests.
+	Action socks5.RuleAction `json:"action"`
+	// Windows are the times matching requests are allowed, in Timezone
+	// (an IANA name, default local time).
+	Windows          []windowFileConfig `json:"windows"`
+	Timezone         string             `json:"timezone"`
+	EndAtWindowClose bool               `json:"end_at_window_close"`
+}
+
+// windowFileConfig is a socks5.TimeWindow, with days such as "mon".
+type windowFileConfig struct {
+	Days []string `json:"days"`
+	From string   `json:"from"`
+	To   string   `json:"to"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func (c *ruleFileConfig) rule() (socks5.Rule, error) {
+	rule := socks5.Rule{
+		Name:        c.Name,
+		Expr:        c.Expr,
+		Action:      c.Action,
+		Hosts:       c.Hosts,
+		Networks:    c.Networks,
+		Ports:       c.Ports,
+		Users:       c.Users,
+		Commands:    c.Commands,
+		Labels:      c.Labels,
+		Priority:    c.Priority,
+		DialTimeout: time.Duration(c.DialTimeout),
+		IdleTimeout: time.Duration(c.IdleTimeout),
+
+		EndAtWindowClose: c.EndAtWindowClose,
+	}
+	for _, w := range c.Windows {
+		window := socks5.TimeWindow{From: w.From, To: w.To}
+		for _, name := range w.Days {
+			day, ok := weekdays[strings.ToLower(name)]
+			if !ok {
+				return rule, errors.New("unknown day " + name)
+			}
+			window.Days = append(window.Days, day)
+		}
+		rule.Windows = append(rule.Windows, window)
+	}
+	if c.Timezone != "" {
+		location, err := time.LoadLocation(c.Timezone)
+		if err != nil {
+			return rule, err
+		}
+		rule.Location = location
+	}
+	return rule, nil
+}
+
+// egressFileConfig configures multi-WAN egress. Link health is checked
+// afresh after a reload.
+type egressFileConfig struct {
+	Links []struct {
+		Name      string `json:"name"`
+		LocalIP   string `json:"local_ip"`
+		Interface string `json:"interface"`
+		Weight    int    `json:"weight"`
+	} `json:"links"`
+	// Policy is "round_robin" (default), "weighted" or "latency".
+	Policy         string   `json:"policy"`
+	HealthCheck    string   `json:"health_check"`
+	HealthInterval duration `json:"health_interval"`
+	HealthTimeout  duration `json:"health_timeout"`
+}
+
+func (c *egressFileConfig) egress() (*socks5.Egress, error) {
+	egress := socks5.Egress{
+		HealthCheck:    c.HealthCheck,
+		HealthInterval: time.Duration(c.HealthInterval),
+		HealthTimeout:  time.Duration(c.HealthTimeout),
+	}
+	switch c.Policy {
+	case "", "round_robin":
+		egress.Policy = socks5.EgressRoundRobin
+	case "weighted":
+		egress.Policy = socks5.EgressWeighted
+	case "latency":
+		egress.Policy = socks5.EgressLatency
+	default:
+		return nil, errors.New("unknown egress policy " + c.Policy)
+	}
+	for _, link := range c.Links {
+		l := socks5.EgressLink{Name: link.Name, Interface: link.Interface, Weight: link.Weight}
+		if link.LocalIP != "" {
+			if l.LocalIP = net.ParseIP(link.LocalIP); l.LocalIP == nil {
+				return nil, errors.New("invalid egress local_ip " + link.LocalIP)
+			}
+		}
+		egress.Links = append(egress.Links, l)
+	}
+	return &egress, nil
+}
+
+func defaultFileConfig() *fileConfig {
+	return &fileConfig{
+		IP:   "localhost",
+		Port: 1080,
+		Auth: "none",
+		Users: map[string]string{
+			"admin":    "123456",
+			"zhangsan": "1234",
+			"lisi":     "abde",
+		},
+		DialTimeout:  duration(5 * time.Second),
+		DrainTimeout: duration(30 * time.Second),
+	}
+}
+
+// loadFileConfig reads path over the defaults. An empty path returns the defaults.
+func loadFileConfig(path string) (*fileConfig, error) {
+	config := defaultFileConfig()
+	if path == "" {
+		return config, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// serverConfig builds the server config, checking passwords with checker
+// and looking up HMAC secrets with secret.
+func (c *fileConfig) serverConfig(checker func(username, password string) bool, secret func(username string) (string, bool)) (_ *socks5.Config, err error) {
+	var config socks5.Config
+	defer func() {
+		if err != nil {
+			closeConfig(&config)
+		}
+	}()
+	config = socks5.Config{
+		PasswordChecker:  checker,
+		DialTimeout:      time.Duration(c.DialTimeout),
+		HandshakeTimeout: time.Duration(c.HandshakeTimeout),
+		RequestTimeout:   time.Duration(c.RequestTimeout),
+		IdleTimeout:      time.Duration(c.IdleTimeout),
+		MaxConnsPerHost:  c.MaxConnsPerHost,
+		EnableUDP:        c.EnableUDP,
+		EnableBind:       c.EnableBind,
+		StrictRSV:        c.StrictRSV,
+	}
+	config.UDPAmplificationRatio = c.UDPAmplificationRatio
+	config.UDPCloseOnUnreachable = c.UDPCloseOnUnreachable
+	config.UDPBatchSize = c.UDPBatchSize
+	config.MaxUDPAssociationsPerUser = c.MaxUDPAssociationsPerUser
+	config.UDPMaxLifetime = time.Duration(c.UDPMaxLifetime)
+	config.UDPMaxDatagrams = c.UDPMaxDatagrams
+	config.HandOffUDP = c.HandOffUDP
+	config.BandwidthLimit = c.BandwidthLimit
+	config.PortClassLimits = c.PortClassLimits
+	config.ListenNetwork = c.ListenNetwork
+	config.IPv6Only = c.IPv6Only
+	if len(c.Teardown) > 0 {
+		config.Teardown = make(map[socks5.TerminationReason]socks5.Teardown)
+	}
+	for reason, teardown := range c.Teardown {
+		config.Teardown[reason] = socks5.Teardown{Reset: teardown.Reset, Linger: time.Duration(teardown.Linger)}
+	}
+	config.RequireSNIMatch = c.RequireSNIMatch
+	config.MaxConcurrentDials = c.MaxConcurrentDials
+	config.DialQueueSize = c.DialQueueSize
+	config.DialQueueTimeout = time.Duration(c.DialQueueTimeout)
+	config.MaxMemory = c.MaxMemory
+	config.MemoryShedIdle = time.Duration(c.MemoryShedIdle)
+	config.DisallowPipelining = c.DisallowPipelining
+	config.Quirks = c.Quirks
+	config.ParallelDial = c.ParallelDial
+	config.RejectDomainTargets = c.RejectDomainTargets
+	if c.StatsFile != "" {
+		config.StatsStore = &socks5.FileStatsStore{Path: c.StatsFile}
+		config.StatsFlushInterval = time.Duration(c.StatsFlushInterval)
+	}
+	if c.DebugHandshake && c.LogRedaction != nil {
+		return nil, errors.New("debug_handshake would log passwords despite log_redaction")
+	}
+	if c.DebugHandshake {
+		config.HandshakeTap = func(data socks5.HandshakeBytes) {
+			from := "server"
+			if data.FromClient {
+				from = "client"
+			}
+			log.Printf("session %s handshake from %s: % x", data.SessionID, from, data.Data)
+		}
+	}
+	if c.Ident != nil {
+		ident := socks5.Ident{Timeout: time.Duration(c.Ident.Timeout), Port: c.Ident.Port}
+		config.IdentResolver = ident.Lookup
+	}
+	if len(c.SourceAllow) > 0 || len(c.SourceDeny) > 0 {
+		config.SourceFilter = &socks5.SourceFilter{Allow: c.SourceAllow, Deny: c.SourceDeny}
+	}
+	if c.Ban != nil {
+		config.ScanGuard = c.Ban.scanGuard()
+	}
+	for i := range c.Rules {
+		rule, err := c.Rules[i].rule()
+		if err != nil {
+			return nil, err
+		}
+		config.Rules = append(config.Rules, rule)
+	}
+	if c.Egress != nil {
+		egress, err := c.Egress.egress()
+		if err != nil {
+			return nil, err
+		}
+		config.Egress = egress
+	}
+	config.KeepIPv4Mapped = c.KeepIPv4Mapped
+	if c.NAT64Prefix != "" {
+		_, prefix, err := net.ParseCIDR(c.NAT64Prefix)
+		if err != nil {
+			return nil, err
+		}
+		config.NAT64Prefix = prefix
+	}
+	config.LogRedaction = c.LogRedaction
+	if c.FallbackAddress != "" {
+		config.Fallback = socks5.FallbackProxy(c.FallbackAddress, config.DialTimeout)
+	}
+	switch c.Auth {
+	case "", "none":
+		config.AuthMethod = socks5.MethodNoAuth
+	case "password":
+		config.AuthMethod = socks5.MethodPassword
+	case "hmac":
+		config.AuthMethod = socks5.MethodHMAC
+		config.HMACSecret = secret
+	default:
+		return nil, errors.New("unknown auth method " + c.Auth)
+	}
+	if c.AccessLog != nil {
+		recorder, err := c.AccessLog.recorder(c.LogRedaction)
+		if err != nil {
+			return nil, err
+		}
+		config.Recorder = recorder
+	}
+	if c.Sinkhole != nil {
+		config.Sinkhole = c.Sinkhole.Open
+	}
+	if c.Reputation != nil {
+		blocklist, err := socks5.LoadIPBlocklist(c.Reputation.Blocklist)
+		if err != nil {
+			return nil, err
+		}
+		config.Reputation = &socks5.Reputation{
+			Provider:    blocklist,
+			CacheTTL:    time.Duration(c.Reputation.CacheTTL),
+			MonitorOnly: c.Reputation.MonitorOnly,
+			FailClosed:  c.Reputation.FailClosed,
+		}
+	}
+	for _, path := range c.Plugins {
+		plugin, err := socks5.LoadPlugin(path)
+		if err != nil {
+			return nil, err
+		}
+		config.Plugins = append(config.Plugins, plugin)
+	}
+	if c.DomainBlocklist != nil {
+		blocklist, err := socks5.LoadDomainBlocklist(time.Duration(c.DomainBlocklist.Refresh), c.DomainBlocklist.Sources...)
+		if err != nil {
+			return nil, err
+		}
+		config.DomainBlocklist = blocklist
+	}
+	return &config, nil
+}
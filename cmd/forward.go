@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net"
+	"os"
+
+	"github.com/Doraemonkeys/socks5"
+)
+
+// runForward runs the forward subcommand, tunnelling a local port to a
+// fixed target through a SOCKS5 server like ssh -L. The password is read
+// from SOCKS5_PASSWORD to keep it out of the process list.
+func runForward(args []string) error {
+	flags := flag.NewFlagSet("forward", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:1081", "local address to listen on")
+	target := flags.String("target", "", "host:port to forward to")
+	proxy := flags.String("proxy", "127.0.0.1:1080", "host:port of the SOCKS5 server")
+	username := flags.String("user", "", "SOCKS5 username, with the password in SOCKS5_PASSWORD")
+	udp := flags.Bool("udp", false, "also forward UDP datagrams")
+	flags.Parse(args)
+	if *target == "" {
+		return errors.New("forward: -target is required")
+	}
+
+	forward := socks5.PortForward{
+		Client: &socks5.Client{
+			ProxyAddress: *proxy,
+			Username:     *username,
+			Password:     os.Getenv("SOCKS5_PASSWORD"),
+		},
+		Target: *target,
+	}
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	errc := make(chan error, 2)
+	go func() { errc <- forward.ServeTCP(listener) }()
+	if *udp {
+		conn, err := net.ListenPacket("udp", *listen)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		go func() { errc <- forward.ServeUDP(conn) }()
+	}
+	return <-errc
+}
@@ -0,0 +1,132 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceName = "socks5"
+
+// runDaemon runs the server as a Windows service when started by the service
+// manager, handles -service control commands, and otherwise runs in the
+// console until interrupted.
+func runDaemon(d *daemon, service string) error {
+	if service != "" {
+		return controlService(d, service)
+	}
+
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return err
+	}
+	if isService {
+		return svc.Run(serviceName, &serviceHandler{daemon: d})
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		<-signals
+		log.Println("interrupted, draining sessions")
+		d.shutdown(context.Background())
+	}()
+	return d.run()
+}
+
+type serviceHandler struct {
+	daemon *daemon
+}
+
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	errc := make(chan error, 1)
+	go func() { errc <- h.daemon.run() }()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange}
+
+	for {
+		select {
+		case err := <-errc:
+			if err != nil {
+				log.Println("server stopped:", err)
+				return false, 1
+			}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.ParamChange:
+				if err := h.daemon.reload(); err != nil {
+					log.Println("reload:", err)
+				}
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				h.daemon.shutdown(context.Background())
+				<-errc
+				return false, 0
+			}
+		}
+	}
+}
+
+func controlService(d *daemon, command string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if command == "install" {
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		var args []string
+		if d.configPath != "" {
+			args = append(args, "-config", d.configPath)
+		}
+		s, err := m.CreateService(serviceName, exe, mgr.Config{
+			DisplayName: "SOCKS5 proxy",
+			StartType:   mgr.StartAutomatic,
+		}, args...)
+		if err != nil {
+			return err
+		}
+		return s.Close()
+	}
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	switch command {
+	case "uninstall":
+		return s.Delete()
+	case "start":
+		return s.Start()
+	case "stop":
+		st, err := s.Control(svc.Stop)
+		if err != nil {
+			return err
+		}
+		for st.State != svc.Stopped {
+			time.Sleep(100 * time.Millisecond)
+			if st, err = s.Query(); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown service command %s", command)
+	}
+}
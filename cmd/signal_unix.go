@@ -0,0 +1,81 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// restartTimeout bounds how long a restarted process may take to get ready.
+const restartTimeout = 30 * time.Second
+
+// runDaemon runs the server until SIGTERM or SIGINT, reloading the config on
+// SIGHUP. SIGUSR2 starts a new process from the executable on disk, hands it
+// the listener and drains this one. A second SIGTERM or SIGINT while
+// draining closes the remaining sessions at once.
+func runDaemon(d *daemon, service string) error {
+	if service != "" {
+		return errors.New("-service is only supported on Windows")
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR2, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+	drain, force := context.WithCancel(context.Background())
+	defer force()
+	// drained is closed once the server has shut down
+	drained := make(chan struct{})
+	go func() {
+		draining := false
+		for {
+			var sig os.Signal
+			select {
+			case sig = <-signals:
+			case <-drained:
+				return
+			}
+			switch {
+			case draining && (sig == syscall.SIGTERM || sig == syscall.SIGINT):
+				log.Println("received", sig, "again, closing remaining sessions")
+				force()
+				continue
+			case draining:
+				log.Println("ignoring", sig, "while draining sessions")
+				continue
+			case sig == syscall.SIGHUP:
+				if err := d.reload(); err != nil {
+					log.Println("reload:", err)
+				}
+				continue
+			case sig == syscall.SIGUSR2:
+				ctx, cancel := context.WithTimeout(context.Background(), restartTimeout)
+				process, err := d.server.Restart(ctx)
+				cancel()
+				if err != nil {
+					log.Println("restart:", err)
+					continue
+				}
+				log.Println("restarted as pid", process.Pid, "draining sessions")
+			default:
+				log.Println("received", sig, "draining sessions")
+			}
+			draining = true
+			go func() {
+				d.shutdown(drain)
+				close(drained)
+			}()
+		}
+	}()
+
+	if err := d.run(); err != nil {
+		return err
+	}
+	<-drained
+	return nil
+}
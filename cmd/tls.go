@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/Doraemonkeys/socks5"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsFileConfig enables TLS on the listener. Plain-text clients keep working
+// on the same port; connections starting with a TLS handshake are unwrapped.
+type tlsFileConfig struct {
+	// CertFile and KeyFile are a PEM certificate chain and key, re-read on reload.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// ACME, if set, obtains and renews certificates automatically instead.
+	ACME *acmeFileConfig `json:"acme"`
+	// ClientCAFile, if set, verifies client certificates against these PEM
+	// CAs, and ClientCertField ("cn", "dns", "email" or "uri") maps them to
+	// usernames that skip SOCKS5 auth.
+	ClientCAFile    string `json:"client_ca_file"`
+	ClientCertField string `json:"client_cert_field"`
+	// ClientCertPins maps SPKI pins (base64 SHA-256) of client certificates
+	// to usernames. With ClientCAFile set, they must also chain to it.
+	ClientCertPins map[string]string `json:"client_cert_pins"`
+	// ClientCertAndPassword requires the mapped certificate and the
+	// password of the same user instead of letting the certificate skip auth.
+	ClientCertAndPassword bool `json:"client_cert_and_password"`
+}
+
+var certFields = map[string]socks5.CertField{
+	"":      socks5.CertFieldNone,
+	"cn":    socks5.CertFieldCommonName,
+	"dns":   socks5.CertFieldDNSName,
+	"email": socks5.CertFieldEmail,
+	"uri":   socks5.CertFieldURI,
+}
+
+// certAuth returns the client certificate authenticator, or nil.
+func (c *tlsFileConfig) certAuth() (*socks5.CertAuth, error) {
+	if c.ClientCAFile == "" && len(c.ClientCertPins) == 0 {
+		return nil, nil
+	}
+	field, ok := certFields[c.ClientCertField]
+	if !ok {
+		return nil, errors.New("unknown client_cert_field " + c.ClientCertField)
+	}
+	return &socks5.CertAuth{Pins: c.ClientCertPins, Field: field, RequirePassword: c.ClientCertAndPassword}, nil
+}
+
+// acmeFileConfig configures certificates from an ACME CA such as Let's
+// Encrypt. It only changes on restart.
+type acmeFileConfig struct {
+	// Domains are the names certificates are requested for.
+	Domains []string `json:"domains"`
+	// Email is the optional contact address of the ACME account.
+	Email string `json:"email"`
+	// CacheDir keeps the account key and certificates across restarts.
+	CacheDir string `json:"cache_dir"`
+	// DirectoryURL selects the CA, Let's Encrypt by default.
+	DirectoryURL string `json:"directory_url"`
+	// HTTPAddress, if set (e.g. ":80"), serves HTTP-01 challenges. TLS-ALPN-01
+	// challenges are answered on the proxy port, which must then be 443.
+	HTTPAddress string `json:"http_address"`
+}
+
+// manager returns the certificate manager for c.
+func (c *acmeFileConfig) manager() (*autocert.Manager, error) {
+	if len(c.Domains) == 0 {
+		return nil, errors.New("acme: domains are required")
+	}
+	if c.CacheDir == "" {
+		return nil, errors.New("acme: cache_dir is required, or every restart requests new certificates")
+	}
+	manager := autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(c.CacheDir),
+		HostPolicy: autocert.HostWhitelist(c.Domains...),
+		Email:      c.Email,
+	}
+	if c.DirectoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: c.DirectoryURL}
+	}
+	return &manager, nil
+}
+
+// serveHTTPChallenges answers HTTP-01 challenges on address until the
+// process exits.
+func serveHTTPChallenges(address string, manager *autocert.Manager) {
+	go func() {
+		if err := http.ListenAndServe(address, manager.HTTPHandler(nil)); err != nil {
+			log.Println("acme: HTTP challenge server:", err)
+		}
+	}()
+}
+
+// serverTLSConfig builds the listener's TLS config, getting certificates
+// from manager when ACME is configured. httpConnect tells whether HTTP
+// CONNECT is served next to SOCKS5.
+func (c *tlsFileConfig) serverTLSConfig(manager *autocert.Manager, httpConnect bool) (*tls.Config, error) {
+	var config tls.Config
+	if c.ACME != nil {
+		if manager == nil {
+			return nil, errors.New("acme: enabling ACME takes a restart")
+		}
+		// Offer the served protocols next to the TLS-ALPN-01 challenge
+		// protocol, as the server does for configs without NextProtos
+		config.GetCertificate = manager.GetCertificate
+		config.NextProtos = []string{socks5.ALPNSOCKS5}
+		if httpConnect {
+			config.NextProtos = append(config.NextProtos, socks5.ALPNHTTP)
+		}
+		config.NextProtos = append(config.NextProtos, acme.ALPNProto)
+	} else {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	// Clients without a certificate can still use SOCKS5 auth
+	if c.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in " + c.ClientCAFile)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	} else if len(c.ClientCertPins) > 0 {
+		config.ClientAuth = tls.RequestClientCert
+	}
+	return &config, nil
+}
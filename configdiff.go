@@ -0,0 +1,301 @@
+package socks5
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ConfigChange is a setting that differs between two configs. Field is the
+// path of the setting, e.g. "Rules[2].Hosts" or "ScanGuard.Threshold".
+// Functions cannot be compared, as closures of one literal look alike
+// whatever they capture, so only setting or clearing one is reported.
+// Values of other packages such as TLSConfig are compared by content but
+// shown as "<set>" or "<nil>". Secrets such as Upstream.Password are shown
+// as "<redacted>", as the changes are usually logged.
+type ConfigChange struct {
+	Field string
+	Old   string
+	New   string
+}
+
+func (c ConfigChange) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.Field, c.Old, c.New)
+}
+
+// DiffConfig returns the settings that differ between old and new.
+func DiffConfig(old, new *Config) []ConfigChange {
+	var changes []ConfigChange
+	diffValue(&changes, "", reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem())
+	return changes
+}
+
+// ApplyConfigDiff is ApplyConfig returning what changed. With dryRun, config
+// is only validated and compared, so a change can be reviewed before it
+// locks anyone out, and is left as it was.
+func (s *SOCKS5Server) ApplyConfigDiff(config *Config, dryRun bool) ([]ConfigChange, error) {
+	if dryRun {
+		config = config.detached()
+	}
+	if err := initConfig(config); err != nil {
+		return nil, err
+	}
+	changes := DiffConfig(s.config(), config)
+	if !dryRun {
+		s.current.Store(config)
+	}
+	return changes, nil
+}
+
+// detached returns a copy of config that initConfig can compile without
+// writing to config or to the rules and filter it shares with it.
+func (config *Config) detached() *Config {
+	c := *config
+	if config.Rules != nil {
+		c.Rules = make([]Rule, len(config.Rules))
+		for i, rule := range config.Rules {
+			rule.nets, rule.windows = nil, nil
+			c.Rules[i] = rule
+		}
+	}
+	if config.SourceFilter != nil {
+		filter := *config.SourceFilter
+		filter.allow, filter.deny = nil, nil
+		c.SourceFilter = &filter
+	}
+	return &c
+}
+
+var packagePath = reflect.TypeOf(Config{}).PkgPath()
+
+// ownStruct returns the struct v points to if it is a struct type of this
+// package with exported fields, which are compared one by one. Types with
+// only internal state, such as DomainBlocklist, are compared as in
+// sameOpaque.
+func ownStruct(v reflect.Value) (reflect.Value, bool) {
+	for v.Kind() == reflect.Interface || v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return v, false
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct || v.Type().PkgPath() != packagePath {
+		return v, false
+	}
+	return v, hasExportedFields(v.Type())
+}
+
+func diffValue(changes *[]ConfigChange, field string, old, new reflect.Value) {
+	oldStruct, oldOwn := ownStruct(old)
+	newStruct, newOwn := ownStruct(new)
+	if oldOwn && newOwn && oldStruct.Type() == newStruct.Type() {
+		for i := 0; i < oldStruct.NumField(); i++ {
+			f := oldStruct.Type().Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name := f.Name
+			if field != "" {
+				name = field + "." + name
+			}
+			if secretField(f) {
+				if !sameConfigValue(oldStruct.Field(i), newStruct.Field(i)) {
+					*changes = append(*changes, ConfigChange{name, formatSecret(oldStruct.Field(i)), formatSecret(newStruct.Field(i))})
+				}
+				continue
+			}
+			diffValue(changes, name, oldStruct.Field(i), newStruct.Field(i))
+		}
+		return
+	}
+
+	if old.Kind() == reflect.Slice && !comparedWhole(old.Type().Elem()) {
+		for i := 0; i < old.Len() || i < new.Len(); i++ {
+			name := field + "[" + strconv.Itoa(i) + "]"
+			switch {
+			case i >= new.Len():
+				*changes = append(*changes, ConfigChange{name, formatConfigValue(old.Index(i)), "<none>"})
+			case i >= old.Len():
+				*changes = append(*changes, ConfigChange{name, "<none>", formatConfigValue(new.Index(i))})
+			default:
+				diffValue(changes, name, old.Index(i), new.Index(i))
+			}
+		}
+		return
+	}
+
+	if !sameConfigValue(old, new) {
+		*changes = append(*changes, ConfigChange{field, formatConfigValue(old), formatConfigValue(new)})
+	}
+}
+
+// comparedWhole reports whether slices of t are compared as a whole rather
+// than element by element.
+func comparedWhole(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Struct, reflect.Pointer, reflect.Interface:
+		return false
+	}
+	return true
+}
+
+// sameConfigValue reports whether old and new, of the same type, hold the
+// same setting. Functions are only compared by whether they are set, and
+// structs by their exported fields, or as in sameOpaque without any.
+func sameConfigValue(old, new reflect.Value) bool {
+	switch old.Kind() {
+	case reflect.Func:
+		return old.IsNil() == new.IsNil()
+	case reflect.Pointer:
+		if old.IsNil() || new.IsNil() {
+			return old.IsNil() == new.IsNil()
+		}
+		if old.Pointer() == new.Pointer() {
+			return true
+		}
+		if same, ok := sameByEqual(old, new); ok {
+			return same
+		}
+		if old.Elem().Kind() == reflect.Struct && !hasExportedFields(old.Elem().Type()) {
+			return sameOpaque(old, new)
+		}
+		return sameConfigValue(old.Elem(), new.Elem())
+	case reflect.Interface:
+		if old.IsNil() || new.IsNil() {
+			return old.IsNil() == new.IsNil()
+		}
+		return old.Elem().Type() == new.Elem().Type() && sameConfigValue(old.Elem(), new.Elem())
+	case reflect.Struct:
+		if same, ok := sameByEqual(old, new); ok {
+			return same
+		}
+		if !hasExportedFields(old.Type()) {
+			return sameOpaque(old, new)
+		}
+		for i := 0; i < old.NumField(); i++ {
+			if old.Type().Field(i).IsExported() && !sameConfigValue(old.Field(i), new.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Slice, reflect.Array:
+		if old.Len() != new.Len() {
+			return false
+		}
+		for i := 0; i < old.Len(); i++ {
+			if !sameConfigValue(old.Index(i), new.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Map:
+		if old.Len() != new.Len() {
+			return false
+		}
+		iter := old.MapRange()
+		for iter.Next() {
+			value := new.MapIndex(iter.Key())
+			if !value.IsValid() || !sameConfigValue(iter.Value(), value) {
+				return false
+			}
+		}
+		return true
+	case reflect.Chan, reflect.UnsafePointer:
+		return old.Pointer() == new.Pointer()
+	}
+	return reflect.DeepEqual(old.Interface(), new.Interface())
+}
+
+// sameByEqual compares old and new with their Equal method, such as that
+// of x509.CertPool or time.Time, if they have one.
+func sameByEqual(old, new reflect.Value) (same, ok bool) {
+	equal := old.MethodByName("Equal")
+	if !equal.IsValid() {
+		return false, false
+	}
+	t := equal.Type()
+	if t.NumIn() != 1 || t.In(0) != new.Type() || t.NumOut() != 1 || t.Out(0).Kind() != reflect.Bool {
+		return false, false
+	}
+	return equal.Call([]reflect.Value{new})[0].Bool(), true
+}
+
+// sameOpaque compares values with only internal state and no Equal
+// method, such as a *time.Location or a *sql.DB: by their String if they
+// have one, else by identity, as their state may be in use.
+func sameOpaque(old, new reflect.Value) bool {
+	if s, ok := old.Interface().(fmt.Stringer); ok {
+		return s.String() == new.Interface().(fmt.Stringer).String()
+	}
+	if old.Kind() == reflect.Pointer {
+		return old.Pointer() == new.Pointer()
+	}
+	return reflect.DeepEqual(old.Interface(), new.Interface())
+}
+
+// hasExportedFields reports whether the struct type t has exported fields.
+func hasExportedFields(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).IsExported() {
+			return true
+		}
+	}
+	return false
+}
+
+func formatConfigValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Func, reflect.Pointer, reflect.Interface, reflect.Chan, reflect.UnsafePointer, reflect.Map:
+		if v.IsNil() {
+			return "<nil>"
+		}
+		if v.Kind() == reflect.Map {
+			return fmt.Sprint(v.Interface())
+		}
+		if s, ok := ownStruct(v); ok {
+			return formatConfigStruct(s)
+		}
+		return "<set>"
+	case reflect.Struct:
+		if _, ok := ownStruct(v); ok {
+			return formatConfigStruct(v)
+		}
+		return fmt.Sprintf("%+v", v.Interface())
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// formatConfigStruct formats the exported fields of v that are set.
+func formatConfigStruct(v reflect.Value) string {
+	var b strings.Builder
+	b.WriteString("{")
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if !f.IsExported() || v.Field(i).IsZero() {
+			continue
+		}
+		if b.Len() > 1 {
+			b.WriteString(" ")
+		}
+		if secretField(f) {
+			b.WriteString(f.Name + ":" + formatSecret(v.Field(i)))
+			continue
+		}
+		b.WriteString(f.Name + ":" + formatConfigValue(v.Field(i)))
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+// secretField reports whether f holds passwords, which are not shown.
+func secretField(f reflect.StructField) bool {
+	return f.Name == "Password" || f.Name == "Credentials"
+}
+
+func formatSecret(v reflect.Value) string {
+	if v.IsZero() {
+		return formatConfigValue(v)
+	}
+	return "<redacted>"
+}
@@ -0,0 +1,122 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffConfig(t *testing.T) {
+	checker := func(username, password string) bool { return true }
+	old := &Config{
+		AuthMethod:      MethodPassword,
+		PasswordChecker: checker,
+		DialTimeout:     5 * time.Second,
+		Rules:           []Rule{{Name: "office", Networks: []string{"10.0.0.0/8"}}, {Hosts: []string{".example.com"}}},
+		ScanGuard:       &ScanGuard{Threshold: 5, Window: time.Minute, BanDuration: time.Hour},
+	}
+	new := &Config{
+		AuthMethod:      MethodPassword,
+		PasswordChecker: checker,
+		DialTimeout:     10 * time.Second,
+		Rules:           []Rule{{Name: "office", Networks: []string{"10.0.0.0/16"}}},
+		ScanGuard:       &ScanGuard{Threshold: 3, Window: time.Minute, BanDuration: time.Hour},
+		SourceFilter:    &SourceFilter{Deny: []string{"192.0.2.0/24"}},
+	}
+	want := []ConfigChange{
+		{"DialTimeout", "5s", "10s"},
+		{"Rules[0].Networks", "[10.0.0.0/8]", "[10.0.0.0/16]"},
+		{"Rules[1]", "{Hosts:[.example.com]}", "<none>"},
+		{"SourceFilter", "<nil>", "{Deny:[192.0.2.0/24]}"},
+		{"ScanGuard.Threshold", "5", "3"},
+	}
+	if got := DiffConfig(old, new); !reflect.DeepEqual(want, got) {
+		t.Fatalf("should get changes %v but got %v", want, got)
+	}
+	if got := DiffConfig(old, old); len(got) != 0 {
+		t.Fatalf("should get no changes but got %v", got)
+	}
+	if got := DiffConfig(old, &Config{AuthMethod: MethodPassword, DialTimeout: 5 * time.Second, Rules: old.Rules, ScanGuard: old.ScanGuard}); !reflect.DeepEqual(got, []ConfigChange{{"PasswordChecker", "<set>", "<nil>"}}) {
+		t.Fatalf("should report the removed checker but got %v", got)
+	}
+}
+
+func TestDiffConfigComparesContent(t *testing.T) {
+	// A config as a daemon builds it anew from the same file
+	build := func(zone string, minVersion uint16, fallback string) *Config {
+		strict := true
+		return &Config{
+			StrictRSV: &strict,
+			TLSConfig: &tls.Config{MinVersion: minVersion, ClientCAs: x509.NewCertPool()},
+			Rules:     []Rule{{Location: time.FixedZone(zone, 3600)}},
+			Fallback:  func(conn net.Conn) { conn.Write([]byte(fallback)) },
+		}
+	}
+	if got := DiffConfig(build("CET", tls.VersionTLS12, "a"), build("CET", tls.VersionTLS12, "a")); len(got) != 0 {
+		t.Fatalf("should get no changes but got %v", got)
+	}
+	want := []ConfigChange{
+		{"Rules[0].Location", "<set>", "<set>"},
+		{"TLSConfig", "<set>", "<set>"},
+	}
+	// Closures of one literal cannot be told apart, so Fallback is not reported
+	if got := DiffConfig(build("CET", tls.VersionTLS12, "a"), build("WAT", tls.VersionTLS13, "b")); !reflect.DeepEqual(want, got) {
+		t.Fatalf("should get changes %v but got %v", want, got)
+	}
+}
+
+func TestDiffConfigRedactsSecrets(t *testing.T) {
+	old := &Config{Upstream: &Upstream{Address: "10.0.0.1:1080", Username: "proxy", Password: "old"}}
+	new := &Config{Upstream: &Upstream{
+		Address:     "10.0.0.1:1080",
+		Username:    "proxy",
+		Password:    "new",
+		Credentials: map[string]UpstreamAccount{"alice": {Username: "a", Password: "secret"}},
+	}}
+	want := []ConfigChange{
+		{"Upstream.Password", "<redacted>", "<redacted>"},
+		{"Upstream.Credentials", "<nil>", "<redacted>"},
+	}
+	if got := DiffConfig(old, new); !reflect.DeepEqual(want, got) {
+		t.Fatalf("should get changes %v but got %v", want, got)
+	}
+	want = []ConfigChange{{"Upstream", "<nil>", "{Address:10.0.0.1:1080 Username:proxy Password:<redacted>}"}}
+	if got := DiffConfig(&Config{}, old); !reflect.DeepEqual(want, got) {
+		t.Fatalf("should get changes %v but got %v", want, got)
+	}
+}
+
+func TestApplyConfigDiffDryRun(t *testing.T) {
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth}}
+	if err := server.init(); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := server.ApplyConfigDiff(&Config{AuthMethod: MethodNoAuth, RejectIPTargets: true}, true)
+	if err != nil || !reflect.DeepEqual(changes, []ConfigChange{{"RejectIPTargets", "false", "true"}}) {
+		t.Fatalf("should report the change but got %v, %v", changes, err)
+	}
+	if server.config().RejectIPTargets {
+		t.Fatalf("dry run should not apply the config")
+	}
+	proposed := func() *Config {
+		return &Config{AuthMethod: MethodNoAuth, TCPTimeout: time.Second,
+			Rules:        []Rule{{Networks: []string{"10.0.0.0/8"}, Windows: []TimeWindow{{From: "09:00", To: "17:00"}}}},
+			SourceFilter: &SourceFilter{Allow: []string{"10.0.0.0/8"}}}
+	}
+	config := proposed()
+	if _, err := server.ApplyConfigDiff(config, true); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config, proposed()) {
+		t.Fatalf("dry run should leave the config untouched but got %+v", config)
+	}
+	if _, err := server.ApplyConfigDiff(&Config{AuthMethod: MethodNoAuth, MaxConnsPerHost: -1}, true); err == nil {
+		t.Fatalf("should reject an invalid config")
+	}
+	if _, err := server.ApplyConfigDiff(&Config{AuthMethod: MethodNoAuth, RejectIPTargets: true}, false); err != nil || !server.config().RejectIPTargets {
+		t.Fatalf("should apply the config but got %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// CountingConn is a net.Conn counting the bytes read and written through it
+// and remembering when it last moved data. When the wrapped connection is a
+// net.PacketConn, such as a UDP relay socket, ReadFrom and WriteTo are
+// counted too. It is safe for concurrent use.
+type CountingConn struct {
+	net.Conn
+
+	read    atomic.Int64
+	written atomic.Int64
+	// last is the time of the last activity in Unix nanoseconds.
+	last  atomic.Int64
+	clock clock
+}
+
+var errPacketConnRequired = errors.New("not a packet connection")
+
+// NewCountingConn wraps conn. The last activity starts at the current time.
+func NewCountingConn(conn net.Conn) *CountingConn {
+	c := CountingConn{Conn: conn}
+	c.touch()
+	return &c
+}
+
+func (c *CountingConn) touch() {
+	c.last.Store(timeNow(c.clock).UnixNano())
+}
+
+func (c *CountingConn) count(counter *atomic.Int64, n int) {
+	if n > 0 {
+		counter.Add(int64(n))
+		c.touch()
+	}
+}
+
+func (c *CountingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.count(&c.read, n)
+	return n, err
+}
+
+func (c *CountingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.count(&c.written, n)
+	return n, err
+}
+
+// ReadFrom reads a packet if the wrapped connection is a net.PacketConn.
+func (c *CountingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	pc, ok := c.Conn.(net.PacketConn)
+	if !ok {
+		return 0, nil, errPacketConnRequired
+	}
+	n, addr, err := pc.ReadFrom(b)
+	c.count(&c.read, n)
+	return n, addr, err
+}
+
+// WriteTo writes a packet if the wrapped connection is a net.PacketConn.
+func (c *CountingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	pc, ok := c.Conn.(net.PacketConn)
+	if !ok {
+		return 0, errPacketConnRequired
+	}
+	n, err := pc.WriteTo(b, addr)
+	c.count(&c.written, n)
+	return n, err
+}
+
+func (c *CountingConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errCloseWriteNotSupported
+}
+
+// ReadBytes returns the number of bytes read so far.
+func (c *CountingConn) ReadBytes() int64 {
+	return c.read.Load()
+}
+
+// WriteBytes returns the number of bytes written so far.
+func (c *CountingConn) WriteBytes() int64 {
+	return c.written.Load()
+}
+
+// LastActivity returns when data was last read or written, or when the
+// connection was wrapped if none was.
+func (c *CountingConn) LastActivity() time.Time {
+	return time.Unix(0, c.last.Load())
+}
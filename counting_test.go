@@ -0,0 +1,58 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCountingConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	clock := newFakeClock()
+	conn := &CountingConn{Conn: a, clock: clock}
+	conn.touch()
+	start := conn.LastActivity()
+
+	go func() {
+		buf := make([]byte, 5)
+		io.ReadFull(b, buf)
+		b.Write([]byte("abc"))
+	}()
+	clock.Advance(time.Second)
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if conn.WriteBytes() != 5 || conn.ReadBytes() != 3 {
+		t.Fatalf("should count 5 written and 3 read but got %d and %d", conn.WriteBytes(), conn.ReadBytes())
+	}
+	if got := conn.LastActivity().Sub(start); got != time.Second {
+		t.Fatalf("last activity should move by 1s but moved %s", got)
+	}
+	if _, _, err := conn.ReadFrom(nil); err != errPacketConnRequired {
+		t.Fatalf("should get error %s but got %v", errPacketConnRequired, err)
+	}
+}
+
+func TestCountingConnPacket(t *testing.T) {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := NewCountingConn(udp)
+	defer conn.Close()
+	if _, err := conn.WriteTo([]byte("ping"), udp.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadFrom(make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if conn.WriteBytes() != 4 || conn.ReadBytes() != 4 {
+		t.Fatalf("should count 4 bytes each way but got %d and %d", conn.WriteBytes(), conn.ReadBytes())
+	}
+}
@@ -0,0 +1,39 @@
+package socks5
+
+// ValidHostname reports whether name is a hostname under RFC 1035 and
+// RFC 1123: at most 253 bytes (255 on the wire) with an optional trailing
+// dot, and dot-separated labels of 1 to 63 letters, digits and hyphens that
+// neither start nor end with a hyphen. It is the default Config.DomainPolicy.
+func ValidHostname(name string) bool {
+	if len(name) > 0 && name[len(name)-1] == '.' {
+		name = name[:len(name)-1]
+	}
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+	start := 0
+	for i := 0; i <= len(name); i++ {
+		if i < len(name) && name[i] != '.' {
+			c := name[i]
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+				return false
+			}
+			continue
+		}
+		label := name[start:i]
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		start = i + 1
+	}
+	return true
+}
+
+// domainAllowed checks a TypeDomain target against the DomainPolicy of
+// config.
+func domainAllowed(config *Config, domain string) bool {
+	if policy := config.DomainPolicy; policy != nil {
+		return policy(domain)
+	}
+	return ValidHostname(domain)
+}
@@ -0,0 +1,62 @@
+package socks5
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestValidHostname(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"example.com", true},
+		{"example.com.", true},
+		{"a-1.B2.example", true},
+		{"localhost", true},
+		{"", false},
+		{".", false},
+		{"example..com", false},
+		{"-example.com", false},
+		{"example-.com", false},
+		{"_http._tcp.example.com", false},
+		{"exa mple.com", false},
+		{strings.Repeat("a", 63) + ".com", true},
+		{strings.Repeat("a", 64) + ".com", false},
+		{strings.Repeat("a.", 126) + "a", true},
+		{strings.Repeat("a.", 127) + "a", false},
+	}
+	for _, test := range tests {
+		if got := ValidHostname(test.name); got != test.want {
+			t.Errorf("ValidHostname(%q) should be %v but got %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestDomainPolicy(t *testing.T) {
+	request := func(domain string) []byte {
+		b := []byte{SOCKS5Version, CmdConnect, ReservedField, TypeDomain, byte(len(domain))}
+		return append(append(b, domain...), 0x00, 0x50)
+	}
+
+	server := SOCKS5Server{Config: &Config{}}
+	var buf bytes.Buffer
+	buf.Write(request("_srv._tcp.local"))
+	if err := server.request(&buf, &AuthContext{}); err != ErrInvalidDomain {
+		t.Fatalf("should get error %s but got %v", ErrInvalidDomain, err)
+	}
+	if got := buf.Bytes(); got[1] != ReplyHostUnreachable {
+		t.Fatalf("should reply %d but got %d", ReplyHostUnreachable, got[1])
+	}
+
+	// A custom policy admits the name, which then fails on the disabled BIND command.
+	server = SOCKS5Server{Config: &Config{DomainPolicy: func(string) bool { return true }}}
+	b := request("_srv._tcp.local")
+	b[1] = CmdBind
+	buf.Reset()
+	buf.Write(b)
+	if err := server.request(&buf, &AuthContext{}); err != ErrCommandNotSupported {
+		t.Fatalf("should get error %s but got %v", ErrCommandNotSupported, err)
+	}
+}
@@ -0,0 +1,40 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"syscall"
+)
+
+// dscpControl returns a net.Dialer Control function setting the DSCP class.
+func dscpControl(dscp uint8) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return setDSCP(c, network == "tcp6", dscp)
+	}
+}
+
+// setConnDSCP sets the DSCP class of the client connection, looking through
+// the server's own wrappers to the socket.
+func setConnDSCP(conn io.ReadWriter, dscp uint8) error {
+	for {
+		switch c := conn.(type) {
+		case *httpTunnel:
+			conn = c.sniffConn
+		case *sniffConn:
+			conn = c.Conn
+		case *tls.Conn:
+			conn = c.NetConn()
+		case *net.TCPConn:
+			raw, err := c.SyscallConn()
+			if err != nil {
+				return err
+			}
+			ip := c.LocalAddr().(*net.TCPAddr).IP
+			return setDSCP(raw, ip.To4() == nil, dscp)
+		default:
+			// Not a socket, e.g. net.Pipe in tests
+			return nil
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package socks5
+
+import "syscall"
+
+const dscpSupported = false
+
+func setDSCP(c syscall.RawConn, ipv6 bool, dscp uint8) error {
+	return ErrDSCPNotSupported
+}
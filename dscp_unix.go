@@ -0,0 +1,26 @@
+//go:build unix
+
+package socks5
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const dscpSupported = true
+
+// setDSCP sets the DSCP bits of the TOS (IPv4) or traffic class (IPv6) of a socket.
+func setDSCP(c syscall.RawConn, ipv6 bool, dscp uint8) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		if ipv6 {
+			err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, int(dscp)<<2)
+		} else {
+			err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, int(dscp)<<2)
+		}
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,56 @@
+//go:build unix
+
+package socks5
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func socketTOS(t *testing.T, conn net.Conn) int {
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tos int
+	raw.Control(func(fd uintptr) {
+		tos, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tos
+}
+
+func TestDSCP(t *testing.T) {
+	client, proxy := tcpPair(t)
+	defer client.Close()
+	defer proxy.Close()
+
+	// Through the sniffing wrapper, as for a sniffed SOCKS5 connection
+	if err := setConnDSCP(&sniffConn{Conn: proxy, reader: bufio.NewReader(proxy)}, 46); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if tos := socketTOS(t, proxy); tos != 46<<2 {
+		t.Fatalf("client socket should get TOS %#x but got %#x", 46<<2, tos)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	server := SOCKS5Server{Config: &Config{}}
+	target, err := server.dial(listener.Addr().String(), &AuthContext{}, time.Second, 0, 10, nil, false)
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	defer target.Close()
+	if tos := socketTOS(t, target); tos != 10<<2 {
+		t.Fatalf("target socket should get TOS %#x but got %#x", 10<<2, tos)
+	}
+}
@@ -0,0 +1,237 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var ErrBindDeviceNotSupported = errors.New("binding to an interface is only supported on Linux")
+
+// EgressPolicy chooses the link of each new session.
+type EgressPolicy int
+
+const (
+	// EgressRoundRobin uses the links in turn.
+	EgressRoundRobin EgressPolicy = iota
+	// EgressWeighted uses the links in turn in proportion to their Weight.
+	EgressWeighted
+	// EgressLatency uses the link with the lowest health check latency.
+	EgressLatency
+)
+
+// Egress spreads new TCP sessions across several outbound links of a
+// multi-WAN host, by source IP or interface. Links failing their health
+// check are skipped until they pass again; when all fail, all are used.
+type Egress struct {
+	Links  []EgressLink
+	Policy EgressPolicy
+	// HealthCheck, if set, is a host:port every link connects to each
+	// HealthInterval (default 10s), giving up after HealthTimeout (default
+	// 5s). Without it, links are always considered healthy and
+	// EgressLatency falls back to round robin.
+	HealthCheck    string
+	HealthInterval time.Duration
+	HealthTimeout  time.Duration
+
+	mu      sync.Mutex
+	links   []egressLinkState
+	next    int
+	started bool
+	stop    chan struct{}
+	clock   clock
+}
+
+// EgressLink is an outbound link, given by its source IP, its interface,
+// or both.
+type EgressLink struct {
+	Name string
+	// LocalIP is the source IP of connections over the link.
+	LocalIP net.IP
+	// Interface binds connections to a network interface (SO_BINDTODEVICE).
+	// Linux only.
+	Interface string
+	// Weight is the share of sessions under EgressWeighted. Zero counts as 1.
+	Weight int
+}
+
+// EgressLinkStatus is the health of a link as reported by Egress.Status.
+type EgressLinkStatus struct {
+	Name    string
+	Healthy bool
+	// Latency is the duration of the last successful health check.
+	Latency time.Duration
+	// LastCheck is when the link was last checked, and Err why it failed.
+	LastCheck time.Time
+	Err       error
+	// Sessions counts the sessions sent over the link.
+	Sessions int64
+}
+
+type egressLinkState struct {
+	unhealthy bool
+	latency   time.Duration
+	lastCheck time.Time
+	err       error
+	sessions  int64
+	// credit is the smooth weighted round robin counter.
+	credit int
+}
+
+func (l *EgressLink) weight() int {
+	if l.Weight <= 0 {
+		return 1
+	}
+	return l.Weight
+}
+
+// dialer returns a dialer sending connections over link, with control run
+// after the interface is bound.
+func (l *EgressLink) dialer(timeout time.Duration, control func(network, address string, c syscall.RawConn) error) *net.Dialer {
+	dialer := net.Dialer{Timeout: timeout, Control: control}
+	if l.LocalIP != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: l.LocalIP}
+	}
+	if l.Interface != "" {
+		dialer.Control = chainControl(bindDeviceControl(l.Interface), control)
+	}
+	return &dialer
+}
+
+// pick chooses the link of a new session and starts the health checks on
+// first use.
+func (e *Egress) pick() *EgressLink {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.links) != len(e.Links) {
+		e.links = make([]egressLinkState, len(e.Links))
+	}
+	if !e.started && e.HealthCheck != "" {
+		e.started = true
+		e.stop = make(chan struct{})
+		go e.check(e.stop)
+	}
+
+	candidates := make([]int, 0, len(e.Links))
+	for i := range e.links {
+		if !e.links[i].unhealthy {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		for i := range e.links {
+			candidates = append(candidates, i)
+		}
+	}
+
+	chosen := candidates[0]
+	switch {
+	case e.Policy == EgressWeighted:
+		// Smooth weighted round robin, which interleaves heavy and light links
+		total := 0
+		for _, i := range candidates {
+			e.links[i].credit += e.Links[i].weight()
+			total += e.Links[i].weight()
+			if e.links[i].credit > e.links[chosen].credit {
+				chosen = i
+			}
+		}
+		e.links[chosen].credit -= total
+	case e.Policy == EgressLatency && e.HealthCheck != "":
+		for _, i := range candidates[1:] {
+			if e.links[i].latency < e.links[chosen].latency {
+				chosen = i
+			}
+		}
+	default:
+		chosen = candidates[e.next%len(candidates)]
+		e.next++
+	}
+	e.links[chosen].sessions++
+	return &e.Links[chosen]
+}
+
+// check runs the health checks every HealthInterval until stop is closed.
+func (e *Egress) check(stop chan struct{}) {
+	interval := e.HealthInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	timeout := e.HealthTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for i := range e.Links {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				e.checkLink(i, timeout)
+			}(i)
+		}
+		wg.Wait()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkLink connects to HealthCheck over link i and records the outcome.
+func (e *Egress) checkLink(i int, timeout time.Duration) {
+	start := timeNow(e.clock)
+	conn, err := e.Links[i].dialer(timeout, nil).Dial("tcp", e.HealthCheck)
+	latency := timeNow(e.clock).Sub(start)
+	if err == nil {
+		conn.Close()
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if i >= len(e.links) {
+		return
+	}
+	link := &e.links[i]
+	link.unhealthy = err != nil
+	link.err = err
+	link.lastCheck = start
+	if err == nil {
+		link.latency = latency
+	}
+}
+
+// Status returns the health of every link, in the order of Links.
+func (e *Egress) Status() []EgressLinkStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	status := make([]EgressLinkStatus, len(e.Links))
+	for i, link := range e.Links {
+		status[i] = EgressLinkStatus{Name: link.Name, Healthy: true}
+		if i < len(e.links) {
+			state := e.links[i]
+			status[i].Healthy = !state.unhealthy
+			status[i].Latency = state.latency
+			status[i].LastCheck = state.lastCheck
+			status[i].Err = state.err
+			status[i].Sessions = state.sessions
+		}
+	}
+	return status
+}
+
+// Close stops the health checks, e.g. once ApplyConfig replaced the config
+// holding e.
+func (e *Egress) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.stop != nil {
+		close(e.stop)
+		e.stop = nil
+	}
+	return nil
+}
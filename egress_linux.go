@@ -0,0 +1,25 @@
+//go:build linux
+
+package socks5
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const bindDeviceSupported = true
+
+// bindDeviceControl returns a net.Dialer Control function binding the socket
+// to the network interface name (SO_BINDTODEVICE).
+func bindDeviceControl(name string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = unix.BindToDevice(int(fd), name)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
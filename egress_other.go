@@ -0,0 +1,13 @@
+//go:build !linux
+
+package socks5
+
+import "syscall"
+
+const bindDeviceSupported = false
+
+func bindDeviceControl(name string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return ErrBindDeviceNotSupported
+	}
+}
@@ -0,0 +1,115 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEgressPick(t *testing.T) {
+	links := []EgressLink{
+		{Name: "a", LocalIP: net.IPv4(127, 0, 0, 1), Weight: 2},
+		{Name: "b", LocalIP: net.IPv4(127, 0, 0, 2)},
+	}
+	picks := func(e *Egress, n int) string {
+		var names []string
+		for i := 0; i < n; i++ {
+			names = append(names, e.pick().Name)
+		}
+		return strings.Join(names, "")
+	}
+
+	if got := picks(&Egress{Links: links}, 4); got != "abab" {
+		t.Fatalf("round robin should pick abab but got %s", got)
+	}
+	if got := picks(&Egress{Links: links, Policy: EgressWeighted}, 6); got != "abaaba" {
+		t.Fatalf("weighted should pick abaaba but got %s", got)
+	}
+
+	// Unhealthy links are skipped unless all are
+	e := Egress{Links: links}
+	e.pick()
+	e.links[0].unhealthy = true
+	if got := picks(&e, 3); got != "bbb" {
+		t.Fatalf("should skip the unhealthy link but got %s", got)
+	}
+	e.links[1].unhealthy = true
+	if got := picks(&e, 2); len(got) != 2 {
+		t.Fatalf("should use all links when all are unhealthy but got %s", got)
+	}
+	if status := e.Status(); status[0].Healthy || status[1].Sessions != 4 {
+		t.Fatalf("should report link health and sessions but got %+v", status)
+	}
+
+	e = Egress{Links: links, Policy: EgressLatency, HealthCheck: "127.0.0.1:1", started: true}
+	e.pick()
+	e.links[0].latency = 20 * time.Millisecond
+	e.links[1].latency = 5 * time.Millisecond
+	if got := picks(&e, 2); got != "bb" {
+		t.Fatalf("latency should pick the fastest link but got %s", got)
+	}
+}
+
+func TestEgressHealthCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	e := Egress{
+		Links: []EgressLink{
+			{Name: "up", LocalIP: net.IPv4(127, 0, 0, 1)},
+			// Cannot reach a loopback address from this source
+			{Name: "down", LocalIP: net.IPv4(192, 0, 2, 1)},
+		},
+		HealthCheck:   listener.Addr().String(),
+		HealthTimeout: time.Second,
+	}
+	e.pick()
+	defer e.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := e.Status()
+		if !status[0].LastCheck.IsZero() && !status[1].LastCheck.IsZero() {
+			if !status[0].Healthy || status[1].Healthy || status[1].Err == nil {
+				t.Fatalf("should find link up healthy and down failing but got %+v", status)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("links should be checked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEgressDial(t *testing.T) {
+	server := SOCKS5Server{Config: &Config{
+		AuthMethod: MethodNoAuth,
+		Egress:     &Egress{Links: []EgressLink{{Name: "lo", LocalIP: net.IPv4(127, 0, 0, 1)}}},
+	}}
+	if err := server.init(); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := server.dial(listener.Addr().String(), &AuthContext{}, time.Second, 0, 0, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if status := server.config().Egress.Status(); status[0].Sessions != 1 {
+		t.Fatalf("should dial over the link but got %+v", status)
+	}
+
+	invalid := Config{Egress: &Egress{Links: []EgressLink{{Name: "none"}}}, Upstream: &Upstream{Address: "127.0.0.1:1080"}}
+	var configErr *ConfigError
+	if err := invalid.Validate(); !errors.As(err, &configErr) || len(configErr.Errors) != 2 {
+		t.Fatalf("should reject a link without address and Upstream but got %v", err)
+	}
+}
@@ -0,0 +1,17 @@
+package socks5
+
+import "encoding/binary"
+
+// maxReplyLength is the length of a reply with an IPv6 BND.ADDR, the
+// longest the server sends: VER, REP, RSV, ATYP, 16-byte address and port.
+const maxReplyLength = 4 + IPv6Length + PortLength
+
+// appendPort appends port in network byte order.
+func appendPort(b []byte, port uint16) []byte {
+	return binary.BigEndian.AppendUint16(b, port)
+}
+
+// readPort decodes a port in network byte order from the first two bytes of b.
+func readPort(b []byte) uint16 {
+	return binary.BigEndian.Uint16(b)
+}
@@ -0,0 +1,151 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/vm"
+)
+
+var ErrInvalidRuleExpr = errors.New("invalid rule expression")
+
+// Rule expressions (Rule.Expr) are boolean expr-lang expressions
+// (https://expr-lang.org) over the attributes of a request:
+//
+//	user        string  authenticated username, "" without auth
+//	rateClass   string  rate class of the Config.Users account
+//	cmd         string  "connect", "bind" or "udp"
+//	dst         string  target host as requested
+//	dstDomain   string  domain target, "" for IP targets
+//	dstIP       string  IP target, "" for domain targets
+//	dstPort     int
+//	clientIP    string
+//	time        string  local time of day, "15:04"
+//	weekday     string  "mon" to "sun"
+//	bytesToday  int     bytes relayed today for user, including open sessions
+//
+// hasSuffix(s, suffix), which ignores case, and inNetwork(ip, "10.0.0.0/8")
+// are also available. For example:
+//
+//	user == "guest" && (time < "08:00" || time >= "18:00")
+//	dstPort in [22, 3389] && !inNetwork(dstIP, "10.0.0.0/8")
+
+// exprEnv is the request being matched.
+type exprEnv struct {
+	User       string `expr:"user"`
+	RateClass  string `expr:"rateClass"`
+	Cmd        string `expr:"cmd"`
+	Dst        string `expr:"dst"`
+	DstDomain  string `expr:"dstDomain"`
+	DstIP      string `expr:"dstIP"`
+	DstPort    int    `expr:"dstPort"`
+	ClientIP   string `expr:"clientIP"`
+	Time       string `expr:"time"`
+	Weekday    string `expr:"weekday"`
+	BytesToday int64  `expr:"bytesToday"`
+}
+
+var exprOptions = []expr.Option{
+	expr.Env(exprEnv{}),
+	expr.AsBool(),
+	expr.DisableBuiltin("hasSuffix"),
+	expr.Function("hasSuffix", func(params ...any) (any, error) {
+		return strings.HasSuffix(strings.ToLower(params[0].(string)), strings.ToLower(params[1].(string))), nil
+	}, new(func(string, string) bool)),
+	expr.Function("inNetwork", func(params ...any) (any, error) {
+		_, ipNet, err := net.ParseCIDR(params[1].(string))
+		if err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(params[0].(string))
+		return ip != nil && ipNet.Contains(ip), nil
+	}, new(func(string, string) bool)),
+}
+
+// compileExpr parses and type-checks a boolean rule expression.
+func compileExpr(src string) (*vm.Program, error) {
+	program, err := expr.Compile(src, exprOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q: %v", ErrInvalidRuleExpr, src, err)
+	}
+	// Catch networks written as literals now rather than on every request
+	node := program.Node()
+	check := exprNetworkCheck{}
+	ast.Walk(&node, &check)
+	if check.err != nil {
+		return nil, fmt.Errorf("%w: %q: %v", ErrInvalidRuleExpr, src, check.err)
+	}
+	return program, nil
+}
+
+// exprNetworkCheck finds inNetwork calls with an invalid literal network.
+type exprNetworkCheck struct {
+	err error
+}
+
+func (c *exprNetworkCheck) Visit(node *ast.Node) {
+	call, ok := (*node).(*ast.CallNode)
+	if !ok || len(call.Arguments) != 2 {
+		return
+	}
+	if callee, ok := call.Callee.(*ast.IdentifierNode); !ok || callee.Value != "inNetwork" {
+		return
+	}
+	if literal, ok := call.Arguments[1].(*ast.StringNode); ok && c.err == nil {
+		if _, _, err := net.ParseCIDR(literal.Value); err != nil {
+			c.err = fmt.Errorf("invalid network %q", literal.Value)
+		}
+	}
+}
+
+// usesBytesToday reports whether the compiled expression reads bytesToday.
+func usesBytesToday(program *vm.Program) bool {
+	node := program.Node()
+	v := exprIdentifierFinder{name: "bytesToday"}
+	ast.Walk(&node, &v)
+	return v.found
+}
+
+// exprIdentifierFinder looks for an identifier in an expression.
+type exprIdentifierFinder struct {
+	name  string
+	found bool
+}
+
+func (v *exprIdentifierFinder) Visit(node *ast.Node) {
+	if ident, ok := (*node).(*ast.IdentifierNode); ok && ident.Value == v.name {
+		v.found = true
+	}
+}
+
+// newExprEnv returns the attributes of a request at now.
+func (s *SOCKS5Server) newExprEnv(message *ClientRequestMessage, authCtx *AuthContext, now time.Time) *exprEnv {
+	env := &exprEnv{
+		User:    authCtx.Username,
+		Cmd:     commandNames[message.Cmd],
+		Dst:     message.TargetIP,
+		DstPort: int(message.Port),
+		Time:    now.Format("15:04"),
+		Weekday: strings.ToLower(now.Weekday().String()[:3]),
+	}
+	if authCtx.User != nil {
+		env.RateClass = authCtx.User.RateClass
+	}
+	if message.AddrType == TypeDomain {
+		env.DstDomain = message.TargetIP
+	} else {
+		env.DstIP = message.TargetIP
+	}
+	if authCtx.ClientAddr != nil {
+		env.ClientIP, _, _ = net.SplitHostPort(authCtx.ClientAddr.String())
+	}
+	if authCtx.Username != "" {
+		env.BytesToday = s.stats.bytesToday(authCtx.Username, now)
+	}
+	return env
+}
@@ -0,0 +1,135 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCompileExpr(t *testing.T) {
+	invalid := []string{
+		``,
+		`user`,
+		`user == 1`,
+		`dstPort in ["22"]`,
+		`nosuch == "x"`,
+		`user == "a" &&`,
+		`(user == "a"`,
+		`inNetwork(dstIP, "not a network")`,
+		`hasSuffix(dstDomain, 1)`,
+		`true < false`,
+	}
+	for _, src := range invalid {
+		if _, err := compileExpr(src); !errors.Is(err, ErrInvalidRuleExpr) {
+			t.Fatalf("%q: should get error %s but got %v", src, ErrInvalidRuleExpr, err)
+		}
+	}
+}
+
+func TestRuleExpr(t *testing.T) {
+	clock := newFakeClock()
+	config := Config{
+		Rules: []Rule{
+			{Name: "night", Expr: `user == "guest" && (time < "08:00" || time >= "18:00")`},
+			{Name: "admin", Expr: `dstPort in [22, 3389] && !inNetwork(dstIP, "10.0.0.0/8")`},
+			{Name: "heavy", Expr: `bytesToday > 1000 && hasSuffix(dstDomain, ".video.example")`},
+			{Name: "lan", Expr: `inNetwork(clientIP, "192.168.0.0/16")`},
+		},
+	}
+	if err := initConfig(&config); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	server := SOCKS5Server{Config: &config, clock: clock}
+	match := func(message ClientRequestMessage, user string) string {
+		if rule := server.matchRule(&message, &AuthContext{Username: user}); rule != nil {
+			return rule.Name
+		}
+		return ""
+	}
+
+	web := ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeDomain, TargetIP: "www.example", Port: 443}
+	clock.now = time.Date(2020, 1, 1, 20, 0, 0, 0, time.Local)
+	if got := match(web, "guest"); got != "night" {
+		t.Fatalf("should match night but got %q", got)
+	}
+	clock.now = time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local)
+	if got := match(web, "guest"); got != "" {
+		t.Fatalf("should match nothing at noon but got %q", got)
+	}
+
+	if got := match(ClientRequestMessage{AddrType: TypeIPv4, TargetIP: "192.0.2.1", Port: 22}, ""); got != "admin" {
+		t.Fatalf("should match admin but got %q", got)
+	}
+	if got := match(ClientRequestMessage{AddrType: TypeIPv4, TargetIP: "10.1.1.1", Port: 22}, ""); got != "" {
+		t.Fatalf("should not match an internal target but got %q", got)
+	}
+
+	video := ClientRequestMessage{AddrType: TypeDomain, TargetIP: "cdn.video.example", Port: 443}
+	if got := match(video, "alice"); got != "" {
+		t.Fatalf("should not match before alice used bytes but got %q", got)
+	}
+	counter, _ := server.stats.todayCounter("alice", clock.Now().Local())
+	counter.Add(5000)
+	if got := match(video, "alice"); got != "heavy" {
+		t.Fatalf("should match heavy but got %q", got)
+	}
+	clock.Advance(24 * time.Hour)
+	if got := match(video, "alice"); got != "" {
+		t.Fatalf("should start a new day but got %q", got)
+	}
+
+	lan := &AuthContext{ClientAddr: &net.TCPAddr{IP: net.ParseIP("192.168.1.2"), Port: 5000}}
+	if rule := server.matchRule(&web, lan); rule == nil || rule.Name != "lan" {
+		t.Fatalf("should match lan but got %v", rule)
+	}
+}
+
+func TestBytesTodayCountsOpenSessions(t *testing.T) {
+	config := Config{Rules: []Rule{{Expr: `bytesToday > 1000`}}}
+	if err := initConfig(&config); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	clock := newFakeClock()
+	server := SOCKS5Server{Config: &config, clock: clock}
+	authCtx := &AuthContext{Username: "alice"}
+	clientConn, serverConn := tcpPair(t)
+	targetConn, peer := tcpPair(t)
+	tally := &relayTally{today: todayUser(&config, authCtx)}
+	done := make(chan error, 1)
+	go func() { done <- server.forward(serverConn, targetConn, &config, tally) }()
+
+	clientConn.Write([]byte("hello"))
+	if _, err := io.ReadFull(peer, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	now := clock.Now().Local()
+	deadline := time.Now().Add(5 * time.Second)
+	for server.stats.bytesToday("alice", now) != 5 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := server.stats.bytesToday("alice", now); got != 5 {
+		t.Fatalf("should count 5 bytes of the open session but got %d", got)
+	}
+
+	// The open session counts for the next day once it has started
+	clock.Advance(24 * time.Hour)
+	clientConn.Write([]byte("hi"))
+	if _, err := io.ReadFull(peer, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	next := clock.Now().Local()
+	for server.stats.bytesToday("alice", next) != 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := server.stats.bytesToday("alice", next); got != 2 {
+		t.Fatalf("should count 2 bytes on the next day but got %d", got)
+	}
+	clientConn.Close()
+	peer.Close()
+	<-done
+	if got := server.stats.bytesToday("alice", next); got != 2 {
+		t.Fatalf("should not count the session twice but got %d", got)
+	}
+}
@@ -0,0 +1,134 @@
+package socks5
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// fairQuantum is the most a relay direction writes per turn under
+// Config.BandwidthLimit.
+const fairQuantum = 16 << 10
+
+// fairLimiter paces the relays of all sessions to a shared rate. Each relay
+// direction asks for a turn of at most fairQuantum bytes times its
+// priority, waits for it and writes before asking for the next, so it never
+// holds more than one turn. Turns are weighted fair queued: a request is
+// tagged with the bytes its direction was served so far divided by its
+// priority, and whenever the link is free the lowest tag goes next. A bulk
+// download cannot get ahead of an interactive session by more than one
+// chunk, and a session of priority n gets n times the bytes of a session
+// of priority 1 however its writes are sized.
+type fairLimiter struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// next is when the shared link is free again.
+	next time.Time
+	// vtime is the tag of the last turn handed out.
+	vtime float64
+	// waiting are the turns asked for, in no order.
+	waiting []*fairTurn
+	// sleeping is set while the first turn waits for the link.
+	sleeping bool
+	clock    clock
+}
+
+// fairTurn is a turn asked for, served in order of tag.
+type fairTurn struct {
+	tag float64
+}
+
+// wait waits for a turn to write n bytes at rate bytes per second. finish
+// is the tag of the previous turn of the relay direction, which has
+// priority weight. An idle link does not save up credit, and neither does
+// an idle direction.
+func (l *fairLimiter) wait(n int, rate int64, weight int, finish *float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cond == nil {
+		l.cond = sync.NewCond(&l.mu)
+	}
+	start := l.vtime
+	if *finish > start {
+		start = *finish
+	}
+	turn := &fairTurn{tag: start + float64(n)/float64(weight)}
+	*finish = turn.tag
+	l.waiting = append(l.waiting, turn)
+	for {
+		if l.sleeping || l.first() != turn {
+			l.cond.Wait()
+			continue
+		}
+		now := timeNow(l.clock)
+		if wait := l.next.Sub(now); wait > 0 {
+			// Turns asked for meanwhile may go first
+			l.sleeping = true
+			l.mu.Unlock()
+			timeSleep(l.clock, wait)
+			l.mu.Lock()
+			l.sleeping = false
+			l.cond.Broadcast()
+			continue
+		}
+		l.remove(turn)
+		l.vtime = turn.tag
+		l.next = now.Add(time.Duration(int64(n) * int64(time.Second) / rate))
+		l.cond.Broadcast()
+		return
+	}
+}
+
+// first returns the waiting turn with the lowest tag.
+func (l *fairLimiter) first() *fairTurn {
+	var first *fairTurn
+	for _, turn := range l.waiting {
+		if first == nil || turn.tag < first.tag {
+			first = turn
+		}
+	}
+	return first
+}
+
+func (l *fairLimiter) remove(turn *fairTurn) {
+	for i, t := range l.waiting {
+		if t == turn {
+			l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// pacedWriter writes through a fairLimiter in chunks of fairQuantum times
+// its priority, which also weighs its turns.
+type pacedWriter struct {
+	w        io.Writer
+	limiter  *fairLimiter
+	rate     int64
+	priority int
+	// finish is the tag of the last turn, see fairLimiter.
+	finish float64
+}
+
+func (p *pacedWriter) Write(b []byte) (int, error) {
+	weight := 1
+	if p.priority > 1 {
+		weight = p.priority
+	}
+	quantum := fairQuantum * weight
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > quantum {
+			chunk = chunk[:quantum]
+		}
+		p.limiter.wait(len(chunk), p.rate, weight, &p.finish)
+		n, err := p.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,140 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFairLimiterWait(t *testing.T) {
+	clock := newFakeClock()
+	l := fairLimiter{clock: clock}
+	const rate = fairQuantum * 10 // a chunk per 100ms
+
+	// A bulk session takes the link, then a session that has been idle goes
+	// before the bulk session's next chunk, even though it asked later
+	var bulk, interactive float64
+	start := clock.Now()
+	l.wait(fairQuantum, rate, 1, &bulk)
+	order := make(chan string, 2)
+	go func() {
+		l.wait(fairQuantum, rate, 1, &bulk)
+		order <- "bulk"
+	}()
+	clock.awaitTimers(t, 1)
+	go func() {
+		l.wait(100, rate, 1, &interactive)
+		order <- "interactive"
+	}()
+	for {
+		l.mu.Lock()
+		waiting := len(l.waiting)
+		l.mu.Unlock()
+		if waiting == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(100 * time.Millisecond)
+	if first := <-order; first != "interactive" {
+		t.Fatalf("should serve the interactive session first but got %s", first)
+	}
+	clock.awaitTimers(t, 1)
+	clock.Advance(100 * time.Millisecond)
+	<-order
+	if elapsed := clock.Now().Sub(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("should wait for the link to be free but took %s", elapsed)
+	}
+}
+
+// countingDiscard counts the bytes written to it until stop is closed.
+type countingDiscard struct {
+	n    atomic.Int64
+	stop chan struct{}
+}
+
+func (w *countingDiscard) Write(b []byte) (int, error) {
+	select {
+	case <-w.stop:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	w.n.Add(int64(len(b)))
+	return len(b), nil
+}
+
+func TestFairLimiterPriorityShare(t *testing.T) {
+	var l fairLimiter
+	stop := make(chan struct{})
+	low, high := &countingDiscard{stop: stop}, &countingDiscard{stop: stop}
+	var wg sync.WaitGroup
+	for _, w := range []struct {
+		w        io.Writer
+		priority int
+	}{{low, 1}, {high, 4}} {
+		wg.Add(1)
+		go func(w io.Writer, priority int) {
+			defer wg.Done()
+			// io.Copy writes 32 KiB at a time, whatever the priority
+			io.Copy(&pacedWriter{w: w, limiter: &l, rate: 4 << 20, priority: priority}, zeroReader{})
+		}(w.w, w.priority)
+	}
+	time.Sleep(500 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	if ratio := float64(high.n.Load()) / float64(low.n.Load()); ratio < 3 || ratio > 5 {
+		t.Fatalf("should relay about 4 times the bytes at priority 4 but got %d and %d", high.n.Load(), low.n.Load())
+	}
+}
+
+// zeroReader reads zeros forever.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// recordingWriter records the size of each write.
+type recordingWriter struct {
+	bytes.Buffer
+	sizes []int
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.sizes = append(w.sizes, len(b))
+	return w.Buffer.Write(b)
+}
+
+func TestPacedWriterChunks(t *testing.T) {
+	var w recordingWriter
+	p := pacedWriter{w: &w, limiter: &fairLimiter{}, rate: 1 << 40}
+	data := bytes.Repeat([]byte{'x'}, 2*fairQuantum+100)
+	if n, err := p.Write(data); n != len(data) || err != nil {
+		t.Fatalf("should write %d bytes but got %d, %v", len(data), n, err)
+	}
+	if want := []int{fairQuantum, fairQuantum, 100}; !reflect.DeepEqual(want, w.sizes) {
+		t.Fatalf("should write chunks %v but got %v", want, w.sizes)
+	}
+	if !bytes.Equal(data, w.Bytes()) {
+		t.Fatalf("should write the data unchanged")
+	}
+}
+
+func TestPacedWriterPriority(t *testing.T) {
+	var w recordingWriter
+	p := pacedWriter{w: &w, limiter: &fairLimiter{}, rate: 1 << 40, priority: 3}
+	data := bytes.Repeat([]byte{'x'}, 4*fairQuantum)
+	if n, err := p.Write(data); n != len(data) || err != nil {
+		t.Fatalf("should write %d bytes but got %d, %v", len(data), n, err)
+	}
+	if want := []int{3 * fairQuantum, fairQuantum}; !reflect.DeepEqual(want, w.sizes) {
+		t.Fatalf("should write chunks %v but got %v", want, w.sizes)
+	}
+}
@@ -0,0 +1,40 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"time"
+)
+
+// NewForwarder returns a server for ip:port without authentication that
+// forwards every CONNECT through client to a remote SOCKS5 server, so
+// applications that only support a local proxy without authentication can
+// use a remote server requiring credentials (Client.Username, Client.HMAC)
+// or TLS (Client.TLSConfig). UDP ASSOCIATE and BIND are not forwarded and
+// get ReplyCommandNotSupported. The returned server's Config may be changed
+// before it runs, e.g. to set timeouts or an access log.
+func NewForwarder(ip string, port int, client *Client) *SOCKS5Server {
+	return &SOCKS5Server{
+		IP:        ip,
+		Port:      port,
+		Config:    &Config{AuthMethod: MethodNoAuth},
+		forwarder: client,
+	}
+}
+
+// forwardDial connects to address through the remote server of a forwarder,
+// running control, if set, before the client's own Control.
+func (s *SOCKS5Server) forwardDial(address string, timeout time.Duration, control func(network, address string, c syscall.RawConn) error) (net.Conn, error) {
+	client := *s.forwarder
+	if control != nil {
+		client.Control = chainControl(control, client.Control)
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return client.DialContext(ctx, "tcp", address)
+}
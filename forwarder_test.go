@@ -0,0 +1,52 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"testing"
+)
+
+func TestForwarder(t *testing.T) {
+	usernames := make(chan string, 1)
+	remote := SOCKS5Server{Config: &Config{
+		AuthMethod: MethodPassword,
+		PasswordChecker: func(username, password string) bool {
+			return username == "admin" && password == "123456"
+		},
+		TLSConfig: selfSignedTLSConfig(t),
+		ReplyHook: func(info *ReplyInfo) { usernames <- info.Auth.Username },
+	}}
+	remoteAddress, _ := startServer(t, &remote)
+	defer remote.Shutdown(context.Background())
+
+	forwarder := NewForwarder("127.0.0.1", 0, &Client{
+		ProxyAddress: remoteAddress,
+		Username:     "admin",
+		Password:     "123456",
+		TLSConfig:    &tls.Config{ServerName: "proxy.test", InsecureSkipVerify: true},
+	})
+	forwarderAddress, _ := startServer(t, forwarder)
+	defer forwarder.Shutdown(context.Background())
+
+	// An application without credentials reaches the target
+	client := Client{ProxyAddress: forwarderAddress}
+	conn, err := client.Dial("tcp", echoServer(t))
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("should echo ping but got %q and %v", buf, err)
+	}
+	if username := <-usernames; username != "admin" {
+		t.Fatalf("remote server should authenticate admin but got %q", username)
+	}
+
+	// UDP is not forwarded
+	if _, err := client.ListenPacket(context.Background()); err != ErrRequestRejected {
+		t.Fatalf("should get error %s but got %v", ErrRequestRejected, err)
+	}
+}
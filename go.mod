@@ -1,3 +1,12 @@
 module github.com/Doraemonkeys/socks5
 
 go 1.19
+
+require (
+	github.com/expr-lang/expr v1.17.8
+	golang.org/x/crypto v0.17.0
+	golang.org/x/net v0.10.0
+	golang.org/x/sys v0.15.0
+)
+
+require golang.org/x/text v0.14.0 // indirect
@@ -0,0 +1,90 @@
+package socks5
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func newHMACServer() *SOCKS5Server {
+	return &SOCKS5Server{Config: &Config{
+		AuthMethod: MethodHMAC,
+		HMACSecret: func(username string) (string, bool) {
+			return "123456", username == "admin"
+		},
+	}}
+}
+
+func TestHMACAuth(t *testing.T) {
+	server := newHMACServer()
+	for _, test := range []struct {
+		name     string
+		password string
+		want     error
+	}{
+		{"right password", "123456", nil},
+		{"wrong password", "wrong", ErrPasswordAuthFailure},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			errc := make(chan error, 1)
+			go func() {
+				authCtx, err := server.auth(serverConn, &Session{config: server.Config})
+				errc <- err
+				if err != nil {
+					return
+				}
+				if authCtx.Username != "admin" {
+					t.Errorf("want username admin but got %s", authCtx.Username)
+				}
+				if _, err := NewClientRequestMessage(serverConn); err == nil {
+					WriteRequestSuccessMessage(serverConn, net.IP{127, 0, 0, 1}, 1080)
+				}
+			}()
+
+			client := Client{Username: "admin", Password: test.password, HMAC: true}
+			if err := client.Handshake(clientConn, "example.com:80"); err != test.want {
+				t.Fatalf("should get error %v but got %v", test.want, err)
+			}
+			if err := <-errc; err != test.want {
+				t.Fatalf("server should get error %v but got %v", test.want, err)
+			}
+		})
+	}
+}
+
+func TestHMACAuthReplay(t *testing.T) {
+	server := newHMACServer()
+
+	// Record a valid proof for one nonce...
+	var captured bytes.Buffer
+	nonce := bytes.Repeat([]byte{1}, hmacNonceLength)
+	WriteClientHMACMessage(&captured, "admin", hmacProof("123456", "admin", nonce))
+
+	// ...and replay it against a fresh challenge
+	var buf bytes.Buffer
+	buf.Write([]byte{SOCKS5Version, 1, MethodHMAC})
+	buf.Write(captured.Bytes())
+	if _, err := server.auth(&buf, &Session{config: server.Config}); err != ErrPasswordAuthFailure {
+		t.Fatalf("should get error %s but got %v", ErrPasswordAuthFailure, err)
+	}
+}
+
+func TestHMACAuthSelectedWithoutSecret(t *testing.T) {
+	server := &SOCKS5Server{Config: &Config{
+		MethodSelector: func(req *MethodRequest) Method { return MethodHMAC },
+	}}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{SOCKS5Version, 1, MethodHMAC})
+	WriteClientHMACMessage(&buf, "admin", make([]byte, 32))
+	if _, err := server.auth(&buf, &Session{config: server.Config}); err != ErrPasswordAuthFailure {
+		t.Fatalf("should get error %s but got %v", ErrPasswordAuthFailure, err)
+	}
+	if got := server.Stats().AuthFailures; got != 1 {
+		t.Fatalf("should count 1 auth failure but got %d", got)
+	}
+}
@@ -0,0 +1,109 @@
+package socks5
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// httpTunnel is a client connection speaking HTTP CONNECT. Replies written
+// through writeReply are translated to HTTP status lines.
+type httpTunnel struct {
+	*sniffConn
+}
+
+func (c *httpTunnel) writeStatus(reply ReplyType) error {
+	status := http.StatusOK
+	switch reply {
+	case ReplySuccess:
+	case ReplyConnectionNotAllowed:
+		status = http.StatusForbidden
+	case ReplyNetworkUnreachable, ReplyHostUnreachable, ReplyConnectionRefused:
+		status = http.StatusBadGateway
+	case ReplyTTLExpired:
+		status = http.StatusGatewayTimeout
+	case ReplyCommandNotSupported:
+		status = http.StatusMethodNotAllowed
+	case ReplyAddressTypeNotSupported:
+		status = http.StatusBadRequest
+	case ReplyHostConnectionLimit:
+		status = http.StatusServiceUnavailable
+	default:
+		status = http.StatusInternalServerError
+	}
+	text := http.StatusText(status)
+	if status == http.StatusOK {
+		text = "Connection established"
+	}
+	_, err := fmt.Fprintf(c, "HTTP/1.1 %d %s\r\n\r\n", status, text)
+	return err
+}
+
+// handleHTTPConnect serves an HTTP CONNECT request, authenticating with
+// Proxy-Authorization Basic when the server requires MethodPassword.
+func (s *SOCKS5Server) handleHTTPConnect(conn *sniffConn, session *Session) error {
+	config := session.config
+	req, err := http.ReadRequest(conn.reader)
+	if err != nil {
+		s.malformedHandshake(conn, config, session.ID, err)
+		return err
+	}
+	if req.Method != http.MethodConnect {
+		fmt.Fprint(conn, "HTTP/1.1 405 Method Not Allowed\r\nAllow: CONNECT\r\nConnection: close\r\n\r\n")
+		logSession(session.ID, "HTTP method not supported", req.Method)
+		return ErrCommandNotSupported
+	}
+
+	authCtx := AuthContext{SessionID: session.ID, Method: config.AuthMethod, ClientAddr: session.ClientAddr, config: config, ctx: session.ctx}
+	if config.AuthMethod != MethodNoAuth {
+		username, password, ok := parseProxyAuthorization(req.Header.Get("Proxy-Authorization"))
+		if !ok || config.AuthMethod != MethodPassword || !s.checkPassword(&authCtx, username, password) {
+			fmt.Fprint(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"proxy\"\r\nConnection: close\r\n\r\n")
+			// Clients first try without credentials to get the challenge
+			if ok {
+				s.authFailure(conn, config, session.ID)
+			}
+			return ErrPasswordAuthFailure
+		}
+		authCtx.Username = username
+	}
+
+	host, portStr, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		fmt.Fprint(conn, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		fmt.Fprint(conn, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+		return err
+	}
+	message := ClientRequestMessage{
+		Cmd:      CmdConnect,
+		AddrType: TypeDomain,
+		TargetIP: host,
+		Port:     uint16(port),
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		message.AddrType = TypeIPv6
+		if ip.To4() != nil {
+			message.AddrType = TypeIPv4
+		}
+	}
+	return s.handleRequest(&httpTunnel{conn}, &message, &authCtx)
+}
+
+func parseProxyAuthorization(header string) (username, password string, ok bool) {
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
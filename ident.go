@@ -0,0 +1,117 @@
+package socks5
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrIdentResponse = errors.New("invalid IDENT response")
+	ErrIdentError    = errors.New("IDENT error")
+)
+
+// IdentResolver returns the identity of the user behind a client
+// connection from remote to local, e.g. Ident.Lookup. The identity is
+// only as trustworthy as the client host.
+type IdentResolver func(local, remote net.Addr) (string, error)
+
+// defaultIdentTimeout bounds an IDENT lookup when Ident.Timeout is zero.
+const defaultIdentTimeout = time.Second
+
+// Ident looks up identities with the IDENT protocol (RFC 1413), querying
+// the ident server on the client host.
+type Ident struct {
+	// Timeout bounds the whole lookup. Zero means one second.
+	Timeout time.Duration
+	// Port is the port of the ident server. Zero means 113.
+	Port int
+}
+
+// Lookup implements IdentResolver.
+func (i *Ident) Lookup(local, remote net.Addr) (string, error) {
+	localAddr, ok1 := local.(*net.TCPAddr)
+	remoteAddr, ok2 := remote.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return "", fmt.Errorf("%w: not a TCP connection", ErrIdentError)
+	}
+	timeout := i.Timeout
+	if timeout <= 0 {
+		timeout = defaultIdentTimeout
+	}
+	port := i.Port
+	if port == 0 {
+		port = 113
+	}
+	// Query from the address the client connected to, as ident servers
+	// may only answer the host the connection went to
+	dialer := net.Dialer{Timeout: timeout, LocalAddr: &net.TCPAddr{IP: localAddr.IP}}
+	conn, err := dialer.Dial("tcp", net.JoinHostPort(remoteAddr.IP.String(), strconv.Itoa(port)))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// The ports are given from the point of view of the ident server
+	if _, err := fmt.Fprintf(conn, "%d , %d\r\n", remoteAddr.Port, localAddr.Port); err != nil {
+		return "", err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return parseIdentResponse(line, remoteAddr.Port, localAddr.Port)
+}
+
+// parseIdentResponse parses "<port>, <port> : USERID : <os> : <user-id>" or
+// "<port>, <port> : ERROR : <error>".
+func parseIdentResponse(line string, serverPort, clientPort int) (string, error) {
+	fields := strings.SplitN(strings.TrimRight(line, "\r\n"), ":", 4)
+	if len(fields) < 3 {
+		return "", ErrIdentResponse
+	}
+	ports := strings.Split(fields[0], ",")
+	if len(ports) != 2 || strings.TrimSpace(ports[0]) != strconv.Itoa(serverPort) || strings.TrimSpace(ports[1]) != strconv.Itoa(clientPort) {
+		return "", ErrIdentResponse
+	}
+	switch strings.TrimSpace(fields[1]) {
+	case "USERID":
+		if len(fields) != 4 {
+			return "", ErrIdentResponse
+		}
+		// The user ID keeps its spaces, except the one after the colon
+		user := strings.TrimPrefix(fields[3], " ")
+		if user == "" {
+			return "", ErrIdentResponse
+		}
+		return user, nil
+	case "ERROR":
+		return "", fmt.Errorf("%w: %s", ErrIdentError, strings.TrimSpace(fields[2]))
+	default:
+		return "", ErrIdentResponse
+	}
+}
+
+// startIdent runs the IdentResolver of the session for conn in the
+// background, during the handshake, and returns a function waiting for the
+// identity.
+func (s *SOCKS5Server) startIdent(conn net.Conn, session *Session) func() string {
+	resolver, sessionID := session.config.IdentResolver, session.ID
+	if resolver == nil {
+		return func() string { return "" }
+	}
+	result := make(chan string, 1)
+	go func() {
+		ident, err := resolver(conn.LocalAddr(), conn.RemoteAddr())
+		if err != nil {
+			logSession(sessionID, "ident lookup failure", err)
+		}
+		result <- ident
+	}()
+	return func() string { return <-result }
+}
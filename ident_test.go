@@ -0,0 +1,78 @@
+package socks5
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestParseIdentResponse(t *testing.T) {
+	// Queries are for the client port 6193 and the server port 23
+	tests := []struct {
+		line string
+		user string
+		err  error
+	}{
+		{"6193, 23 : USERID : UNIX : stjohns\r\n", "stjohns", nil},
+		{"6193,23:USERID:UNIX,US-ASCII: two words\r\n", "two words", nil},
+		{"6193, 23 : ERROR : NO-USER\r\n", "", ErrIdentError},
+		{"6193, 23 : USERID : UNIX :\r\n", "", ErrIdentResponse},
+		{"6193, 24 : USERID : UNIX : stjohns\r\n", "", ErrIdentResponse},
+		{"garbage\r\n", "", ErrIdentResponse},
+	}
+	for _, tt := range tests {
+		user, err := parseIdentResponse(tt.line, 6193, 23)
+		if user != tt.user || !errors.Is(err, tt.err) {
+			t.Fatalf("%q: should get %q, %v but got %q, %v", tt.line, tt.user, tt.err, user, err)
+		}
+	}
+}
+
+// identServer answers every query with user.
+func identServer(t *testing.T, user string) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			query, _ := bufio.NewReader(conn).ReadString('\n')
+			var serverPort, clientPort int
+			fmt.Sscanf(query, "%d , %d", &serverPort, &clientPort)
+			fmt.Fprintf(conn, "%d , %d : USERID : UNIX : %s\r\n", serverPort, clientPort, user)
+			conn.Close()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestIdentLookup(t *testing.T) {
+	ident := Ident{Port: identServer(t, "alice")}
+	clientConn, serverConn := tcpPair(t)
+	defer clientConn.Close()
+	defer serverConn.Close()
+	user, err := ident.Lookup(serverConn.LocalAddr(), serverConn.RemoteAddr())
+	if err != nil || user != "alice" {
+		t.Fatalf("should get alice but got %q, %v", user, err)
+	}
+}
+
+func TestIdentResolver(t *testing.T) {
+	idents := make(chan string, 1)
+	server := SOCKS5Server{Config: &Config{
+		AuthMethod:    MethodNoAuth,
+		IdentResolver: (&Ident{Port: identServer(t, "bob")}).Lookup,
+		ReplyHook:     func(info *ReplyInfo) { idents <- info.Auth.Ident },
+	}}
+	relaySession(t, &server).Close()
+	if ident := <-idents; ident != "bob" {
+		t.Fatalf("should get ident bob but got %q", ident)
+	}
+}
@@ -0,0 +1,25 @@
+// Package testhook lets package socks5test replace the clock and the random
+// source of a socks5.SOCKS5Server, which are not part of the socks5 API.
+package testhook
+
+import (
+	"io"
+	"time"
+)
+
+// Clock is the clock of a server. AfterFunc calls f in its own goroutine
+// after d, and the stop it returns cancels the call, reporting whether it
+// did so before f was called.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+	Sleep(d time.Duration)
+}
+
+// SetClock and SetRand are set by package socks5. server is a
+// *socks5.SOCKS5Server that has not started serving.
+var (
+	SetClock func(server any, clock Clock)
+	SetRand  func(server any, rand io.Reader)
+)
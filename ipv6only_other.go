@@ -0,0 +1,11 @@
+//go:build !unix
+
+package socks5
+
+import "syscall"
+
+const ipv6OnlySupported = false
+
+func setIPv6Only(c syscall.RawConn) error {
+	return ErrIPv6OnlyNotSupported
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package socks5
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const ipv6OnlySupported = true
+
+// setIPv6Only sets IPV6_V6ONLY on an IPv6 socket, so that it does not
+// accept IPv4 connections as IPv4-mapped addresses.
+func setIPv6Only(c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,119 @@
+package socks5
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrHostConnectionLimit = errors.New("too many connections to destination host")
+	ErrDialQueueFull       = errors.New("too many requests waiting to dial")
+	ErrDialQueueTimeout    = errors.New("timed out waiting to dial")
+)
+
+// hostLimiter counts concurrent sessions per destination host.
+type hostLimiter struct {
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+// acquire reserves a connection slot for host, reporting false when max are in use.
+func (l *hostLimiter) acquire(host string, max int) bool {
+	host = strings.ToLower(host)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns == nil {
+		l.conns = make(map[string]int)
+	}
+	if l.conns[host] >= max {
+		return false
+	}
+	l.conns[host]++
+	return true
+}
+
+// hold takes a connection slot for host even past the limit, for sessions
+// taken over from elsewhere.
+func (l *hostLimiter) hold(host string) {
+	host = strings.ToLower(host)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns == nil {
+		l.conns = make(map[string]int)
+	}
+	l.conns[host]++
+}
+
+func (l *hostLimiter) release(host string) {
+	host = strings.ToLower(host)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[host] <= 1 {
+		delete(l.conns, host)
+		return
+	}
+	l.conns[host]--
+}
+
+// dialQueue caps concurrent outbound dials. Requests past the cap wait in
+// FIFO order and are handed the slot of a finished dial.
+type dialQueue struct {
+	mu      sync.Mutex
+	active  int
+	waiters []chan struct{}
+	clock   clock
+}
+
+// acquire reserves a dial slot, waiting for up to timeout, or for as long
+// as it takes if zero, behind at most queueSize other requests when limit
+// dials are in progress.
+func (q *dialQueue) acquire(limit, queueSize int, timeout time.Duration) error {
+	q.mu.Lock()
+	if q.active < limit {
+		q.active++
+		q.mu.Unlock()
+		return nil
+	}
+	if len(q.waiters) >= queueSize {
+		q.mu.Unlock()
+		return ErrDialQueueFull
+	}
+	ready := make(chan struct{})
+	q.waiters = append(q.waiters, ready)
+	q.mu.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = timeAfter(q.clock, timeout)
+	}
+	select {
+	case <-ready:
+		return nil
+	case <-expired:
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, waiter := range q.waiters {
+		if waiter == ready {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			return ErrDialQueueTimeout
+		}
+	}
+	// Handed a slot just as the timer fired
+	return nil
+}
+
+// release frees a dial slot, handing it to the oldest waiting request
+// unless limit was lowered below the dials in progress.
+func (q *dialQueue) release(limit int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiters) > 0 && q.active <= limit {
+		close(q.waiters[0])
+		q.waiters = q.waiters[1:]
+		return
+	}
+	q.active--
+}
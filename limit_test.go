@@ -0,0 +1,147 @@
+package socks5
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHostLimiter(t *testing.T) {
+	var l hostLimiter
+	if !l.acquire("example.com", 2) || !l.acquire("EXAMPLE.com", 2) {
+		t.Fatalf("should acquire two slots")
+	}
+	if l.acquire("example.com", 2) {
+		t.Fatalf("should not acquire a third slot")
+	}
+	l.release("example.com")
+	if !l.acquire("example.com", 2) {
+		t.Fatalf("should acquire a released slot")
+	}
+	l.release("example.com")
+	l.release("example.com")
+	if len(l.conns) != 0 {
+		t.Fatalf("should forget hosts without connections but got %v", l.conns)
+	}
+}
+
+func TestHostConnectionLimitReply(t *testing.T) {
+	server := SOCKS5Server{
+		Config: &Config{AuthMethod: MethodNoAuth, MaxConnsPerHost: 1},
+	}
+	server.hostLimiter.acquire("127.0.0.1", 1)
+
+	var buf bytes.Buffer
+	buf.Write([]byte{SOCKS5Version, CmdConnect, ReservedField, TypeIPv4, 127, 0, 0, 1, 0x00, 0x50})
+	if err := server.request(&buf, &AuthContext{}); err != ErrHostConnectionLimit {
+		t.Fatalf("should get error %s but got %v", ErrHostConnectionLimit, err)
+	}
+
+	want := []byte{SOCKS5Version, ReplyHostConnectionLimit, ReservedField, TypeIPv4, 0, 0, 0, 0, 0, 0}
+	if got := buf.Bytes(); !reflect.DeepEqual(want, got) {
+		t.Fatalf("should get message %v but got %v", want, got)
+	}
+	if got := server.Stats().HostLimitRejections; got != 1 {
+		t.Fatalf("should count 1 rejection but got %d", got)
+	}
+}
+
+func TestDialQueue(t *testing.T) {
+	var q dialQueue
+	if err := q.acquire(1, 1, time.Second); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+
+	// A second request waits for the slot, a third finds the queue full
+	granted := make(chan error, 1)
+	go func() { granted <- q.acquire(1, 1, time.Minute) }()
+	for {
+		q.mu.Lock()
+		waiting := len(q.waiters)
+		q.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := q.acquire(1, 1, time.Minute); err != ErrDialQueueFull {
+		t.Fatalf("should get error %s but got %v", ErrDialQueueFull, err)
+	}
+	q.release(1)
+	if err := <-granted; err != nil {
+		t.Fatalf("waiting request should get the released slot but got %s", err)
+	}
+
+	clock := newFakeClock()
+	q.clock = clock
+	expired := make(chan error, 1)
+	go func() { expired <- q.acquire(1, 1, time.Minute) }()
+	clock.awaitTimers(t, 1)
+	clock.Advance(time.Minute)
+	if err := <-expired; err != ErrDialQueueTimeout {
+		t.Fatalf("should get error %s but got %v", ErrDialQueueTimeout, err)
+	}
+	q.release(1)
+	if q.active != 0 || len(q.waiters) != 0 {
+		t.Fatalf("queue should be empty but has %d active, %d waiting", q.active, len(q.waiters))
+	}
+}
+
+func TestDialQueueWithoutTimeout(t *testing.T) {
+	target := echoServer(t)
+	host, port, _ := net.SplitHostPort(target)
+	portNum, _ := strconv.Atoi(port)
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth, MaxConcurrentDials: 1, DialQueueSize: 1}}
+	server.dialQueue.acquire(1, 0, 0)
+
+	// Without DialQueueTimeout and DialTimeout, the request waits for the slot
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		defer serverConn.Close()
+		server.request(serverConn, &AuthContext{})
+	}()
+	if err := WriteClientRequestMessage(clientConn, CmdConnect, host, uint16(portNum)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		server.dialQueue.mu.Lock()
+		waiting := len(server.dialQueue.waiters)
+		server.dialQueue.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		if i == 1000 {
+			t.Fatal("request should wait in the queue")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	server.dialQueue.release(1)
+	reply, err := NewServerReplyMessage(clientConn)
+	if err != nil || reply.Reply != ReplySuccess {
+		t.Fatalf("should serve the queued request but got %+v, %v", reply, err)
+	}
+}
+
+func TestDialQueueReply(t *testing.T) {
+	server := SOCKS5Server{
+		Config: &Config{AuthMethod: MethodNoAuth, MaxConcurrentDials: 1, DialQueueTimeout: 10 * time.Millisecond},
+	}
+	server.dialQueue.acquire(1, 0, 0)
+
+	var buf bytes.Buffer
+	buf.Write([]byte{SOCKS5Version, CmdConnect, ReservedField, TypeIPv4, 127, 0, 0, 1, 0x00, 0x50})
+	if err := server.request(&buf, &AuthContext{}); err != ErrDialQueueFull {
+		t.Fatalf("should get error %s but got %v", ErrDialQueueFull, err)
+	}
+	want := []byte{SOCKS5Version, ReplyServerFailure, ReservedField, TypeIPv4, 0, 0, 0, 0, 0, 0}
+	if got := buf.Bytes(); !reflect.DeepEqual(want, got) {
+		t.Fatalf("should get message %v but got %v", want, got)
+	}
+	if got := server.Stats().DialQueueRejections; got != 1 {
+		t.Fatalf("should count 1 rejection but got %d", got)
+	}
+}
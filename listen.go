@@ -0,0 +1,149 @@
+package socks5
+
+import (
+	"context"
+	"log"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// interfaceListenAddrs returns the listen addresses for port on the current
+// addresses of interface name, or ok false if there is no such interface.
+// IPv6 link-local addresses are left out, as they need a zone clients
+// rarely give, and so are the addresses of the family network, "tcp4" or
+// "tcp6", excludes.
+func interfaceListenAddrs(name string, port int, network string) (addrs []string, ok bool, err error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, false, nil
+	}
+	ifaceAddrs, err := iface.Addrs()
+	if err != nil {
+		return nil, true, err
+	}
+	for _, addr := range ifaceAddrs {
+		ipNet, isIPNet := addr.(*net.IPNet)
+		if !isIPNet || (ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast()) {
+			continue
+		}
+		if (network == "tcp4" && ipNet.IP.To4() == nil) || (network == "tcp6" && ipNet.IP.To4() != nil) {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(ipNet.IP.String(), strconv.Itoa(port)))
+	}
+	return addrs, true, nil
+}
+
+// serveInterface serves on every address of the interface named by s.IP
+// until Shutdown, following address changes on RefreshListeners.
+func (s *SOCKS5Server) serveInterface() error {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.ifaceListeners = make(map[string]net.Listener)
+	s.ifaceDone = make(chan struct{})
+	done := s.ifaceDone
+	s.mu.Unlock()
+	if err := s.RefreshListeners(); err != nil {
+		s.closeIfaceListeners()
+		return err
+	}
+	<-done
+	return ErrServerClosed
+}
+
+// RefreshListeners re-expands an interface name in s.IP, e.g. "eth0", to
+// the interface's current addresses: it listens on new addresses and
+// closes the listeners of addresses the interface lost. Sessions accepted
+// before keep running. It does nothing unless Run serves an interface.
+func (s *SOCKS5Server) RefreshListeners() error {
+	addrs, _, err := interfaceListenAddrs(s.IP, s.Port, s.listenNetwork())
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.ifaceListeners == nil {
+		return nil
+	}
+	want := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		want[addr] = true
+	}
+	for addr, listener := range s.ifaceListeners {
+		if !want[addr] {
+			delete(s.ifaceListeners, addr)
+			listener.Close()
+			logPrintln("stopped listening on", addr)
+		}
+	}
+	for _, addr := range addrs {
+		addr := addr
+		if _, ok := s.ifaceListeners[addr]; ok {
+			continue
+		}
+		listener, err := s.listen(addr)
+		if err != nil {
+			return err
+		}
+		s.ifaceListeners[addr] = listener
+		logPrintln("listening on", addr)
+		go s.accept(listener, func() bool {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return s.closed || s.ifaceListeners[addr] != listener
+		})
+	}
+	if len(s.ifaceListeners) == 0 {
+		logPrintln("interface", s.IP, "has no addresses to listen on yet")
+	}
+	return nil
+}
+
+// closeIfaceListeners closes the listeners of serveInterface and lets it
+// return. The caller must not hold s.mu.
+func (s *SOCKS5Server) closeIfaceListeners() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeIfaceListenersLocked()
+}
+
+func (s *SOCKS5Server) closeIfaceListenersLocked() {
+	for _, listener := range s.ifaceListeners {
+		listener.Close()
+	}
+	s.ifaceListeners = nil
+	if s.ifaceDone != nil {
+		close(s.ifaceDone)
+		s.ifaceDone = nil
+	}
+}
+
+// listen listens on address with Config.ListenNetwork and Config.IPv6Only.
+func (s *SOCKS5Server) listen(address string) (net.Listener, error) {
+	var lc net.ListenConfig
+	if s.config().IPv6Only {
+		lc.Control = ipv6OnlyControl
+	}
+	return lc.Listen(context.Background(), s.listenNetwork(), address)
+}
+
+func (s *SOCKS5Server) listenNetwork() string {
+	if network := s.config().ListenNetwork; network != "" {
+		return network
+	}
+	return "tcp"
+}
+
+// ipv6OnlyControl is a net.ListenConfig Control function setting
+// IPV6_V6ONLY on IPv6 sockets.
+func ipv6OnlyControl(network, address string, c syscall.RawConn) error {
+	if network != "tcp6" {
+		return nil
+	}
+	return setIPv6Only(c)
+}
@@ -0,0 +1,214 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func loopbackInterface(t *testing.T) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 && iface.Flags&net.FlagUp != 0 {
+			return iface.Name
+		}
+	}
+	t.Skip("no loopback interface")
+	return ""
+}
+
+func TestServeInterface(t *testing.T) {
+	server := SOCKS5Server{IP: loopbackInterface(t), Config: &Config{AuthMethod: MethodNoAuth}}
+	errc := make(chan error, 1)
+	go func() { errc <- server.Run() }()
+
+	var listener net.Listener
+	for i := 0; i < 100 && listener == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		server.mu.Lock()
+		listener = server.ifaceListeners["127.0.0.1:0"]
+		server.mu.Unlock()
+	}
+	if listener == nil {
+		t.Fatal("should listen on 127.0.0.1")
+	}
+	client := Client{ProxyAddress: listener.Addr().String()}
+	conn, err := client.Dial("tcp", echoServer(t))
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	conn.Close()
+
+	// An address the interface lost is dropped on refresh
+	gone, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	server.ifaceListeners["192.0.2.1:0"] = gone
+	server.mu.Unlock()
+	if err := server.RefreshListeners(); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if _, err := gone.Accept(); err == nil {
+		t.Fatal("the listener of a lost address should be closed")
+	}
+	server.mu.Lock()
+	_, kept := server.ifaceListeners["127.0.0.1:0"]
+	server.mu.Unlock()
+	if !kept {
+		t.Fatal("should keep listening on 127.0.0.1")
+	}
+
+	server.Shutdown(context.Background())
+	if err := <-errc; err != ErrServerClosed {
+		t.Fatalf("should get error %s but got %v", ErrServerClosed, err)
+	}
+}
+
+func TestListenIPv6(t *testing.T) {
+	probe, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback")
+	}
+	probe.Close()
+	echo := echoServer(t)
+
+	serve := func(ip string, config *Config) net.Addr {
+		t.Helper()
+		server := &SOCKS5Server{IP: ip, Config: config}
+		go server.Run()
+		t.Cleanup(func() { server.Shutdown(context.Background()) })
+		for i := 0; i < 100; i++ {
+			if addr := server.Addr(); addr != nil {
+				return addr
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("should listen on %s", ip)
+		return nil
+	}
+	dial := func(proxy string) error {
+		client := Client{ProxyAddress: proxy}
+		conn, err := client.Dial("tcp", echo)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	// IPv6 literals, bare or bracketed
+	for _, ip := range []string{"::1", "[::1]"} {
+		addr := serve(ip, &Config{AuthMethod: MethodNoAuth})
+		if err := dial(addr.String()); err != nil {
+			t.Fatalf("%s: should serve on %s but got %s", ip, addr, err)
+		}
+	}
+
+	if !ipv6OnlySupported {
+		return
+	}
+	port := serve("::", &Config{AuthMethod: MethodNoAuth, IPv6Only: true}).(*net.TCPAddr).Port
+	if err := dial(net.JoinHostPort("::1", strconv.Itoa(port))); err != nil {
+		t.Fatalf("should serve IPv6 but got %s", err)
+	}
+	if err := dial(net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err == nil {
+		t.Fatal("should not take IPv4 connections with IPv6Only")
+	}
+}
+
+func TestServeIPv6Client(t *testing.T) {
+	probe, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback")
+	}
+	probe.Close()
+	echo, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	udpEcho, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpEcho.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := udpEcho.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			udpEcho.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	server := &SOCKS5Server{IP: "::1", Config: &Config{AuthMethod: MethodNoAuth, EnableUDP: true}}
+	go server.Run()
+	defer server.Shutdown(context.Background())
+	var proxy net.Addr
+	for i := 0; i < 100 && proxy == nil; i++ {
+		if proxy = server.Addr(); proxy == nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if proxy == nil {
+		t.Fatal("should listen on ::1")
+	}
+	client := Client{ProxyAddress: proxy.String()}
+
+	// CONNECT to an IPv6 literal
+	conn, err := client.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("should connect to %s but got %s", echo.Addr(), err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("should relay ping but got %q, %v", buf, err)
+	}
+
+	// UDP ASSOCIATE from the client's IPv6 address
+	a, err := client.ListenPacket(context.Background())
+	if err != nil {
+		t.Fatalf("should associate but got %s", err)
+	}
+	defer a.Close()
+	roundTrip(t, a, udpEcho.LocalAddr().(*net.UDPAddr))
+}
+
+func TestInterfaceListenAddrsNetwork(t *testing.T) {
+	name := loopbackInterface(t)
+	for _, network := range []string{"tcp4", "tcp6"} {
+		addrs, _, err := interfaceListenAddrs(name, 1080, network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, addr := range addrs {
+			host, _, _ := net.SplitHostPort(addr)
+			if ipv4 := net.ParseIP(host).To4() != nil; ipv4 != (network == "tcp4") {
+				t.Fatalf("%s should not listen on %s", network, addr)
+			}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package socks5
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// logQueueSize bounds the log lines waiting for the writer.
+const logQueueSize = 1024
+
+// logQueue hands formatted log lines to a single writer goroutine, so a slow
+// log destination (a blocked stderr pipe, journald under pressure) costs
+// dropped lines instead of stalled relays. Lines are formatted with the
+// standard logger's prefix and flags when logged, keeping their timestamps
+// and file positions.
+type logQueue struct {
+	once    sync.Once
+	lines   chan logLine
+	dropped atomic.Int64
+}
+
+// logLine is a formatted line, or a flush marker when done is set.
+type logLine struct {
+	b    []byte
+	done chan struct{}
+}
+
+var logs logQueue
+
+func (q *logQueue) start() {
+	q.once.Do(func() {
+		q.lines = make(chan logLine, logQueueSize)
+		go q.write()
+	})
+}
+
+func (q *logQueue) output(calldepth int, s string) {
+	q.start()
+	var buf bytes.Buffer
+	log.New(&buf, log.Prefix(), log.Flags()).Output(calldepth+1, s)
+	select {
+	case q.lines <- logLine{b: buf.Bytes()}:
+	default:
+		q.dropped.Add(1)
+	}
+}
+
+func (q *logQueue) write() {
+	for line := range q.lines {
+		if line.done != nil {
+			close(line.done)
+			continue
+		}
+		log.Writer().Write(line.b)
+	}
+}
+
+// flush waits for the lines queued so far to be written.
+func (q *logQueue) flush() {
+	q.start()
+	done := make(chan struct{})
+	q.lines <- logLine{done: done}
+	<-done
+}
+
+// logPrintln logs like log.Println through the queue.
+func logPrintln(v ...any) {
+	logs.output(2, fmt.Sprintln(v...))
+}
+
+// logPrintf logs like log.Printf through the queue.
+func logPrintf(format string, v ...any) {
+	logs.output(2, fmt.Sprintf(format, v...))
+}
+
+// DroppedLogs returns the number of log lines dropped by this package
+// because the log writer could not keep up.
+func DroppedLogs() int64 {
+	return logs.dropped.Load()
+}
+
+// FlushLogs waits until the log lines queued by this package are written,
+// e.g. before the process exits.
+func FlushLogs() {
+	logs.flush()
+}
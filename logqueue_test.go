@@ -0,0 +1,58 @@
+package socks5
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingWriter blocks writes until release is closed.
+type blockingWriter struct {
+	release chan struct{}
+	mu      sync.Mutex
+	buf     bytes.Buffer
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	<-w.release
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(b)
+}
+
+func TestLogQueueDropsInsteadOfBlocking(t *testing.T) {
+	FlushLogs()
+	w := &blockingWriter{release: make(chan struct{})}
+	defer log.SetOutput(log.Writer())
+	defer log.SetFlags(log.Flags())
+	log.SetOutput(w)
+	log.SetFlags(log.Lshortfile)
+
+	dropped := DroppedLogs()
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < logQueueSize+10; i++ {
+			logPrintln("line", i)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("logging should not block on a stalled writer")
+	}
+	if got := DroppedLogs() - dropped; got < 9 {
+		t.Fatalf("should drop at least 9 lines but dropped %d", got)
+	}
+
+	close(w.release)
+	FlushLogs()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !strings.HasPrefix(w.buf.String(), "logqueue_test.go:") {
+		t.Fatalf("lines should keep the caller position but got %.40q", w.buf.String())
+	}
+}
@@ -0,0 +1,24 @@
+//go:build linux
+
+package socks5
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const markSupported = true
+
+// markControl returns a net.Dialer Control function setting SO_MARK to mark.
+func markControl(mark int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
@@ -0,0 +1,42 @@
+//go:build linux
+
+package socks5
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestDialMark(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	server := SOCKS5Server{Config: &Config{}}
+	conn, err := server.dial(listener.Addr().String(), &AuthContext{}, 0, 42, 0, nil, false)
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("setting SO_MARK needs CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	defer conn.Close()
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mark int
+	raw.Control(func(fd uintptr) {
+		mark, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK)
+	})
+	if err != nil || mark != 42 {
+		t.Fatalf("should get mark 42 but got %d, %v", mark, err)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package socks5
+
+import "syscall"
+
+const markSupported = false
+
+func markControl(mark int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return ErrMarkNotSupported
+	}
+}
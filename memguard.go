@@ -0,0 +1,195 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrMemoryLimit is returned for connections refused because Config.MaxMemory
+// was reached.
+var ErrMemoryLimit = errors.New("memory limit reached")
+
+// Approximate memory held by sessions, charged against Config.MaxMemory.
+const (
+	// sessionMemory covers the goroutines, socket and handshake buffers of
+	// an accepted connection.
+	sessionMemory = 16 << 10
+	// copyBufferMemory is the buffer io.Copy allocates per relay direction.
+	copyBufferMemory = 32 << 10
+	// udpBufferMemory is the read buffer of a UDP datagram.
+	udpBufferMemory = 65535
+)
+
+// memoryGuard accounts the approximate buffer memory of every session.
+type memoryGuard struct {
+	mu       sync.Mutex
+	used     int64
+	sessions map[string]*memoryCharge
+}
+
+// memoryCharge is the memory charged to one session.
+type memoryCharge struct {
+	id    string
+	conn  net.Conn
+	bytes int64
+	// shed is set when the guard evicted the session to make room.
+	shed bool
+	// lastActive is the UnixNano time the session last relayed, zero until
+	// it starts relaying.
+	lastActive atomic.Int64
+}
+
+// admit charges sessionMemory to a new session. When that would exceed max
+// (if positive), it evicts sessions idle for at least shedIdle (if positive),
+// longest idle first, until there is room, and returns them for the caller
+// to close. It returns a nil charge if there still is no room.
+func (g *memoryGuard) admit(id string, conn net.Conn, max int64, shedIdle time.Duration, now time.Time) (*memoryCharge, []*memoryCharge) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var shed []*memoryCharge
+	if max > 0 && g.used+sessionMemory > max {
+		if shedIdle <= 0 {
+			return nil, nil
+		}
+		var idle []*memoryCharge
+		for _, c := range g.sessions {
+			if active := c.lastActive.Load(); active != 0 && now.Sub(time.Unix(0, active)) >= shedIdle {
+				idle = append(idle, c)
+			}
+		}
+		sort.Slice(idle, func(i, j int) bool { return idle[i].lastActive.Load() < idle[j].lastActive.Load() })
+		freed := int64(0)
+		for _, c := range idle {
+			if g.used-freed+sessionMemory <= max {
+				break
+			}
+			freed += c.bytes
+			shed = append(shed, c)
+		}
+		if g.used-freed+sessionMemory > max {
+			return nil, nil
+		}
+		for _, c := range shed {
+			g.used -= c.bytes
+			c.shed = true
+			delete(g.sessions, c.id)
+		}
+	}
+	if g.sessions == nil {
+		g.sessions = make(map[string]*memoryCharge)
+	}
+	c := &memoryCharge{id: id, conn: conn, bytes: sessionMemory}
+	g.sessions[id] = c
+	g.used += sessionMemory
+	return c, shed
+}
+
+// grow charges n more bytes to session id and returns its charge, or nil if
+// the session is not tracked.
+func (g *memoryGuard) grow(id string, n int64) *memoryCharge {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c, ok := g.sessions[id]
+	if !ok {
+		return nil
+	}
+	c.bytes += n
+	g.used += n
+	return c
+}
+
+// release uncharges a session that ended.
+func (g *memoryGuard) release(c *memoryCharge) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if c.shed {
+		return
+	}
+	g.used -= c.bytes
+	delete(g.sessions, c.id)
+}
+
+// usage returns the bytes charged to session id.
+func (g *memoryGuard) usage(id string) int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if c, ok := g.sessions[id]; ok {
+		return c.bytes
+	}
+	return 0
+}
+
+func (g *memoryGuard) inUse() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.used
+}
+
+// admitMemory charges a new connection under Config.MaxMemory and closes
+// the idle sessions evicted to make room. It returns nil when the
+// connection must be refused.
+func (s *SOCKS5Server) admitMemory(conn net.Conn, session *Session) *memoryCharge {
+	config := session.config
+	charge, shed := s.memory.admit(session.ID, conn, config.MaxMemory, config.MemoryShedIdle, timeNow(s.clock))
+	if len(shed) > 0 {
+		var ending []endingConn
+		s.mu.Lock()
+		for _, c := range shed {
+			ending = s.endSessionLocked(c.id, c.conn, TerminationMemoryShed, ending)
+		}
+		s.mu.Unlock()
+		closeEnding(ending)
+		s.stats.memoryShedSessions.Add(int64(len(shed)))
+		for _, c := range shed {
+			logSession(c.id, "closed idle session to free memory")
+		}
+	}
+	return charge
+}
+
+// relayMemory returns the buffer memory of relaying one TCP session under
+// config.
+func relayMemory(config *Config) int64 {
+	if size := config.RelayBufferSize; size > 0 {
+		return 2 * int64(size)
+	}
+	return 2 * copyBufferMemory
+}
+
+// activityConn records the time of every read and write of conn in charge,
+// so Config.MemoryShedIdle can tell idle sessions.
+type activityConn struct {
+	conn   io.ReadWriter
+	charge *memoryCharge
+	clock  clock
+}
+
+func (c *activityConn) Read(b []byte) (int, error) {
+	n, err := c.conn.Read(b)
+	c.charge.lastActive.Store(timeNow(c.clock).UnixNano())
+	return n, err
+}
+
+func (c *activityConn) Write(b []byte) (int, error) {
+	c.charge.lastActive.Store(timeNow(c.clock).UnixNano())
+	return c.conn.Write(b)
+}
+
+func (c *activityConn) CloseWrite() error {
+	if cw, ok := c.conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errCloseWriteNotSupported
+}
+
+func (c *activityConn) Close() error {
+	if closer, ok := c.conn.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package socks5
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestMemoryGuard(t *testing.T) {
+	var g memoryGuard
+	now := time.Unix(1000, 0)
+	a, _ := g.admit("a", nil, 3*sessionMemory, 0, now)
+	b, _ := g.admit("b", nil, 3*sessionMemory, 0, now)
+	if a == nil || b == nil {
+		t.Fatalf("should admit two sessions")
+	}
+	g.grow("a", sessionMemory)
+	if c, _ := g.admit("c", nil, 3*sessionMemory, 0, now); c != nil {
+		t.Fatalf("should refuse a session past the cap")
+	}
+
+	// Only sessions idle long enough are shed
+	a.lastActive.Store(now.Add(-time.Minute).UnixNano())
+	b.lastActive.Store(now.UnixNano())
+	c, shed := g.admit("c", nil, 3*sessionMemory, 30*time.Second, now)
+	if c == nil || len(shed) != 1 || shed[0] != a {
+		t.Fatalf("should shed session a to admit c but got %v, %v", c, shed)
+	}
+	if got := g.inUse(); got != 2*sessionMemory {
+		t.Fatalf("should have %d bytes in use but got %d", 2*sessionMemory, got)
+	}
+	g.release(a)
+	g.release(b)
+	g.release(c)
+	if got := g.inUse(); got != 0 || len(g.sessions) != 0 {
+		t.Fatalf("should release everything but got %d bytes, %d sessions", got, len(g.sessions))
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	clock := newFakeClock()
+	server := SOCKS5Server{
+		Config: &Config{AuthMethod: MethodNoAuth, MaxMemory: sessionMemory + 2*copyBufferMemory},
+		clock:  clock,
+	}
+	relaySession(t, &server)
+	if sessions := server.Sessions(); len(sessions) != 1 || sessions[0].Memory != sessionMemory+2*copyBufferMemory {
+		t.Fatalf("should charge the relaying session but got %+v", sessions)
+	}
+
+	clientConn, serverConn := tcpPair(t)
+	if err := server.ServeConn(serverConn); err != ErrMemoryLimit {
+		t.Fatalf("should get error %s but got %v", ErrMemoryLimit, err)
+	}
+	clientConn.Close()
+	if got := server.Stats().MemoryRejections; got != 1 {
+		t.Fatalf("should count 1 rejection but got %d", got)
+	}
+
+	// With shedding, an idle session makes room
+	shedding := SOCKS5Server{
+		Config: &Config{AuthMethod: MethodNoAuth, MaxMemory: sessionMemory + 2*copyBufferMemory, MemoryShedIdle: time.Minute},
+		clock:  clock,
+	}
+	idleConn := relaySession(t, &shedding)
+	clock.Advance(2 * time.Minute)
+	clientConn, serverConn = tcpPair(t)
+	defer clientConn.Close()
+	go shedding.ServeConn(serverConn)
+	idleConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := idleConn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("idle session should be closed but got %v", err)
+	}
+	if got := shedding.Stats().MemoryShedSessions; got != 1 {
+		t.Fatalf("should count 1 shed session but got %d", got)
+	}
+}
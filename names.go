@@ -0,0 +1,109 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidReplyName  = errors.New("invalid reply name")
+	ErrInvalidMethodName = errors.New("invalid auth method name")
+)
+
+// Names of the protocol's codes, for logs, metrics labels and config files.
+// Codes without a name are written in hex, e.g. "0x09", which the Parse
+// functions accept as well.
+var (
+	methodNames = map[Method]string{
+		MethodNoAuth:       "none",
+		MethodGSSAPI:       "gssapi",
+		MethodPassword:     "password",
+		MethodHMAC:         "hmac",
+		MethodNoAcceptable: "no_acceptable",
+	}
+	addressTypeNames = map[AddressType]string{TypeIPv4: "ipv4", TypeDomain: "domain", TypeIPv6: "ipv6"}
+	replyNames       = map[ReplyType]string{
+		ReplySuccess:                 "success",
+		ReplyServerFailure:           "server_failure",
+		ReplyConnectionNotAllowed:    "connection_not_allowed",
+		ReplyNetworkUnreachable:      "network_unreachable",
+		ReplyHostUnreachable:         "host_unreachable",
+		ReplyConnectionRefused:       "connection_refused",
+		ReplyTTLExpired:              "ttl_expired",
+		ReplyCommandNotSupported:     "command_not_supported",
+		ReplyAddressTypeNotSupported: "address_type_not_supported",
+		ReplyHostConnectionLimit:     "host_connection_limit",
+	}
+)
+
+// MethodName returns the name of an auth method, e.g. "password".
+func MethodName(method Method) string {
+	return codeName(methodNames, method)
+}
+
+// CommandName returns the name of a command, "connect", "bind" or "udp".
+func CommandName(cmd Command) string {
+	return codeName(commandNames, cmd)
+}
+
+// AddressTypeName returns the name of an address type, "ipv4", "domain"
+// or "ipv6".
+func AddressTypeName(addrType AddressType) string {
+	return codeName(addressTypeNames, addrType)
+}
+
+// ReplyName returns the name of a reply, e.g. "connection_refused".
+func ReplyName(reply ReplyType) string {
+	return codeName(replyNames, reply)
+}
+
+// ParseMethod returns the auth method named name, as by MethodName.
+func ParseMethod(name string) (Method, error) {
+	method, ok := parseCode(methodNames, name)
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidMethodName, name)
+	}
+	return method, nil
+}
+
+// ParseCommand returns the command named name, as by CommandName.
+func ParseCommand(name string) (Command, error) {
+	cmd, ok := parseCode(commandNames, name)
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrCommandNotSupported, name)
+	}
+	return cmd, nil
+}
+
+// ParseReply returns the reply named name, as by ReplyName.
+func ParseReply(name string) (ReplyType, error) {
+	reply, ok := parseCode(replyNames, name)
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidReplyName, name)
+	}
+	return reply, nil
+}
+
+func codeName(names map[byte]string, code byte) string {
+	if name, ok := names[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("%#02x", code)
+}
+
+// parseCode looks name up in names, ignoring case, or parses it as a hex
+// code.
+func parseCode(names map[byte]string, name string) (byte, bool) {
+	for code, codeName := range names {
+		if strings.EqualFold(name, codeName) {
+			return code, true
+		}
+	}
+	if len(name) > 2 && strings.EqualFold(name[:2], "0x") {
+		code, err := strconv.ParseUint(name[2:], 16, 8)
+		return byte(code), err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,46 @@
+package socks5
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNames(t *testing.T) {
+	if got := MethodName(MethodHMAC); got != "hmac" {
+		t.Fatalf("should name MethodHMAC hmac but got %s", got)
+	}
+	if got := CommandName(CmdUDP); got != "udp" {
+		t.Fatalf("should name CmdUDP udp but got %s", got)
+	}
+	if got := AddressTypeName(TypeDomain); got != "domain" {
+		t.Fatalf("should name TypeDomain domain but got %s", got)
+	}
+	if got := ReplyName(ReplyConnectionRefused); got != "connection_refused" {
+		t.Fatalf("should name ReplyConnectionRefused connection_refused but got %s", got)
+	}
+	if got := ReplyName(0x42); got != "0x42" {
+		t.Fatalf("should write an unknown reply in hex but got %s", got)
+	}
+
+	// Every code survives a round trip through its name
+	for code := 0; code <= 0xff; code++ {
+		if reply, err := ParseReply(ReplyName(byte(code))); err != nil || reply != byte(code) {
+			t.Fatalf("reply %#x: got %#x, %v", code, reply, err)
+		}
+		if method, err := ParseMethod(MethodName(byte(code))); err != nil || method != byte(code) {
+			t.Fatalf("method %#x: got %#x, %v", code, method, err)
+		}
+		if cmd, err := ParseCommand(CommandName(byte(code))); err != nil || cmd != byte(code) {
+			t.Fatalf("command %#x: got %#x, %v", code, cmd, err)
+		}
+	}
+	if method, err := ParseMethod("Password"); err != nil || method != MethodPassword {
+		t.Fatalf("should parse names ignoring case but got %#x, %v", method, err)
+	}
+	if _, err := ParseReply("great"); !errors.Is(err, ErrInvalidReplyName) {
+		t.Fatalf("should get error %s but got %v", ErrInvalidReplyName, err)
+	}
+	if _, err := ParseMethod("0x100"); !errors.Is(err, ErrInvalidMethodName) {
+		t.Fatalf("should get error %s but got %v", ErrInvalidMethodName, err)
+	}
+}
@@ -0,0 +1,66 @@
+package socks5
+
+import "net"
+
+// validNAT64PrefixLength reports whether RFC 6052 defines an embedding for
+// prefixes of length ones.
+func validNAT64PrefixLength(ones int) bool {
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+		return true
+	}
+	return false
+}
+
+// embedIPv4 returns the IPv6 address embedding ip4 in prefix as RFC 6052
+// specifies, skipping bits 64 to 71 which must be zero.
+func embedIPv4(prefix *net.IPNet, ip4 net.IP) net.IP {
+	ones, _ := prefix.Mask.Size()
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16())
+	pos := ones / 8
+	for _, b := range ip4.To4() {
+		if pos == 8 {
+			pos++
+		}
+		ip[pos] = b
+		pos++
+	}
+	return ip
+}
+
+// extractIPv4 returns the IPv4 address embedded in ip by embedIPv4, or nil
+// if ip is not in prefix.
+func extractIPv4(prefix *net.IPNet, ip net.IP) net.IP {
+	if ip.To4() != nil || !prefix.Contains(ip) {
+		return nil
+	}
+	ones, _ := prefix.Mask.Size()
+	ip4 := make(net.IP, net.IPv4len)
+	pos := ones / 8
+	for i := range ip4 {
+		if pos == 8 {
+			pos++
+		}
+		ip4[i] = ip[pos]
+		pos++
+	}
+	return ip4
+}
+
+// nat64Address returns address with an IPv4 literal host replaced by its
+// address in prefix, if set, or address as is.
+func nat64Address(prefix *net.IPNet, address string) string {
+	if prefix == nil {
+		return address
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() == nil {
+		return address
+	}
+	return net.JoinHostPort(embedIPv4(prefix, ip).String(), port)
+}
@@ -0,0 +1,92 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestEmbedIPv4(t *testing.T) {
+	// The examples of RFC 6052 section 2.4
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+	}
+	ip4 := net.IP{192, 0, 2, 33}
+	for _, test := range tests {
+		_, prefix, _ := net.ParseCIDR(test.prefix)
+		ip := embedIPv4(prefix, ip4)
+		if ip.String() != test.want {
+			t.Fatalf("%s should embed %s as %s but got %s", test.prefix, ip4, test.want, ip)
+		}
+		if got := extractIPv4(prefix, ip); !got.Equal(ip4) {
+			t.Fatalf("%s should extract %s from %s but got %s", test.prefix, ip4, ip, got)
+		}
+	}
+
+	_, prefix, _ := net.ParseCIDR("64:ff9b::/96")
+	if got := extractIPv4(prefix, net.ParseIP("2001:db8::1")); got != nil {
+		t.Fatalf("should extract nothing outside the prefix but got %s", got)
+	}
+}
+
+func TestNAT64Validate(t *testing.T) {
+	for prefix, valid := range map[string]bool{"64:ff9b::/96": true, "2001:db8::/64": true, "2001:db8::/80": false, "10.0.0.0/8": false} {
+		_, ipNet, _ := net.ParseCIDR(prefix)
+		err := (&Config{NAT64Prefix: ipNet}).Validate()
+		if valid && err != nil {
+			t.Fatalf("%s should be valid but got %s", prefix, err)
+		}
+		if !valid && (err == nil || !strings.Contains(err.Error(), "NAT64Prefix")) {
+			t.Fatalf("%s should be invalid but got %v", prefix, err)
+		}
+	}
+}
+
+func TestNAT64Connect(t *testing.T) {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback:", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	// ::/96 embeds 0.0.0.1 as ::1
+	_, prefix, _ := net.ParseCIDR("::/96")
+	server := SOCKS5Server{Config: &Config{NAT64Prefix: prefix}}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		defer serverConn.Close()
+		server.request(serverConn, &AuthContext{})
+	}()
+	port := listener.Addr().(*net.TCPAddr).Port
+	if err := WriteClientRequestMessage(clientConn, CmdConnect, "0.0.0.1", uint16(port)); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := NewServerReplyMessage(clientConn)
+	if err != nil || reply.Reply != ReplySuccess {
+		t.Fatalf("should reach [::1]:%s but got %+v and %v", strconv.Itoa(port), reply, err)
+	}
+	clientConn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(clientConn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("should echo ping but got %q and %v", buf, err)
+	}
+}
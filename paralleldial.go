@@ -0,0 +1,87 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// startLookup resolves host with resolver, nil for net.DefaultResolver, in
+// the background, while the request waits for a dial slot and the dialer is
+// set up. The returned function waits for the addresses.
+func startLookup(resolver *net.Resolver, host string, timeout time.Duration) func() ([]net.IP, error) {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	type result struct {
+		ips []net.IP
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		addrs, err := resolver.LookupIPAddr(ctx, host)
+		ips := make([]net.IP, len(addrs))
+		for i, addr := range addrs {
+			ips[i] = addr.IP
+		}
+		done <- result{ips, err}
+	}()
+	return func() ([]net.IP, error) {
+		r := <-done
+		return r.ips, r.err
+	}
+}
+
+// dialParallel dials port on ips in order, up to parallel at once, and
+// returns the first connection made. The other dials are canceled, and
+// connections they made anyway are closed.
+func dialParallel(dialer *net.Dialer, ips []net.IP, port string, parallel int) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	// One result per address
+	results := make(chan result, len(ips))
+	slots := make(chan struct{}, parallel)
+	go func() {
+		for _, ip := range ips {
+			select {
+			case slots <- struct{}{}:
+				go func(address string) {
+					conn, err := dialer.DialContext(ctx, "tcp", address)
+					<-slots
+					results <- result{conn, err}
+				}(net.JoinHostPort(ip.String(), port))
+			case <-ctx.Done():
+				results <- result{err: ctx.Err()}
+			}
+		}
+	}()
+
+	var firstErr error
+	for i := range ips {
+		r := <-results
+		if r.err == nil {
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					if r := <-results; r.conn != nil {
+						r.conn.Close()
+					}
+				}
+			}(len(ips) - i - 1)
+			return r.conn, nil
+		}
+		if firstErr == nil {
+			firstErr = r.err
+		}
+	}
+	return nil, firstErr
+}
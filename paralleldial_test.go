@@ -0,0 +1,86 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDialParallel(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	// A documentation address, which never answers, must not hold up the
+	// dial to the listener
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	start := time.Now()
+	conn, err := dialParallel(&dialer, []net.IP{net.ParseIP("198.51.100.1"), net.IPv4(127, 0, 0, 1)}, port, 2)
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("should connect without waiting for the first address but took %s", elapsed)
+	}
+
+	listener.Close()
+	if _, err := dialParallel(&dialer, []net.IP{net.IPv4(127, 0, 0, 1)}, port, 2); err == nil {
+		t.Fatal("should fail when no address connects")
+	}
+}
+
+func TestParallelDialSession(t *testing.T) {
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth, ParallelDial: 2}}
+	address, _ := startServer(t, &server)
+	defer server.Shutdown(context.Background())
+	_, port, _ := net.SplitHostPort(echoServer(t))
+	client := Client{ProxyAddress: address}
+	// localhost may resolve to ::1 as well, where the echo server is not
+	conn, err := client.Dial("tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := conn.Read(buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("should echo ping but got %q, %v", buf, err)
+	}
+}
+
+func TestParallelDialResolverAndNAT64(t *testing.T) {
+	var queried atomic.Bool
+	resolver := &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		queried.Store(true)
+		return nil, errors.New("no DNS in tests")
+	}}
+	if _, err := startLookup(resolver, "www.example", time.Second)(); err == nil || !queried.Load() {
+		t.Fatalf("should look up through the configured resolver but got %v", err)
+	}
+
+	_, prefix, _ := net.ParseCIDR("64:ff9b::/96")
+	var dialed atomic.Value
+	server := SOCKS5Server{Config: &Config{
+		NAT64Prefix:  prefix,
+		ParallelDial: 2,
+		DialControl: func(network, address string, c syscall.RawConn) error {
+			dialed.Store(address)
+			return errors.New("not dialing in tests")
+		},
+	}}
+	lookup := func() ([]net.IP, error) { return []net.IP{net.IPv4(192, 0, 2, 1)}, nil }
+	if _, err := server.dial("www.example:80", &AuthContext{}, time.Second, 0, 0, lookup, false); err == nil {
+		t.Fatal("should fail the dial")
+	}
+	if got := dialed.Load(); got != "[64:ff9b::c000:201]:80" {
+		t.Fatalf("should dial the NAT64 address but got %v", got)
+	}
+}
@@ -0,0 +1,166 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"plugin"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrPluginRejected   = errors.New("request rejected by plugin")
+	ErrPluginAPIVersion = errors.New("plugin built for another API version")
+)
+
+// PluginAPIVersion is the version of the host API that LoadPlugin accepts.
+// It changes only when the symbols below or their fields change
+// incompatibly.
+const PluginAPIVersion = 1
+
+// Plugin is a policy or telemetry module, usually loaded with LoadPlugin.
+type Plugin interface {
+	// OnRequest is called for every request once the auth phase and rules
+	// allowed it, and likewise for every datagram of a UDP association with
+	// its target. A non-nil error refuses the request with
+	// ReplyConnectionNotAllowed, or drops the datagram.
+	OnRequest(req PluginRequest) error
+	// OnClose is called with the record of every finished TCP session.
+	OnClose(record SessionRecord)
+}
+
+// PluginRequest describes a request for Plugin.OnRequest.
+type PluginRequest struct {
+	SessionID  string
+	ClientAddr string
+	Username   string
+	// Command is "connect", "bind" or "udp".
+	Command string
+	// Target is the host:port requested.
+	Target string
+	Labels []string
+}
+
+// LoadPlugin opens a Go plugin (go build -buildmode=plugin), which must be
+// built with the same Go version as the daemon. Only builtin types cross
+// the boundary, so a plugin does not import this package. It exports:
+//
+//	var SOCKS5PluginAPI = 1 // PluginAPIVersion
+//	func OnRequest(fields map[string]string) error // optional
+//	func OnClose(fields map[string]string)         // optional
+//
+// OnRequest gets the fields id, client, username, command, target and
+// labels (comma separated); OnClose gets id, client, username, target,
+// labels, start (RFC 3339), duration, sent, received and termination.
+func LoadPlugin(path string) (Plugin, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	symbol, err := p.Lookup("SOCKS5PluginAPI")
+	if err != nil {
+		return nil, err
+	}
+	if version, ok := symbol.(*int); !ok || *version != PluginAPIVersion {
+		return nil, fmt.Errorf("%w: %s", ErrPluginAPIVersion, path)
+	}
+	gp := goPlugin{name: path}
+	var ok bool
+	if symbol, err := p.Lookup("OnRequest"); err == nil {
+		if gp.onRequest, ok = symbol.(func(map[string]string) error); !ok {
+			return nil, fmt.Errorf("%s: OnRequest has type %T", path, symbol)
+		}
+	}
+	if symbol, err := p.Lookup("OnClose"); err == nil {
+		if gp.onClose, ok = symbol.(func(map[string]string)); !ok {
+			return nil, fmt.Errorf("%s: OnClose has type %T", path, symbol)
+		}
+	}
+	return &gp, nil
+}
+
+// goPlugin adapts the functions of a Go plugin to Plugin. A panicking
+// OnRequest refuses the request rather than crashing the server.
+type goPlugin struct {
+	name      string
+	onRequest func(map[string]string) error
+	onClose   func(map[string]string)
+}
+
+func (p *goPlugin) OnRequest(req PluginRequest) (err error) {
+	if p.onRequest == nil {
+		return nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("plugin %s panicked: %v", p.name, r)
+		}
+	}()
+	return p.onRequest(map[string]string{
+		"id":       req.SessionID,
+		"client":   req.ClientAddr,
+		"username": req.Username,
+		"command":  req.Command,
+		"target":   req.Target,
+		"labels":   strings.Join(req.Labels, ","),
+	})
+}
+
+func (p *goPlugin) OnClose(record SessionRecord) {
+	if p.onClose == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			logSession(record.SessionID, "plugin", p.name, "panicked:", r)
+		}
+	}()
+	fields := make(map[string]string)
+	for _, field := range recordFields(record) {
+		fields[field[0]] = field[1]
+	}
+	p.onClose(fields)
+}
+
+// pluginsAllow asks every plugin about a request of a session with labels,
+// returning the first refusal.
+func (s *SOCKS5Server) pluginsAllow(message *ClientRequestMessage, authCtx *AuthContext, labels []string) error {
+	config := s.sessionConfig(authCtx)
+	plugins := config.Plugins
+	if len(plugins) == 0 {
+		return nil
+	}
+	req := PluginRequest{
+		SessionID: authCtx.SessionID,
+		Username:  authCtx.Username,
+		Command:   commandNames[message.Cmd],
+		Target:    net.JoinHostPort(message.TargetIP, strconv.Itoa(int(message.Port))),
+		Labels:    labels,
+	}
+	if authCtx.ClientAddr != nil {
+		req.ClientAddr = authCtx.ClientAddr.String()
+	}
+	for _, plugin := range plugins {
+		if err := plugin.OnRequest(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pluginRecorder passes session records to Recorder, if set, and to the
+// OnClose of plugins.
+type pluginRecorder struct {
+	recorder SessionRecorder
+	plugins  []Plugin
+}
+
+func (p pluginRecorder) Record(record SessionRecord) {
+	if p.recorder != nil {
+		p.recorder.Record(record)
+	}
+	for _, plugin := range p.plugins {
+		plugin.OnClose(record)
+	}
+}
@@ -0,0 +1,93 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+type testPlugin struct {
+	requests chan PluginRequest
+	records  chan SessionRecord
+}
+
+func (p *testPlugin) OnRequest(req PluginRequest) error {
+	p.requests <- req
+	if req.Target == "blocked.example:80" {
+		return errors.New("blocked")
+	}
+	return nil
+}
+
+func (p *testPlugin) OnClose(record SessionRecord) {
+	p.records <- record
+}
+
+func TestPlugins(t *testing.T) {
+	plugin := &testPlugin{requests: make(chan PluginRequest, 2), records: make(chan SessionRecord, 1)}
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth, Plugins: []Plugin{plugin}}}
+	if err := initConfig(server.Config); err != nil {
+		t.Fatal(err)
+	}
+
+	host, portStr, _ := net.SplitHostPort(echoServer(t))
+	port, _ := strconv.Atoi(portStr)
+	clientConn, serverConn := tcpPair(t)
+	go server.ServeConn(serverConn)
+	clientConn.Write([]byte{SOCKS5Version, 1, byte(MethodNoAuth)})
+	io.ReadFull(clientConn, make([]byte, 2))
+	WriteClientRequestMessage(clientConn, CmdConnect, host, uint16(port))
+	if reply, err := NewServerReplyMessage(clientConn); err != nil || reply.Reply != ReplySuccess {
+		t.Fatalf("should be allowed but got %+v, %v", reply, err)
+	}
+	req := <-plugin.requests
+	if req.Command != "connect" || req.Target != net.JoinHostPort(host, portStr) || req.ClientAddr != clientConn.LocalAddr().String() {
+		t.Fatalf("unexpected plugin request %+v", req)
+	}
+	clientConn.Write([]byte("ping"))
+	io.ReadFull(clientConn, make([]byte, 4))
+	clientConn.Close()
+	if record := <-plugin.records; record.SessionID != req.SessionID || record.Sent != 4 || record.Received != 4 {
+		t.Fatalf("unexpected plugin record %+v", record)
+	}
+
+	clientConn, serverConn = tcpPair(t)
+	defer clientConn.Close()
+	go server.ServeConn(serverConn)
+	clientConn.Write([]byte{SOCKS5Version, 1, byte(MethodNoAuth)})
+	io.ReadFull(clientConn, make([]byte, 2))
+	WriteClientRequestMessage(clientConn, CmdConnect, "blocked.example", 80)
+	if reply, err := NewServerReplyMessage(clientConn); err != nil || reply.Reply != ReplyConnectionNotAllowed {
+		t.Fatalf("should be rejected but got %+v, %v", reply, err)
+	}
+}
+
+func TestGoPlugin(t *testing.T) {
+	var closed map[string]string
+	plugin := &goPlugin{
+		name: "test.so",
+		onRequest: func(fields map[string]string) error {
+			if fields["labels"] == "a,b" {
+				panic("boom")
+			}
+			return nil
+		},
+		onClose: func(fields map[string]string) { closed = fields },
+	}
+	if err := plugin.OnRequest(PluginRequest{Labels: []string{"a"}}); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if err := plugin.OnRequest(PluginRequest{Labels: []string{"a", "b"}}); err == nil {
+		t.Fatal("should refuse the request when the plugin panics")
+	}
+	plugin.OnClose(SessionRecord{SessionID: "s1", Sent: 3})
+	if closed["id"] != "s1" || closed["sent"] != "3" {
+		t.Fatalf("unexpected fields %v", closed)
+	}
+
+	if _, err := LoadPlugin("testdata/nosuch.so"); err == nil {
+		t.Fatal("should fail to load a missing plugin")
+	}
+}
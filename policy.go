@@ -0,0 +1,97 @@
+package socks5
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+// policyRefusal is why checkPolicy refused a request or a UDP datagram.
+type policyRefusal struct {
+	// err is what the request phase returns and reply what it answers.
+	err   error
+	reply ReplyType
+	// log describes the refusal for the session's log.
+	log []any
+}
+
+// checkPolicy applies the policy of the session of authCtx to message: the
+// target filters of the config if filterTarget, then the first matching
+// rule with its commands, time windows and action, then the plugins. The
+// request phase and the relay of UDP datagrams, with a message per
+// datagram, share it so that no target escapes a check through one of
+// them. Plugins are not asked about sinkholed requests.
+//
+// It returns the matching rule, if any, and the end of its time window the
+// request falls in, and whether and why the request is refused.
+func (s *SOCKS5Server) checkPolicy(message *ClientRequestMessage, authCtx *AuthContext, filterTarget bool) (*Rule, time.Time, *policyRefusal) {
+	config := s.sessionConfig(authCtx)
+	redaction := config.LogRedaction
+	var end time.Time
+	if filterTarget {
+		domain := message.AddrType == TypeDomain
+		switch {
+		case config.RejectIPTargets && !domain:
+			s.stats.targetTypeRejections.Add(1)
+			return nil, end, &policyRefusal{ErrAddressTypeNotSupported, ReplyAddressTypeNotSupported,
+				[]any{"IP targets are rejected", redaction.Host(message.TargetIP), redaction.Port(message.Port)}}
+		case config.RejectDomainTargets && domain:
+			s.stats.targetTypeRejections.Add(1)
+			return nil, end, &policyRefusal{ErrAddressTypeNotSupported, ReplyAddressTypeNotSupported,
+				[]any{"domain targets are rejected", redaction.Host(message.TargetIP), redaction.Port(message.Port)}}
+		case domain && !domainAllowed(config, message.TargetIP):
+			return nil, end, &policyRefusal{ErrInvalidDomain, ReplyHostUnreachable,
+				[]any{"invalid domain", strconv.Quote(redaction.Host(message.TargetIP))}}
+		case domain && config.DomainBlocklist != nil && config.DomainBlocklist.Blocked(message.TargetIP):
+			s.stats.blocklistRejections.Add(1)
+			return nil, end, &policyRefusal{ErrDomainBlocked, ReplyConnectionNotAllowed,
+				[]any{"domain blocked by blocklist", redaction.Host(message.TargetIP)}}
+		}
+	}
+
+	rule := s.matchRule(message, authCtx)
+	if !commandAllowed(message, authCtx, rule) {
+		return rule, end, &policyRefusal{ErrCommandNotAllowed, ReplyCommandNotSupported,
+			[]any{"Command not allowed", CommandName(message.Cmd), "for user", redaction.Username(authCtx.Username)}}
+	}
+	labels := authCtx.Labels
+	if rule != nil {
+		if len(rule.windows) > 0 {
+			var open bool
+			if end, open = rule.windowEnd(timeNow(s.clock)); !open {
+				return rule, end, &policyRefusal{ErrOutsideTimeWindow, ReplyConnectionNotAllowed,
+					[]any{"Request outside the time windows of rule", rule.key}}
+			}
+		}
+		switch rule.Action {
+		case RuleReject:
+			return rule, end, &policyRefusal{ErrRuleRejected, ReplyConnectionNotAllowed,
+				[]any{"Request rejected by rule", rule.key}}
+		case RuleSinkhole:
+			return rule, end, nil
+		}
+		for _, label := range rule.Labels {
+			if !containsString(labels, label) {
+				labels = append(labels[:len(labels):len(labels)], label)
+			}
+		}
+	}
+	if err := s.pluginsAllow(message, authCtx, labels); err != nil {
+		return rule, end, &policyRefusal{ErrPluginRejected, ReplyConnectionNotAllowed,
+			[]any{"Request rejected by plugin:", err}}
+	}
+	return rule, end, nil
+}
+
+// normalizeMapped presents an IPv4-mapped IPv6 target, which
+// net.IP.String printed as IPv4, as IPv4 or, with keepMapped, in its IPv6
+// form, so that rules and filters see it as configured.
+func (m *ClientRequestMessage) normalizeMapped(keepMapped bool) {
+	if ip := net.ParseIP(m.TargetIP); m.AddrType == TypeIPv6 && ip.To4() != nil {
+		if keepMapped {
+			m.TargetIP = ipString(ip, true)
+		} else {
+			m.AddrType = TypeIPv4
+		}
+	}
+}
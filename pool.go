@@ -0,0 +1,126 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrStaleConn is returned by ProbeIdle for a connection the peer closed or
+// wrote to while it was supposed to be idle.
+var ErrStaleConn = errors.New("idle connection is stale")
+
+// probeTimeout is how long ProbeIdle waits for a pending EOF or error.
+const probeTimeout = time.Millisecond
+
+// ProbeIdle checks that conn, an idle connection on which nothing is
+// expected to arrive, is still usable: it returns ErrStaleConn if the peer
+// closed it or sent data, or the read error if the connection failed.
+// It briefly sets and then clears the read deadline.
+func ProbeIdle(conn net.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(probeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	n, err := conn.Read(make([]byte, 1))
+	if n > 0 {
+		return ErrStaleConn
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		return ErrStaleConn
+	}
+	return err
+}
+
+// ProxyPool keeps spare connections to a proxy server dialed ahead of time,
+// so Client.Dial can skip connection setup. A proxy closes connections that
+// sit in the handshake phase for too long, so every spare is checked with
+// ProbeIdle before use and dropped when stale. A pool must only be shared
+// by Clients of the same proxy address.
+type ProxyPool struct {
+	// MaxIdle is the number of spare connections to keep.
+	MaxIdle int
+	// MaxIdleTime drops spares older than this, e.g. shorter than the proxy's
+	// handshake timeout. Zero keeps them until they fail the probe.
+	MaxIdleTime time.Duration
+
+	mu      sync.Mutex
+	idle    []pooledConn
+	dialing int
+	closed  bool
+	clock   clock
+}
+
+type pooledConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// get returns a live spare connection, newest first, or nil.
+func (p *ProxyPool) get() net.Conn {
+	for {
+		p.mu.Lock()
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if p.MaxIdleTime > 0 && timeNow(p.clock).Sub(pc.since) > p.MaxIdleTime {
+			pc.conn.Close()
+			continue
+		}
+		if err := ProbeIdle(pc.conn); err != nil {
+			pc.conn.Close()
+			continue
+		}
+		return pc.conn
+	}
+}
+
+// fill dials until the pool holds MaxIdle spares. Spares are dialed
+// without a deadline, as they do not belong to any caller.
+func (p *ProxyPool) fill(dial func(ctx context.Context) (net.Conn, error)) {
+	for {
+		p.mu.Lock()
+		if p.closed || len(p.idle)+p.dialing >= p.MaxIdle {
+			p.mu.Unlock()
+			return
+		}
+		p.dialing++
+		p.mu.Unlock()
+
+		conn, err := dial(context.Background())
+
+		p.mu.Lock()
+		p.dialing--
+		if err != nil || p.closed {
+			p.mu.Unlock()
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		p.idle = append(p.idle, pooledConn{conn: conn, since: timeNow(p.clock)})
+		p.mu.Unlock()
+	}
+}
+
+// Close closes the spare connections and stops refilling.
+func (p *ProxyPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, pc := range p.idle {
+		pc.conn.Close()
+	}
+	p.idle = nil
+	return nil
+}
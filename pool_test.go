@@ -0,0 +1,70 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProbeIdle(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	if err := ProbeIdle(client); err != nil {
+		t.Fatalf("should get error nil for a live connection but got %s", err)
+	}
+	server.Write([]byte{0})
+	time.Sleep(10 * time.Millisecond)
+	if err := ProbeIdle(client); err != ErrStaleConn {
+		t.Fatalf("should get error %s for unexpected data but got %v", ErrStaleConn, err)
+	}
+
+	client, server = tcpPair(t)
+	defer client.Close()
+	server.Close()
+	time.Sleep(10 * time.Millisecond)
+	if err := ProbeIdle(client); err != ErrStaleConn {
+		t.Fatalf("should get error %s for a closed connection but got %v", ErrStaleConn, err)
+	}
+}
+
+func TestClientPool(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth}}
+	accepted := make(chan net.Conn, 8)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	pool := &ProxyPool{MaxIdle: 1}
+	defer pool.Close()
+	client := Client{ProxyAddress: l.Addr().String(), Pool: pool}
+	pool.fill(client.dialProxy)
+	spare := <-accepted
+
+	// A spare the proxy closed is skipped in favor of a fresh connection.
+	spare.Close()
+	time.Sleep(10 * time.Millisecond)
+	go func() {
+		conn := <-accepted
+		if _, err := server.auth(conn, &Session{config: server.Config}); err != nil {
+			return
+		}
+		NewClientRequestMessage(conn)
+		WriteRequestSuccessMessage(conn, net.IP{127, 0, 0, 1}, 1080)
+	}()
+	conn, err := client.Dial("tcp", "example.com:80")
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,64 @@
+package socks5
+
+// PortClass is a built-in traffic class of TCP sessions by destination
+// port, shaped by Config.PortClassLimits.
+type PortClass int
+
+const (
+	// PortClassBulk is every port of neither other class.
+	PortClassBulk PortClass = iota
+	// PortClassInteractive is SSH (22) and RDP (3389).
+	PortClassInteractive
+	// PortClassWeb is HTTP (80) and HTTPS (443).
+	PortClassWeb
+
+	numPortClasses
+)
+
+var portClassNames = [numPortClasses]string{
+	PortClassBulk:        "bulk",
+	PortClassInteractive: "interactive",
+	PortClassWeb:         "web",
+}
+
+func (c PortClass) String() string {
+	if c < 0 || c >= numPortClasses {
+		return "unknown"
+	}
+	return portClassNames[c]
+}
+
+// portClass returns the class of sessions to port.
+func portClass(port uint16) PortClass {
+	switch port {
+	case 22, 3389:
+		return PortClassInteractive
+	case 80, 443:
+		return PortClassWeb
+	default:
+		return PortClassBulk
+	}
+}
+
+// PortClassLimits caps the relay throughput of the TCP sessions of each
+// PortClass, both directions together, in bytes per second, without
+// writing rules. Sessions of a class share its cap and take turns like
+// under Config.BandwidthLimit, which still applies to all of them. Zero
+// means no limit for the class.
+type PortClassLimits struct {
+	Interactive int64 `json:"interactive"`
+	Web         int64 `json:"web"`
+	Bulk        int64 `json:"bulk"`
+}
+
+// rate returns the cap of class.
+func (l *PortClassLimits) rate(class PortClass) int64 {
+	switch class {
+	case PortClassInteractive:
+		return l.Interactive
+	case PortClassWeb:
+		return l.Web
+	default:
+		return l.Bulk
+	}
+}
@@ -0,0 +1,43 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPortClass(t *testing.T) {
+	tests := map[uint16]PortClass{22: PortClassInteractive, 3389: PortClassInteractive, 80: PortClassWeb, 443: PortClassWeb, 8080: PortClassBulk, 0: PortClassBulk}
+	for port, want := range tests {
+		if got := portClass(port); got != want {
+			t.Fatalf("port %d: should get class %s but got %s", port, want, got)
+		}
+	}
+}
+
+func TestPortClassLimits(t *testing.T) {
+	clock := newFakeClock()
+	server := SOCKS5Server{Config: &Config{PortClassLimits: PortClassLimits{Web: 100}}}
+	for i := range server.classLimiters {
+		server.classLimiters[i].clock = clock
+	}
+
+	// 50 bytes at 100 bytes per second book the web class for half a second
+	if n, err := server.copy(io.Discard, strings.NewReader(strings.Repeat("x", 50)), server.Config, 0, PortClassWeb); n != 50 || err != nil {
+		t.Fatalf("should copy 50 bytes but got %d, %v", n, err)
+	}
+	if next := server.classLimiters[PortClassWeb].next; !next.Equal(clock.Now().Add(500 * time.Millisecond)) {
+		t.Fatalf("should book the web class until %s but got %s", clock.Now().Add(500*time.Millisecond), next)
+	}
+
+	// The bulk class has no cap
+	var buf bytes.Buffer
+	if n, err := server.copy(&buf, strings.NewReader("bulk"), server.Config, 0, PortClassBulk); n != 4 || err != nil {
+		t.Fatalf("should copy 4 bytes but got %d, %v", n, err)
+	}
+	if next := server.classLimiters[PortClassBulk].next; !next.IsZero() {
+		t.Fatalf("should not pace the bulk class but got %s", next)
+	}
+}
@@ -0,0 +1,218 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PortForward tunnels a local port to one fixed target through a SOCKS5
+// server, like ssh -L: every accepted connection, and every UDP source,
+// reaches Target through Client.
+type PortForward struct {
+	Client *Client
+	// Target is the host:port connections and datagrams are forwarded to.
+	// A domain is resolved by the proxy unless Client.ResolveLocally.
+	Target string
+	// UDPIdleTimeout ends the association of a UDP source that exchanged
+	// nothing for this long, 2 minutes by default.
+	UDPIdleTimeout time.Duration
+}
+
+const defaultUDPIdleTimeout = 2 * time.Minute
+
+// ServeTCP accepts connections on listener and tunnels each to Target until
+// listener is closed.
+func (f *PortForward) ServeTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go f.forwardTCP(conn)
+	}
+}
+
+func (f *PortForward) forwardTCP(conn net.Conn) {
+	defer conn.Close()
+	target, err := f.Client.Dial("tcp", f.Target)
+	if err != nil {
+		logPrintln("port forward to", f.Target, "failure:", err)
+		return
+	}
+	defer target.Close()
+
+	done := make(chan struct{})
+	go func() {
+		pipe(target, conn)
+		close(done)
+	}()
+	pipe(conn, target)
+	<-done
+}
+
+// pipe copies src to dst, then half-closes dst or, if it cannot, closes
+// both so the other direction ends too.
+func pipe(dst, src net.Conn) {
+	_, err := io.Copy(dst, src)
+	if cw, ok := dst.(closeWriter); ok && err == nil && cw.CloseWrite() == nil {
+		return
+	}
+	dst.Close()
+	src.Close()
+}
+
+// maxPendingDatagrams bounds the datagrams of a UDP source queued while its
+// association is set up; more are dropped.
+const maxPendingDatagrams = 16
+
+// ServeUDP relays datagrams received on conn to Target, through a UDP
+// association per source address, and the replies back to the source, until
+// conn is closed. Associations are set up in the background, so a slow
+// proxy does not hold up the datagrams of other sources.
+func (f *PortForward) ServeUDP(conn net.PacketConn) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var mu sync.Mutex
+	flows := make(map[string]*udpFlow)
+	closed := false
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		closed = true
+		for _, flow := range flows {
+			flow.close()
+		}
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		key := from.String()
+		mu.Lock()
+		flow := flows[key]
+		if flow == nil {
+			flow = &udpFlow{target: domainAddr(f.Target)}
+			flows[key] = flow
+			go func() {
+				association, err := f.Client.ListenPacket(ctx)
+				if err != nil {
+					logPrintln("port forward to", f.Target, "failure:", err)
+				}
+				mu.Lock()
+				if err == nil && closed {
+					association.Close()
+					err = net.ErrClosed
+				}
+				if err != nil {
+					delete(flows, key)
+					mu.Unlock()
+					return
+				}
+				mu.Unlock()
+				if !flow.start(association) {
+					return
+				}
+				f.relayUDPFlow(conn, from, flow)
+				mu.Lock()
+				delete(flows, key)
+				mu.Unlock()
+			}()
+		}
+		mu.Unlock()
+		flow.touch()
+		flow.send(buf[:n])
+	}
+}
+
+// udpFlow is the association forwarding the datagrams of one UDP source.
+type udpFlow struct {
+	target net.Addr
+	// last is when the flow last carried a datagram, in Unix nanoseconds.
+	last atomic.Int64
+
+	mu sync.Mutex
+	// association is nil while it is being set up, and pending holds the
+	// datagrams to send once it is.
+	association *UDPAssociation
+	pending     [][]byte
+	closed      bool
+}
+
+func (f *udpFlow) touch() {
+	f.last.Store(time.Now().UnixNano())
+}
+
+// send sends b through the association, or queues it until start.
+func (f *udpFlow) send(b []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.association == nil {
+		if len(f.pending) < maxPendingDatagrams {
+			f.pending = append(f.pending, append([]byte(nil), b...))
+		}
+		return
+	}
+	f.association.WriteTo(b, f.target)
+}
+
+// start sends the queued datagrams through association and then the
+// datagrams to come. It reports false, closing association, if the flow was
+// closed meanwhile.
+func (f *udpFlow) start(association *UDPAssociation) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		association.Close()
+		return false
+	}
+	for _, b := range f.pending {
+		association.WriteTo(b, f.target)
+	}
+	f.association, f.pending = association, nil
+	return true
+}
+
+func (f *udpFlow) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	if f.association != nil {
+		f.association.Close()
+	}
+}
+
+// relayUDPFlow relays replies from the association of flow to source until
+// the flow is idle for UDPIdleTimeout or the association fails, and then
+// closes it.
+func (f *PortForward) relayUDPFlow(conn net.PacketConn, source net.Addr, flow *udpFlow) {
+	defer flow.association.Close()
+	idle := f.UDPIdleTimeout
+	if idle <= 0 {
+		idle = defaultUDPIdleTimeout
+	}
+	buf := make([]byte, 65535)
+	for {
+		flow.association.SetReadDeadline(time.Unix(0, flow.last.Load()).Add(idle))
+		n, _, err := flow.association.ReadFrom(buf)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			if time.Since(time.Unix(0, flow.last.Load())) >= idle {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			return
+		}
+		flow.touch()
+		conn.WriteTo(buf[:n], source)
+	}
+}
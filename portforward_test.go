@@ -0,0 +1,79 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPortForwardTCP(t *testing.T) {
+	server := SOCKS5Server{Config: &Config{}}
+	proxyAddress, _ := startServer(t, &server)
+	defer server.Shutdown(context.Background())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	forward := PortForward{Client: &Client{ProxyAddress: proxyAddress}, Target: echoServer(t)}
+	go forward.ServeTCP(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("should echo ping but got %q and %v", buf, err)
+	}
+}
+
+func TestPortForwardUDP(t *testing.T) {
+	server := SOCKS5Server{Config: &Config{EnableUDP: true, UDPBindIP: net.IP{127, 0, 0, 1}}}
+	proxyAddress, _ := startServer(t, &server)
+	defer server.Shutdown(context.Background())
+
+	local, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	forward := PortForward{
+		Client:         &Client{ProxyAddress: proxyAddress},
+		Target:         udpEchoServer(t).String(),
+		UDPIdleTimeout: 200 * time.Millisecond,
+	}
+	go forward.ServeUDP(local)
+
+	conn, err := net.Dial("udp", local.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 16)
+	for _, data := range []string{"ping", "pong"} {
+		conn.Write([]byte(data))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil || string(buf[:n]) != data {
+			t.Fatalf("should echo %s but got %q and %v", data, buf[:n], err)
+		}
+	}
+	if sessions := len(server.Sessions()); sessions != 1 {
+		t.Fatalf("should reuse 1 association but got %d", sessions)
+	}
+
+	// The idle flow's association ends
+	deadline := time.Now().Add(5 * time.Second)
+	for len(server.Sessions()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("idle association should end")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,177 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Progress is a snapshot of a relayed TCP session, reported to
+// Config.ProgressHook while the session runs and once when it ends.
+type Progress struct {
+	SessionID string
+	Username  string
+	// Target is the requested host:port.
+	Target string
+	Labels []string
+	Start  time.Time
+	// Sent counts bytes from the client to the target, Received the other way.
+	Sent     int64
+	Received int64
+	// Done is set on the final report, along with Termination.
+	Done        bool
+	Termination TerminationReason
+}
+
+// SessionRecord describes a finished TCP session for a SessionRecorder.
+type SessionRecord struct {
+	SessionID  string
+	ClientAddr string
+	Username   string
+	Target     string
+	Labels     []string
+	Start      time.Time
+	End        time.Time
+	Sent       int64
+	Received   int64
+	// Termination tells why the session ended.
+	Termination TerminationReason
+}
+
+// SessionRecorder stores finished-session records, e.g. SQLRecorder.
+type SessionRecorder interface {
+	Record(record SessionRecord)
+}
+
+// progressMeter counts the bytes of a session and reports them every
+// interval and every step bytes, and records the session when it ends.
+type progressMeter struct {
+	hook       func(Progress)
+	recorder   SessionRecorder
+	clock      clock
+	clientAddr string
+	progress   Progress
+	step       int64
+
+	sent     atomic.Int64
+	received atomic.Int64
+	next     atomic.Int64
+	mu       sync.Mutex // serializes hook calls
+	stopped  chan struct{}
+}
+
+func (s *SOCKS5Server) newProgressMeter(conn io.ReadWriter, authCtx *AuthContext, target string) *progressMeter {
+	config := s.sessionConfig(authCtx)
+	m := progressMeter{
+		hook:     config.ProgressHook,
+		recorder: config.Recorder,
+		clock:    s.clock,
+		progress: Progress{
+			SessionID: authCtx.SessionID,
+			Username:  authCtx.Username,
+			Target:    target,
+			Labels:    append([]string(nil), authCtx.Labels...),
+			Start:     timeNow(s.clock),
+		},
+		step:    config.ProgressBytes,
+		stopped: make(chan struct{}),
+	}
+	if len(config.Plugins) > 0 {
+		m.recorder = pluginRecorder{config.Recorder, config.Plugins}
+	}
+	if c, ok := conn.(net.Conn); ok {
+		m.clientAddr = c.RemoteAddr().String()
+	}
+	if m.hook == nil {
+		m.step = 0
+	}
+	m.next.Store(m.step)
+	if m.hook != nil && config.ProgressInterval > 0 {
+		go m.tick(config.ProgressInterval)
+	}
+	return &m
+}
+
+func (m *progressMeter) tick(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.report(false, TerminationNone)
+		case <-m.stopped:
+			return
+		}
+	}
+}
+
+func (m *progressMeter) add(counter *atomic.Int64, n int) {
+	if n <= 0 {
+		return
+	}
+	counter.Add(int64(n))
+	if m.step <= 0 {
+		return
+	}
+	total := m.sent.Load() + m.received.Load()
+	for next := m.next.Load(); total >= next; next = m.next.Load() {
+		if m.next.CompareAndSwap(next, total-total%m.step+m.step) {
+			m.report(false, TerminationNone)
+			return
+		}
+	}
+}
+
+func (m *progressMeter) report(done bool, reason TerminationReason) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	progress := m.progress
+	progress.Sent = m.sent.Load()
+	progress.Received = m.received.Load()
+	progress.Done = done
+	progress.Termination = reason
+	m.hook(progress)
+}
+
+// wrap counts what is read from conn as sent and from target as received.
+func (m *progressMeter) wrap(conn io.ReadWriter, target io.ReadWriteCloser) (io.ReadWriter, io.ReadWriteCloser) {
+	client := &readerConn{Reader: countingReader{conn, func(n int) { m.add(&m.sent, n) }}, conn: conn}
+	server := &readerConn{Reader: countingReader{target, func(n int) { m.add(&m.received, n) }}, conn: target}
+	return client, server
+}
+
+// stop ends periodic reports, sends the final one and records the session
+// with the termination reason of tally.
+func (m *progressMeter) stop(tally *relayTally) {
+	close(m.stopped)
+	if m.hook != nil {
+		m.report(true, tally.reason)
+	}
+	if m.recorder != nil {
+		m.recorder.Record(SessionRecord{
+			SessionID:   m.progress.SessionID,
+			ClientAddr:  m.clientAddr,
+			Username:    m.progress.Username,
+			Target:      m.progress.Target,
+			Labels:      m.progress.Labels,
+			Start:       m.progress.Start,
+			End:         timeNow(m.clock),
+			Sent:        m.sent.Load(),
+			Received:    m.received.Load(),
+			Termination: tally.reason,
+		})
+	}
+}
+
+type countingReader struct {
+	r   io.Reader
+	add func(n int)
+}
+
+func (c countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.add(n)
+	return n, err
+}
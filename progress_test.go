@@ -0,0 +1,59 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestProgressHook(t *testing.T) {
+	var mu sync.Mutex
+	var reports []Progress
+	server := SOCKS5Server{Config: &Config{
+		ProgressHook: func(progress Progress) {
+			mu.Lock()
+			reports = append(reports, progress)
+			mu.Unlock()
+		},
+		ProgressBytes: 8,
+	}}
+	host, portStr, _ := net.SplitHostPort(echoServer(t))
+	port, _ := strconv.Atoi(portStr)
+
+	clientConn, serverConn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		defer serverConn.Close()
+		done <- server.request(serverConn, &AuthContext{SessionID: "s1", Username: "alice"})
+	}()
+	if err := WriteClientRequestMessage(clientConn, CmdConnect, host, uint16(port)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewServerReplyMessage(clientConn); err != nil {
+		t.Fatalf("should read reply but got %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		clientConn.Write([]byte("ping"))
+		io.ReadFull(clientConn, make([]byte, 4))
+	}
+	clientConn.Close()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reports) < 2 {
+		t.Fatalf("should get a progress report and a final one but got %+v", reports)
+	}
+	if reports[0].Done || reports[0].Sent+reports[0].Received < 8 {
+		t.Fatalf("first report should come after 8 bytes but got %+v", reports[0])
+	}
+	final := reports[len(reports)-1]
+	if !final.Done || final.Sent != 8 || final.Received != 8 || final.SessionID != "s1" || final.Username != "alice" {
+		t.Fatalf("unexpected final report %+v", final)
+	}
+	if final.Target != net.JoinHostPort(host, portStr) {
+		t.Fatalf("should report target %s but got %s", net.JoinHostPort(host, portStr), final.Target)
+	}
+}
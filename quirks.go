@@ -0,0 +1,18 @@
+package socks5
+
+// Quirks works around bugs of known SOCKS5 clients. They loosen the
+// protocol, so set them on a server of their own, listening on a separate
+// port for those clients, to stay strict with everyone else.
+type Quirks struct {
+	// AnyPasswordVersion accepts username/password sub-negotiations whose
+	// VER is not 1, e.g. 4 or 5, and replies with the client's VER.
+	AnyPasswordVersion bool `json:"any_password_version"`
+	// UDPWithoutRSV accepts UDP datagrams whose header starts at FRAG,
+	// lacking the two RSV bytes, and sends such an association's replies
+	// without them too.
+	UDPWithoutRSV bool `json:"udp_without_rsv"`
+	// EchoRequestAddress sends the request's DST.ADDR and DST.PORT as
+	// BND.ADDR and BND.PORT of CONNECT replies, for clients that check them.
+	// Domain targets get the address the server connected to.
+	EchoRequestAddress bool `json:"echo_request_address"`
+}
@@ -0,0 +1,98 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestQuirksAnyPasswordVersion(t *testing.T) {
+	for _, quirk := range []bool{false, true} {
+		server := SOCKS5Server{Config: &Config{
+			AuthMethod:      MethodPassword,
+			PasswordChecker: func(username, password string) bool { return true },
+			Quirks:          Quirks{AnyPasswordVersion: quirk},
+		}}
+		clientConn, serverConn := tcpPair(t)
+		defer clientConn.Close()
+		go server.ServeConn(serverConn)
+		clientConn.Write([]byte{SOCKS5Version, 1, byte(MethodPassword)})
+		io.ReadFull(clientConn, make([]byte, 2))
+		clientConn.Write(append(append([]byte{SOCKS5Version, 5}, "alice"...), append([]byte{6}, "secret"...)...))
+
+		reply := make([]byte, 2)
+		_, err := io.ReadFull(clientConn, reply)
+		if !quirk {
+			if err == nil {
+				t.Fatalf("should drop a VER 5 sub-negotiation but got reply % x", reply)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(reply, []byte{SOCKS5Version, PasswordAuthSuccess}) {
+			t.Fatalf("should get reply 05 00 but got % x, %v", reply, err)
+		}
+	}
+}
+
+func TestQuirksUDPWithoutRSV(t *testing.T) {
+	echo := udpEchoServer(t)
+	server := SOCKS5Server{Config: &Config{
+		EnableUDP: true,
+		UDPBindIP: net.IP{127, 0, 0, 1},
+		Quirks:    Quirks{UDPWithoutRSV: true},
+	}}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		defer serverConn.Close()
+		server.request(serverConn, &AuthContext{})
+	}()
+	clientConn.Write([]byte{SOCKS5Version, CmdUDP, ReservedField, TypeIPv4, 0, 0, 0, 0, 0, 0})
+	reply, err := NewServerReplyMessage(clientConn)
+	if err != nil {
+		t.Fatalf("should read reply but got %s", err)
+	}
+	udpConn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: int(reply.Port)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	request := UDPDatagram{AddrType: TypeIPv4, TargetIP: "127.0.0.1", Port: uint16(echo.Port), Data: []byte("ping")}
+	udpConn.Write(request.Bytes()[2:])
+
+	udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := udpConn.Read(buf)
+	if err != nil {
+		t.Fatalf("should receive echo but got %s", err)
+	}
+	response, err := parseUDPDatagram(buf[:n])
+	if err != nil || !bytes.Equal(response.Data, []byte("ping")) {
+		t.Fatalf("should get a reply without RSV but got % x", buf[:n])
+	}
+}
+
+func TestQuirksEchoRequestAddress(t *testing.T) {
+	server := SOCKS5Server{Config: &Config{
+		AuthMethod: MethodNoAuth,
+		Quirks:     Quirks{EchoRequestAddress: true},
+	}}
+	host, portStr, _ := net.SplitHostPort(echoServer(t))
+	port, _ := strconv.Atoi(portStr)
+	clientConn, serverConn := tcpPair(t)
+	defer clientConn.Close()
+	go server.ServeConn(serverConn)
+	clientConn.Write([]byte{SOCKS5Version, 1, byte(MethodNoAuth)})
+	io.ReadFull(clientConn, make([]byte, 2))
+	WriteClientRequestMessage(clientConn, CmdConnect, host, uint16(port))
+	reply, err := NewServerReplyMessage(clientConn)
+	if err != nil {
+		t.Fatalf("should read reply but got %s", err)
+	}
+	if reply.BindIP != host || reply.Port != uint16(port) {
+		t.Fatalf("should echo %s:%d but got %s:%d", host, port, reply.BindIP, reply.Port)
+	}
+}
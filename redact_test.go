@@ -0,0 +1,74 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRedaction(t *testing.T) {
+	var none *Redaction
+	if got := none.Address("10.0.0.1:443"); got != "10.0.0.1:443" {
+		t.Fatalf("nil redaction should keep the address but got %q", got)
+	}
+
+	r := &Redaction{HashUsernames: true, Salt: "s", HostLabels: 2, OmitIPs: true}
+	tests := []struct{ got, want string }{
+		{r.Address("www.mail.example.com:443"), "*.example.com:443"},
+		{r.Address("example.com:443"), "example.com:443"},
+		{r.Address("10.0.0.1:443"), "-:443"},
+		{r.Address("[2001:db8::1]:443"), "-:443"},
+		{r.Host("10.0.0.1"), "-"},
+		{r.Error(errors.New("dial tcp 10.0.0.1:443: connection refused"), "10.0.0.1:443"), "dial tcp -:443: connection refused"},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("should get %q but got %q", test.want, test.got)
+		}
+	}
+
+	alice := r.Username("alice")
+	if alice == "alice" || alice != r.Username("alice") || alice == r.Username("bob") {
+		t.Fatalf("usernames should hash stably and distinctly but got %q", alice)
+	}
+
+	r.OmitPorts = true
+	record := r.Record(SessionRecord{ClientAddr: "192.0.2.1:5000", Username: "alice", Target: "a.b.example.com:80"})
+	if record.ClientAddr != "-" || record.Username != alice || record.Target != "*.example.com" {
+		t.Fatalf("unexpected redacted record %+v", record)
+	}
+}
+
+func TestRedactionCoversRequestPath(t *testing.T) {
+	FlushLogs()
+	var logged bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logged)
+	stdout := os.Stdout
+	defer func() { os.Stdout = stdout }()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+
+	server := SOCKS5Server{Config: &Config{RejectDomainTargets: true, LogRedaction: &Redaction{HostLabels: 1}}}
+	if err := initConfig(server.Config); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	WriteClientRequestMessage(&buf, CmdConnect, "secret.internal.example", 80)
+	if err := server.request(&buf, &AuthContext{}); err != ErrAddressTypeNotSupported {
+		t.Fatalf("should get error %s but got %v", ErrAddressTypeNotSupported, err)
+	}
+	FlushLogs()
+	w.Close()
+	printed, _ := io.ReadAll(r)
+	if out := logged.String() + string(printed); strings.Contains(out, "secret") || !strings.Contains(out, "*.example") {
+		t.Fatalf("should log the redacted host only but got %q", out)
+	}
+}
@@ -0,0 +1,242 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrBadReputation        = errors.New("destination IP has a bad reputation")
+	ErrReputationLookup     = errors.New("destination IP reputation unknown")
+	ErrInvalidBlocklistLine = errors.New("invalid IP blocklist line")
+)
+
+// ReputationProvider rates destination IPs, e.g. from a local blocklist
+// file (IPBlocklist) or a threat intelligence API (ReputationFunc).
+type ReputationProvider interface {
+	// Lookup reports whether ip is known to be malicious, and why. ctx
+	// ends with the dial the lookup is for.
+	Lookup(ctx context.Context, ip net.IP) (bad bool, reason string, err error)
+}
+
+// ReputationFunc adapts a function, e.g. a threat intelligence API client,
+// to a ReputationProvider.
+type ReputationFunc func(ctx context.Context, ip net.IP) (bad bool, reason string, err error)
+
+func (f ReputationFunc) Lookup(ctx context.Context, ip net.IP) (bool, string, error) {
+	return f(ctx, ip)
+}
+
+// Reputation refuses connections to destination IPs its Provider rates as
+// malicious, with ReplyConnectionNotAllowed. It checks every address the
+// server connects to, including those of domain targets, but not the
+// targets of Upstream servers, which resolve domains themselves, nor UDP
+// datagrams. Behind Config.NAT64Prefix, the IPv4 address of the target is
+// checked. Lookups count against Config.DialTimeout; one that does not
+// finish in time failed.
+type Reputation struct {
+	Provider ReputationProvider
+	// CacheTTL is how long verdicts are cached, default ten minutes.
+	CacheTTL time.Duration
+	// FailClosed refuses connections whose IP the Provider failed to rate.
+	// By default they are allowed.
+	FailClosed bool
+	// MonitorOnly logs and counts connections to malicious IPs without
+	// refusing them.
+	MonitorOnly bool
+
+	clock clock
+	mu    sync.Mutex
+	cache map[string]reputationVerdict
+}
+
+type reputationVerdict struct {
+	bad     bool
+	reason  string
+	expires time.Time
+}
+
+// maxReputationCache bounds the verdicts cached; a full cache is cleared.
+const maxReputationCache = 100000
+
+// lookup returns the cached or fresh verdict on ip, giving up when ctx
+// ends even if the Provider ignores it.
+func (r *Reputation) lookup(ctx context.Context, ip net.IP) (bool, string, error) {
+	key := ip.String()
+	now := timeNow(r.clock)
+	r.mu.Lock()
+	verdict, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok && now.Before(verdict.expires) {
+		return verdict.bad, verdict.reason, nil
+	}
+
+	type result struct {
+		bad    bool
+		reason string
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		bad, reason, err := r.Provider.Lookup(ctx, ip)
+		done <- result{bad, reason, err}
+	}()
+	var bad bool
+	var reason string
+	select {
+	case res := <-done:
+		if res.err != nil {
+			return false, "", res.err
+		}
+		bad, reason = res.bad, res.reason
+	case <-ctx.Done():
+		return false, "", ctx.Err()
+	}
+	ttl := r.CacheTTL
+	if ttl <= 0 {
+		ttl = 10 * time.Minute
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cache == nil || len(r.cache) >= maxReputationCache {
+		r.cache = make(map[string]reputationVerdict)
+	}
+	r.cache[key] = reputationVerdict{bad: bad, reason: reason, expires: now.Add(ttl)}
+	return bad, reason, nil
+}
+
+// reputationControl returns a net.Dialer Control function checking the IP
+// about to be connected to for the session id against the Reputation of
+// config, by deadline if not zero.
+func (s *SOCKS5Server) reputationControl(config *Config, id string, deadline time.Time) func(network, address string, c syscall.RawConn) error {
+	r := config.Reputation
+	return func(network, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil
+		}
+		if prefix := config.NAT64Prefix; prefix != nil {
+			// Rate the target, not its synthesized NAT64 address
+			if ip4 := extractIPv4(prefix, ip); ip4 != nil {
+				ip, host = ip4, ip4.String()
+			}
+		}
+		ctx := context.Background()
+		if !deadline.IsZero() {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+		}
+		redacted := config.LogRedaction.Host(host)
+		bad, reason, err := r.lookup(ctx, ip)
+		if err != nil {
+			logSession(id, "reputation lookup for", redacted, "failure:", err)
+			if r.FailClosed {
+				return fmt.Errorf("%w: %v", ErrReputationLookup, err)
+			}
+			return nil
+		}
+		if !bad {
+			return nil
+		}
+		s.stats.reputationHits.Add(1)
+		if r.MonitorOnly {
+			logSession(id, "connecting to", redacted, "with a bad reputation:", reason)
+			return nil
+		}
+		logSession(id, "refusing to connect to", redacted, "with a bad reputation:", reason)
+		return fmt.Errorf("%w: %s", ErrBadReputation, reason)
+	}
+}
+
+// IPBlocklist is a ReputationProvider rating the IPs of its networks as
+// malicious. Lookups take one map access per prefix length in the list.
+type IPBlocklist struct {
+	// networks maps each prefix length to the networks of that length by
+	// their masked address; lengths lists the lengths, longest first.
+	networks map[blocklistPrefix]map[string]*net.IPNet
+	lengths  []blocklistPrefix
+}
+
+type blocklistPrefix struct {
+	ones, bits int
+}
+
+func (l *IPBlocklist) add(ipNet *net.IPNet) {
+	if ip4 := ipNet.IP.To4(); ip4 != nil && len(ipNet.Mask) == net.IPv6len {
+		ones, _ := ipNet.Mask.Size()
+		ipNet = &net.IPNet{IP: ip4, Mask: net.CIDRMask(ones-96, 32)}
+	}
+	ones, bits := ipNet.Mask.Size()
+	prefix := blocklistPrefix{ones, bits}
+	if l.networks == nil {
+		l.networks = make(map[blocklistPrefix]map[string]*net.IPNet)
+	}
+	networks, ok := l.networks[prefix]
+	if !ok {
+		networks = make(map[string]*net.IPNet)
+		l.networks[prefix] = networks
+		l.lengths = append(l.lengths, prefix)
+		sort.Slice(l.lengths, func(i, j int) bool { return l.lengths[i].ones > l.lengths[j].ones })
+	}
+	networks[string(ipNet.IP.Mask(ipNet.Mask))] = ipNet
+}
+
+// LoadIPBlocklist reads a blocklist file of one IP or CIDR network per
+// line, as published by most IP reputation feeds. Text after a '#' or ';'
+// is a comment.
+func LoadIPBlocklist(path string) (*IPBlocklist, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var list IPBlocklist
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		ipNet, err := parseNetwork(line)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s:%d: %q", ErrInvalidBlocklistLine, path, n, line)
+		}
+		list.add(ipNet)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+func (l *IPBlocklist) Lookup(ctx context.Context, ip net.IP) (bool, string, error) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, prefix := range l.lengths {
+		if len(ip)*8 != prefix.bits {
+			continue
+		}
+		if ipNet, ok := l.networks[prefix][string(ip.Mask(net.CIDRMask(prefix.ones, prefix.bits)))]; ok {
+			return true, "listed in " + ipNet.String(), nil
+		}
+	}
+	return false, "", nil
+}
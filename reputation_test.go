@@ -0,0 +1,113 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadIPBlocklist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	os.WriteFile(path, []byte("# feed\n192.0.2.1\n198.51.100.0/24 ; botnet\n\n2001:db8::/32\n::ffff:203.0.113.0/120\n"), 0o600)
+	list, err := LoadIPBlocklist(path)
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	for ip, want := range map[string]bool{"192.0.2.1": true, "192.0.2.2": false, "198.51.100.7": true, "2001:db8::1": true, "127.0.0.1": false, "203.0.113.9": true, "2001:db9::1": false} {
+		if bad, _, _ := list.Lookup(context.Background(), net.ParseIP(ip)); bad != want {
+			t.Fatalf("%s: should get %v but got %v", ip, want, bad)
+		}
+	}
+
+	os.WriteFile(path, []byte("not-an-ip\n"), 0o600)
+	if _, err := LoadIPBlocklist(path); !errors.Is(err, ErrInvalidBlocklistLine) {
+		t.Fatalf("should get error %s but got %v", ErrInvalidBlocklistLine, err)
+	}
+}
+
+func TestReputation(t *testing.T) {
+	lookups := 0
+	var lookupErr error
+	reputation := &Reputation{Provider: ReputationFunc(func(ctx context.Context, ip net.IP) (bool, string, error) {
+		lookups++
+		return ip.IsLoopback(), "test feed", lookupErr
+	})}
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth, Reputation: reputation}}
+	address, _ := startServer(t, &server)
+	defer server.Shutdown(context.Background())
+	client := Client{ProxyAddress: address}
+	target := echoServer(t)
+
+	if _, err := client.Dial("tcp", target); err == nil {
+		t.Fatal("should refuse to connect to a malicious IP")
+	}
+	if _, err := client.Dial("tcp", target); err == nil {
+		t.Fatal("should refuse to connect to a malicious IP")
+	}
+	if lookups != 1 {
+		t.Fatalf("should cache the verdict but looked up %d times", lookups)
+	}
+	if hits := server.Stats().ReputationHits; hits != 2 {
+		t.Fatalf("should count 2 hits but got %d", hits)
+	}
+
+	reputation.MonitorOnly = true
+	conn, err := client.Dial("tcp", target)
+	if err != nil {
+		t.Fatalf("should only flag in monitor mode but got %s", err)
+	}
+	conn.Close()
+
+	// Lookup failures fail open unless FailClosed
+	reputation.MonitorOnly = false
+	reputation.cache = nil
+	lookupErr = errors.New("feed down")
+	conn, err = client.Dial("tcp", target)
+	if err != nil {
+		t.Fatalf("should fail open but got %s", err)
+	}
+	conn.Close()
+	reputation.FailClosed = true
+	if _, err := client.Dial("tcp", target); err == nil {
+		t.Fatal("should fail closed")
+	}
+}
+
+func TestReputationLookupTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	reputation := &Reputation{FailClosed: true, Provider: ReputationFunc(func(ctx context.Context, ip net.IP) (bool, string, error) {
+		// A provider ignoring ctx
+		<-release
+		return false, "", nil
+	})}
+	server := SOCKS5Server{Config: &Config{Reputation: reputation}}
+	start := time.Now()
+	if _, err := server.dial(echoServer(t), &AuthContext{}, 100*time.Millisecond, 0, 0, nil, false); !errors.Is(err, ErrReputationLookup) {
+		t.Fatalf("should get error %s but got %v", ErrReputationLookup, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("should give up with the dial timeout but took %s", elapsed)
+	}
+}
+
+func TestReputationNAT64(t *testing.T) {
+	var rated net.IP
+	reputation := &Reputation{Provider: ReputationFunc(func(ctx context.Context, ip net.IP) (bool, string, error) {
+		rated = ip
+		return true, "test feed", nil
+	})}
+	_, prefix, _ := net.ParseCIDR("64:ff9b::/96")
+	server := SOCKS5Server{Config: &Config{Reputation: reputation, NAT64Prefix: prefix}}
+	control := server.reputationControl(server.Config, "", time.Time{})
+	if err := control("tcp6", "[64:ff9b::c000:201]:443", nil); !errors.Is(err, ErrBadReputation) {
+		t.Fatalf("should get error %s but got %v", ErrBadReputation, err)
+	}
+	if !rated.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Fatalf("should rate 192.0.2.1 but rated %s", rated)
+	}
+}
@@ -1,9 +1,7 @@
 package socks5
 
 import (
-	"fmt"
 	"io"
-	"log"
 	"net"
 )
 
@@ -50,7 +48,25 @@ const (
 	ReplyAddressTypeNotSupported
 )
 
+// ReplyHostConnectionLimit, from the range RFC 1928 leaves unassigned,
+// answers a request refused by Config.MaxConnsPerHost, so that clients and
+// logs can tell a full host from a policy refusal. Clients that do not know
+// it treat it as a general failure.
+const ReplyHostConnectionLimit ReplyType = 0x0A
+
 func NewClientRequestMessage(conn io.Reader) (*ClientRequestMessage, error) {
+	message, err := readClientRequestMessage(conn, true)
+	if err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// readClientRequestMessage reads a request, rejecting a non-zero RSV byte
+// only when strictRSV is set. A well-formed request with an unknown command
+// is read whole and returned along with ErrCommandNotSupported, so the
+// server can answer it.
+func readClientRequestMessage(conn io.Reader, strictRSV bool) (*ClientRequestMessage, error) {
 	// +----+-----+-------+------+----------+----------+
 	// |VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
 	// +----+-----+-------+------+----------+----------+
@@ -71,26 +87,25 @@ func NewClientRequestMessage(conn io.Reader) (*ClientRequestMessage, error) {
 	// Read version, command, reserved, address type
 	buf := make([]byte, 4)
 	if _, err := io.ReadFull(conn, buf); err != nil {
-		log.Println("read request message error", err)
+		if !closedByPeer(err) {
+			logPrintln("read request message error", err)
+		}
 		return nil, err
 	}
 	version, command, reserved, addrType := buf[0], buf[1], buf[2], buf[3]
 
 	// Check if the fields are valid
 	if version != SOCKS5Version {
-		log.Println(ErrVersionNotSupported, version)
+		logPrintln(ErrVersionNotSupported, version)
 		return nil, ErrVersionNotSupported
 	}
-	if command != CmdConnect && command != CmdBind && command != CmdUDP {
-		log.Println(ErrCommandNotSupported, command)
-		return nil, ErrCommandNotSupported
-	}
-	if reserved != ReservedField {
-		log.Println(ErrInvalidReservedField, reserved)
+	supported := command == CmdConnect || command == CmdBind || command == CmdUDP
+	if strictRSV && reserved != ReservedField {
+		logPrintln(ErrInvalidReservedField, reserved)
 		return nil, ErrInvalidReservedField
 	}
 	if addrType != TypeIPv4 && addrType != TypeIPv6 && addrType != TypeDomain {
-		log.Println(ErrAddressTypeNotSupported, addrType)
+		logPrintln(ErrAddressTypeNotSupported, addrType)
 		return nil, ErrAddressTypeNotSupported
 	}
 
@@ -105,14 +120,14 @@ func NewClientRequestMessage(conn io.Reader) (*ClientRequestMessage, error) {
 		fallthrough
 	case TypeIPv4:
 		if _, err := io.ReadFull(conn, buf); err != nil {
-			log.Println("read request message IP error", err)
+			logPrintln("read request message IP error", err)
 			return nil, err
 		}
 		ip := net.IP(buf)
 		message.TargetIP = ip.String()
 	case TypeDomain:
 		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
-			log.Println("read request message domain length error", err)
+			logPrintln("read request message domain length error", err)
 			return nil, err
 		}
 		domainLength := buf[0]
@@ -120,23 +135,32 @@ func NewClientRequestMessage(conn io.Reader) (*ClientRequestMessage, error) {
 			buf = make([]byte, domainLength)
 		}
 		if _, err := io.ReadFull(conn, buf[:domainLength]); err != nil {
-			log.Println("read request message domain error", err)
+			logPrintln("read request message domain error", err)
 			return nil, err
 		}
 		message.TargetIP = string(buf[:domainLength])
 	}
-	fmt.Println("message.Address", message.TargetIP)
 
 	// Read port number
 	if _, err := io.ReadFull(conn, buf[:PortLength]); err != nil {
 		return nil, err
 	}
-	message.Port = (uint16(buf[0]) << 8) + uint16(buf[1])
-	fmt.Println("message.Port", message.Port)
+	message.Port = readPort(buf)
+	if !supported {
+		return &message, ErrCommandNotSupported
+	}
 	return &message, nil
 }
 
+// WriteRequestSuccessMessage writes a success reply binding ip and port.
+// IPv4-mapped IPv6 addresses are written as IPv4.
 func WriteRequestSuccessMessage(conn io.Writer, ip net.IP, port uint16) error {
+	return writeRequestSuccess(conn, ip, port, false)
+}
+
+// writeRequestSuccess is WriteRequestSuccessMessage, writing IPv4-mapped
+// addresses as IPv6 if keepMapped.
+func writeRequestSuccess(conn io.Writer, ip net.IP, port uint16, keepMapped bool) error {
 	// +----+-----+-------+------+----------+----------+
 	// |VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
 	// +----+-----+-------+------+----------+----------+
@@ -150,41 +174,139 @@ func WriteRequestSuccessMessage(conn io.Writer, ip net.IP, port uint16) error {
 	// BND.PORT 服务绑定的端口DST.PORT
 
 	addressType := TypeIPv4
-	if len(ip) > IPv4Length {
+	if ip4 := ip.To4(); ip4 != nil && !(keepMapped && len(ip) == IPv6Length) {
+		ip = ip4
+	} else if len(ip) > IPv4Length {
 		if len(ip) != IPv6Length {
-			log.Println("invalid IP length:", len(ip), ",ip:", ip)
+			logPrintln("invalid IP length:", len(ip), ",ip:", ip)
 		}
 		addressType = TypeIPv6
 	}
 
-	// Write version, reply success, reserved, address type
-	_, err := conn.Write([]byte{SOCKS5Version, ReplySuccess, ReservedField, addressType})
+	// Write the whole reply at once, not one syscall per field
+	var buf [maxReplyLength]byte
+	b := append(buf[:0], SOCKS5Version, ReplySuccess, ReservedField, addressType)
+	b = append(b, ip...)
+	b = appendPort(b, port)
+	_, err := conn.Write(b)
 	if err != nil {
-		log.Println("write request success message error:", err)
-		return err
+		logPrintln("write request success message error:", err)
 	}
+	return err
+}
 
-	// Write bind IP(IPv4/IPv6)
-	if _, err := conn.Write(ip); err != nil {
-		log.Println("write request success message error:", err)
-		return err
+// isIPv4Mapped reports whether ip is an IPv4-mapped IPv6 address,
+// ::ffff:a.b.c.d, in its 16-byte form.
+func isIPv4Mapped(ip net.IP) bool {
+	return len(ip) == IPv6Length && ip.To4() != nil
+}
+
+// ipString formats ip, keeping the IPv6 form of IPv4-mapped addresses if
+// keepMapped, which net.IP.String prints as IPv4.
+func ipString(ip net.IP, keepMapped bool) string {
+	if keepMapped && isIPv4Mapped(ip) {
+		return "::ffff:" + ip.To4().String()
 	}
+	return ip.String()
+}
 
-	// Write bind port
-	buf := make([]byte, 2)
-	buf[0] = byte(port >> 8)
-	buf[1] = byte(port - uint16(buf[0])<<8)
-	_, err = conn.Write(buf)
+func WriteRequestFailureMessage(conn io.Writer, replyType ReplyType) error {
+	_, err := conn.Write([]byte{SOCKS5Version, replyType, ReservedField, TypeIPv4, 0, 0, 0, 0, 0, 0})
 	if err != nil {
-		log.Println("write request success message error:", err)
+		logPrintln("write request failure message error", err)
 	}
 	return err
 }
 
-func WriteRequestFailureMessage(conn io.Writer, replyType ReplyType) error {
-	_, err := conn.Write([]byte{SOCKS5Version, replyType, ReservedField, TypeIPv4, 0, 0, 0, 0, 0, 0})
+type ServerReplyMessage struct {
+	Reply    ReplyType
+	AddrType AddressType
+	BindIP   string
+	Port     uint16
+}
+
+func WriteClientRequestMessage(conn io.Writer, cmd Command, host string, port uint16) error {
+	// +----+-----+-------+------+----------+----------+
+	// |VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
+	// +----+-----+-------+------+----------+----------+
+	// | 1  |  1  | X'00' |  1   | Variable |    2     |
+	// +----+-----+-------+------+----------+----------+
+	buf := []byte{SOCKS5Version, cmd, ReservedField}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append(buf, TypeIPv4)
+			buf = append(buf, ip4...)
+		} else {
+			buf = append(buf, TypeIPv6)
+			buf = append(buf, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return ErrDomainTooLong
+		}
+		buf = append(buf, TypeDomain, byte(len(host)))
+		buf = append(buf, host...)
+	}
+	buf = appendPort(buf, port)
+	_, err := conn.Write(buf)
 	if err != nil {
-		log.Println("write request failure message error", err)
+		logPrintln("write client request message error:", err)
 	}
 	return err
 }
+
+func NewServerReplyMessage(conn io.Reader) (*ServerReplyMessage, error) {
+	// +----+-----+-------+------+----------+----------+
+	// |VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
+	// +----+-----+-------+------+----------+----------+
+	// | 1  |  1  | X'00' |  1   | Variable |    2     |
+	// +----+-----+-------+------+----------+----------+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		logPrintln("read server reply message error", err)
+		return nil, err
+	}
+	version, reply, addrType := buf[0], buf[1], buf[3]
+	if version != SOCKS5Version {
+		logPrintln(ErrVersionNotSupported, version)
+		return nil, ErrVersionNotSupported
+	}
+
+	message := ServerReplyMessage{
+		Reply:    reply,
+		AddrType: addrType,
+	}
+	switch addrType {
+	case TypeIPv4, TypeIPv6:
+		if addrType == TypeIPv6 {
+			buf = make([]byte, IPv6Length)
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			logPrintln("read server reply message IP error", err)
+			return nil, err
+		}
+		message.BindIP = net.IP(buf).String()
+	case TypeDomain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			logPrintln("read server reply message domain length error", err)
+			return nil, err
+		}
+		domainLength := buf[0]
+		buf = make([]byte, domainLength)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			logPrintln("read server reply message domain error", err)
+			return nil, err
+		}
+		message.BindIP = string(buf)
+	default:
+		logPrintln(ErrAddressTypeNotSupported, addrType)
+		return nil, ErrAddressTypeNotSupported
+	}
+
+	port := make([]byte, PortLength)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return nil, err
+	}
+	message.Port = readPort(port)
+	return &message, nil
+}
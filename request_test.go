@@ -2,7 +2,11 @@ package socks5
 
 import (
 	"bytes"
+	"io"
+	"net"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestNewClientRequestMessage(t *testing.T) {
@@ -64,3 +68,231 @@ func TestNewClientRequestMessage(t *testing.T) {
 		}
 	}
 }
+
+func TestRejectIPTargets(t *testing.T) {
+	server := SOCKS5Server{Config: &Config{RejectIPTargets: true}}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{SOCKS5Version, CmdConnect, ReservedField, TypeIPv4, 127, 0, 0, 1, 0x00, 0x50})
+	if err := server.request(&buf, &AuthContext{}); err != ErrAddressTypeNotSupported {
+		t.Fatalf("should get error %s, but got %v\n", ErrAddressTypeNotSupported, err)
+	}
+	if got := buf.Bytes(); got[1] != ReplyAddressTypeNotSupported {
+		t.Fatalf("should reply %d, but got %d\n", ReplyAddressTypeNotSupported, got[1])
+	}
+}
+
+func TestRejectDomainTargets(t *testing.T) {
+	server := SOCKS5Server{Config: &Config{RejectDomainTargets: true}}
+
+	var buf bytes.Buffer
+	WriteClientRequestMessage(&buf, CmdConnect, "example.com", 80)
+	if err := server.request(&buf, &AuthContext{}); err != ErrAddressTypeNotSupported {
+		t.Fatalf("should get error %s, but got %v\n", ErrAddressTypeNotSupported, err)
+	}
+	if got := buf.Bytes(); got[1] != ReplyAddressTypeNotSupported {
+		t.Fatalf("should reply %d, but got %d\n", ReplyAddressTypeNotSupported, got[1])
+	}
+	if got := server.Stats().TargetTypeRejections; got != 1 {
+		t.Fatalf("should count 1 rejection, but got %d\n", got)
+	}
+}
+
+func TestStrictRSV(t *testing.T) {
+	request := []byte{SOCKS5Version, CmdConnect, 0x01, TypeIPv4, 127, 0, 0, 1, 0x00, 0x50}
+
+	server := SOCKS5Server{Config: &Config{RejectIPTargets: true}}
+	if err := server.request(bytes.NewBuffer(append([]byte(nil), request...)), &AuthContext{}); err != ErrInvalidReservedField {
+		t.Fatalf("should get error %s by default, but got %v\n", ErrInvalidReservedField, err)
+	}
+
+	// A tolerated RSV lets the request reach the IP target check.
+	strict := false
+	server = SOCKS5Server{Config: &Config{RejectIPTargets: true, StrictRSV: &strict}}
+	if err := server.request(bytes.NewBuffer(append([]byte(nil), request...)), &AuthContext{}); err != ErrAddressTypeNotSupported {
+		t.Fatalf("should get error %s, but got %v\n", ErrAddressTypeNotSupported, err)
+	}
+
+	// The session's config decides, not one applied since
+	session := &AuthContext{config: server.Config}
+	if err := server.ApplyConfig(&Config{RejectIPTargets: true}); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if err := server.request(bytes.NewBuffer(append([]byte(nil), request...)), session); err != ErrAddressTypeNotSupported {
+		t.Fatalf("should get error %s under the session's config, but got %v\n", ErrAddressTypeNotSupported, err)
+	}
+}
+
+func TestReplyHookOverridesBindAddress(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+
+	var seen ReplyInfo
+	server := SOCKS5Server{Config: &Config{
+		ReplyHook: func(info *ReplyInfo) {
+			seen = *info
+			info.BindIP = net.IP{203, 0, 113, 7}
+			info.BindPort = 443
+		},
+	}}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	errc := make(chan error, 1)
+	go func() {
+		defer serverConn.Close()
+		errc <- server.request(serverConn, &AuthContext{})
+	}()
+
+	clientConn.Write([]byte{SOCKS5Version, CmdConnect, ReservedField, TypeIPv4, 127, 0, 0, 1, byte(port >> 8), byte(port)})
+	got := make([]byte, 10)
+	if _, err := io.ReadFull(clientConn, got); err != nil {
+		t.Fatalf("should read reply, but got %s\n", err)
+	}
+	clientConn.Close()
+	if err := <-errc; err != nil {
+		t.Fatalf("should get error nil, but got %s\n", err)
+	}
+
+	if seen.Reply != ReplySuccess || seen.BindPort == 0 || seen.Request.Port != port {
+		t.Fatalf("hook got unexpected reply info %+v\n", seen)
+	}
+	want := []byte{SOCKS5Version, ReplySuccess, ReservedField, TypeIPv4, 203, 0, 113, 7, 0x01, 0xbb}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("should get message %v, but got %v\n", want, got)
+	}
+}
+
+func TestWriteRequestSuccessMessageIPv4Mapped(t *testing.T) {
+	mapped := net.ParseIP("192.0.2.1")
+	var buf bytes.Buffer
+	if err := WriteRequestSuccessMessage(&buf, mapped, 80); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	want := []byte{SOCKS5Version, ReplySuccess, ReservedField, TypeIPv4, 192, 0, 2, 1, 0, 80}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("should write %v but got %v", want, buf.Bytes())
+	}
+
+	buf.Reset()
+	writeRequestSuccess(&buf, mapped, 80, true)
+	if got := buf.Bytes(); got[3] != TypeIPv6 || len(got) != 4+IPv6Length+PortLength {
+		t.Fatalf("should keep the IPv6 form but got %v", got)
+	}
+}
+
+func TestIPv4MappedTarget(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+	request := append([]byte{SOCKS5Version, CmdConnect, ReservedField, TypeIPv6}, net.ParseIP("127.0.0.1").To16()...)
+	request = append(request, byte(port>>8), byte(port))
+
+	// Normalized to IPv4, the target is served
+	var seen ClientRequestMessage
+	server := SOCKS5Server{Config: &Config{ReplyHook: func(info *ReplyInfo) { seen = *info.Request }}}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		defer serverConn.Close()
+		server.request(serverConn, &AuthContext{})
+	}()
+	clientConn.Write(request)
+	reply, err := NewServerReplyMessage(clientConn)
+	if err != nil || reply.Reply != ReplySuccess {
+		t.Fatalf("should connect to the mapped address but got %+v and %v", reply, err)
+	}
+	if seen.AddrType != TypeIPv4 || seen.TargetIP != "127.0.0.1" {
+		t.Fatalf("should normalize the target to IPv4 but got %+v", seen)
+	}
+
+	// Kept as IPv6, it is treated as such and still served
+	kept := SOCKS5Server{Config: &Config{KeepIPv4Mapped: true, ReplyHook: func(info *ReplyInfo) { seen = *info.Request }}}
+	clientConn, serverConn = net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		defer serverConn.Close()
+		kept.request(serverConn, &AuthContext{})
+	}()
+	clientConn.Write(request)
+	reply, err = NewServerReplyMessage(clientConn)
+	if err != nil || reply.Reply != ReplySuccess {
+		t.Fatalf("should connect to the kept mapped address but got %+v and %v", reply, err)
+	}
+	if seen.AddrType != TypeIPv6 || seen.TargetIP != "::ffff:127.0.0.1" {
+		t.Fatalf("should keep the IPv6 form but got %+v", seen)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+
+	// A dial stuck in policy, which no client deadline interrupts
+	release := make(chan struct{})
+	clock := newFakeClock()
+	server := SOCKS5Server{clock: clock, Config: &Config{
+		RequestTimeout: 50 * time.Millisecond,
+		DialControl: func(network, address string, c syscall.RawConn) error {
+			<-release
+			return nil
+		},
+	}}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	errc := make(chan error, 1)
+	go func() {
+		defer serverConn.Close()
+		errc <- server.request(serverConn, &AuthContext{})
+	}()
+
+	clientConn.Write([]byte{SOCKS5Version, CmdConnect, ReservedField, TypeIPv4, 127, 0, 0, 1, byte(port >> 8), byte(port)})
+	clock.awaitTimers(t, 1)
+	clock.Advance(50 * time.Millisecond)
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := NewServerReplyMessage(clientConn)
+	if err != nil {
+		t.Fatalf("should read reply but got %s", err)
+	}
+	if reply.Reply != ReplyTTLExpired {
+		t.Fatalf("should get reply %d but got %d", ReplyTTLExpired, reply.Reply)
+	}
+	if _, err := clientConn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("should be disconnected but got %v", err)
+	}
+	if got := server.Stats().RequestTimeouts; got != 1 {
+		t.Fatalf("should count 1 request timeout but got %d", got)
+	}
+
+	// The abandoned request must not reply once its dial completes
+	close(release)
+	if err := <-errc; err != ErrRequestTimeout {
+		t.Fatalf("should get error %s but got %v", ErrRequestTimeout, err)
+	}
+}
@@ -0,0 +1,176 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// CmdResolve is the RESOLVE command of Tor's SOCKS extensions: the server
+// resolves the domain of the request and replies with its address in
+// BND.ADDR.
+const CmdResolve Command = 0xF0
+
+// ErrNoAddresses is returned by Client.Resolve for names without addresses.
+var ErrNoAddresses = errors.New("no addresses found")
+
+// resolveTimeout bounds the DNS exchange of Client.Resolve's fallback when
+// ctx has no deadline.
+const resolveTimeout = 5 * time.Second
+
+// Resolve looks up host on the proxy side of the connection, for
+// applications that need the address without connecting. It first asks the
+// server with Tor's RESOLVE extension, which yields a single address, and,
+// if the server does not support it, queries Client.DNSServer through a UDP
+// association for all A and AAAA records. Without a DNSServer, it then
+// returns ErrCommandNotSupported.
+func (c *Client) Resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	ip, err := c.resolveCommand(ctx, host)
+	if err == nil {
+		return []net.IP{ip}, nil
+	}
+	if err != ErrCommandNotSupported || c.DNSServer == "" {
+		return nil, err
+	}
+	return c.resolveUDP(ctx, host)
+}
+
+// resolveCommand sends a RESOLVE request for host. It returns
+// ErrCommandNotSupported if the server rejects the command or hangs up on it.
+func (c *Client) resolveCommand(ctx context.Context, host string) (net.IP, error) {
+	conn, err := c.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := watchContext(ctx, conn)
+	reply, err := c.resolveRequest(conn, host)
+	err = stop(err)
+	if err != nil {
+		return nil, err
+	}
+	switch reply.Reply {
+	case ReplySuccess:
+	case ReplyCommandNotSupported:
+		return nil, ErrCommandNotSupported
+	default:
+		logPrintln("proxy server rejected RESOLVE", host, "reply:", ReplyName(reply.Reply))
+		return nil, ErrRequestRejected
+	}
+	ip := net.ParseIP(reply.BindIP)
+	if ip == nil {
+		return nil, ErrNoAddresses
+	}
+	return ip, nil
+}
+
+func (c *Client) resolveRequest(conn net.Conn, host string) (*ServerReplyMessage, error) {
+	if err := c.authenticate(conn); err != nil {
+		return nil, err
+	}
+	if err := WriteClientRequestMessage(conn, CmdResolve, host, 0); err != nil {
+		return nil, err
+	}
+	reply, err := NewServerReplyMessage(conn)
+	if err != nil && closedByPeer(err) {
+		// Servers without the extension may drop the request as malformed
+		return nil, ErrCommandNotSupported
+	}
+	return reply, err
+}
+
+// resolveUDP queries the A and AAAA records of host through a UDP association.
+func (c *Client) resolveUDP(ctx context.Context, host string) ([]net.IP, error) {
+	serverAddr, err := net.ResolveUDPAddr("udp", c.DNSServer)
+	if err != nil {
+		return nil, err
+	}
+	name, err := dnsmessage.NewName(dnsFQDN(host))
+	if err != nil {
+		return nil, err
+	}
+
+	association, err := c.ListenPacket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer association.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(resolveTimeout)
+	}
+	association.SetReadDeadline(deadline)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			association.SetReadDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	pending := make(map[uint16]bool)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		var id [2]byte
+		randRead(nil, id[:])
+		msg := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: uint16(id[0])<<8 | uint16(id[1]), RecursionDesired: true},
+			Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+		}
+		query, err := msg.Pack()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := association.WriteTo(query, serverAddr); err != nil {
+			return nil, err
+		}
+		pending[msg.Header.ID] = true
+	}
+
+	var ips []net.IP
+	buf := make([]byte, 65535)
+	for len(pending) > 0 {
+		n, _, err := association.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		var msg dnsmessage.Message
+		if msg.Unpack(buf[:n]) != nil || !msg.Response {
+			continue
+		}
+		if _, ok := pending[msg.ID]; !ok {
+			continue
+		}
+		delete(pending, msg.ID)
+		for _, answer := range msg.Answers {
+			switch body := answer.Body.(type) {
+			case *dnsmessage.AResource:
+				ips = append(ips, net.IP(body.A[:]))
+			case *dnsmessage.AAAAResource:
+				ips = append(ips, net.IP(body.AAAA[:]))
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, ErrNoAddresses
+	}
+	return ips, nil
+}
+
+// dnsFQDN returns host with the trailing dot of a fully qualified name.
+func dnsFQDN(host string) string {
+	if len(host) > 0 && host[len(host)-1] == '.' {
+		return host
+	}
+	return host + "."
+}
@@ -0,0 +1,119 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestClientResolveCommand(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	requests := make(chan *ClientRequestMessage, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.ReadFull(conn, make([]byte, 3))
+		SendServerAuthMessage(conn, MethodNoAuth)
+		buf := make([]byte, 4)
+		io.ReadFull(conn, buf)
+		domain := make([]byte, 1)
+		io.ReadFull(conn, domain)
+		domain = make([]byte, domain[0])
+		io.ReadFull(conn, domain)
+		io.ReadFull(conn, make([]byte, 2))
+		requests <- &ClientRequestMessage{Cmd: buf[1], AddrType: buf[3], TargetIP: string(domain)}
+		writeRequestSuccess(conn, net.IPv4(192, 0, 2, 7), 0, false)
+	}()
+
+	client := Client{ProxyAddress: listener.Addr().String()}
+	ips, err := client.Resolve(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if want := net.IPv4(192, 0, 2, 7); len(ips) != 1 || !ips[0].Equal(want) {
+		t.Fatalf("should get %v but got %v", want, ips)
+	}
+	if request := <-requests; request.Cmd != CmdResolve || request.TargetIP != "example.com" {
+		t.Fatalf("should send RESOLVE for example.com but got %+v", request)
+	}
+}
+
+// dnsServer answers A queries for any name with 192.0.2.1 and AAAA queries
+// with no records.
+// dnsServer answers A queries with ip.
+func dnsServer(t *testing.T, ip [4]byte) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if query.Unpack(buf[:n]) != nil || len(query.Questions) != 1 {
+				continue
+			}
+			reply := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true},
+				Questions: query.Questions,
+			}
+			question := query.Questions[0]
+			if question.Type == dnsmessage.TypeA {
+				reply.Answers = append(reply.Answers, dnsmessage.Resource{
+					Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+					Body:   &dnsmessage.AResource{A: ip},
+				})
+			}
+			b, _ := reply.Pack()
+			conn.WriteToUDP(b, from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestClientResolveUDPFallback(t *testing.T) {
+	// This server does not know RESOLVE, so the client falls back to DNS over UDP
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth, EnableUDP: true}}
+	address, _ := startServer(t, &server)
+	defer server.Shutdown(context.Background())
+
+	client := Client{ProxyAddress: address, DNSServer: dnsServer(t, [4]byte{192, 0, 2, 1})}
+	ips, err := client.Resolve(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if want := []net.IP{net.IPv4(192, 0, 2, 1).To4()}; !reflect.DeepEqual(want, ips) {
+		t.Fatalf("should get %v but got %v", want, ips)
+	}
+}
+
+func TestServerRepliesToResolve(t *testing.T) {
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth}}
+	address, _ := startServer(t, &server)
+	defer server.Shutdown(context.Background())
+
+	// Without a DNS server to fall back to, the server's reply is final
+	client := Client{ProxyAddress: address}
+	if _, err := client.Resolve(context.Background(), "example.com"); err != ErrCommandNotSupported {
+		t.Fatalf("should get error %s but got %v", ErrCommandNotSupported, err)
+	}
+	if got := server.Stats().MalformedHandshakes; got != 0 {
+		t.Fatalf("should not count RESOLVE as malformed but got %d", got)
+	}
+}
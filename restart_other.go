@@ -0,0 +1,21 @@
+//go:build !unix
+
+package socks5
+
+import (
+	"context"
+	"net"
+	"os"
+)
+
+func (s *SOCKS5Server) Restart(ctx context.Context) (*os.Process, error) {
+	return nil, ErrRestartNotSupported
+}
+
+func InheritedListener() (net.Listener, error) {
+	return nil, nil
+}
+
+func InheritedUDPAssociations() ([]UDPHandoff, error) {
+	return nil, nil
+}
@@ -0,0 +1,190 @@
+//go:build unix
+
+package socks5
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// Environment variables telling a process started by Restart which
+// inherited file descriptors hold the listener and the readiness pipe.
+const (
+	listenerFDEnv = "SOCKS5_LISTENER_FD"
+	readyFDEnv    = "SOCKS5_READY_FD"
+	// udpHandoffEnv holds the UDPHandoff list in JSON; the control, relay
+	// and connected sockets of each follow the readiness pipe in order,
+	// from descriptor 5, the connected one only if ConnectedTarget is set.
+	udpHandoffEnv = "SOCKS5_UDP_HANDOFF"
+)
+
+// Restart starts a new instance of the running executable with the same
+// arguments and hands it the listening socket, for upgrades that do not
+// refuse a single connection. The new process picks the socket up with
+// InheritedListener. Restart returns once the new process is ready; the
+// caller then drains its own sessions with Shutdown. If the new process
+// exits or ctx is done first, it is killed and s keeps serving. With
+// Config.StatsStore, s saves its counters and stops saving them before
+// starting the new process, which takes the store over. With
+// Config.HandOffUDP, the UDP associations move to the new process too,
+// which resumes them with InheritedUDPAssociations.
+func (s *SOCKS5Server) Restart(ctx context.Context) (*os.Process, error) {
+	s.mu.Lock()
+	listener := s.listener
+	s.mu.Unlock()
+	filer, ok := listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, ErrRestartNotSupported
+	}
+	file, err := filer.File()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyReader.Close()
+	executable, err := os.Executable()
+	if err != nil {
+		readyWriter.Close()
+		return nil, err
+	}
+
+	// ExtraFiles start at descriptor 3
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), listenerFDEnv+"=3", readyFDEnv+"=4")
+	cmd.ExtraFiles = []*os.File{file, readyWriter}
+	var handoffs []UDPHandoff
+	if s.config().HandOffUDP {
+		handoffs = s.ExportUDPAssociations()
+	}
+	if len(handoffs) > 0 {
+		state, err := json.Marshal(handoffs)
+		if err != nil {
+			readyWriter.Close()
+			s.resumeUDPHandoffs(handoffs)
+			return nil, err
+		}
+		cmd.Env = append(cmd.Env, udpHandoffEnv+"="+string(state))
+		for _, handoff := range handoffs {
+			cmd.ExtraFiles = append(cmd.ExtraFiles, handoff.Control, handoff.Relay)
+			if handoff.Connected != nil {
+				cmd.ExtraFiles = append(cmd.ExtraFiles, handoff.Connected)
+			}
+		}
+	}
+	// The new process restores the counters from the store, so they must
+	// not change there any more
+	flushing := s.stopStatsFlush()
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		s.resumeUDPHandoffs(handoffs)
+		if flushing {
+			s.startStatsFlush()
+		}
+		return nil, err
+	}
+
+	// The pipe reads EOF without a byte if the new process exits early.
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyReader.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if err == io.EOF {
+			err = ErrRestartFailed
+		}
+		s.resumeUDPHandoffs(handoffs)
+		if flushing {
+			s.startStatsFlush()
+		}
+		return nil, err
+	}
+	closeUDPHandoffs(handoffs)
+	return cmd.Process, nil
+}
+
+// resumeUDPHandoffs takes back the UDP associations exported for a restart
+// that failed.
+func (s *SOCKS5Server) resumeUDPHandoffs(handoffs []UDPHandoff) {
+	if len(handoffs) == 0 {
+		return
+	}
+	if err := s.ImportUDPAssociations(handoffs); err != nil {
+		logPrintln("resume UDP associations failure:", err)
+	}
+}
+
+// InheritedUDPAssociations returns the UDP associations handed over by
+// Restart, for ImportUDPAssociations. Resume them before calling
+// InheritedListener, which tells the old process to drain.
+func InheritedUDPAssociations() ([]UDPHandoff, error) {
+	value := os.Getenv(udpHandoffEnv)
+	if value == "" {
+		return nil, nil
+	}
+	os.Unsetenv(udpHandoffEnv)
+	var handoffs []UDPHandoff
+	if err := json.Unmarshal([]byte(value), &handoffs); err != nil {
+		return nil, err
+	}
+	fd := uintptr(5)
+	for i := range handoffs {
+		handoffs[i].Control = os.NewFile(fd, "control")
+		handoffs[i].Relay = os.NewFile(fd+1, "relay")
+		fd += 2
+		if handoffs[i].ConnectedTarget != "" {
+			handoffs[i].Connected = os.NewFile(fd, "connected")
+			fd++
+		}
+	}
+	return handoffs, nil
+}
+
+// InheritedListener returns the listener handed over by Restart, or nil if
+// the process was not started by Restart. It also tells the old process
+// that this one is ready, so call it once everything else is set up.
+func InheritedListener() (net.Listener, error) {
+	value := os.Getenv(listenerFDEnv)
+	if value == "" {
+		return nil, nil
+	}
+	os.Unsetenv(listenerFDEnv)
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, err
+	}
+	file := os.NewFile(uintptr(fd), "listener")
+	listener, err := net.FileListener(file)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if value := os.Getenv(readyFDEnv); value != "" {
+		os.Unsetenv(readyFDEnv)
+		if fd, err := strconv.Atoi(value); err == nil {
+			ready := os.NewFile(uintptr(fd), "ready")
+			ready.Write([]byte{1})
+			ready.Close()
+		}
+	}
+	return listener, nil
+}
@@ -0,0 +1,232 @@
+//go:build unix
+
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestInheritedListener(t *testing.T) {
+	if listener, err := InheritedListener(); listener != nil || err != nil {
+		t.Fatalf("should get no listener but got %v, %v", listener, err)
+	}
+
+	original, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := original.(*net.TCPListener).File()
+	original.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readyReader.Close()
+	// InheritedListener takes over the descriptors, so hand it copies.
+	listenerFD, err := syscall.Dup(int(file.Fd()))
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	readyFD, err := syscall.Dup(int(readyWriter.Fd()))
+	readyWriter.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(listenerFDEnv, strconv.Itoa(listenerFD))
+	t.Setenv(readyFDEnv, strconv.Itoa(readyFD))
+
+	listener, err := InheritedListener()
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	defer listener.Close()
+	if n, err := readyReader.Read(make([]byte, 1)); n != 1 || err != nil {
+		t.Fatalf("should signal readiness but got %d, %v", n, err)
+	}
+	if os.Getenv(listenerFDEnv) != "" || os.Getenv(readyFDEnv) != "" {
+		t.Fatalf("should clear the environment for later restarts")
+	}
+
+	// The inherited socket must still accept on the original address.
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth}}
+	go server.Serve(listener)
+	defer server.Shutdown(context.Background())
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{SOCKS5Version, 1, byte(MethodNoAuth)})
+	reply := make([]byte, 2)
+	if _, err := conn.Read(reply); err != nil || reply[1] != byte(MethodNoAuth) {
+		t.Fatalf("should get method reply but got %v, %v", reply, err)
+	}
+}
+
+func TestRestartWithoutListener(t *testing.T) {
+	var server SOCKS5Server
+	if _, err := server.Restart(context.Background()); err != ErrRestartNotSupported {
+		t.Fatalf("should get error %s but got %v", ErrRestartNotSupported, err)
+	}
+}
+
+func TestUDPHandoff(t *testing.T) {
+	// An echo server telling where each datagram came from
+	echoConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoConn.Close()
+	sources := make(chan string, 2)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := echoConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			sources <- from.String()
+			echoConn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	echo := echoConn.LocalAddr().(*net.UDPAddr)
+	config := Config{AuthMethod: MethodNoAuth, EnableUDP: true, UDPBindIP: net.IP{127, 0, 0, 1}, MaxUDPAssociationsPerUser: 1}
+	old := SOCKS5Server{Config: &config}
+	address, _ := startServer(t, &old)
+	defer old.Shutdown(context.Background())
+
+	control, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+	control.Write([]byte{SOCKS5Version, 1, byte(MethodNoAuth)})
+	if _, err := io.ReadFull(control, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	control.Write([]byte{SOCKS5Version, CmdUDP, ReservedField, TypeIPv4, 0, 0, 0, 0, 0, 0})
+	reply, err := NewServerReplyMessage(control)
+	if err != nil {
+		t.Fatalf("should read reply but got %s", err)
+	}
+	udpConn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: int(reply.Port)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	ping := func(data string) {
+		t.Helper()
+		request := UDPDatagram{AddrType: TypeIPv4, TargetIP: "127.0.0.1", Port: uint16(echo.Port), Data: []byte(data)}
+		udpConn.Write(request.Bytes())
+		udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1024)
+		n, err := udpConn.Read(buf)
+		if err != nil {
+			t.Fatalf("should receive echo but got %s", err)
+		}
+		if response, err := NewUDPDatagram(buf[:n]); err != nil || string(response.Data) != data {
+			t.Fatalf("should echo %q but got %v, %v", data, response, err)
+		}
+	}
+	ping("before")
+
+	handoffs := old.ExportUDPAssociations()
+	if len(handoffs) != 1 || handoffs[0].Client == "" || handoffs[0].Connected == nil {
+		t.Fatalf("should hand off the association but got %+v", handoffs)
+	}
+	successor := SOCKS5Server{Config: &config}
+	if err := successor.ImportUDPAssociations(handoffs); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	defer successor.Shutdown(context.Background())
+	if sessions := successor.Sessions(); len(sessions) != 1 || sessions[0].ID != handoffs[0].SessionID {
+		t.Fatalf("should resume session %s but got %+v", handoffs[0].SessionID, sessions)
+	}
+	ping("after")
+	if before, after := <-sources, <-sources; before != after {
+		t.Fatalf("should reach the target from %s after the handoff but got %s", before, after)
+	}
+	// The association counts against the client's limit
+	if !successor.udpAssociations.acquire("127.0.0.1", 2) || successor.udpAssociations.acquire("127.0.0.1", 2) {
+		t.Fatal("should count the resumed association against its client")
+	}
+	successor.udpAssociations.release("127.0.0.1")
+
+	// The control connection still ends the association
+	control.Close()
+	for i := 0; len(successor.Sessions()) > 0; i++ {
+		if i == 100 {
+			t.Fatal("should end the association with its control connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// restartResultEnv names the file TestRestartChild writes the counters it
+// restored to.
+const restartResultEnv = "SOCKS5_TEST_RESTART_RESULT"
+
+func TestRestartStatsStore(t *testing.T) {
+	dir := t.TempDir()
+	store := &FileStatsStore{Path: filepath.Join(dir, "stats.json")}
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth, StatsStore: store, StatsFlushInterval: time.Hour}}
+	startServer(t, &server)
+	defer server.Shutdown(context.Background())
+	server.stats.connections.Add(5)
+
+	// The new process runs only TestRestartChild
+	t.Setenv(restartResultEnv, filepath.Join(dir, "child.json"))
+	args := os.Args
+	os.Args = []string{args[0], "-test.run=^TestRestartChild$"}
+	defer func() { os.Args = args }()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	process, err := server.Restart(ctx)
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	process.Wait()
+
+	restored, err := (&FileStatsStore{Path: filepath.Join(dir, "child.json")}).Load()
+	if err != nil || restored == nil || restored.Connections != 5 {
+		t.Fatalf("should restore 5 connections in the new process but got %+v, %v", restored, err)
+	}
+	// The old process no longer saves what it counts while draining
+	server.stats.connections.Add(1)
+	server.Shutdown(context.Background())
+	if saved, err := store.Load(); err != nil || saved.Connections != 5 {
+		t.Fatalf("should keep 5 connections saved but got %+v, %v", saved, err)
+	}
+}
+
+// TestRestartChild is the new process of TestRestartStatsStore.
+func TestRestartChild(t *testing.T) {
+	result := os.Getenv(restartResultEnv)
+	if result == "" || os.Getenv(listenerFDEnv) == "" {
+		t.Skip("only run by TestRestartStatsStore")
+	}
+	saved, err := (&FileStatsStore{Path: filepath.Join(filepath.Dir(result), "stats.json")}).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&FileStatsStore{Path: result}).Save(saved); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := InheritedListener()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+}
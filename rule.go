@@ -0,0 +1,215 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+var ErrInvalidRuleNetwork = errors.New("invalid network in rule")
+
+// Rule matches requests by destination and user and overrides settings for
+// the sessions it matches. Config.Rules are evaluated in order and the first
+// matching rule wins.
+type Rule struct {
+	// Name identifies the rule in Stats.Rules. Unnamed rules are reported by
+	// position, "#0" for the first, so their counters move when rules are
+	// reordered.
+	Name string
+	// Hosts matches domain targets. A leading "." matches the domain and all
+	// of its subdomains, e.g. ".example.com".
+	Hosts []string
+	// Networks matches IP targets in CIDR notation, e.g. "10.0.0.0/8".
+	// A rule with neither Hosts nor Networks matches every destination.
+	Networks []string
+	// Ports matches the destination port. Empty matches every port.
+	Ports []uint16
+	// Users matches the authenticated username. Empty matches every user.
+	Users []string
+	// RateClasses matches sessions of Config.Users accounts with one of these
+	// rate classes. Empty matches any.
+	RateClasses []string
+	// Expr, if set, is a boolean expression over request attributes that
+	// must also hold, e.g. `user == "guest" && time >= "18:00"`. It is
+	// compiled once with the config; see the attributes in expr.go.
+	Expr string
+	// Action is what happens to matching requests: served (RuleAllow, the
+	// default), refused (RuleReject) or relayed to Config.Sinkhole
+	// (RuleSinkhole).
+	Action RuleAction
+	// Windows, if set, are the times matching requests are allowed, in
+	// Location (nil means time.Local); at other times they are refused
+	// with ReplyConnectionNotAllowed. EndAtWindowClose also closes
+	// sessions when the window they started in closes.
+	Windows          []TimeWindow
+	Location         *time.Location
+	EndAtWindowClose bool
+
+	// DialTimeout and IdleTimeout override the Config values when non-zero.
+	DialTimeout time.Duration
+	IdleTimeout time.Duration
+	// Mark overrides Config.Mark when non-zero.
+	Mark int
+	// DSCP, when non-zero, is the DSCP class (0-63, e.g. 46 for EF) set on
+	// both the client and the target connection of matching sessions.
+	DSCP uint8
+	// Priority weights matching sessions under Config.BandwidthLimit: while
+	// the limit throttles, a session of priority 4 gets four times the
+	// share of one of priority 1, keeping SSH or VoIP snappy next to bulk
+	// transfers. Zero counts as 1.
+	Priority int
+	// Commands restricts the SOCKS commands allowed for matching requests,
+	// e.g. CONNECT only. Empty allows all.
+	Commands Commands
+	// CacheHTTP enables Config.HTTPCache for matching sessions.
+	CacheHTTP bool
+	// Capture enables Config.Capture for matching sessions.
+	Capture bool
+	// Labels are added to matching sessions, see AuthContext.Labels.
+	Labels []string
+	// FailoverDirect dials matching targets directly when Config.Upstream
+	// cannot be reached, instead of failing the request.
+	FailoverDirect bool
+
+	nets       []*net.IPNet
+	expr       *vm.Program
+	bytesToday bool
+	windows    []compiledWindow
+	key        string
+}
+
+// compile prepares the rule at index of Config.Rules.
+func (r *Rule) compile(index int) error {
+	r.key = r.Name
+	if r.key == "" {
+		r.key = "#" + strconv.Itoa(index)
+	}
+	r.nets = r.nets[:0]
+	for _, cidr := range r.Networks {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return ErrInvalidRuleNetwork
+		}
+		r.nets = append(r.nets, ipNet)
+	}
+	r.expr, r.bytesToday = nil, false
+	if r.Expr != "" {
+		program, err := compileExpr(r.Expr)
+		if err != nil {
+			return err
+		}
+		r.expr, r.bytesToday = program, usesBytesToday(program)
+	}
+	r.windows = r.windows[:0]
+	for i := range r.Windows {
+		window, err := r.Windows[i].compile()
+		if err != nil {
+			return err
+		}
+		r.windows = append(r.windows, window)
+	}
+	return nil
+}
+
+func (r *Rule) match(message *ClientRequestMessage, authCtx *AuthContext) bool {
+	if len(r.Users) > 0 && (authCtx == nil || !containsString(r.Users, authCtx.Username)) {
+		return false
+	}
+	if len(r.RateClasses) > 0 && (authCtx == nil || authCtx.User == nil || !containsString(r.RateClasses, authCtx.User.RateClass)) {
+		return false
+	}
+	if len(r.Ports) > 0 && !containsPort(r.Ports, message.Port) {
+		return false
+	}
+	if len(r.Hosts) == 0 && len(r.Networks) == 0 {
+		return true
+	}
+	if message.AddrType == TypeDomain {
+		return matchHost(r.Hosts, message.TargetIP)
+	}
+	ip := net.ParseIP(message.TargetIP)
+	// IPv4-mapped targets kept as IPv6 by Config.KeepIPv4Mapped only match
+	// IPv6 networks, which net.IPNet.Contains would compare as IPv4
+	mapped := message.AddrType == TypeIPv6 && ip.To4() != nil
+	for _, ipNet := range r.nets {
+		if mapped && len(ipNet.Mask) == IPv6Length && ip.Mask(ipNet.Mask).Equal(ipNet.IP) {
+			return true
+		}
+		if !mapped && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHost(patterns []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, ".") {
+			if host == pattern[1:] || strings.HasSuffix(host, pattern) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPort(list []uint16, port uint16) bool {
+	for _, v := range list {
+		if v == port {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRule returns the first rule matching the request, or nil.
+func (s *SOCKS5Server) matchRule(message *ClientRequestMessage, authCtx *AuthContext) *Rule {
+	config := s.sessionConfig(authCtx)
+	rules := config.Rules
+	var env *exprEnv
+	for i := range rules {
+		if !rules[i].match(message, authCtx) {
+			continue
+		}
+		if rules[i].expr != nil {
+			if env == nil {
+				if authCtx == nil {
+					authCtx = &AuthContext{}
+				}
+				env = s.newExprEnv(message, authCtx, timeNow(s.clock).Local())
+			}
+			if matched, err := expr.Run(rules[i].expr, env); err != nil || matched != true {
+				continue
+			}
+		}
+		return &rules[i]
+	}
+	return nil
+}
+
+// commandAllowed checks message.Cmd against the user's account and rule,
+// the rule matching the request, if any.
+func commandAllowed(message *ClientRequestMessage, authCtx *AuthContext, rule *Rule) bool {
+	if authCtx.User != nil && len(authCtx.User.Commands) > 0 && !authCtx.User.Commands.contains(message.Cmd) {
+		return false
+	}
+	return rule == nil || len(rule.Commands) == 0 || rule.Commands.contains(message.Cmd)
+}
@@ -0,0 +1,128 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRuleMatch(t *testing.T) {
+	config := Config{
+		Rules: []Rule{
+			{Hosts: []string{".sat.example"}, DialTimeout: time.Minute},
+			{Networks: []string{"10.0.0.0/8"}, Ports: []uint16{22}, IdleTimeout: time.Hour},
+			{Users: []string{"alice"}, DialTimeout: time.Second},
+		},
+	}
+	if err := initConfig(&config); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	server := SOCKS5Server{Config: &config}
+
+	tests := []struct {
+		Name    string
+		Message ClientRequestMessage
+		User    string
+		Want    *Rule
+	}{
+		{"subdomain", ClientRequestMessage{AddrType: TypeDomain, TargetIP: "a.sat.example", Port: 80}, "", &config.Rules[0]},
+		{"domain itself", ClientRequestMessage{AddrType: TypeDomain, TargetIP: "SAT.example", Port: 80}, "", &config.Rules[0]},
+		{"cidr and port", ClientRequestMessage{AddrType: TypeIPv4, TargetIP: "10.1.2.3", Port: 22}, "", &config.Rules[1]},
+		{"cidr wrong port", ClientRequestMessage{AddrType: TypeIPv4, TargetIP: "10.1.2.3", Port: 80}, "", nil},
+		{"user", ClientRequestMessage{AddrType: TypeIPv4, TargetIP: "1.1.1.1", Port: 80}, "alice", &config.Rules[2]},
+		{"no match", ClientRequestMessage{AddrType: TypeDomain, TargetIP: "example.com", Port: 80}, "bob", nil},
+	}
+	for _, test := range tests {
+		got := server.matchRule(&test.Message, &AuthContext{Username: test.User})
+		if got != test.Want {
+			t.Fatalf("%s: should match rule %p but got %p", test.Name, test.Want, got)
+		}
+	}
+}
+
+func TestRuleMatchIPv4Mapped(t *testing.T) {
+	config := Config{
+		Rules: []Rule{
+			{Networks: []string{"10.0.0.0/8"}},
+			{Networks: []string{"::ffff:192.0.2.0/120"}},
+		},
+	}
+	if err := initConfig(&config); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	server := SOCKS5Server{Config: &config}
+
+	tests := []struct {
+		Name    string
+		Message ClientRequestMessage
+		Want    *Rule
+	}{
+		{"IPv4 network", ClientRequestMessage{AddrType: TypeIPv4, TargetIP: "10.1.2.3"}, &config.Rules[0]},
+		{"mapped network normalized", ClientRequestMessage{AddrType: TypeIPv4, TargetIP: "192.0.2.1"}, &config.Rules[1]},
+		{"kept mapped skips IPv4 network", ClientRequestMessage{AddrType: TypeIPv6, TargetIP: "::ffff:10.1.2.3"}, nil},
+		{"kept mapped network", ClientRequestMessage{AddrType: TypeIPv6, TargetIP: "::ffff:192.0.2.1"}, &config.Rules[1]},
+	}
+	for _, test := range tests {
+		got := server.matchRule(&test.Message, &AuthContext{})
+		if got != test.Want {
+			t.Fatalf("%s: should match rule %p but got %p", test.Name, test.Want, got)
+		}
+	}
+}
+
+func TestInvalidRuleNetwork(t *testing.T) {
+	config := Config{Rules: []Rule{{Networks: []string{"10.0.0.0/33"}}}}
+	if err := initConfig(&config); !errors.Is(err, ErrInvalidRuleNetwork) {
+		t.Fatalf("should get error %s but got %v", ErrInvalidRuleNetwork, err)
+	}
+}
+
+func TestCommandAllowed(t *testing.T) {
+	server := SOCKS5Server{Config: &Config{
+		AuthMethod: MethodNoAuth,
+		Rules:      []Rule{{Users: []string{"guest"}, Commands: Commands{CmdConnect}}},
+	}}
+	udp := ClientRequestMessage{Cmd: CmdUDP, AddrType: TypeIPv4, TargetIP: "0.0.0.0"}
+
+	tests := []struct {
+		Name    string
+		AuthCtx AuthContext
+		Want    bool
+	}{
+		{"unrestricted", AuthContext{Username: "admin"}, true},
+		{"rule", AuthContext{Username: "guest"}, false},
+		{"account", AuthContext{Username: "alice", User: &User{Name: "alice", Commands: Commands{CmdConnect, CmdBind}}}, false},
+		{"account allows", AuthContext{Username: "bob", User: &User{Name: "bob", Commands: Commands{CmdUDP}}}, true},
+	}
+	for _, test := range tests {
+		if got := commandAllowed(&udp, &test.AuthCtx, server.matchRule(&udp, &test.AuthCtx)); got != test.Want {
+			t.Fatalf("%s: should get %v but got %v", test.Name, test.Want, got)
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{SOCKS5Version, CmdUDP, ReservedField, TypeIPv4, 0, 0, 0, 0, 0, 0})
+	if err := server.request(&buf, &AuthContext{Username: "guest"}); err != ErrCommandNotAllowed {
+		t.Fatalf("should get error %s but got %v", ErrCommandNotAllowed, err)
+	}
+	want := []byte{SOCKS5Version, ReplyCommandNotSupported, ReservedField, TypeIPv4, 0, 0, 0, 0, 0, 0}
+	if got := buf.Bytes(); !bytes.Equal(want, got) {
+		t.Fatalf("should get message %v but got %v", want, got)
+	}
+}
+
+func TestCommandsJSON(t *testing.T) {
+	data, err := json.Marshal(Commands{CmdConnect, CmdUDP})
+	if err != nil || string(data) != `["connect","udp"]` {
+		t.Fatalf("unexpected JSON %s, %v", data, err)
+	}
+	var commands Commands
+	if err := json.Unmarshal([]byte(`["CONNECT","bind"]`), &commands); err != nil || !bytes.Equal(commands, []byte{CmdConnect, CmdBind}) {
+		t.Fatalf("unexpected commands %v, %v", commands, err)
+	}
+	if err := json.Unmarshal([]byte(`["ping"]`), &commands); !errors.Is(err, ErrCommandNotSupported) {
+		t.Fatalf("should get error %s but got %v", ErrCommandNotSupported, err)
+	}
+}
@@ -0,0 +1,176 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrSourceBanned = errors.New("source address temporarily banned")
+
+// ScanGuard tracks sources whose connections fail the handshake (invalid
+// versions, commands or fields, or connect-and-close without handshaking)
+// and temporarily bans sources that keep failing, to reduce the noise of
+// internet scanners on public listeners. It can also count failed
+// authentication and requests refused by policy, and report bans to external
+// firewalls through Actions.
+type ScanGuard struct {
+	// Threshold is the number of failed handshakes within Window that bans
+	// a source. Zero only counts failures.
+	Threshold int
+	Window    time.Duration
+	// BanDuration is how long a banned source is refused.
+	BanDuration time.Duration
+	// AuthFailures also counts failed username/password and HMAC
+	// authentication as failures.
+	AuthFailures bool
+	// RuleViolations also counts requests refused by policy: disallowed
+	// commands, rejected IP targets and invalid domains.
+	RuleViolations bool
+	// Actions run, each in its own goroutine, whenever a source is banned,
+	// e.g. to block it in a firewall. The in-memory ban applies regardless.
+	Actions []BanAction
+
+	mu      sync.Mutex
+	sources map[string]*scanRecord
+	clock   clock
+}
+
+type scanRecord struct {
+	failures    int
+	windowStart time.Time
+	bannedUntil time.Time
+}
+
+// maxScanRecords bounds the tracked sources before expired ones are pruned.
+const maxScanRecords = 4096
+
+// fail records a failed handshake from ip and reports whether it is now banned.
+func (g *ScanGuard) fail(ip string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := timeNow(g.clock)
+	if g.sources == nil {
+		g.sources = make(map[string]*scanRecord)
+	}
+	if len(g.sources) >= maxScanRecords {
+		g.prune(now)
+	}
+
+	record, ok := g.sources[ip]
+	if !ok || now.Sub(record.windowStart) > g.Window {
+		if !ok {
+			record = &scanRecord{}
+			g.sources[ip] = record
+		}
+		record.failures = 0
+		record.windowStart = now
+	}
+	record.failures++
+	if g.Threshold > 0 && record.failures >= g.Threshold && now.After(record.bannedUntil) {
+		record.bannedUntil = now.Add(g.BanDuration)
+		return true
+	}
+	return false
+}
+
+func (g *ScanGuard) prune(now time.Time) {
+	for ip, record := range g.sources {
+		if now.Sub(record.windowStart) > g.Window && now.After(record.bannedUntil) {
+			delete(g.sources, ip)
+		}
+	}
+}
+
+func (g *ScanGuard) banned(ip string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	record, ok := g.sources[ip]
+	return ok && timeNow(g.clock).Before(record.bannedUntil)
+}
+
+// Banned returns the currently banned sources and when their bans expire.
+func (g *ScanGuard) Banned() map[string]time.Time {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := timeNow(g.clock)
+	bans := make(map[string]time.Time)
+	for ip, record := range g.sources {
+		if now.Before(record.bannedUntil) {
+			bans[ip] = record.bannedUntil
+		}
+	}
+	return bans
+}
+
+// sourceIP returns the remote IP of conn, or "" if conn is not a net.Conn.
+func sourceIP(conn io.ReadWriter) string {
+	c, ok := conn.(net.Conn)
+	if !ok || c.RemoteAddr() == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return c.RemoteAddr().String()
+	}
+	return host
+}
+
+// malformedHandshake counts a handshake that failed before a valid request
+// was read and feeds the source to the ScanGuard of config.
+func (s *SOCKS5Server) malformedHandshake(conn io.ReadWriter, config *Config, sessionID string, err error) {
+	switch {
+	case err == io.EOF:
+		s.stats.emptyConnections.Add(1)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		// A message cut short, as scanners send
+		s.stats.malformedHandshakes.Add(1)
+	case closedByPeer(err):
+		// The client hung up mid-handshake, which is not malformed
+		return
+	default:
+		s.stats.malformedHandshakes.Add(1)
+	}
+
+	s.guardFailure(conn, config, sessionID, "invalid handshakes")
+}
+
+// authFailure feeds failed authentication to the ScanGuard of config if it
+// counts them.
+func (s *SOCKS5Server) authFailure(conn io.ReadWriter, config *Config, sessionID string) {
+	if guard := config.ScanGuard; guard != nil && guard.AuthFailures {
+		s.guardFailure(conn, config, sessionID, "authentication failures")
+	}
+}
+
+// ruleViolation feeds a request refused by policy to the ScanGuard of
+// config if it counts them.
+func (s *SOCKS5Server) ruleViolation(conn io.ReadWriter, config *Config, sessionID string) {
+	if guard := config.ScanGuard; guard != nil && guard.RuleViolations {
+		s.guardFailure(conn, config, sessionID, "rule violations")
+	}
+}
+
+// guardFailure records a failure of the source of conn and, if that bans
+// it, runs the guard's actions.
+func (s *SOCKS5Server) guardFailure(conn io.ReadWriter, config *Config, sessionID string, reason string) {
+	guard := config.ScanGuard
+	ip := sourceIP(conn)
+	if guard == nil || ip == "" || !guard.fail(ip) {
+		return
+	}
+	logSession(sessionID, "banning", config.LogRedaction.Host(ip), "for", guard.BanDuration, "after repeated", reason)
+	if len(guard.Actions) == 0 {
+		return
+	}
+	event := BanEvent{IP: ip, Reason: reason, Until: timeNow(guard.clock).Add(guard.BanDuration), Duration: guard.BanDuration}
+	for _, action := range guard.Actions {
+		go func(action BanAction) {
+			if err := action.Ban(event); err != nil {
+				logSession(sessionID, "ban action failed for", config.LogRedaction.Host(ip), err)
+			}
+		}(action)
+	}
+}
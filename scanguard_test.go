@@ -0,0 +1,140 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestScanGuard(t *testing.T) {
+	guard := ScanGuard{Threshold: 3, Window: time.Minute, BanDuration: time.Minute}
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth, ScanGuard: &guard}}
+
+	serve := func(payload []byte) error {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		go func() {
+			clientConn.Write(payload)
+			clientConn.Close()
+		}()
+		return server.ServeConn(serverConn)
+	}
+
+	// Wrong version, then connect-and-close twice
+	if err := serve([]byte{0x04, 1, MethodNoAuth}); err != ErrVersionNotSupported {
+		t.Fatalf("should get error %s but got %v", ErrVersionNotSupported, err)
+	}
+	serve(nil)
+	serve(nil)
+	if err := serve([]byte{SOCKS5Version, 1, MethodNoAuth}); err != ErrSourceBanned {
+		t.Fatalf("should get error %s but got %v", ErrSourceBanned, err)
+	}
+
+	stats := server.Stats()
+	if stats.MalformedHandshakes != 1 || stats.EmptyConnections != 2 || stats.BannedConnections != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if _, ok := guard.Banned()["pipe"]; !ok {
+		t.Fatalf("source should be listed as banned but got %v", guard.Banned())
+	}
+}
+
+func TestScanGuardWindow(t *testing.T) {
+	clock := newFakeClock()
+	guard := ScanGuard{Threshold: 2, Window: time.Second, BanDuration: time.Minute, clock: clock}
+	guard.fail("192.0.2.1")
+	clock.Advance(2 * time.Second)
+	if guard.fail("192.0.2.1") {
+		t.Fatalf("failures outside the window should not ban")
+	}
+	if !guard.fail("192.0.2.1") {
+		t.Fatalf("failures inside the window should ban")
+	}
+	if !guard.banned("192.0.2.1") || guard.banned("192.0.2.2") {
+		t.Fatalf("only 192.0.2.1 should be banned")
+	}
+	clock.Advance(2 * time.Minute)
+	if guard.banned("192.0.2.1") {
+		t.Fatalf("ban should expire after BanDuration")
+	}
+}
+
+func TestScanGuardAuthFailures(t *testing.T) {
+	events := make(chan BanEvent, 1)
+	guard := ScanGuard{
+		Threshold:    2,
+		Window:       time.Minute,
+		BanDuration:  time.Minute,
+		AuthFailures: true,
+		Actions: []BanAction{BanActionFunc(func(event BanEvent) error {
+			events <- event
+			return nil
+		})},
+	}
+	server := SOCKS5Server{Config: &Config{
+		AuthMethod:      MethodPassword,
+		PasswordChecker: func(username, password string) bool { return password == "secret" },
+		ScanGuard:       &guard,
+	}}
+
+	login := func(password string) error {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		go func() {
+			clientConn.Write([]byte{SOCKS5Version, 1, MethodPassword})
+			clientConn.Read(make([]byte, 2))
+			clientConn.Write(append([]byte{1, 1, 'u', byte(len(password))}, password...))
+			clientConn.Read(make([]byte, 2))
+			clientConn.Close()
+		}()
+		return server.ServeConn(serverConn)
+	}
+	for i := 0; i < 2; i++ {
+		if err := login("wrong"); err != ErrPasswordAuthFailure {
+			t.Fatalf("should get error %s but got %v", ErrPasswordAuthFailure, err)
+		}
+	}
+	select {
+	case event := <-events:
+		if event.IP != "pipe" || event.Reason != "authentication failures" || event.Duration != time.Minute {
+			t.Fatalf("unexpected ban event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ban action should run")
+	}
+	if err := login("secret"); err != ErrSourceBanned {
+		t.Fatalf("should get error %s but got %v", ErrSourceBanned, err)
+	}
+}
+
+func TestScanGuardRuleViolations(t *testing.T) {
+	guard := ScanGuard{Threshold: 1, Window: time.Minute, BanDuration: time.Minute}
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth, RejectIPTargets: true, ScanGuard: &guard}}
+	request := []byte{SOCKS5Version, CmdConnect, 0, TypeIPv4, 192, 0, 2, 1, 0, 80}
+
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		io.Copy(io.Discard, clientConn)
+	}()
+	server.handleRequest(serverConn, mustReadRequest(t, request), &AuthContext{SessionID: "s1"})
+	if len(guard.Banned()) != 0 {
+		t.Fatalf("rule violations should not count unless enabled")
+	}
+	guard.RuleViolations = true
+	server.handleRequest(serverConn, mustReadRequest(t, request), &AuthContext{SessionID: "s2"})
+	clientConn.Close()
+	if _, ok := guard.Banned()["pipe"]; !ok {
+		t.Fatalf("source should be banned after a rule violation but got %v", guard.Banned())
+	}
+}
+
+func mustReadRequest(t *testing.T, b []byte) *ClientRequestMessage {
+	t.Helper()
+	message, err := readClientRequestMessage(bytes.NewReader(b), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
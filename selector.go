@@ -0,0 +1,71 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+)
+
+// MethodRequest is what Config.MethodSelector picks an auth method from.
+type MethodRequest struct {
+	SessionID  string
+	ClientAddr net.Addr
+	// Offered are the methods in the client's greeting.
+	Offered []Method
+	// TLS is the state of the TLS connection the greeting arrived on, or nil.
+	TLS *tls.ConnectionState
+}
+
+// selectMethod returns the auth method of config for a greeting offering
+// offered, or MethodNoAcceptable.
+func (s *SOCKS5Server) selectMethod(conn io.ReadWriter, config *Config, sessionID string, offered []Method) Method {
+	selector := config.MethodSelector
+	if selector == nil {
+		for _, method := range offered {
+			if method == config.AuthMethod {
+				return method
+			}
+		}
+		return MethodNoAcceptable
+	}
+
+	req := MethodRequest{SessionID: sessionID, Offered: offered, TLS: connTLSState(conn)}
+	if c, ok := conn.(net.Conn); ok {
+		req.ClientAddr = c.RemoteAddr()
+	}
+	method := selector(&req)
+	if method != MethodNoAuth && method != MethodPassword && method != MethodHMAC {
+		return MethodNoAcceptable
+	}
+	if containsMethod(offered, method) {
+		return method
+	}
+	return MethodNoAcceptable
+}
+
+func containsMethod(methods []Method, method Method) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// connTLSState returns the TLS state of the client connection, looking
+// through the server's own wrappers, or nil if it is not TLS.
+func connTLSState(conn io.ReadWriter) *tls.ConnectionState {
+	for {
+		switch c := conn.(type) {
+		case *httpTunnel:
+			conn = c.sniffConn
+		case *sniffConn:
+			conn = c.Conn
+		case *tls.Conn:
+			state := c.ConnectionState()
+			return &state
+		default:
+			return nil
+		}
+	}
+}
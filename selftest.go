@@ -0,0 +1,99 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ProbeReport is the outcome of Probe or SelfTest, stage by stage.
+type ProbeReport struct {
+	// OK is true if every stage succeeded.
+	OK bool `json:"ok"`
+	// Stages are "dial", "auth" and "connect", up to the first failing one.
+	Stages []ProbeStage `json:"stages"`
+}
+
+// ProbeStage is a step of a probe.
+type ProbeStage struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration"`
+	// Error is empty if the stage succeeded.
+	Error string `json:"error,omitempty"`
+}
+
+// Probe checks that client's proxy server works: it dials the server,
+// authenticates and CONNECTs to target, a canary host:port the server should
+// always reach, reporting how long each stage took and where it failed. It
+// suits container liveness and readiness probes.
+func Probe(ctx context.Context, client *Client, target string) *ProbeReport {
+	report := &ProbeReport{}
+	stage := func(name string, run func() error) bool {
+		start := time.Now()
+		err := run()
+		result := ProbeStage{Name: name, Duration: time.Since(start)}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		report.Stages = append(report.Stages, result)
+		return err == nil
+	}
+
+	var conn net.Conn
+	if !stage("dial", func() (err error) {
+		conn, err = client.dialProxy(ctx)
+		return err
+	}) {
+		return report
+	}
+	defer conn.Close()
+	if !stage("auth", func() error {
+		stop := watchContext(ctx, conn)
+		return stop(client.authenticate(conn))
+	}) {
+		return report
+	}
+	report.OK = stage("connect", func() error {
+		host, portStr, err := net.SplitHostPort(target)
+		if err != nil {
+			return err
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return err
+		}
+		stop := watchContext(ctx, conn)
+		_, err = client.request(conn, CmdConnect, host, uint16(port), target)
+		return stop(err)
+	})
+	return report
+}
+
+// SelfTest probes the server through its own listener over loopback, as
+// Probe with a client authenticating as username, if not empty.
+func (s *SOCKS5Server) SelfTest(ctx context.Context, target, username, password string) *ProbeReport {
+	s.mu.Lock()
+	listener := s.listener
+	s.mu.Unlock()
+	var addr *net.TCPAddr
+	if listener != nil {
+		addr, _ = listener.Addr().(*net.TCPAddr)
+	}
+	if addr == nil {
+		return &ProbeReport{Stages: []ProbeStage{{Name: "dial", Error: ErrServerNotListening.Error()}}}
+	}
+
+	ip := addr.IP
+	if ip.IsUnspecified() && ip.To4() != nil {
+		ip = net.IPv4(127, 0, 0, 1)
+	} else if ip.IsUnspecified() {
+		ip = net.IPv6loopback
+	}
+	client := Client{
+		ProxyAddress: net.JoinHostPort(ip.String(), strconv.Itoa(addr.Port)),
+		Username:     username,
+		Password:     password,
+	}
+	return Probe(ctx, &client, target)
+}
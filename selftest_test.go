@@ -0,0 +1,36 @@
+package socks5
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	server := SOCKS5Server{Config: &Config{
+		AuthMethod: MethodPassword,
+		PasswordChecker: func(username, password string) bool {
+			return username == "admin" && password == "123456"
+		},
+	}}
+	if report := server.SelfTest(context.Background(), echoServer(t), "admin", "123456"); report.OK || report.Stages[0].Error != ErrServerNotListening.Error() {
+		t.Fatalf("should fail with %s before serving but got %+v", ErrServerNotListening, report)
+	}
+	startServer(t, &server)
+	defer server.Shutdown(context.Background())
+
+	report := server.SelfTest(context.Background(), echoServer(t), "admin", "123456")
+	if !report.OK || len(report.Stages) != 3 {
+		t.Fatalf("should pass dial, auth and connect but got %+v", report)
+	}
+
+	report = server.SelfTest(context.Background(), echoServer(t), "admin", "wrong")
+	if report.OK || len(report.Stages) != 2 || report.Stages[1].Error != ErrPasswordAuthFailure.Error() {
+		t.Fatalf("should fail auth but got %+v", report)
+	}
+
+	// A canary the server cannot reach fails the connect stage
+	report = server.SelfTest(context.Background(), "127.0.0.1:1", "admin", "123456")
+	if report.OK || len(report.Stages) != 3 || report.Stages[2].Error != ErrRequestRejected.Error() {
+		t.Fatalf("should fail connect but got %+v", report)
+	}
+}
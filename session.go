@@ -0,0 +1,84 @@
+package socks5
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// Session describes a client connection being served. Its ID appears in the
+// server's log lines, AuthContext (and so ReplyInfo and rules), and capture
+// file names, so a complaint can be traced to exact records.
+type Session struct {
+	ID         string
+	ClientAddr net.Addr
+	Start      time.Time
+	// Memory is the approximate buffer memory the session holds, as charged
+	// against Config.MaxMemory. It is only set in Sessions.
+	Memory int64
+
+	// config is the config the session was accepted under. Reloads apply
+	// to later sessions, so that one session never mixes two configs.
+	config *Config
+	// ctx is canceled when the session ends, by cancel.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (s *SOCKS5Server) newSession(conn net.Conn) *Session {
+	b := make([]byte, 8)
+	randRead(s.rand, b)
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Session{ID: hex.EncodeToString(b), ClientAddr: conn.RemoteAddr(), Start: timeNow(s.clock), config: s.config(), ctx: ctx, cancel: cancel}
+}
+
+// end cancels the context of the session, aborting its pending dials.
+func (session *Session) end() {
+	if session.cancel != nil {
+		session.cancel()
+	}
+}
+
+// sessionConfig returns the config of the session of authCtx, or the
+// config in use for requests served without one.
+func (s *SOCKS5Server) sessionConfig(authCtx *AuthContext) *Config {
+	if authCtx != nil && authCtx.config != nil {
+		return authCtx.config
+	}
+	return s.config()
+}
+
+// Sessions returns the sessions currently being served, oldest first.
+func (s *SOCKS5Server) Sessions() []Session {
+	s.mu.Lock()
+	sessions := make([]Session, 0, len(s.conns))
+	for _, session := range s.conns {
+		sessions = append(sessions, *session)
+	}
+	s.mu.Unlock()
+	for i := range sessions {
+		sessions[i].Memory = s.memory.usage(sessions[i].ID)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Start.Before(sessions[j].Start) })
+	return sessions
+}
+
+// context returns the context of the session of authCtx, or
+// context.Background for requests served without one.
+func (a *AuthContext) context() context.Context {
+	if a != nil && a.ctx != nil {
+		return a.ctx
+	}
+	return context.Background()
+}
+
+// logSession logs v prefixed with the session ID, if any.
+func logSession(sessionID string, v ...any) {
+	if sessionID != "" {
+		v = append([]any{"[" + sessionID + "]"}, v...)
+	}
+	logs.output(2, fmt.Sprintln(v...))
+}
@@ -0,0 +1,51 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestSessions(t *testing.T) {
+	hookIDs := make(chan string, 1)
+	server := SOCKS5Server{Config: &Config{
+		AuthMethod: MethodNoAuth,
+		ReplyHook:  func(info *ReplyInfo) { hookIDs <- info.Auth.SessionID },
+	}}
+	address, _ := startServer(t, &server)
+	defer server.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := Client{}
+	if err := client.Handshake(conn, echoServer(t)); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+
+	sessions := server.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("should have 1 session but got %d", len(sessions))
+	}
+	if sessions[0].ClientAddr.String() != conn.LocalAddr().String() {
+		t.Fatalf("should have client address %s but got %s", conn.LocalAddr(), sessions[0].ClientAddr)
+	}
+	if id := <-hookIDs; id == "" || id != sessions[0].ID {
+		t.Fatalf("reply hook should see session ID %q but got %q", sessions[0].ID, id)
+	}
+}
+
+func TestSessionIDSource(t *testing.T) {
+	clock := newFakeClock()
+	server := SOCKS5Server{clock: clock, rand: zeroRand{}}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	session := server.newSession(serverConn)
+	if session.ID != "0000000000000000" || !session.Start.Equal(clock.Now()) {
+		t.Fatalf("unexpected session %+v", session)
+	}
+}
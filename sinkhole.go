@@ -0,0 +1,149 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRuleRejected         = errors.New("request rejected by rule")
+	ErrInvalidRuleAction    = errors.New("invalid rule action")
+	ErrSinkholeNotSupported = errors.New("sinkhole supports CONNECT only")
+)
+
+// RuleAction is what happens to the requests a Rule matches.
+type RuleAction string
+
+const (
+	// RuleAllow serves matching requests with the rule's overrides.
+	RuleAllow RuleAction = ""
+	// RuleReject refuses matching requests with ReplyConnectionNotAllowed.
+	RuleReject RuleAction = "reject"
+	// RuleSinkhole pretends to connect matching CONNECT requests and relays
+	// them to Config.Sinkhole instead of the target, e.g. to record what
+	// malware or an abusive client sends.
+	RuleSinkhole RuleAction = "sinkhole"
+)
+
+func (a RuleAction) valid() bool {
+	return a == RuleAllow || a == RuleReject || a == RuleSinkhole
+}
+
+// SinkholeHandler opens the stand-in for the target of a sinkholed session.
+// The client is relayed to it like to a real target until either side
+// closes.
+type SinkholeHandler func(target string, authCtx *AuthContext) (io.ReadWriteCloser, error)
+
+// sinkhole serves a request matching a RuleSinkhole rule.
+func (s *SOCKS5Server) sinkhole(conn io.ReadWriter, message *ClientRequestMessage, authCtx *AuthContext, rule *Rule) error {
+	config := s.sessionConfig(authCtx)
+	address := net.JoinHostPort(message.TargetIP, strconv.Itoa(int(message.Port)))
+	if message.Cmd != CmdConnect {
+		s.writeFailure(conn, message, authCtx, ReplyConnectionNotAllowed)
+		logSession(authCtx.SessionID, "Command", CommandName(message.Cmd), "to sinkholed", config.LogRedaction.Address(address), "rejected")
+		return ErrSinkholeNotSupported
+	}
+	handler := config.Sinkhole
+	if handler == nil {
+		s.writeFailure(conn, message, authCtx, ReplyConnectionNotAllowed)
+		return ErrRuleRejected
+	}
+	target, err := handler(address, authCtx)
+	if err != nil {
+		s.writeFailure(conn, message, authCtx, ReplyServerFailure)
+		logSession(authCtx.SessionID, "open sinkhole for", config.LogRedaction.Address(address), "failure", err)
+		return err
+	}
+	logSession(authCtx.SessionID, "sinkhole", config.LogRedaction.Address(address))
+	info := ReplyInfo{
+		Request: message,
+		Auth:    authCtx,
+		Reply:   ReplySuccess,
+		BindIP:  net.IPv4zero,
+	}
+	if err := s.writeReply(conn, &info); err != nil {
+		target.Close()
+		return err
+	}
+
+	tally := &relayTally{rule: rule.key, priority: rule.Priority, today: todayUser(config, authCtx)}
+	defer s.stats.sessionStarted(authCtx)(tally)
+	// Idle clients must not hold the session forever
+	idleTimeout := config.IdleTimeout
+	if rule.IdleTimeout > 0 {
+		idleTimeout = rule.IdleTimeout
+	}
+	if c, ok := conn.(net.Conn); ok {
+		c.SetDeadline(time.Time{})
+		if idleTimeout > 0 {
+			conn = &idleConn{Conn: c, timeout: idleTimeout}
+		}
+	}
+	if config.ProgressHook != nil || config.Recorder != nil || len(config.Plugins) > 0 {
+		meter := s.newProgressMeter(conn, authCtx, address)
+		defer meter.stop(tally)
+		conn, target = meter.wrap(conn, target)
+	}
+	err = s.forward(conn, target, config, tally)
+	s.relayEnded(authCtx, tally)
+	return err
+}
+
+// FileSinkhole is a SinkholeHandler that writes what each client sends to
+// a file named after the session in Dir and sends nothing back.
+type FileSinkhole struct {
+	Dir string `json:"dir"`
+	// MaxBytes, if positive, caps each file; the rest is discarded.
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+// Open implements SinkholeHandler.
+func (f *FileSinkhole) Open(target string, authCtx *AuthContext) (io.ReadWriteCloser, error) {
+	file, err := os.OpenFile(filepath.Join(f.Dir, authCtx.SessionID+".bin"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &sinkholeFile{file: file, max: f.MaxBytes, closed: make(chan struct{})}, nil
+}
+
+// sinkholeFile reads nothing until it is closed.
+type sinkholeFile struct {
+	file    *os.File
+	max     int64
+	written int64
+	once    sync.Once
+	closed  chan struct{}
+}
+
+func (f *sinkholeFile) Read(b []byte) (int, error) {
+	<-f.closed
+	return 0, io.EOF
+}
+
+func (f *sinkholeFile) Write(b []byte) (int, error) {
+	keep := b
+	if f.max > 0 && f.written+int64(len(keep)) > f.max {
+		keep = keep[:f.max-f.written]
+	}
+	n, err := f.file.Write(keep)
+	f.written += int64(n)
+	if err != nil {
+		return n, err
+	}
+	return len(b), nil
+}
+
+func (f *sinkholeFile) Close() error {
+	err := os.ErrClosed
+	f.once.Do(func() {
+		close(f.closed)
+		err = f.file.Close()
+	})
+	return err
+}
@@ -0,0 +1,113 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSinkholeRule(t *testing.T) {
+	dir := t.TempDir()
+	sessions := make(chan string, 1)
+	sinkhole := &FileSinkhole{Dir: dir, MaxBytes: 6}
+	config := &Config{
+		AuthMethod: MethodNoAuth,
+		Rules: []Rule{
+			{Name: "trap", Hosts: []string{"c2.example"}, Action: RuleSinkhole},
+			{Name: "deny", Hosts: []string{"denied.example"}, Action: RuleReject},
+		},
+		Sinkhole: func(target string, authCtx *AuthContext) (io.ReadWriteCloser, error) {
+			sessions <- authCtx.SessionID
+			return sinkhole.Open(target, authCtx)
+		},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	server := SOCKS5Server{Config: config}
+	if err := initConfig(server.Config); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(host string, cmd Command) *ServerReplyMessage {
+		clientConn, serverConn := tcpPair(t)
+		go server.ServeConn(serverConn)
+		clientConn.Write([]byte{SOCKS5Version, 1, byte(MethodNoAuth)})
+		io.ReadFull(clientConn, make([]byte, 2))
+		WriteClientRequestMessage(clientConn, cmd, host, 80)
+		reply, err := NewServerReplyMessage(clientConn)
+		if err != nil {
+			t.Fatalf("should read reply but got %s", err)
+		}
+		if reply.Reply == ReplySuccess {
+			clientConn.Write([]byte("GET / HTTP/1.0\r\n"))
+		}
+		clientConn.Close()
+		return reply
+	}
+
+	if reply := request("c2.example", CmdConnect); reply.Reply != ReplySuccess {
+		t.Fatalf("should pretend to connect but got reply %d", reply.Reply)
+	}
+	path := filepath.Join(dir, <-sessions+".bin")
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		b, _ := os.ReadFile(path)
+		if string(b) == "GET / " {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("should record the first 6 bytes but got %q", b)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if reply := request("c2.example", CmdBind); reply.Reply != ReplyConnectionNotAllowed {
+		t.Fatalf("should reject BIND to a sinkhole but got reply %d", reply.Reply)
+	}
+	if reply := request("denied.example", CmdConnect); reply.Reply != ReplyConnectionNotAllowed {
+		t.Fatalf("should reject but got reply %d", reply.Reply)
+	}
+}
+
+func TestValidateRuleAction(t *testing.T) {
+	config := Config{Rules: []Rule{{Action: "drop"}, {Action: RuleSinkhole}}}
+	err := config.Validate()
+	if !errors.Is(err, ErrInvalidRuleAction) {
+		t.Fatalf("should get error %s but got %v", ErrInvalidRuleAction, err)
+	}
+}
+
+func TestSinkholeIdleTimeout(t *testing.T) {
+	plugin := &testPlugin{requests: make(chan PluginRequest, 1)}
+	sinkhole := &FileSinkhole{Dir: t.TempDir()}
+	server := SOCKS5Server{Config: &Config{
+		AuthMethod: MethodNoAuth,
+		Rules:      []Rule{{Name: "trap", Hosts: []string{"c2.example"}, Action: RuleSinkhole, IdleTimeout: 100 * time.Millisecond}},
+		Sinkhole:   sinkhole.Open,
+		Plugins:    []Plugin{plugin},
+	}}
+	if err := initConfig(server.Config); err != nil {
+		t.Fatal(err)
+	}
+
+	clientConn, serverConn := tcpPair(t)
+	go server.ServeConn(serverConn)
+	clientConn.Write([]byte{SOCKS5Version, 1, byte(MethodNoAuth)})
+	io.ReadFull(clientConn, make([]byte, 2))
+	WriteClientRequestMessage(clientConn, CmdConnect, "c2.example", 80)
+	if reply, err := NewServerReplyMessage(clientConn); err != nil || reply.Reply != ReplySuccess {
+		t.Fatalf("should pretend to connect but got %v, %v", reply, err)
+	}
+	// The idle client is disconnected
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := clientConn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("should get error %s but got %v", io.EOF, err)
+	}
+	// Rules decide before plugins are asked
+	if len(plugin.requests) != 0 {
+		t.Fatalf("should not ask plugins about a sinkholed request but got %+v", <-plugin.requests)
+	}
+}
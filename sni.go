@@ -0,0 +1,111 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	ErrSNIMismatch        = errors.New("TLS server name does not match the requested domain")
+	ErrInvalidClientHello = errors.New("invalid TLS ClientHello")
+)
+
+// errHelloRead aborts the TLS handshake used to parse a ClientHello.
+var errHelloRead = errors.New("ClientHello read")
+
+// tlsRecordHandshake is the content type of TLS handshake records.
+const tlsRecordHandshake = 0x16
+
+// readServerName reads the ClientHello the client sends first and returns
+// its server name, and a reader replaying everything read from conn. isTLS
+// is false, and nothing is consumed, if the client does not start with a TLS
+// handshake record.
+func readServerName(conn io.Reader) (serverName string, isTLS bool, replay io.Reader, err error) {
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil || first[0] != tlsRecordHandshake {
+		return "", false, br, err
+	}
+
+	var read bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	tlsConn := tls.Server(&helloConn{Reader: io.TeeReader(br, &read)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errHelloRead
+		},
+	})
+	tlsConn.Handshake()
+	replay = io.MultiReader(&read, br)
+	if hello == nil {
+		return "", true, replay, ErrInvalidClientHello
+	}
+	return hello.ServerName, true, replay, nil
+}
+
+// helloConn feeds a reader to crypto/tls and discards what it writes.
+type helloConn struct {
+	io.Reader
+}
+
+func (c *helloConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (c *helloConn) Close() error                       { return nil }
+func (c *helloConn) LocalAddr() net.Addr                { return nil }
+func (c *helloConn) RemoteAddr() net.Addr               { return nil }
+func (c *helloConn) SetDeadline(t time.Time) error      { return nil }
+func (c *helloConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *helloConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// serverNameMatches reports whether the TLS server name agrees with the
+// requested domain. ClientHellos without a server name match any domain.
+func serverNameMatches(serverName, domain string) bool {
+	if serverName == "" {
+		return true
+	}
+	return strings.EqualFold(strings.TrimSuffix(serverName, "."), strings.TrimSuffix(domain, "."))
+}
+
+// checkSNI returns conn checking, as the relay reads it, that a ClientHello
+// the client starts with names domain. The check happens on the client's
+// first read so that protocols where the server speaks first keep working.
+func (s *SOCKS5Server) checkSNI(conn io.ReadWriter, config *Config, domain string, sessionID string) io.ReadWriter {
+	return &readerConn{Reader: &sniReader{server: s, config: config, conn: conn, domain: domain, sessionID: sessionID}, conn: conn}
+}
+
+// sniReader reads the client side of a session for checkSNI.
+type sniReader struct {
+	server    *SOCKS5Server
+	config    *Config
+	conn      io.ReadWriter
+	domain    string
+	sessionID string
+
+	replay io.Reader
+	err    error
+}
+
+func (r *sniReader) Read(b []byte) (int, error) {
+	if r.replay == nil && r.err == nil {
+		var serverName string
+		var isTLS bool
+		serverName, isTLS, r.replay, r.err = readServerName(r.conn)
+		if r.err == nil && isTLS && !serverNameMatches(serverName, r.domain) {
+			s := r.server
+			s.stats.sniMismatches.Add(1)
+			redaction := r.config.LogRedaction
+			logSession(r.sessionID, "TLS server name", redaction.Host(serverName), "does not match", redaction.Host(r.domain))
+			s.ruleViolation(r.conn, r.config, r.sessionID)
+			r.err = ErrSNIMismatch
+		}
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.replay.Read(b)
+}
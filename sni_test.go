@@ -0,0 +1,93 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadServerName(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go tls.Client(clientConn, &tls.Config{ServerName: "example.com"}).Handshake()
+
+	serverName, isTLS, replay, err := readServerName(serverConn)
+	if err != nil || !isTLS || serverName != "example.com" {
+		t.Fatalf("should read example.com but got %q, %v, %v", serverName, isTLS, err)
+	}
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(replay, header); err != nil || header[0] != tlsRecordHandshake {
+		t.Fatalf("should replay the ClientHello record but got %v, %v", header, err)
+	}
+
+	serverName, isTLS, replay, err = readServerName(strings.NewReader("GET / HTTP/1.1\r\n"))
+	if err != nil || isTLS || serverName != "" {
+		t.Fatalf("should pass non-TLS data but got %q, %v, %v", serverName, isTLS, err)
+	}
+	if b, _ := io.ReadAll(replay); string(b) != "GET / HTTP/1.1\r\n" {
+		t.Fatalf("should replay non-TLS data but got %q", b)
+	}
+
+	if _, _, _, err = readServerName(strings.NewReader("\x16\x03\x01\x00\x02xx")); err != ErrInvalidClientHello {
+		t.Fatalf("should get error %s but got %v", ErrInvalidClientHello, err)
+	}
+}
+
+func TestServerNameMatches(t *testing.T) {
+	tests := []struct {
+		serverName, domain string
+		want               bool
+	}{
+		{"example.com", "example.com", true},
+		{"Example.COM.", "example.com", true},
+		{"", "example.com", true},
+		{"front.example.net", "example.com", false},
+	}
+	for _, test := range tests {
+		if got := serverNameMatches(test.serverName, test.domain); got != test.want {
+			t.Fatalf("%q for %q: should get %v but got %v", test.serverName, test.domain, test.want, got)
+		}
+	}
+}
+
+func TestRequireSNIMatch(t *testing.T) {
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth, RequireSNIMatch: true}}
+	_, portStr, _ := net.SplitHostPort(echoServer(t))
+	port, _ := strconv.Atoi(portStr)
+
+	connect := func(serverName string) error {
+		clientConn, serverConn := tcpPair(t)
+		defer clientConn.Close()
+		go server.ServeConn(serverConn)
+		clientConn.Write([]byte{SOCKS5Version, 1, byte(MethodNoAuth)})
+		io.ReadFull(clientConn, make([]byte, 2))
+		if err := WriteClientRequestMessage(clientConn, CmdConnect, "localhost", uint16(port)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewServerReplyMessage(clientConn); err != nil {
+			t.Fatalf("should read reply but got %s", err)
+		}
+		clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+		tlsConn := tls.Client(clientConn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		// The echo server answers with the ClientHello, so a matching name
+		// still fails the handshake, but later
+		tlsConn.Handshake()
+		_, err := clientConn.Read(make([]byte, 1))
+		return err
+	}
+
+	connect("localhost")
+	if got := server.Stats().SNIMismatches; got != 0 {
+		t.Fatalf("should count no mismatch but got %d", got)
+	}
+	if err := connect("front.example.net"); err == nil {
+		t.Fatalf("mismatching session should be closed")
+	}
+	if got := server.Stats().SNIMismatches; got != 1 {
+		t.Fatalf("should count 1 mismatch but got %d", got)
+	}
+}
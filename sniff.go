@@ -0,0 +1,180 @@
+package socks5
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+)
+
+const tlsRecordTypeHandshake = 0x16
+
+// ALPN protocol IDs offered on TLS connections, so a client can pick the
+// engine up front instead of relying on sniffing.
+const (
+	ALPNSOCKS5 = "socks5"
+	ALPNHTTP   = "http/1.1"
+)
+
+// sniffConn is a net.Conn whose first bytes were peeked by a bufio.Reader.
+type sniffConn struct {
+	net.Conn
+	reader *bufio.Reader
+	// holding, set during the SOCKS5 handshake, keeps replies in pending
+	// while the client has already sent its next message, so the replies
+	// to a pipelined handshake go out in one write.
+	holding bool
+	pending []byte
+	// tap, if set, sees the bytes read and written until the handshake
+	// ends. See Config.HandshakeTap.
+	tap func(fromClient bool, b []byte)
+}
+
+func (c *sniffConn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 && c.reader.Buffered() == 0 {
+		// The client waits for the replies before sending more
+		if err := c.flush(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := c.reader.Read(b)
+	if c.tap != nil && n > 0 {
+		c.tap(true, b[:n])
+	}
+	return n, err
+}
+
+func (c *sniffConn) Write(b []byte) (int, error) {
+	if c.tap != nil {
+		c.tap(false, b)
+	}
+	if c.holding {
+		c.pending = append(c.pending, b...)
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *sniffConn) flush() error {
+	_, err := c.Conn.Write(c.pending)
+	c.pending = nil
+	return err
+}
+
+// releaseReplies ends holding and sends the held replies.
+func (c *sniffConn) releaseReplies() error {
+	c.tap = nil
+	if !c.holding {
+		return nil
+	}
+	c.holding = false
+	if len(c.pending) == 0 {
+		return nil
+	}
+	return c.flush()
+}
+
+func (c *sniffConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errCloseWriteNotSupported
+}
+
+// sniff routes conn by its first byte to the SOCKS5 engine, the HTTP CONNECT
+// engine, or, when allowTLS is set, a TLS unwrapper that sniffs again inside.
+func (s *SOCKS5Server) sniff(conn net.Conn, session *Session, allowTLS bool) error {
+	config := session.config
+	sc := &sniffConn{Conn: conn, reader: bufio.NewReader(conn)}
+	first, err := sc.reader.Peek(1)
+	if err != nil {
+		s.malformedHandshake(conn, config, session.ID, err)
+		return err
+	}
+
+	switch {
+	case first[0] == SOCKS5Version:
+		return s.handleSOCKS5(sc, session)
+	case first[0] == tlsRecordTypeHandshake && allowTLS && config.TLSConfig != nil:
+		tlsConn := tls.Server(sc, config.serverTLS)
+		if err := tlsConn.Handshake(); err != nil {
+			s.malformedHandshake(conn, config, session.ID, err)
+			return err
+		}
+		switch tlsConn.ConnectionState().NegotiatedProtocol {
+		case ALPNSOCKS5:
+			return s.handleSOCKS5(tlsConn, session)
+		case ALPNHTTP:
+			if config.HTTPConnect {
+				return s.handleHTTPConnect(&sniffConn{Conn: tlsConn, reader: bufio.NewReader(tlsConn)}, session)
+			}
+		}
+		return s.sniff(tlsConn, session, false)
+	case first[0] >= 'A' && first[0] <= 'Z' && config.HTTPConnect:
+		if config.Fallback != nil {
+			if method, _ := sc.reader.Peek(len(httpConnectPrefix)); string(method) != httpConnectPrefix {
+				return s.fallback(sc, session)
+			}
+		}
+		return s.handleHTTPConnect(sc, session)
+	case config.Fallback != nil:
+		return s.fallback(sc, session)
+	default:
+		// Let the SOCKS5 engine reject it
+		return s.handleSOCKS5(sc, session)
+	}
+}
+
+const httpConnectPrefix = "CONNECT "
+
+// fallback hands a connection that is not a proxy request to Config.Fallback,
+// with the sniffed bytes still to be read. It switches from the handshake
+// deadline to Config.IdleTimeout, if set, and keeps the handshake deadline
+// otherwise, so that clients that are not proxy clients cannot hold the
+// connection open for free.
+func (s *SOCKS5Server) fallback(conn *sniffConn, session *Session) error {
+	logSession(session.ID, "handing connection to fallback")
+	var handed net.Conn = conn
+	if timeout := session.config.IdleTimeout; timeout > 0 {
+		conn.SetDeadline(time.Time{})
+		handed = &idleConn{Conn: conn, timeout: timeout}
+	}
+	session.config.Fallback(handed)
+	return nil
+}
+
+// FallbackProxy returns a Config.Fallback relaying connections to address,
+// e.g. a web server, so scanners see that server on the proxy port.
+func FallbackProxy(address string, timeout time.Duration) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		target, err := net.DialTimeout("tcp", address, timeout)
+		if err != nil {
+			logPrintln("dial fallback failure", address, err)
+			return
+		}
+		defer target.Close()
+		go func() {
+			io.Copy(target, conn)
+			if cw, ok := target.(closeWriter); ok {
+				cw.CloseWrite()
+			}
+		}()
+		io.Copy(conn, target)
+	}
+}
+
+// serverTLSConfig returns c.TLSConfig, offering ALPNSOCKS5 (and ALPNHTTP
+// with HTTPConnect) unless it sets NextProtos itself.
+func serverTLSConfig(c *Config) *tls.Config {
+	config := c.TLSConfig
+	if config == nil || len(config.NextProtos) > 0 {
+		return config
+	}
+	config = config.Clone()
+	config.NextProtos = []string{ALPNSOCKS5}
+	if c.HTTPConnect {
+		config.NextProtos = append(config.NextProtos, ALPNHTTP)
+	}
+	return config
+}
@@ -0,0 +1,279 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoServer returns the address of a loopback TCP server echoing back what it reads.
+func echoServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func selfSignedTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"proxy.test"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func newSniffServer(t *testing.T) *SOCKS5Server {
+	return &SOCKS5Server{Config: &Config{
+		AuthMethod: MethodPassword,
+		PasswordChecker: func(username, password string) bool {
+			return username == "admin" && password == "123456"
+		},
+		HTTPConnect: true,
+		TLSConfig:   selfSignedTLSConfig(t),
+	}}
+}
+
+func serveOverPipe(server *SOCKS5Server) net.Conn {
+	clientConn, serverConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	return clientConn
+}
+
+func TestSniffHTTPConnect(t *testing.T) {
+	server := newSniffServer(t)
+	target := echoServer(t)
+
+	t.Run("authorized", func(t *testing.T) {
+		conn := serveOverPipe(server)
+		defer conn.Close()
+
+		go io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\nProxy-Authorization: Basic YWRtaW46MTIzNDU2\r\n\r\n")
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("should get 200 but got %v, %v", resp, err)
+		}
+
+		go io.WriteString(conn, "ping")
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("should echo ping but got %q, %v", buf, err)
+		}
+	})
+
+	t.Run("missing credentials", func(t *testing.T) {
+		conn := serveOverPipe(server)
+		defer conn.Close()
+
+		go io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+		if err != nil || resp.StatusCode != http.StatusProxyAuthRequired {
+			t.Fatalf("should get 407 but got %v, %v", resp, err)
+		}
+	})
+
+	t.Run("not connect", func(t *testing.T) {
+		conn := serveOverPipe(server)
+		defer conn.Close()
+
+		go io.WriteString(conn, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		status, _ := bufio.NewReader(conn).ReadString('\n')
+		if !strings.Contains(status, "405") {
+			t.Fatalf("should get 405 but got %q", status)
+		}
+	})
+}
+
+func TestSniffTLS(t *testing.T) {
+	server := newSniffServer(t)
+	target := echoServer(t)
+
+	conn := tls.Client(serveOverPipe(server), &tls.Config{InsecureSkipVerify: true})
+	defer conn.Close()
+
+	client := Client{Username: "admin", Password: "123456"}
+	if err := client.Handshake(conn, target); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	go io.WriteString(conn, "ping")
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("should echo ping but got %q, %v", buf, err)
+	}
+}
+
+func TestSniffTLSResumption(t *testing.T) {
+	server := newSniffServer(t)
+	target := echoServer(t)
+	cache := tls.NewLRUClientSessionCache(1)
+	for i := 0; i < 2; i++ {
+		conn := tls.Client(serveOverPipe(server), &tls.Config{InsecureSkipVerify: true, ClientSessionCache: cache})
+		client := Client{Username: "admin", Password: "123456"}
+		if err := client.Handshake(conn, target); err != nil {
+			t.Fatalf("should get error nil but got %s", err)
+		}
+		// Reading takes in the session ticket sent after the handshake
+		go io.WriteString(conn, "ping")
+		if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+			t.Fatal(err)
+		}
+		if resumed := conn.ConnectionState().DidResume; resumed != (i == 1) {
+			t.Fatalf("connection %d: should resume %v but got %v", i, i == 1, resumed)
+		}
+		conn.Close()
+	}
+}
+
+func TestSniffPlainSOCKS5(t *testing.T) {
+	server := newSniffServer(t)
+	target := echoServer(t)
+
+	conn := serveOverPipe(server)
+	defer conn.Close()
+	client := Client{Username: "admin", Password: "123456"}
+	if err := client.Handshake(conn, target); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+}
+
+func TestSniffTLSALPN(t *testing.T) {
+	server := newSniffServer(t)
+	target := echoServer(t)
+
+	t.Run("socks5", func(t *testing.T) {
+		conn := tls.Client(serveOverPipe(server), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{ALPNSOCKS5}})
+		defer conn.Close()
+		client := Client{Username: "admin", Password: "123456"}
+		if err := client.Handshake(conn, target); err != nil {
+			t.Fatalf("should get error nil but got %s", err)
+		}
+		if got := conn.ConnectionState().NegotiatedProtocol; got != ALPNSOCKS5 {
+			t.Fatalf("should negotiate %q but got %q", ALPNSOCKS5, got)
+		}
+	})
+
+	t.Run("http/1.1", func(t *testing.T) {
+		conn := tls.Client(serveOverPipe(server), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{ALPNHTTP}})
+		defer conn.Close()
+		go io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\nProxy-Authorization: Basic YWRtaW46MTIzNDU2\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("should get 200 but got %v, %v", resp, err)
+		}
+		if got := conn.ConnectionState().NegotiatedProtocol; got != ALPNHTTP {
+			t.Fatalf("should negotiate %q but got %q", ALPNHTTP, got)
+		}
+	})
+}
+
+func TestSniffFallback(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "welcome")
+	}))
+	defer web.Close()
+
+	server := newSniffServer(t)
+	server.Config.Fallback = FallbackProxy(web.Listener.Addr().String(), time.Second)
+	target := echoServer(t)
+
+	t.Run("http get", func(t *testing.T) {
+		conn := serveOverPipe(server)
+		defer conn.Close()
+		go io.WriteString(conn, "GET / HTTP/1.1\r\nHost: proxy.test\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("should get 200 from the fallback but got %v, %v", resp, err)
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 7))
+		if string(body) != "welcome" {
+			t.Fatalf("should get the fallback page but got %q", body)
+		}
+	})
+
+	t.Run("garbage", func(t *testing.T) {
+		var seen []byte
+		server := newSniffServer(t)
+		server.Config.Fallback = func(conn net.Conn) {
+			seen = make([]byte, 3)
+			io.ReadFull(conn, seen)
+		}
+		conn := serveOverPipe(server)
+		defer conn.Close()
+		conn.Write([]byte{0x01, 0x02, 0x03})
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		conn.Read(make([]byte, 1))
+		if !bytes.Equal(seen, []byte{0x01, 0x02, 0x03}) {
+			t.Fatalf("fallback should read the sniffed bytes but got %v", seen)
+		}
+	})
+
+	t.Run("timeouts", func(t *testing.T) {
+		for _, config := range []Config{{HandshakeTimeout: 100 * time.Millisecond}, {IdleTimeout: 100 * time.Millisecond}} {
+			server := SOCKS5Server{Config: &config}
+			ended := make(chan error, 1)
+			server.Config.Fallback = func(conn net.Conn) {
+				_, err := io.ReadAll(conn)
+				ended <- err
+			}
+			conn := serveOverPipe(&server)
+			defer conn.Close()
+			conn.Write([]byte("GET"))
+			select {
+			case err := <-ended:
+				if !errors.Is(err, os.ErrDeadlineExceeded) {
+					t.Fatalf("should time out the idle fallback connection but got %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("should not keep an idle fallback connection open")
+			}
+		}
+	})
+
+	t.Run("connect still served", func(t *testing.T) {
+		conn := serveOverPipe(server)
+		defer conn.Close()
+		go io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\nProxy-Authorization: Basic YWRtaW46MTIzNDU2\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("should get 200 but got %v, %v", resp, err)
+		}
+	})
+}
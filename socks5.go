@@ -1,11 +1,18 @@
 package socks5
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
-	"fmt"
 	"io"
 	"log"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -13,8 +20,22 @@ var (
 	ErrVersionNotSupported       = errors.New("protocol version not supported")
 	ErrMethodVersionNotSupported = errors.New("sub-negotiation method version not supported")
 	ErrCommandNotSupported       = errors.New("requst command not supported")
+	ErrCommandNotAllowed         = errors.New("request command not allowed for this user")
 	ErrInvalidReservedField      = errors.New("invalid reserved field")
 	ErrAddressTypeNotSupported   = errors.New("address type not supported")
+	ErrDomainTooLong             = errors.New("domain name longer than 255 bytes")
+	ErrInvalidDomain             = errors.New("domain name rejected by policy")
+	ErrServerClosed              = errors.New("server closed")
+	ErrServerNotListening        = errors.New("server is not listening")
+	ErrClientClosed              = errors.New("client closed connection")
+	ErrNoAcceptableMethod        = errors.New("no acceptable auth method")
+	ErrMarkNotSupported          = errors.New("SO_MARK is only supported on Linux")
+	ErrDSCPNotSupported          = errors.New("DSCP is not supported on this platform")
+	ErrIPv6OnlyNotSupported      = errors.New("IPV6_V6ONLY is only supported on Unix")
+	ErrRestartNotSupported       = errors.New("restart is not supported on this platform or listener")
+	ErrRestartFailed             = errors.New("restarted process exited before it was ready")
+	ErrPipelinedHandshake        = errors.New("client sent data before the server replied")
+	ErrRequestTimeout            = errors.New("request not answered within RequestTimeout")
 )
 
 const (
@@ -26,167 +47,1410 @@ type Server interface {
 	Run() error
 }
 
+// ManagedServer is a Server whose whole lifecycle its owner drives, as the
+// daemon does. SOCKS5Server implements it; other implementations and test
+// doubles can stand in for it.
+type ManagedServer interface {
+	Server
+	// Serve accepts connections on listener until Shutdown closes it.
+	Serve(listener net.Listener) error
+	// Shutdown stops accepting connections and waits for the sessions to
+	// end until ctx is done.
+	Shutdown(ctx context.Context) error
+	// Addr returns the address the server listens on, or nil.
+	Addr() net.Addr
+	// Stats returns a snapshot of the server's counters.
+	Stats() Stats
+}
+
+var _ ManagedServer = (*SOCKS5Server)(nil)
+
 type SOCKS5Server struct {
 	IP     string
 	Port   int
 	Config *Config
+
+	hostLimiter  hostLimiter
+	dialQueue    dialQueue
+	fairLimiter  fairLimiter
+	memory       memoryGuard
+	stats        serverStats
+	relayBuffers sync.Pool
+	udpPorts     udpPortAllocator
+	clock        clock
+	rand         randSource
+
+	initOnce sync.Once
+	initErr  error
+	// current is the config in use, replaced by ApplyConfig.
+	current  atomic.Pointer[Config]
+	mu       sync.Mutex
+	listener net.Listener
+	// ifaceListeners are the listeners on the addresses of the interface
+	// named by IP, keyed by address; ifaceDone ends serveInterface.
+	ifaceListeners map[string]net.Listener
+	ifaceDone      chan struct{}
+	conns          map[net.Conn]*Session
+	// ending holds why sessions closed by CloseSession or Shutdown ended.
+	ending map[string]TerminationReason
+	// forwarder is the client of a NewForwarder server.
+	forwarder *Client
+	sessions  sync.WaitGroup
+	closed    bool
+
+	// udpAssociations counts the UDP associations of each user or client IP.
+	udpAssociations hostLimiter
+	// statsStop stops the flushes to Config.StatsStore, which close
+	// statsDone when finished.
+	statsStop, statsDone chan struct{}
+	// classLimiters pace the sessions of each class under
+	// Config.PortClassLimits.
+	classLimiters [numPortClasses]fairLimiter
+	// udpRelays are the running UDP associations, for
+	// ExportUDPAssociations.
+	udpRelays map[*udpAssociation]struct{}
+	// targets are the target connections of TCP sessions, keyed by session
+	// ID, for Config.Teardown.
+	targets map[string]net.Conn
 }
 
 type Config struct {
 	AuthMethod      Method
 	PasswordChecker func(username, password string) bool
-	TCPTimeout      time.Duration
+	// MethodSelector, if set, chooses the auth method of each SOCKS5
+	// handshake instead of AuthMethod, e.g. by source address or TLS client
+	// certificate. Returning a method the client did not offer, or
+	// MethodNoAcceptable, rejects the client. Clients it picks MethodHMAC
+	// or MethodPassword for fail auth unless HMACSecret, respectively
+	// Users or PasswordChecker, is set.
+	MethodSelector func(req *MethodRequest) Method
+	// MaxAuthMethods rejects greetings announcing more auth methods as
+	// malformed, without reading them. Zero allows the protocol's 255.
+	MaxAuthMethods int
+	// SilentReject closes connections offering no acceptable auth method
+	// without the MethodNoAcceptable reply, giving scanners less to
+	// fingerprint the service by.
+	SilentReject bool
+	// HMACSecret returns the password of a user for MethodHMAC. It is
+	// required when AuthMethod is MethodHMAC.
+	HMACSecret func(username string) (secret string, ok bool)
+	// Users, if set, authenticates MethodPassword clients instead of PasswordChecker.
+	Users *Users
+	// Deprecated: TCPTimeout is used as DialTimeout when DialTimeout is not set.
+	TCPTimeout time.Duration
+	// DialTimeout bounds connecting to the target (or upstream) server.
+	DialTimeout time.Duration
+	// HandshakeTimeout bounds the auth and request phases of a connection.
+	HandshakeTimeout time.Duration
+	// RequestTimeout bounds the time from reading a request to its reply,
+	// covering rules, policy hooks, DNS and the dial, which a client
+	// deadline cannot interrupt. When it passes, the client gets
+	// ReplyTTLExpired and is disconnected while the request is abandoned.
+	RequestTimeout time.Duration
+	// IdleTimeout closes a relayed session after it has seen no traffic for this long.
+	IdleTimeout time.Duration
+	// Teardown chooses, by TerminationReason, how the connections of
+	// sessions closed by CloseSession, Shutdown or Config.MaxMemory are
+	// ended, e.g. with an RST for TerminationQuotaExceeded. Reasons
+	// without an entry get a FIN.
+	Teardown map[TerminationReason]Teardown
+	// Mark sets SO_MARK (fwmark) on outbound TCP connections so policy
+	// routing can steer proxy egress, e.g. through a VPN interface. Linux only.
+	Mark int
+	// DialControl, if set, is called with the raw socket of every outbound
+	// TCP connection before it connects, like net.Dialer.Control, to set
+	// arbitrary socket options (TTL, TOS, SO_BINDTODEVICE, ...). It runs
+	// after Mark is applied.
+	DialControl func(network, address string, c syscall.RawConn) error
+	// MaxConnsPerHost caps concurrent sessions to a single destination host.
+	// Requests past the cap are answered with ReplyHostConnectionLimit and
+	// counted in Stats.HostLimitRejections. Zero means no limit.
+	MaxConnsPerHost int
+	// MaxConcurrentDials caps outbound dials in progress across all
+	// sessions, smoothing bursts such as many clients reconnecting at once.
+	// Requests past the cap wait, at most DialQueueSize of them, for up to
+	// DialQueueTimeout (DialTimeout if zero) before failing, or for as long
+	// as it takes if both are zero. Zero means no limit.
+	MaxConcurrentDials int
+	DialQueueSize      int
+	DialQueueTimeout   time.Duration
+	// RelayBufferSize switches the relay to fixed, pooled buffers of this size.
+	// Zero uses io.Copy, which lets the kernel splice TCP to TCP on Linux.
+	RelayBufferSize int
+	// BandwidthLimit caps the total relay throughput of TCP sessions, both
+	// directions together, in bytes per second. Sessions take turns writing
+	// small chunks, so a bulk transfer cannot starve interactive sessions.
+	// It disables splicing. Zero means no limit.
+	BandwidthLimit int64
+	// PortClassLimits caps the throughput of interactive, web and bulk
+	// sessions separately, by destination port. It disables splicing for
+	// capped classes.
+	PortClassLimits PortClassLimits
+	// MaxMemory caps the approximate memory held by session buffers, in
+	// bytes, so that a load spike cannot get the process OOM-killed. New
+	// connections past the cap are closed right away. Zero means no limit.
+	MaxMemory int64
+	// MemoryShedIdle, if set, makes room under MaxMemory for new connections
+	// by closing relayed sessions that have been idle for at least this
+	// long, longest idle first. It disables splicing.
+	MemoryShedIdle time.Duration
+	// RequireSNIMatch closes CONNECT sessions to a domain whose client starts
+	// with a TLS ClientHello naming another server, to prevent domain
+	// fronting around domain rules. ClientHellos without a server name, and
+	// clients not starting with TLS, pass. It disables splicing of checked
+	// sessions.
+	RequireSNIMatch bool
+	// RejectIPTargets refuses CONNECT requests for raw IPv4/IPv6 targets so
+	// that every session carries a domain that rules can match on, and
+	// drops UDP datagrams for IP targets.
+	RejectIPTargets bool
+	// RejectDomainTargets refuses CONNECT requests for domain targets with
+	// ReplyAddressTypeNotSupported, for deployments where clients must
+	// resolve names themselves, and drops UDP datagrams for domain targets.
+	// It cannot be combined with RejectIPTargets.
+	RejectDomainTargets bool
+	// DomainPolicy decides which domain targets are accepted, e.g. to allow
+	// service-discovery names with underscores. Nil uses ValidHostname.
+	// Rejected domains get ReplyHostUnreachable; UDP datagrams for them are
+	// dropped.
+	DomainPolicy func(domain string) bool
+	// StrictRSV drops requests with a non-zero RSV byte, as RFC 1928 requires.
+	// Set it to false to tolerate broken clients that fill in the field.
+	// Nil means true.
+	StrictRSV *bool
+	// DisallowPipelining drops clients that send the next handshake message,
+	// or data for the target, before the reply to the previous one, as
+	// "0-RTT" clients do to save round trips. Pipelined clients are served
+	// by default. Only bytes that arrive together with a message are
+	// detected.
+	DisallowPipelining bool
+	// IdentResolver, if set, looks up who is behind each SOCKS5 client, e.g.
+	// (&Ident{}).Lookup for RFC 1413 IDENT, while the handshake runs. The
+	// result is stored in AuthContext.Ident. The request phase waits for
+	// it, so the resolver should give up quickly.
+	IdentResolver IdentResolver
+	// EnableUDP serves UDP ASSOCIATE requests. When off they get
+	// ReplyCommandNotSupported.
+	EnableUDP bool
+	// EnableBind serves BIND requests. When off they get ReplyCommandNotSupported.
+	EnableBind bool
+	// UDPBindIP is the local IP that UDP relay sockets listen on. It defaults
+	// to the local IP of the TCP control connection.
+	UDPBindIP net.IP
+	// UDPAdvertisedIP is sent as BND.ADDR in UDP ASSOCIATE replies, e.g. the
+	// public IP of a deployment behind NAT. It defaults to the bind IP.
+	UDPAdvertisedIP net.IP
+	// UDPPortMin and UDPPortMax restrict UDP relay sockets to a port range,
+	// e.g. a firewall pinhole. Zero uses ephemeral ports.
+	UDPPortMin int
+	UDPPortMax int
+	// UDPAmplificationRatio caps the bytes relayed to a UDP client at this
+	// multiple of the bytes it sent, dropping replies past the cap, until
+	// the association is confirmed. An association is confirmed when its
+	// client address is the IP of the TCP control connection; one naming
+	// another IP may be a spoofed reflection target. Zero disables the cap.
+	UDPAmplificationRatio int
+	// UDPCloseOnUnreachable closes UDP associations whose only target is
+	// reported unreachable by ICMP, instead of dropping the datagrams.
+	UDPCloseOnUnreachable bool
+	// KeepIPv4Mapped presents IPv4-mapped IPv6 addresses (::ffff:a.b.c.d)
+	// as IPv6 in replies, logs and rule matching, where they then only match
+	// IPv6 networks. By default they are normalized to IPv4.
+	KeepIPv4Mapped bool
+	// NAT64Prefix, if set, is the NAT64 prefix (RFC 6052, e.g. 64:ff9b::/96)
+	// of an IPv6-only egress network. IPv4 targets are then reached at their
+	// address within the prefix, and UDP replies from the prefix are
+	// presented to clients with the embedded IPv4 address.
+	NAT64Prefix *net.IPNet
+	// UDPBatchSize, if above 1, relays up to this many UDP datagrams per
+	// system call on Linux (recvmmsg and sendmmsg), cutting overhead at high
+	// packet rates. Every relay socket then holds UDPBatchSize 64KiB buffers.
+	UDPBatchSize int
+	// MaxUDPAssociationsPerUser caps the concurrent UDP associations of a
+	// user, or of a client IP for sessions without a username. Requests past
+	// the cap get ReplyConnectionNotAllowed.
+	MaxUDPAssociationsPerUser int
+	// UDPMaxLifetime, if non-zero, closes UDP associations this long after
+	// they start, releasing their sockets and NAT state.
+	UDPMaxLifetime time.Duration
+	// UDPMaxDatagrams, if non-zero, closes UDP associations after relaying
+	// this many datagrams, counting both directions.
+	UDPMaxDatagrams int64
+	// HandOffUDP makes Restart hand the running UDP associations over to
+	// the new process along with the listener, see ExportUDPAssociations.
+	HandOffUDP bool
+	// Rules override per-session settings for matching requests.
+	Rules []Rule
+	// HTTPCache, if set, caches plaintext HTTP GET responses for sessions
+	// matching a Rule with CacheHTTP. It is off by default.
+	HTTPCache *HTTPCache
+	// Capture, if set, mirrors relayed bytes of sessions matching a Rule
+	// with Capture into per-session files. It is off by default.
+	Capture *Capture
+	// HTTPConnect also serves HTTP CONNECT proxy requests on the SOCKS5
+	// port, detected from the first byte of the connection.
+	HTTPConnect bool
+	// Fallback, if set, is handed connections that are neither SOCKS5 nor
+	// (with HTTPConnect) HTTP CONNECT, e.g. to serve a decoy web page or
+	// relay to a real web server with FallbackProxy, so the port looks like
+	// that server to scanners. The connection is closed when it returns.
+	// It times out after IdleTimeout without traffic, or without one at
+	// HandshakeTimeout.
+	Fallback func(conn net.Conn)
+	// TLSConfig, if set, unwraps connections that start with a TLS
+	// handshake and serves SOCKS5 (or HTTP CONNECT) inside, picked by the
+	// negotiated ALPN protocol or else by sniffing.
+	TLSConfig *tls.Config
+	// CertAuth, if set, authenticates TLS clients by their client
+	// certificate instead of SOCKS5 auth.
+	CertAuth *CertAuth
+	// CircuitBreaker, if set, rejects requests to destinations whose dials keep failing.
+	CircuitBreaker *CircuitBreaker
+	// SourceFilter, if set, drops connections from unwanted source networks.
+	SourceFilter *SourceFilter
+	// ListenNetwork is the network Run listens on: "tcp" (the default)
+	// listens on both IPv4 and IPv6 where the address allows, e.g. for an
+	// empty IP or "::", while "tcp4" and "tcp6" restrict it to one family.
+	ListenNetwork string
+	// IPv6Only sets IPV6_V6ONLY on IPv6 listeners, so that one on "::"
+	// does not also take IPv4 connections, e.g. to serve IPv4 from another
+	// process. Unix only.
+	IPv6Only bool
+	// ScanGuard, if set, temporarily bans sources that repeatedly fail the
+	// handshake, and optionally authentication or policy checks.
+	ScanGuard *ScanGuard
+	// LogRedaction, if set, redacts usernames, hosts and addresses in the
+	// server's log lines.
+	LogRedaction *Redaction
+	// ReplyHook is called with the final reply details before the reply is
+	// sent to the client. It may change BindIP and BindPort of a success reply.
+	ReplyHook func(info *ReplyInfo)
+	// HandshakeTap, if set, is called with the raw bytes of every read and
+	// write of a SOCKS5 handshake, from the method negotiation to the reply
+	// to the request, to debug odd clients without a packet capture. The
+	// bytes include passwords.
+	HandshakeTap func(data HandshakeBytes)
+	// ProgressHook, if set, is called with the byte counts of relayed TCP
+	// sessions every ProgressInterval and every ProgressBytes bytes (when
+	// non-zero), and once more when a session ends.
+	ProgressHook     func(progress Progress)
+	ProgressInterval time.Duration
+	ProgressBytes    int64
+	// Recorder, if set, stores a record of every finished TCP session.
+	Recorder SessionRecorder
+	// Plugins, if set, are asked about every request and told about every
+	// finished TCP session, in order. See LoadPlugin.
+	Plugins []Plugin
+	// Sinkhole receives the sessions of RuleSinkhole rules, e.g.
+	// (&FileSinkhole{Dir: dir}).Open.
+	Sinkhole SinkholeHandler
+	// Upstream, if set, chains every outbound TCP connection through another SOCKS5 server.
+	Upstream *Upstream
+	// Egress, if set, spreads outbound TCP connections across several
+	// source IPs or interfaces. It cannot be combined with Upstream.
+	Egress *Egress
+	// Quirks works around bugs of known clients.
+	Quirks Quirks
+	// DomainBlocklist, if set, refuses requests for the domains it lists
+	// with ReplyConnectionNotAllowed and drops UDP datagrams for them.
+	DomainBlocklist *DomainBlocklist
+	// Reputation, if set, refuses connections to destination IPs known to
+	// be malicious.
+	Reputation *Reputation
+	// StatsStore, if set, keeps the cumulative counters of Stats, totals and
+	// per user, across restarts: they are restored on start and saved every
+	// StatsFlushInterval (default one minute) and on Shutdown. It is read
+	// once, when the server starts. Restart saves them a last time before
+	// the new process restores them, so what the old process counts while
+	// it drains is not saved.
+	StatsStore         StatsStore
+	StatsFlushInterval time.Duration
+	// ParallelDial, if above 1, resolves the domain of a CONNECT request
+	// while the request waits for its dial, then dials up to this many of
+	// the domain's addresses at once and relays through the first to
+	// connect, canceling the others. It speeds up hosts with several
+	// addresses of which some are down. It does not apply with Upstream.
+	ParallelDial int
+	// Resolver resolves the domains of targets dialed directly, including
+	// the lookups of ParallelDial, and of UDP datagrams. Nil uses
+	// net.DefaultResolver.
+	Resolver *net.Resolver
+
+	// serverTLS is TLSConfig as served, see serverTLSConfig. One instance
+	// per config keeps its session ticket keys, so clients can resume.
+	serverTLS *tls.Config
+}
+
+// Upstream describes a SOCKS5 server that outbound connections are chained through.
+type Upstream struct {
+	Address string
+	// Username and Password are the default upstream credentials.
+	// Leave Username empty to offer only MethodNoAuth.
+	Username string
+	Password string
+	// Credentials maps a locally authenticated username to the upstream
+	// account used for its sessions. Users without an entry fall back to
+	// Username and Password.
+	Credentials map[string]UpstreamAccount
+	// OnFailover, if set, is called when a connection to target is dialed
+	// directly because the upstream could not be reached, with the error of
+	// the upstream dial. See Rule.FailoverDirect.
+	OnFailover func(target string, err error)
+}
+
+type UpstreamAccount struct {
+	Username string
+	Password string
+}
+
+// AuthContext records the outcome of the auth phase of a connection.
+type AuthContext struct {
+	// SessionID is the ID of the Session the request arrived on.
+	SessionID string
+	Method    Method
+	// Username is set when the client authenticated with MethodPassword.
+	Username string
+	// User is the account of Config.Users the client authenticated as.
+	User *User
+	// Labels tag the session for Stats and session records, e.g. "team=qa".
+	// They come from the user account and the matching rule, and a
+	// ReplyHook may add more with AddLabels.
+	Labels []string
+	// Ident is the identity Config.IdentResolver returned for the client,
+	// if any.
+	Ident string
+	// ClientAddr is the address the client connected from.
+	ClientAddr net.Addr
+
+	// deadline enforces Config.RequestTimeout until the reply is written.
+	deadline *requestDeadline
+	// config is the config of the session, see Session.
+	config *Config
+	// ctx is the context of the session, see Session.
+	ctx context.Context
+}
+
+// AddLabels adds labels the session does not have yet.
+func (a *AuthContext) AddLabels(labels ...string) {
+	for _, label := range labels {
+		if !containsString(a.Labels, label) {
+			a.Labels = append(a.Labels, label)
+		}
+	}
+}
+
+// ReplyInfo describes the reply that ends the request phase of a session.
+type ReplyInfo struct {
+	Request *ClientRequestMessage
+	Auth    *AuthContext
+	Reply   ReplyType
+	// BindIP and BindPort are presented to the client in a success reply.
+	// A ReplyHook may override them, e.g. with the public address behind NAT.
+	BindIP   net.IP
+	BindPort uint16
+}
+
+// HandshakeBytes is the data of one read or write of a SOCKS5 handshake,
+// passed to Config.HandshakeTap.
+type HandshakeBytes struct {
+	SessionID string
+	// FromClient is set for bytes read from the client, unset for replies.
+	FromClient bool
+	Data       []byte
+}
+
+func (u *Upstream) client(username string, timeout time.Duration) *Client {
+	client := Client{
+		ProxyAddress: u.Address,
+		Username:     u.Username,
+		Password:     u.Password,
+		Timeout:      timeout,
+	}
+	if account, ok := u.Credentials[username]; ok && username != "" {
+		client.Username = account.Username
+		client.Password = account.Password
+	}
+	return &client
 }
 
 func initConfig(config *Config) error {
-	if config.AuthMethod == MethodPassword && config.PasswordChecker == nil {
-		return ErrPasswordCheckerNotSet
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	if config.DialTimeout == 0 {
+		config.DialTimeout = config.TCPTimeout
+	}
+	for i := range config.Rules {
+		if err := config.Rules[i].compile(i); err != nil {
+			return err
+		}
+	}
+	config.serverTLS = serverTLSConfig(config)
+	if config.SourceFilter != nil {
+		return config.SourceFilter.compile()
 	}
 	return nil
 }
 
 func (s *SOCKS5Server) Run() error {
-	//Set log level
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-
 	// Initialize server configuration
-	if err := initConfig(s.Config); err != nil {
+	if err := s.init(); err != nil {
 		return err
 	}
 
-	// Listen on the specified IP:PORT
-	address := fmt.Sprintf("%s:%d", s.IP, s.Port)
-	listener, err := net.Listen("tcp", address)
+	// An interface name stands for all of its addresses
+	if _, ok, _ := interfaceListenAddrs(s.IP, s.Port, s.listenNetwork()); ok {
+		return s.serveInterface()
+	}
+
+	// Listen on the specified IP:PORT, where IPv6 literals may come bracketed
+	host := strings.TrimSuffix(strings.TrimPrefix(s.IP, "["), "]")
+	listener, err := s.listen(net.JoinHostPort(host, strconv.Itoa(s.Port)))
 	if err != nil {
 		return err
 	}
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on listener, which may have been inherited
+// from a parent process with InheritedListener, until Shutdown closes it.
+// It always returns a non-nil error, ErrServerClosed after Shutdown.
+func (s *SOCKS5Server) Serve(listener net.Listener) error {
+	//Set log level
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	if err := s.init(); err != nil {
+		listener.Close()
+		return err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+	return s.accept(listener, s.isClosed)
+}
+
+// Addr returns the address of the listener of Run or Serve, or nil before
+// the server listens and while it serves the addresses of an interface.
+func (s *SOCKS5Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// accept serves the connections of listener until stopped reports that
+// it was closed on purpose.
+func (s *SOCKS5Server) accept(listener net.Listener, stopped func() bool) error {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("connection failure from %s: %s", conn.RemoteAddr(), err)
+			if stopped() {
+				return ErrServerClosed
+			}
+			logPrintf("accept failure: %s", err)
 			continue
 		}
 
 		go func() {
-			defer conn.Close()
-			if err := s.handleConnection(conn); err != nil {
-				log.Printf("handle connection failure from %s: %s", conn.RemoteAddr(), err)
+			session := s.newSession(conn)
+			if err := s.serve(conn, session); err != nil && err != ErrServerClosed && err != ErrSourceBanned && err != ErrSourceFiltered && err != ErrMemoryLimit && err != ErrClientClosed {
+				logSession(session.ID, "handle connection failure from", session.config.LogRedaction.Address(conn.RemoteAddr().String()), err)
 			}
 		}()
 	}
 }
 
-func (s *SOCKS5Server) handleConnection(conn net.Conn) error {
+// ServeConn serves a single SOCKS5 connection accepted by the caller, from
+// any transport, and closes it when done. It returns ErrServerClosed after
+// Shutdown, and ErrClientClosed when the client hung up or reset the
+// connection, which is routine rather than a failure.
+func (s *SOCKS5Server) ServeConn(conn net.Conn) error {
+	return s.serve(conn, s.newSession(conn))
+}
+
+func (s *SOCKS5Server) serve(conn net.Conn, session *Session) error {
+	defer conn.Close()
+	defer session.end()
+	if err := s.init(); err != nil {
+		return err
+	}
+	config := session.config
+	if filter := config.SourceFilter; filter != nil && !filter.allowed(net.ParseIP(sourceIP(conn))) {
+		s.stats.filteredConnections.Add(1)
+		return ErrSourceFiltered
+	}
+	if !s.trackConn(conn, session) {
+		return ErrServerClosed
+	}
+	defer s.untrackConn(conn)
+	charge := s.admitMemory(conn, session)
+	if charge == nil {
+		s.stats.memoryRejections.Add(1)
+		return ErrMemoryLimit
+	}
+	defer s.memory.release(charge)
+	if guard := config.ScanGuard; guard != nil && guard.banned(sourceIP(conn)) {
+		s.stats.bannedConnections.Add(1)
+		return ErrSourceBanned
+	}
+	err := s.handleConnection(conn, session)
+	switch {
+	case err != nil && closedByPeer(err):
+		return ErrClientClosed
+	case errors.Is(err, net.ErrClosed):
+		// Closed on this side, e.g. by CloseSession or Shutdown
+		return nil
+	}
+	return err
+}
+
+// closedByPeer reports whether err means the other end closed or reset the
+// connection, which browsers and other clients do routinely. Errors of the
+// target of a relay, see targetError, are not the client's.
+func closedByPeer(err error) bool {
+	var targetErr *targetError
+	if errors.As(err, &targetErr) {
+		return false
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE)
+}
+
+// targetError is an error of the target connection of a relay.
+type targetError struct {
+	err error
+}
+
+func (e *targetError) Error() string { return "target: " + e.err.Error() }
+
+func (e *targetError) Unwrap() error { return e.err }
+
+// relayError returns err, from copying src to dst, marked as a targetError
+// if it came from the target side: writing to it if fromClient, reading
+// from it otherwise.
+func relayError(err error, fromClient bool) error {
+	var opErr *net.OpError
+	if err == nil || !errors.As(err, &opErr) {
+		return err
+	}
+	written := opErr.Op == "write" || opErr.Op == "readfrom"
+	if written == fromClient {
+		return &targetError{err}
+	}
+	return err
+}
+
+// init initializes s.Config once.
+func (s *SOCKS5Server) init() error {
+	s.initOnce.Do(func() {
+		s.initErr = initConfig(s.Config)
+		s.stats.started.Store(timeNow(s.clock).UnixNano())
+		if store := s.Config.StatsStore; s.initErr == nil && store != nil {
+			if s.initErr = s.restoreStats(store); s.initErr == nil {
+				s.startStatsFlush()
+			}
+		}
+		if s.initErr == nil {
+			s.current.CompareAndSwap(nil, s.Config)
+		}
+	})
+	return s.initErr
+}
+
+// config returns the config in use.
+func (s *SOCKS5Server) config() *Config {
+	if config := s.current.Load(); config != nil {
+		return config
+	}
+	return s.Config
+}
+
+// ApplyConfig validates config and makes it the config for new requests.
+// Established sessions keep running; s.Config is left untouched. Use
+// ApplyConfigDiff to see what changes.
+func (s *SOCKS5Server) ApplyConfig(config *Config) error {
+	_, err := s.ApplyConfigDiff(config, false)
+	return err
+}
+
+// Shutdown stops accepting connections and waits for active sessions to
+// finish. When ctx is done first, the remaining sessions are closed and
+// ctx.Err() is returned.
+func (s *SOCKS5Server) Shutdown(ctx context.Context) error {
+	defer s.stopStatsFlush()
+	s.mu.Lock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.closeIfaceListenersLocked()
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.sessions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		var ending []endingConn
+		s.mu.Lock()
+		for conn, session := range s.conns {
+			ending = s.endSessionLocked(session.ID, conn, TerminationShutdown, ending)
+		}
+		s.mu.Unlock()
+		closeEnding(ending)
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (s *SOCKS5Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// trackConn registers an accepted connection, reporting false after Shutdown.
+func (s *SOCKS5Server) trackConn(conn net.Conn, session *Session) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]*Session)
+	}
+	s.conns[conn] = session
+	s.sessions.Add(1)
+	s.stats.connections.Add(1)
+	return true
+}
+
+func (s *SOCKS5Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	if session, ok := s.conns[conn]; ok {
+		delete(s.ending, session.ID)
+	}
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.sessions.Done()
+}
+
+func (s *SOCKS5Server) handleConnection(conn net.Conn, session *Session) error {
+	config := session.config
+	if config.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(config.HandshakeTimeout))
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		// Go enables TCP_NODELAY by default; make sure Nagle does not hold
+		// back handshake replies on conns that had it turned off
+		tcpConn.SetNoDelay(true)
+	}
+	if config.HTTPConnect || config.TLSConfig != nil || config.Fallback != nil {
+		return s.sniff(conn, session, true)
+	}
+	return s.handleSOCKS5(conn, session)
+}
+
+// handleSOCKS5 serves a SOCKS5 client. Handshake messages are read exactly,
+// so whatever a pipelining client sent ahead stays in conn (or in the
+// reader of a sniffConn) for the next phase and the relay. Each reply is a
+// single write, and on a sniffConn the replies to messages that arrived
+// together are sent together.
+func (s *SOCKS5Server) handleSOCKS5(conn net.Conn, session *Session) error {
+	config := session.config
+	tap := config.HandshakeTap
+	if _, ok := conn.(*sniffConn); !ok && (config.DisallowPipelining || tap != nil) {
+		// Buffer reads to see what arrives along with each message
+		conn = &sniffConn{Conn: conn, reader: bufio.NewReader(conn)}
+	}
+	if sc, ok := conn.(*sniffConn); ok {
+		sc.holding = true
+		if tap != nil {
+			sc.tap = func(fromClient bool, b []byte) {
+				tap(HandshakeBytes{SessionID: session.ID, FromClient: fromClient, Data: append([]byte(nil), b...)})
+			}
+		}
+		defer sc.releaseReplies()
+	}
+	ident := s.startIdent(conn, session)
 	// 协商过程
-	if err := s.auth(conn); err != nil {
+	authCtx, err := s.auth(conn, session)
+	if err != nil {
+		releaseReplies(conn)
+		switch err {
+		case ErrPasswordAuthFailure:
+			s.authFailure(conn, config, session.ID)
+		case ErrNoAcceptableMethod:
+		default:
+			s.malformedHandshake(conn, config, session.ID, err)
+		}
 		return err
 	}
+	if authCtx.Ident = ident(); authCtx.Ident != "" {
+		logSession(session.ID, "ident", config.LogRedaction.Username(authCtx.Ident))
+	}
 
 	// Request phase
-	return s.request(conn)
+	return s.request(conn, authCtx)
+}
+
+type closeWriter interface {
+	CloseWrite() error
 }
 
-func forward(conn io.ReadWriter, targetConn io.ReadWriteCloser) error {
+var errCloseWriteNotSupported = errors.New("half-close not supported")
+
+// forward relays both directions until each side has finished sending.
+// An EOF from one side is propagated to the other as a half-close (FIN)
+// when the destination supports CloseWrite, so the other direction keeps
+// flowing; otherwise both connections are torn down. Relayed bytes are
+// added to the server totals and to tally, if set, and as they are
+// relayed to the day's count of tally.today. The relay is paced by the
+// limits of config.
+func (s *SOCKS5Server) forward(conn io.ReadWriter, targetConn io.ReadWriteCloser, config *Config, tally *relayTally) error {
 	defer targetConn.Close()
-	go io.Copy(targetConn, conn)
-	_, err := io.Copy(conn, targetConn)
-	if err != nil && err != io.EOF {
-		log.Println("forward error", err)
+
+	closeAll := func() {
+		targetConn.Close()
+		if c, ok := conn.(io.Closer); ok {
+			c.Close()
+		}
+	}
+	var tornDown atomic.Bool
+	// The direction that finishes first tells why the session ended
+	var first sync.Once
+	var reason TerminationReason
+	errc := make(chan error, 2)
+	priority, class := 0, PortClassBulk
+	if tally != nil {
+		priority, class = tally.priority, tally.class
+	}
+	relay := func(dst io.Writer, src io.Reader, total, session *atomic.Int64, fromClient bool) {
+		w := dst
+		if tally != nil && tally.today != "" {
+			w = &todayWriter{w: dst, server: s, username: tally.today}
+		}
+		n, err := s.copy(w, src, config, priority, class)
+		err = relayError(err, fromClient)
+		total.Add(n)
+		if session != nil {
+			session.Add(n)
+		}
+		first.Do(func() { reason = relayTermination(err, fromClient) })
+		if tornDown.Load() {
+			// Caused by the other direction closing everything
+			err = nil
+		}
+		if cw, ok := dst.(closeWriter); ok && err == nil && cw.CloseWrite() == nil {
+			// Half-closed, keep relaying the other direction
+		} else {
+			tornDown.Store(true)
+			closeAll()
+		}
+		errc <- err
+	}
+	var sent, received *atomic.Int64
+	if tally != nil {
+		sent, received = &tally.sent, &tally.received
+	}
+	go relay(targetConn, conn, &s.stats.bytesSent, sent, true)
+	go relay(conn, targetConn, &s.stats.bytesReceived, received, false)
+
+	var err error
+	for i := 0; i < 2; i++ {
+		if e := <-errc; e != nil && err == nil {
+			err = e
+		}
+	}
+	if tally != nil {
+		tally.reason = reason
 	}
 	return err
 }
 
-func (s *SOCKS5Server) request(conn io.ReadWriter) error {
+// idleConn extends the connection deadline on every read and write.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+func (c *idleConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errCloseWriteNotSupported
+}
+
+// readerConn replaces the read side of conn, e.g. with a reader that
+// already buffered some of its data, and keeps its write and close methods.
+type readerConn struct {
+	io.Reader
+	conn io.ReadWriter
+}
+
+func (c *readerConn) Write(b []byte) (int, error) {
+	return c.conn.Write(b)
+}
+
+func (c *readerConn) CloseWrite() error {
+	if cw, ok := c.conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errCloseWriteNotSupported
+}
+
+func (c *readerConn) Close() error {
+	if closer, ok := c.conn.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// copy relays src to dst, using a pooled buffer when the RelayBufferSize of
+// config is set and pacing writes with the given Rule.Priority when its
+// BandwidthLimit or the PortClassLimits of class are.
+func (s *SOCKS5Server) copy(dst io.Writer, src io.Reader, config *Config, priority int, class PortClass) (int64, error) {
+	if rate := config.BandwidthLimit; rate > 0 {
+		dst = &pacedWriter{w: dst, limiter: &s.fairLimiter, rate: rate, priority: priority}
+	}
+	if rate := config.PortClassLimits.rate(class); rate > 0 {
+		dst = &pacedWriter{w: dst, limiter: &s.classLimiters[class], rate: rate, priority: priority}
+	}
+	size := config.RelayBufferSize
+	if size <= 0 {
+		return io.Copy(dst, src)
+	}
+	buf, ok := s.relayBuffers.Get().(*[]byte)
+	if !ok || len(*buf) != size {
+		b := make([]byte, size)
+		buf = &b
+	}
+	defer s.relayBuffers.Put(buf)
+	// Hide ReaderFrom/WriterTo so io.CopyBuffer actually uses buf
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
+
+// writeReply runs the reply hook and sends the reply to the client.
+func (s *SOCKS5Server) writeReply(conn io.Writer, info *ReplyInfo) error {
+	if info.Auth != nil && info.Auth.deadline != nil && !info.Auth.deadline.reply() {
+		return ErrRequestTimeout
+	}
+	return s.sendReply(conn, info)
+}
+
+// sendReply writes the reply of info, regardless of Config.RequestTimeout.
+func (s *SOCKS5Server) sendReply(conn io.Writer, info *ReplyInfo) error {
+	config := s.sessionConfig(info.Auth)
+	if config.ReplyHook != nil {
+		config.ReplyHook(info)
+	}
+	if tunnel, ok := conn.(*httpTunnel); ok {
+		return tunnel.writeStatus(info.Reply)
+	}
+	if info.Reply != ReplySuccess {
+		if err := WriteRequestFailureMessage(conn, info.Reply); err != nil {
+			return err
+		}
+		return releaseReplies(conn)
+	}
+	redaction := config.LogRedaction
+	keepMapped := config.KeepIPv4Mapped
+	logSession(info.Auth.SessionID, "reply success to", redaction.Host(info.Request.TargetIP), redaction.Port(info.Request.Port),
+		"bind", redaction.Host(ipString(info.BindIP, keepMapped)), redaction.Port(info.BindPort))
+	if err := writeRequestSuccess(conn, info.BindIP, info.BindPort, keepMapped); err != nil {
+		return err
+	}
+	return releaseReplies(conn)
+}
+
+// releaseReplies sends the replies a sniffConn held during the handshake,
+// which ends with the reply to the request.
+func releaseReplies(conn io.Writer) error {
+	if sc, ok := conn.(*sniffConn); ok {
+		return sc.releaseReplies()
+	}
+	return nil
+}
+
+func (s *SOCKS5Server) writeFailure(conn io.Writer, message *ClientRequestMessage, authCtx *AuthContext, reply ReplyType) error {
+	return s.writeReply(conn, &ReplyInfo{Request: message, Auth: authCtx, Reply: reply})
+}
+
+func (s *SOCKS5Server) request(conn io.ReadWriter, authCtx *AuthContext) error {
+	config := s.sessionConfig(authCtx)
 	// Read client request message from connection
-	message, err := NewClientRequestMessage(conn)
+	strict := config.StrictRSV == nil || *config.StrictRSV
+	message, err := readClientRequestMessage(conn, strict)
+	if err == ErrCommandNotSupported {
+		// A well-formed request of an extension such as Tor's RESOLVE
+		s.writeFailure(conn, message, authCtx, ReplyCommandNotSupported)
+		logSession(authCtx.SessionID, "Command not supported", CommandName(message.Cmd))
+		return err
+	}
+	if err == nil && pipelined(conn, config) {
+		err = ErrPipelinedHandshake
+	}
 	if err != nil {
+		s.malformedHandshake(conn, config, authCtx.SessionID, err)
 		return err
 	}
+	return s.handleRequest(conn, message, authCtx)
+}
 
-	// Check if the address type is supported
-	if message.AddrType == TypeIPv6 {
-		WriteRequestFailureMessage(conn, ReplyAddressTypeNotSupported)
-		log.Println("IPv6 is not supported", message.TargetIP, message.Port)
-		return ErrAddressTypeNotSupported
+// requestDeadline answers a request with ReplyTTLExpired if the server has
+// not replied to it in time. Whichever of the reply and the deadline comes
+// first wins.
+type requestDeadline struct {
+	mu      sync.Mutex
+	replied bool
+	expired bool
+	// stopTimer cancels the timer answering the request.
+	stopTimer func() bool
+}
+
+func (s *SOCKS5Server) startRequestDeadline(conn io.Writer, message *ClientRequestMessage, authCtx *AuthContext, timeout time.Duration) *requestDeadline {
+	config := s.sessionConfig(authCtx)
+	d := &requestDeadline{}
+	d.stopTimer = timeAfterFunc(s.clock, timeout, func() {
+		d.mu.Lock()
+		if d.replied {
+			d.mu.Unlock()
+			return
+		}
+		d.expired = true
+		d.mu.Unlock()
+		s.stats.requestTimeouts.Add(1)
+		logSession(authCtx.SessionID, "request to", config.LogRedaction.Address(net.JoinHostPort(message.TargetIP, strconv.Itoa(int(message.Port)))), "not answered within", timeout)
+		s.sendReply(conn, &ReplyInfo{Request: message, Auth: authCtx, Reply: ReplyTTLExpired})
+		if c, ok := conn.(io.Closer); ok {
+			c.Close()
+		}
+	})
+	return d
+}
+
+// reply reports whether the reply may still be written, and if so stops
+// the deadline.
+func (d *requestDeadline) reply() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.expired {
+		return false
 	}
+	d.replied = true
+	d.stopTimer()
+	return true
+}
 
-	if message.Cmd == CmdConnect {
-		return s.handleTCP(conn, message)
-	} else if message.Cmd == CmdUDP {
-		return s.handleUDP()
-	} else {
-		WriteRequestFailureMessage(conn, ReplyCommandNotSupported)
-		log.Println("Command not supported", message.Cmd)
+func (d *requestDeadline) stop() {
+	d.stopTimer()
+}
+
+// pipelined reports whether the DisallowPipelining of config is set and the
+// client sent more than the message just read.
+func pipelined(conn io.ReadWriter, config *Config) bool {
+	sc, ok := conn.(*sniffConn)
+	return ok && config.DisallowPipelining && sc.reader.Buffered() > 0
+}
+
+func (s *SOCKS5Server) handleRequest(conn io.ReadWriter, message *ClientRequestMessage, authCtx *AuthContext) error {
+	config := s.sessionConfig(authCtx)
+	if timeout := config.RequestTimeout; timeout > 0 {
+		authCtx.deadline = s.startRequestDeadline(conn, message, authCtx, timeout)
+		defer authCtx.deadline.stop()
+	}
+	message.normalizeMapped(config.KeepIPv4Mapped)
+
+	// The address of UDP ASSOCIATE and BIND is the client's, not a target;
+	// the targets of datagrams are checked as they are relayed. The rule is
+	// evaluated once, so that the command, the action and the dial options
+	// all follow the same match.
+	rule, windowEnd, refusal := s.checkPolicy(message, authCtx, message.Cmd == CmdConnect)
+	if rule != nil {
+		s.stats.ruleHit(rule.key, timeNow(s.clock))
+		authCtx.AddLabels(rule.Labels...)
+	}
+	if refusal != nil {
+		s.writeFailure(conn, message, authCtx, refusal.reply)
+		logSession(authCtx.SessionID, refusal.log...)
+		s.ruleViolation(conn, config, authCtx.SessionID)
+		return refusal.err
+	}
+	if rule != nil && rule.EndAtWindowClose && len(rule.windows) > 0 {
+		defer s.endSessionAt(authCtx.SessionID, windowEnd)()
+	}
+	if rule != nil && rule.Action == RuleSinkhole {
+		return s.sinkhole(conn, message, authCtx, rule)
+	}
+
+	switch {
+	case message.Cmd == CmdConnect:
+		return s.handleTCP(conn, message, authCtx, rule)
+	case message.Cmd == CmdUDP && config.EnableUDP && s.forwarder == nil:
+		return s.handleUDP(conn, message, authCtx)
+	case message.Cmd == CmdBind && config.EnableBind && s.forwarder == nil:
+		return s.handleBind(conn, message, authCtx)
+	default:
+		s.writeFailure(conn, message, authCtx, ReplyCommandNotSupported)
+		logSession(authCtx.SessionID, "Command not supported", CommandName(message.Cmd))
 		return ErrCommandNotSupported
 	}
 }
 
-func (s *SOCKS5Server) handleUDP() error {
-	log.Println("handleUDP Not implemented")
-	return nil
+// dial connects to address, directly or as configured. lookup, if set,
+// resolves the host of address for a dial with Config.ParallelDial.
+// failover dials directly when Config.Upstream is unreachable.
+func (s *SOCKS5Server) dial(address string, authCtx *AuthContext, timeout time.Duration, mark int, dscp uint8, lookup func() ([]net.IP, error), failover bool) (net.Conn, error) {
+	config := s.sessionConfig(authCtx)
+	dialer := net.Dialer{Timeout: timeout, Control: config.DialControl, Resolver: config.Resolver}
+	if dscp != 0 {
+		dialer.Control = chainControl(dscpControl(dscp), dialer.Control)
+	}
+	if mark != 0 {
+		dialer.Control = chainControl(markControl(mark), dialer.Control)
+	}
+	if s.forwarder != nil {
+		return s.forwardDial(address, timeout, dialer.Control)
+	}
+	if upstream := config.Upstream; upstream != nil {
+		client := upstream.client(authCtx.Username, timeout)
+		client.Control = dialer.Control
+		ctx := authCtx.context()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		conn, err := client.DialContext(ctx, "tcp", address)
+		if err == nil || !failover || !upstreamDown(err) {
+			return conn, err
+		}
+		s.stats.upstreamFailovers.Add(1)
+		logSession(authCtx.SessionID, "upstream unreachable, dialing directly", config.LogRedaction.Address(address), err)
+		if upstream.OnFailover != nil {
+			upstream.OnFailover(address, err)
+		}
+	}
+	if config.Reputation != nil {
+		var deadline time.Time
+		if timeout > 0 {
+			deadline = time.Now().Add(timeout)
+		}
+		dialer.Control = chainControl(s.reputationControl(config, authCtx.SessionID, deadline), dialer.Control)
+	}
+	direct := &dialer
+	if egress := config.Egress; egress != nil {
+		link := egress.pick()
+		logSession(authCtx.SessionID, "egress via", link.Name)
+		direct = link.dialer(timeout, dialer.Control)
+		direct.Resolver = dialer.Resolver
+	}
+	if lookup != nil {
+		ips, err := lookup()
+		if err != nil {
+			return nil, err
+		}
+		if prefix := config.NAT64Prefix; prefix != nil {
+			for i, ip := range ips {
+				if ip.To4() != nil {
+					ips[i] = embedIPv4(prefix, ip)
+				}
+			}
+		}
+		_, port, _ := net.SplitHostPort(address)
+		return dialParallel(direct, ips, port, config.ParallelDial)
+	}
+	return direct.Dial("tcp", nat64Address(config.NAT64Prefix, address))
+}
+
+// upstreamDown reports whether err, returned by dialing through
+// Config.Upstream, means the upstream itself could not be reached rather
+// than it refusing or failing the request.
+func upstreamDown(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// chainControl returns a net.Dialer Control function running first, then
+// second if it is not nil.
+func chainControl(first, second func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	if second == nil {
+		return first
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		if err := first(network, address, c); err != nil {
+			return err
+		}
+		return second(network, address, c)
+	}
 }
 
-func (s *SOCKS5Server) handleTCP(conn io.ReadWriter, message *ClientRequestMessage) error {
+// handleTCP serves CONNECT, with the options of rule, the rule matching
+// the request, if any.
+func (s *SOCKS5Server) handleTCP(conn io.ReadWriter, message *ClientRequestMessage, authCtx *AuthContext, rule *Rule) error {
+	config := s.sessionConfig(authCtx)
 	// 请求访问目标TCP服务
-	address := fmt.Sprintf("%s:%d", message.TargetIP, message.Port)
-	fmt.Println("connect to", address)
-	targetConn, err := net.DialTimeout("tcp", address, s.Config.TCPTimeout)
+	address := net.JoinHostPort(message.TargetIP, strconv.Itoa(int(message.Port)))
+	logSession(authCtx.SessionID, "connect to", config.LogRedaction.Address(address))
+	dialTimeout, idleTimeout, mark := config.DialTimeout, config.IdleTimeout, config.Mark
+	var dscp uint8
+	if rule != nil {
+		dscp = rule.DSCP
+		if rule.Mark != 0 {
+			mark = rule.Mark
+		}
+		if rule.DialTimeout > 0 {
+			dialTimeout = rule.DialTimeout
+		}
+		if rule.IdleTimeout > 0 {
+			idleTimeout = rule.IdleTimeout
+		}
+	}
+	s.stats.request(message.TargetIP)
+	if config.MaxConnsPerHost > 0 {
+		if !s.hostLimiter.acquire(message.TargetIP, config.MaxConnsPerHost) {
+			s.stats.hostLimitRejections.Add(1)
+			s.writeFailure(conn, message, authCtx, ReplyHostConnectionLimit)
+			logSession(authCtx.SessionID, "connection limit reached for host", config.LogRedaction.Host(message.TargetIP))
+			return ErrHostConnectionLimit
+		}
+		defer s.hostLimiter.release(message.TargetIP)
+	}
+	var lookup func() ([]net.IP, error)
+	if message.AddrType == TypeDomain && config.ParallelDial > 1 && s.forwarder == nil && config.Upstream == nil {
+		lookup = startLookup(config.Resolver, message.TargetIP, dialTimeout)
+	}
+	releaseDial, err := s.acquireDial(config, dialTimeout)
 	if err != nil {
-		WriteRequestFailureMessage(conn, ReplyConnectionRefused)
-		log.Println("connect to target failure", address, err)
+		s.stats.dialQueueRejections.Add(1)
+		s.writeFailure(conn, message, authCtx, ReplyServerFailure)
+		logSession(authCtx.SessionID, "dial queue rejected", config.LogRedaction.Address(address), err)
+		return err
+	}
+	breaker := config.CircuitBreaker
+	if breaker != nil && !breaker.allow(address) {
+		releaseDial()
+		s.stats.circuitOpenRejections.Add(1)
+		s.writeFailure(conn, message, authCtx, ReplyHostUnreachable)
+		logSession(authCtx.SessionID, "circuit open for", config.LogRedaction.Address(address))
+		return ErrCircuitOpen
+	}
+	targetConn, err := s.dial(address, authCtx, dialTimeout, mark, dscp, lookup, rule != nil && rule.FailoverDirect)
+	releaseDial()
+	if breaker != nil {
+		breaker.done(address, err == nil)
+	}
+	if errors.Is(err, ErrBadReputation) || errors.Is(err, ErrReputationLookup) {
+		s.writeFailure(conn, message, authCtx, ReplyConnectionNotAllowed)
+		return err
+	}
+	if err != nil {
+		s.stats.dialFailures.Add(1)
+		s.writeFailure(conn, message, authCtx, ReplyConnectionRefused)
+		logSession(authCtx.SessionID, "connect to target failure", config.LogRedaction.Address(address), config.LogRedaction.Error(err, address))
 		return err
 	}
 
 	// Send success reply
-	addrValue := targetConn.LocalAddr()
-	addr := addrValue.(*net.TCPAddr)
-	if err := WriteRequestSuccessMessage(conn, addr.IP, uint16(addr.Port)); err != nil {
+	addr := targetConn.LocalAddr().(*net.TCPAddr)
+	info := ReplyInfo{
+		Request:  message,
+		Auth:     authCtx,
+		Reply:    ReplySuccess,
+		BindIP:   addr.IP,
+		BindPort: uint16(addr.Port),
+	}
+	if config.Quirks.EchoRequestAddress {
+		info.BindIP, info.BindPort = net.ParseIP(message.TargetIP), message.Port
+		if remote, ok := targetConn.RemoteAddr().(*net.TCPAddr); ok && info.BindIP == nil {
+			info.BindIP = remote.IP
+		}
+	}
+	if err := s.writeReply(conn, &info); err != nil {
+		targetConn.Close()
 		return err
 	}
+	if len(config.Teardown) > 0 {
+		defer s.trackTarget(authCtx.SessionID, targetConn)()
+	}
+
+	tally := &relayTally{class: portClass(message.Port), today: todayUser(config, authCtx)}
+	if rule != nil {
+		tally.rule = rule.key
+		tally.priority = rule.Priority
+	}
+	defer s.stats.sessionStarted(authCtx)(tally)
 
-	return forward(conn, targetConn)
+	if dscp != 0 {
+		if err := setConnDSCP(conn, dscp); err != nil {
+			logSession(authCtx.SessionID, "set client DSCP failure", err)
+		}
+	}
+
+	// The handshake is over, switch from the handshake deadline to the idle timeout
+	if c, ok := conn.(net.Conn); ok {
+		c.SetDeadline(time.Time{})
+		if idleTimeout > 0 {
+			conn = &idleConn{Conn: c, timeout: idleTimeout}
+			targetConn = &idleConn{Conn: targetConn, timeout: idleTimeout}
+		}
+	}
+	if charge := s.memory.grow(authCtx.SessionID, relayMemory(config)); charge != nil && config.MemoryShedIdle > 0 {
+		charge.lastActive.Store(timeNow(s.clock).UnixNano())
+		conn = &activityConn{conn: conn, charge: charge, clock: s.clock}
+	}
+	if config.RequireSNIMatch && message.AddrType == TypeDomain {
+		conn = s.checkSNI(conn, config, message.TargetIP, authCtx.SessionID)
+	}
+	var target io.ReadWriteCloser = targetConn
+	if capture := config.Capture; capture != nil && rule != nil && rule.Capture {
+		var cf *captureFile
+		if conn, target, cf = s.tapSession(conn, targetConn, capture, authCtx.SessionID); cf != nil {
+			defer cf.Close()
+		}
+	}
+	if config.ProgressHook != nil || config.Recorder != nil || len(config.Plugins) > 0 {
+		meter := s.newProgressMeter(conn, authCtx, address)
+		defer meter.stop(tally)
+		conn, target = meter.wrap(conn, target)
+	}
+	if cache := config.HTTPCache; cache != nil && rule != nil && rule.CacheHTTP {
+		err = s.forwardHTTP(conn, target, address, cache, config, authCtx.SessionID, tally)
+	} else {
+		err = s.forward(conn, target, config, tally)
+	}
+	s.relayEnded(authCtx, tally)
+	return err
+}
+
+// acquireDial waits for a slot under the MaxConcurrentDials of config and
+// returns the function releasing it.
+func (s *SOCKS5Server) acquireDial(config *Config, dialTimeout time.Duration) (func(), error) {
+	limit := config.MaxConcurrentDials
+	if limit <= 0 {
+		return func() {}, nil
+	}
+	timeout := config.DialQueueTimeout
+	if timeout <= 0 {
+		timeout = dialTimeout
+	}
+	if err := s.dialQueue.acquire(limit, config.DialQueueSize, timeout); err != nil {
+		return nil, err
+	}
+	return func() { s.dialQueue.release(limit) }, nil
 }
 
-func (s *SOCKS5Server) auth(conn io.ReadWriter) error {
+func (s *SOCKS5Server) auth(conn io.ReadWriter, session *Session) (*AuthContext, error) {
+	config, sessionID := session.config, session.ID
 	// Read client auth message
-	clientMessage, err := NewClientAuthMessage(conn)
+	maxMethods := config.MaxAuthMethods
+	if maxMethods <= 0 {
+		maxMethods = 255
+	}
+	clientMessage, err := readClientAuthMessage(conn, maxMethods)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if pipelined(conn, config) {
+		return nil, ErrPipelinedHandshake
 	}
 
-	// Check if the auth method is supported
-	var acceptable bool
-	for _, method := range clientMessage.Methods {
-		if method == s.Config.AuthMethod {
-			acceptable = true
-			break
+	// A mapped client certificate replaces SOCKS5 auth, or is required in
+	// addition to a password
+	var certUsername string
+	if certAuth := config.CertAuth; certAuth != nil && certAuth.RequirePassword {
+		username, ok := certAuth.Username(connTLSState(conn))
+		if !ok || !containsMethod(clientMessage.Methods, MethodPassword) {
+			if !config.SilentReject {
+				SendServerAuthMessage(conn, MethodNoAcceptable)
+			}
+			logSession(sessionID, "client certificate and password required")
+			return nil, ErrNoAcceptableMethod
+		}
+		certUsername = username
+	} else if certAuth != nil && containsMethod(clientMessage.Methods, MethodNoAuth) {
+		authCtx := AuthContext{SessionID: sessionID, Method: MethodNoAuth, ClientAddr: session.ClientAddr, config: config, ctx: session.ctx}
+		if s.certAuth(conn, &authCtx) {
+			if err := SendServerAuthMessage(conn, MethodNoAuth); err != nil {
+				return nil, err
+			}
+			logSession(sessionID, "auth success with client certificate for", config.LogRedaction.Username(authCtx.Username))
+			return &authCtx, nil
 		}
 	}
-	if !acceptable {
-		SendServerAuthMessage(conn, MethodNoAcceptable)
-		log.Println("auth method not supported", clientMessage.Methods)
-		return ErrVersionNotSupported
+
+	// Choose an auth method the client offered
+	method := MethodPassword
+	if certUsername == "" {
+		method = s.selectMethod(conn, config, sessionID, clientMessage.Methods)
 	}
-	if err := SendServerAuthMessage(conn, s.Config.AuthMethod); err != nil {
-		return err
+	if method == MethodNoAcceptable {
+		if !config.SilentReject {
+			SendServerAuthMessage(conn, MethodNoAcceptable)
+		}
+		offered := make([]string, len(clientMessage.Methods))
+		for i, m := range clientMessage.Methods {
+			offered[i] = MethodName(m)
+		}
+		logSession(sessionID, "auth method not supported", offered)
+		return nil, ErrNoAcceptableMethod
+	}
+	if err := SendServerAuthMessage(conn, method); err != nil {
+		return nil, err
 	}
 
-	if s.Config.AuthMethod == MethodPassword {
-		cpm, err := NewClientPasswordMessage(conn)
+	authCtx := AuthContext{SessionID: sessionID, Method: method, ClientAddr: session.ClientAddr, config: config, ctx: session.ctx}
+	if method == MethodPassword {
+		cpm, version, err := readClientPasswordMessage(conn, config.Quirks.AnyPasswordVersion)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if pipelined(conn, config) {
+			return nil, ErrPipelinedHandshake
 		}
 
-		if !s.Config.PasswordChecker(cpm.Username, cpm.Password) {
-			WriteServerPasswordMessage(conn, PasswordAuthFailure)
-			return ErrPasswordAuthFailure
+		if certUsername != "" && cpm.Username != certUsername {
+			s.stats.authFailures.Add(1)
+			writeServerPasswordMessage(conn, version, PasswordAuthFailure)
+			logSession(sessionID, "username", config.LogRedaction.Username(cpm.Username), "does not match the client certificate")
+			return nil, ErrPasswordAuthFailure
+		}
+		if !s.checkPassword(&authCtx, cpm.Username, cpm.Password) {
+			writeServerPasswordMessage(conn, version, PasswordAuthFailure)
+			return nil, ErrPasswordAuthFailure
 		}
 
-		if err := WriteServerPasswordMessage(conn, PasswordAuthSuccess); err != nil {
-			return err
+		if err := writeServerPasswordMessage(conn, version, PasswordAuthSuccess); err != nil {
+			return nil, err
+		}
+		authCtx.Username = cpm.Username
+	} else if method == MethodHMAC {
+		if err := s.authHMAC(conn, &authCtx); err != nil {
+			return nil, err
 		}
 	}
-	fmt.Println("auth success")
+	logSession(sessionID, "auth success")
 
-	return nil
+	return &authCtx, nil
 }
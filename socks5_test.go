@@ -2,9 +2,17 @@ package socks5
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"reflect"
+	"strconv"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestAuth(t *testing.T) {
@@ -17,7 +25,7 @@ func TestAuth(t *testing.T) {
 	t.Run("a valid client auth message", func(t *testing.T) {
 		var buf bytes.Buffer
 		buf.Write([]byte{SOCKS5Version, 2, MethodNoAuth, MethodGSSAPI})
-		if err := server.auth(&buf); err != nil {
+		if _, err := server.auth(&buf, &Session{config: server.Config}); err != nil {
 			t.Fatalf("should get error nil but got %s", err)
 		}
 
@@ -31,12 +39,93 @@ func TestAuth(t *testing.T) {
 	t.Run("an invalid client auth message", func(t *testing.T) {
 		var buf bytes.Buffer
 		buf.Write([]byte{SOCKS5Version, 2, MethodNoAuth})
-		if err := server.auth(&buf); err == nil {
+		if _, err := server.auth(&buf, &Session{config: server.Config}); err == nil {
 			t.Fatalf("should get error EOF but got nil")
 		}
 	})
 }
 
+func TestAuthMethodLimits(t *testing.T) {
+	server := SOCKS5Server{Config: &Config{MaxAuthMethods: 2, SilentReject: true}}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{SOCKS5Version, 3})
+	if _, err := server.auth(&buf, &Session{config: server.Config}); err != ErrTooManyMethods {
+		t.Fatalf("should get error %s but got %v", ErrTooManyMethods, err)
+	}
+
+	buf.Reset()
+	buf.Write([]byte{SOCKS5Version, 1, MethodGSSAPI})
+	if _, err := server.auth(&buf, &Session{config: server.Config}); err != ErrNoAcceptableMethod {
+		t.Fatalf("should get error %s but got %v", ErrNoAcceptableMethod, err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("should reject silently but replied %v", buf.Bytes())
+	}
+}
+
+func TestClientClosed(t *testing.T) {
+	server := SOCKS5Server{Config: &Config{}}
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		clientConn.Write([]byte{SOCKS5Version, 1, MethodNoAuth})
+		io.ReadFull(clientConn, make([]byte, 2))
+		clientConn.Close()
+	}()
+	if err := server.ServeConn(serverConn); err != ErrClientClosed {
+		t.Fatalf("should get error %s but got %v", ErrClientClosed, err)
+	}
+	if got := server.Stats().MalformedHandshakes; got != 0 {
+		t.Fatalf("should not count a hang-up as malformed but got %d", got)
+	}
+
+	// A message cut short is malformed, so scanners sending partial
+	// greetings are counted
+	clientConn, serverConn = net.Pipe()
+	go func() {
+		clientConn.Write([]byte{SOCKS5Version, 2, MethodNoAuth})
+		clientConn.Close()
+	}()
+	if err := server.ServeConn(serverConn); err != ErrClientClosed {
+		t.Fatalf("should get error %s but got %v", ErrClientClosed, err)
+	}
+	if got := server.Stats().MalformedHandshakes; got != 1 {
+		t.Fatalf("should count a partial greeting as malformed but got %d", got)
+	}
+}
+
+func TestMethodSelector(t *testing.T) {
+	var seen []Method
+	server := SOCKS5Server{Config: &Config{
+		PasswordChecker: func(username, password string) bool { return password == "secret" },
+		MethodSelector: func(req *MethodRequest) Method {
+			seen = req.Offered
+			return MethodPassword
+		},
+	}}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{SOCKS5Version, 2, MethodNoAuth, MethodPassword})
+	buf.Write([]byte{PasswordMethodVersion, 1, 'u', 6, 's', 'e', 'c', 'r', 'e', 't'})
+	authCtx, err := server.auth(&buf, &Session{config: server.Config})
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if authCtx.Method != MethodPassword || !reflect.DeepEqual(seen, []Method{MethodNoAuth, MethodPassword}) {
+		t.Fatalf("should choose MethodPassword from the offer but got %#x from %v", authCtx.Method, seen)
+	}
+
+	// A method the client did not offer is not acceptable
+	buf.Reset()
+	buf.Write([]byte{SOCKS5Version, 1, MethodNoAuth})
+	if _, err := server.auth(&buf, &Session{config: server.Config}); err != ErrNoAcceptableMethod {
+		t.Fatalf("should get error %s but got %v", ErrNoAcceptableMethod, err)
+	}
+	if want, got := []byte{SOCKS5Version, MethodNoAcceptable}, buf.Bytes(); !reflect.DeepEqual(want, got) {
+		t.Fatalf("should get message %v but got %v", want, got)
+	}
+}
+
 func TestWriteRequestSuccessMessage(t *testing.T) {
 	var buf bytes.Buffer
 	ip := net.IP([]byte{123, 123, 11, 11})
@@ -51,4 +140,443 @@ func TestWriteRequestSuccessMessage(t *testing.T) {
 	if !reflect.DeepEqual(want, got) {
 		t.Fatalf("message not match: want %v, got %v", want, got)
 	}
+
+	// The reply goes out in a single write
+	var w countingWriter
+	if err := WriteRequestSuccessMessage(&w, net.ParseIP("2001:db8::1"), 0xfffe); err != nil {
+		t.Fatalf("error while writing: %s", err)
+	}
+	if w.writes != 1 || w.Len() != maxReplyLength {
+		t.Fatalf("should write %d bytes once but wrote %d bytes in %d writes", maxReplyLength, w.Len(), w.writes)
+	}
+	if port := readPort(w.Bytes()[w.Len()-PortLength:]); port != 0xfffe {
+		t.Fatalf("should encode port 65534 but got %d", port)
+	}
+}
+
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(b)
+}
+
+func BenchmarkHandshake(b *testing.B) {
+	server := SOCKS5Server{
+		Config: &Config{
+			AuthMethod: MethodNoAuth,
+		},
+	}
+	message := []byte{
+		SOCKS5Version, 1, MethodNoAuth,
+		SOCKS5Version, CmdConnect, ReservedField, TypeIPv4, 127, 0, 0, 1, 0x00, 0x50,
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := bytes.NewBuffer(message)
+		if _, err := server.auth(buf, &Session{config: server.Config}); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := NewClientRequestMessage(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(tb testing.TB) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return dialed, <-accepted
+}
+
+func BenchmarkRelay(b *testing.B) {
+	for _, size := range []int{0, 32 * 1024, 256 * 1024} {
+		b.Run(fmt.Sprintf("buffer=%d", size), func(b *testing.B) {
+			server := SOCKS5Server{Config: &Config{RelayBufferSize: size}}
+			client, proxyIn := tcpPair(b)
+			proxyOut, target := tcpPair(b)
+			defer client.Close()
+			defer target.Close()
+			go server.forward(proxyIn, proxyOut, server.Config, nil)
+
+			chunk := make([]byte, 64*1024)
+			go func() {
+				for i := 0; i < b.N; i++ {
+					if _, err := client.Write(chunk); err != nil {
+						return
+					}
+				}
+			}()
+
+			b.SetBytes(int64(len(chunk)))
+			b.ResetTimer()
+			if _, err := io.CopyN(io.Discard, target, int64(b.N*len(chunk))); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestForwardHalfClose(t *testing.T) {
+	server := SOCKS5Server{Config: &Config{}}
+	client, proxyIn := tcpPair(t)
+	proxyOut, target := tcpPair(t)
+	defer client.Close()
+	defer target.Close()
+	defer proxyIn.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- server.forward(proxyIn, proxyOut, server.Config, nil) }()
+
+	// The client finishes sending first, the target must still be able to answer
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	client.(*net.TCPConn).CloseWrite()
+
+	request, err := io.ReadAll(target)
+	if err != nil || string(request) != "ping" {
+		t.Fatalf("target should read ping and EOF but got %q, %v", request, err)
+	}
+	target.Write([]byte("pong"))
+	target.Close()
+
+	response, err := io.ReadAll(client)
+	if err != nil || string(response) != "pong" {
+		t.Fatalf("client should read pong and EOF but got %q, %v", response, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+}
+
+// startServer runs server on a random loopback port and returns its address.
+func startServer(t *testing.T, server *SOCKS5Server) (string, <-chan error) {
+	server.IP = "127.0.0.1"
+	errc := make(chan error, 1)
+	go func() { errc <- server.Run() }()
+	for i := 0; i < 100; i++ {
+		server.mu.Lock()
+		listener := server.listener
+		server.mu.Unlock()
+		if listener != nil {
+			return listener.Addr().String(), errc
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("server did not start")
+	return "", nil
+}
+
+func TestShutdown(t *testing.T) {
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth}}
+	address, errc := startServer(t, &server)
+
+	// A session stuck in the auth phase must be closed once the drain deadline passes
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 100; i++ {
+		server.mu.Lock()
+		n := len(server.conns)
+		server.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("should get error %s but got %v", context.DeadlineExceeded, err)
+	}
+	if err := <-errc; err != ErrServerClosed {
+		t.Fatalf("Run should return %s but got %v", ErrServerClosed, err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("session should be closed")
+	}
+	if _, err := net.Dial("tcp", address); err == nil {
+		t.Fatalf("listener should be closed")
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth}}
+
+	if err := server.ApplyConfig(&Config{AuthMethod: MethodPassword}); !errors.Is(err, ErrPasswordCheckerNotSet) {
+		t.Fatalf("should get error %s but got %v", ErrPasswordCheckerNotSet, err)
+	}
+	if server.config() != server.Config {
+		t.Fatalf("an invalid config should not be applied")
+	}
+
+	config := &Config{AuthMethod: MethodNoAuth, DialTimeout: time.Second}
+	if err := server.ApplyConfig(config); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if server.config() != config {
+		t.Fatalf("config should be applied")
+	}
+}
+
+func TestApplyConfigKeepsSessionConfig(t *testing.T) {
+	hooked := make(chan string, 2)
+	hook := func(name string) func(*ReplyInfo) {
+		return func(*ReplyInfo) { hooked <- name }
+	}
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth, ReplyHook: hook("old")}}
+	host, portStr, _ := net.SplitHostPort(echoServer(t))
+	port, _ := strconv.Atoi(portStr)
+	clientConn, serverConn := tcpPair(t)
+	defer clientConn.Close()
+	go server.ServeConn(serverConn)
+	clientConn.Write([]byte{SOCKS5Version, 1, byte(MethodNoAuth)})
+	if _, err := io.ReadFull(clientConn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reload between auth and request must not reach the session
+	if err := server.ApplyConfig(&Config{AuthMethod: MethodNoAuth, RejectIPTargets: true, ReplyHook: hook("new")}); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if err := WriteClientRequestMessage(clientConn, CmdConnect, host, uint16(port)); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := NewServerReplyMessage(clientConn)
+	if err != nil || reply.Reply != ReplySuccess {
+		t.Fatalf("should connect under the old config but got %v, %v", reply, err)
+	}
+	if name := <-hooked; name != "old" {
+		t.Fatalf("should run the reply hook of the old config but ran %s", name)
+	}
+}
+
+func TestApplyConfigDuringAuth(t *testing.T) {
+	checker := func(want string) func(string, string) bool {
+		return func(username, password string) bool { return password == want }
+	}
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodPassword, PasswordChecker: checker("old")}}
+	clientConn, serverConn := tcpPair(t)
+	defer clientConn.Close()
+	go server.ServeConn(serverConn)
+	clientConn.Write([]byte{SOCKS5Version, 1, byte(MethodPassword)})
+	if _, err := io.ReadFull(clientConn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reload between the greeting and the password must not reach the session
+	if err := server.ApplyConfig(&Config{AuthMethod: MethodPassword, PasswordChecker: checker("new")}); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	clientConn.Write([]byte{PasswordMethodVersion, 1, 'u', 3, 'o', 'l', 'd'})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(clientConn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != PasswordAuthSuccess {
+		t.Fatalf("should authenticate under the old config but got status %d", reply[1])
+	}
+}
+
+func TestDialControl(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	var controlled string
+	server := SOCKS5Server{Config: &Config{
+		DialControl: func(network, address string, c syscall.RawConn) error {
+			controlled = network + " " + address
+			return nil
+		},
+	}}
+	conn, err := server.dial(listener.Addr().String(), &AuthContext{}, time.Second, 0, 0, nil, false)
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	conn.Close()
+	if want := "tcp4 " + listener.Addr().String(); controlled != want {
+		t.Fatalf("should control %q but got %q", want, controlled)
+	}
+
+	refused := errors.New("refused by control")
+	server.Config.DialControl = func(network, address string, c syscall.RawConn) error { return refused }
+	if _, err := server.dial(listener.Addr().String(), &AuthContext{}, time.Second, 0, 0, nil, false); !errors.Is(err, refused) {
+		t.Fatalf("should get error %s but got %v", refused, err)
+	}
+}
+
+// pipelinedHandshake is a password greeting, auth and CONNECT request to
+// address followed by "ping", all sent in one write.
+func pipelinedHandshake(t *testing.T, address string) []byte {
+	host, portStr, _ := net.SplitHostPort(address)
+	port, _ := strconv.Atoi(portStr)
+	var buf bytes.Buffer
+	buf.Write([]byte{SOCKS5Version, 1, byte(MethodPassword)})
+	WriteClientPasswordMessage(&buf, "alice", "secret")
+	if err := WriteClientRequestMessage(&buf, CmdConnect, host, uint16(port)); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("ping")
+	return buf.Bytes()
+}
+
+func TestPipelinedHandshake(t *testing.T) {
+	target := echoServer(t)
+	for _, sniff := range []bool{false, true} {
+		server := SOCKS5Server{Config: &Config{
+			AuthMethod:      MethodPassword,
+			PasswordChecker: func(username, password string) bool { return username == "alice" && password == "secret" },
+			HTTPConnect:     sniff,
+		}}
+		clientConn, serverConn := tcpPair(t)
+		go server.ServeConn(serverConn)
+		clientConn.Write(pipelinedHandshake(t, target))
+		if _, err := io.ReadFull(clientConn, make([]byte, 2)); err != nil {
+			t.Fatalf("sniff %v: should read method reply but got %s", sniff, err)
+		}
+		if status, err := NewServerPasswordMessage(clientConn); err != nil || status != PasswordAuthSuccess {
+			t.Fatalf("sniff %v: should authenticate but got %d, %v", sniff, status, err)
+		}
+		if reply, err := NewServerReplyMessage(clientConn); err != nil || reply.Reply != ReplySuccess {
+			t.Fatalf("sniff %v: should connect but got %+v, %v", sniff, reply, err)
+		}
+		echo := make([]byte, 4)
+		if _, err := io.ReadFull(clientConn, echo); err != nil || string(echo) != "ping" {
+			t.Fatalf("sniff %v: should echo the early data but got %q, %v", sniff, echo, err)
+		}
+		clientConn.Close()
+	}
+}
+
+func TestDisallowPipelining(t *testing.T) {
+	target := echoServer(t)
+	server := SOCKS5Server{Config: &Config{
+		AuthMethod:         MethodPassword,
+		PasswordChecker:    func(username, password string) bool { return true },
+		DisallowPipelining: true,
+	}}
+	clientConn, serverConn := tcpPair(t)
+	defer clientConn.Close()
+	errc := make(chan error, 1)
+	go func() { errc <- server.ServeConn(serverConn) }()
+	clientConn.Write(pipelinedHandshake(t, target))
+	if err := <-errc; !errors.Is(err, ErrPipelinedHandshake) {
+		t.Fatalf("should get error %s but got %v", ErrPipelinedHandshake, err)
+	}
+
+	// A client waiting for each reply is served
+	address, _ := startServer(t, &server)
+	defer server.Shutdown(context.Background())
+	client := Client{ProxyAddress: address, Username: "alice", Password: "secret"}
+	conn, err := client.Dial("tcp", target)
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	conn.Close()
+}
+
+func TestPipelinedRepliesCoalesced(t *testing.T) {
+	server := SOCKS5Server{Config: &Config{
+		AuthMethod:      MethodPassword,
+		PasswordChecker: func(username, password string) bool { return true },
+		HTTPConnect:     true,
+	}}
+	// net.Pipe hands each write to a single read
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go server.ServeConn(serverConn)
+	go clientConn.Write(pipelinedHandshake(t, echoServer(t)))
+
+	buf := make([]byte, 64)
+	n, err := clientConn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Method, auth status and a success reply with an IPv4 address
+	if want := 2 + 2 + 10; n != want || buf[1] != byte(MethodPassword) || buf[3] != PasswordAuthSuccess || buf[5] != ReplySuccess {
+		t.Fatalf("should get the replies in one write of %d bytes but got %v", want, buf[:n])
+	}
+	if _, err := io.ReadFull(clientConn, buf[:4]); err != nil || string(buf[:4]) != "ping" {
+		t.Fatalf("should echo the early data but got %q, %v", buf[:4], err)
+	}
+}
+
+func TestHandshakeTap(t *testing.T) {
+	var mu sync.Mutex
+	var fromClient, fromServer []byte
+	server := SOCKS5Server{Config: &Config{
+		AuthMethod: MethodNoAuth,
+		HandshakeTap: func(data HandshakeBytes) {
+			mu.Lock()
+			defer mu.Unlock()
+			if data.FromClient {
+				fromClient = append(fromClient, data.Data...)
+			} else {
+				fromServer = append(fromServer, data.Data...)
+			}
+		},
+	}}
+	relaySession(t, &server).Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	// The greeting and a CONNECT request to 127.0.0.1; relayed bytes are not tapped
+	if len(fromClient) != 3+10 || !bytes.Equal(fromClient[:3], []byte{SOCKS5Version, 1, byte(MethodNoAuth)}) || fromClient[3+1] != CmdConnect {
+		t.Fatalf("should tap the client handshake but got % x", fromClient)
+	}
+	if len(fromServer) != 2+10 || !bytes.Equal(fromServer[:2], []byte{SOCKS5Version, byte(MethodNoAuth)}) || fromServer[2+1] != ReplySuccess {
+		t.Fatalf("should tap the server replies but got % x", fromServer)
+	}
+}
+
+func TestManagedServer(t *testing.T) {
+	server := &SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth}}
+	var managed ManagedServer = server
+	if addr := managed.Addr(); addr != nil {
+		t.Fatalf("should get no address before listening but got %s", addr)
+	}
+	address, errc := startServer(t, server)
+	if addr := managed.Addr(); addr == nil || addr.String() != address {
+		t.Fatalf("should get address %s but got %v", address, addr)
+	}
+	client := Client{ProxyAddress: address}
+	conn, err := client.Dial("tcp", echoServer(t))
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	conn.Close()
+	if err := managed.Shutdown(context.Background()); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if err := <-errc; err != ErrServerClosed {
+		t.Fatalf("should get error %s but got %v", ErrServerClosed, err)
+	}
+	if sessions := managed.Stats().Sessions; sessions != 1 {
+		t.Fatalf("should count 1 session but got %d", sessions)
+	}
 }
@@ -0,0 +1,130 @@
+package socks5test
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Doraemonkeys/socks5"
+	"github.com/Doraemonkeys/socks5/internal/testhook"
+)
+
+// Clock drives the time of a server: expiry decisions, request deadlines,
+// UDP association lifetimes, time windows, dial queueing and bandwidth
+// pacing. AfterFunc calls f in its own goroutine after d, and the stop it
+// returns cancels the call, reporting whether it did so before f was
+// called. Socket deadlines stay on the system clock.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+	Sleep(d time.Duration)
+}
+
+// SetClock makes clock the clock of server. Call it before server serves.
+func SetClock(server *socks5.SOCKS5Server, clock Clock) {
+	testhook.SetClock(server, clock)
+}
+
+// SetRand makes rand the source of the session IDs of server and of its
+// choice of UDP relay ports. Call it before server serves.
+func SetRand(server *socks5.SOCKS5Server, rand io.Reader) {
+	testhook.SetRand(server, rand)
+}
+
+// FakeClock is a Clock that only moves when advanced, firing the timers
+// that come due.
+type FakeClock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	when time.Time
+	fire func()
+}
+
+// NewFakeClock returns a FakeClock set to now.
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.schedule(d, func(now time.Time) { ch <- now })
+	return ch
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) func() bool {
+	timer := c.schedule(d, func(time.Time) { go f() })
+	return func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for i, t := range c.timers {
+			if t == timer {
+				c.timers = append(c.timers[:i], c.timers[i+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (c *FakeClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+// schedule calls fire with the time once the clock reaches now+d.
+func (c *FakeClock) schedule(d time.Duration, fire func(now time.Time)) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	when := c.now.Add(d)
+	timer := &fakeTimer{when: when, fire: func() { fire(when) }}
+	if d <= 0 {
+		timer.fire()
+		return timer
+	}
+	c.timers = append(c.timers, timer)
+	c.cond.Broadcast()
+	return timer
+}
+
+// Advance moves the clock by d and fires the timers that come due.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeTimer
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.when.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			due = append(due, t)
+		}
+	}
+	c.timers = pending
+	c.mu.Unlock()
+	for _, t := range due {
+		t.fire()
+	}
+}
+
+// BlockUntil waits for at least n timers to be pending, such as those a
+// server starts in other goroutines, so that Advance fires them.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
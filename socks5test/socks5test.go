@@ -0,0 +1,212 @@
+// Package socks5test provides a scriptable fake SOCKS5 client and server and
+// helpers that run in-memory handshakes over net.Pipe, so hooks and configs
+// can be regression-tested without real sockets.
+package socks5test
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Doraemonkeys/socks5"
+)
+
+// Handler serves a single SOCKS5 connection, e.g. a server's ServeConn.
+type Handler func(conn net.Conn) error
+
+// Client is a scriptable fake SOCKS5 client.
+type Client struct {
+	// Version overrides the protocol version sent in the auth message. Zero means SOCKS5Version.
+	Version byte
+	// Methods are the offered auth methods.
+	Methods []socks5.Method
+	// Username and Password are sent when the server selects MethodPassword.
+	Username string
+	Password string
+	Cmd      socks5.Command
+	// Host is an IPv4/IPv6 literal or a domain name; it decides the address type.
+	Host string
+	Port uint16
+}
+
+// Result is what the server answered during a handshake.
+type Result struct {
+	Method         socks5.Method
+	PasswordStatus byte
+	// Reply is nil when the handshake ended before the request phase.
+	Reply *socks5.ServerReplyMessage
+}
+
+func (c *Client) String() string {
+	return fmt.Sprintf("methods=%v cmd=%d host=%s", c.Methods, c.Cmd, c.Host)
+}
+
+// Handshake runs the client side of the handshake on conn.
+func (c *Client) Handshake(conn net.Conn) (Result, error) {
+	var result Result
+
+	version := c.Version
+	if version == 0 {
+		version = socks5.SOCKS5Version
+	}
+	buf := append([]byte{version, byte(len(c.Methods))}, c.Methods...)
+	if _, err := conn.Write(buf); err != nil {
+		return result, err
+	}
+	method, err := socks5.NewServerAuthMessage(conn)
+	result.Method = method
+	if err != nil || method == socks5.MethodNoAcceptable {
+		return result, err
+	}
+
+	if method == socks5.MethodPassword {
+		if err := socks5.WriteClientPasswordMessage(conn, c.Username, c.Password); err != nil {
+			return result, err
+		}
+		status, err := socks5.NewServerPasswordMessage(conn)
+		result.PasswordStatus = status
+		if err != nil || status != socks5.PasswordAuthSuccess {
+			return result, err
+		}
+	}
+
+	if err := socks5.WriteClientRequestMessage(conn, c.Cmd, c.Host, c.Port); err != nil {
+		return result, err
+	}
+	result.Reply, err = socks5.NewServerReplyMessage(conn)
+	return result, err
+}
+
+// Transcript records what a client sent to a fake Server.
+type Transcript struct {
+	Auth     *socks5.ClientAuthMessage
+	Password *socks5.ClientPasswordMessage
+	Request  *socks5.ClientRequestMessage
+}
+
+// Server is a scriptable fake SOCKS5 server that answers with fixed values.
+type Server struct {
+	// Method is selected when the client offers it, otherwise MethodNoAcceptable is sent.
+	Method         socks5.Method
+	PasswordStatus byte
+	Reply          socks5.ReplyType
+	BindIP         net.IP
+	BindPort       uint16
+
+	// Transcript is filled in by Serve.
+	Transcript Transcript
+}
+
+// Serve runs the server side of the handshake on conn. It can be used as a Handler.
+func (s *Server) Serve(conn net.Conn) error {
+	auth, err := socks5.NewClientAuthMessage(conn)
+	if err != nil {
+		return err
+	}
+	s.Transcript.Auth = auth
+
+	method := socks5.MethodNoAcceptable
+	for _, m := range auth.Methods {
+		if m == s.Method {
+			method = m
+		}
+	}
+	if err := socks5.SendServerAuthMessage(conn, method); err != nil || method == socks5.MethodNoAcceptable {
+		return err
+	}
+
+	if method == socks5.MethodPassword {
+		password, err := socks5.NewClientPasswordMessage(conn)
+		if err != nil {
+			return err
+		}
+		s.Transcript.Password = password
+		if err := socks5.WriteServerPasswordMessage(conn, s.PasswordStatus); err != nil || s.PasswordStatus != socks5.PasswordAuthSuccess {
+			return err
+		}
+	}
+
+	request, err := socks5.NewClientRequestMessage(conn)
+	if err != nil {
+		return err
+	}
+	s.Transcript.Request = request
+	if s.Reply != socks5.ReplySuccess {
+		return socks5.WriteRequestFailureMessage(conn, s.Reply)
+	}
+	bindIP := s.BindIP
+	if bindIP == nil {
+		bindIP = net.IPv4zero.To4()
+	}
+	return socks5.WriteRequestSuccessMessage(conn, bindIP, s.BindPort)
+}
+
+// Pipe runs client against handler over an in-memory net.Pipe and returns
+// the client result together with the handler's error.
+func Pipe(handler Handler, client *Client) (result Result, clientErr, serverErr error) {
+	clientConn, serverConn := net.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		defer serverConn.Close()
+		errc <- handler(serverConn)
+	}()
+
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	result, clientErr = client.Handshake(clientConn)
+	clientConn.Close()
+	return result, clientErr, <-errc
+}
+
+var (
+	// AllMethods are the auth methods used by Matrix when none are given.
+	AllMethods = []socks5.Method{socks5.MethodNoAuth, socks5.MethodPassword}
+	// AllHosts holds one target per address type.
+	AllHosts = []string{"127.0.0.1", "::1", "localhost"}
+	// AllCommands are the commands defined by RFC 1928.
+	AllCommands = []socks5.Command{socks5.CmdConnect, socks5.CmdBind, socks5.CmdUDP}
+)
+
+// Matrix returns a client for every combination of auth method, host and command.
+// Empty arguments default to AllMethods, AllHosts and AllCommands.
+func Matrix(methods []socks5.Method, hosts []string, commands []socks5.Command) []Client {
+	if len(methods) == 0 {
+		methods = AllMethods
+	}
+	if len(hosts) == 0 {
+		hosts = AllHosts
+	}
+	if len(commands) == 0 {
+		commands = AllCommands
+	}
+
+	var clients []Client
+	for _, method := range methods {
+		for _, host := range hosts {
+			for _, cmd := range commands {
+				clients = append(clients, Client{
+					Methods: []socks5.Method{method},
+					Cmd:     cmd,
+					Host:    host,
+					Port:    80,
+				})
+			}
+		}
+	}
+	return clients
+}
+
+// Check verifies the outcome of a single matrix case.
+type Check func(t *testing.T, client Client, result Result, clientErr, serverErr error)
+
+// RunMatrix runs every client against a fresh handler in its own subtest.
+func RunMatrix(t *testing.T, newHandler func() Handler, clients []Client, check Check) {
+	t.Helper()
+	for _, client := range clients {
+		client := client
+		t.Run(client.String(), func(t *testing.T) {
+			result, clientErr, serverErr := Pipe(newHandler(), &client)
+			check(t, client, result, clientErr, serverErr)
+		})
+	}
+}
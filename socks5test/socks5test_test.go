@@ -0,0 +1,152 @@
+package socks5test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Doraemonkeys/socks5"
+)
+
+func TestRunMatrix(t *testing.T) {
+	clients := Matrix(nil, nil, nil)
+	if len(clients) != len(AllMethods)*len(AllHosts)*len(AllCommands) {
+		t.Fatalf("unexpected matrix size %d", len(clients))
+	}
+
+	var server *Server
+	newHandler := func() Handler {
+		server = &Server{
+			Method:   socks5.MethodPassword,
+			Reply:    socks5.ReplySuccess,
+			BindIP:   net.IP{127, 0, 0, 1},
+			BindPort: 1080,
+		}
+		return server.Serve
+	}
+
+	RunMatrix(t, newHandler, clients, func(t *testing.T, client Client, result Result, clientErr, serverErr error) {
+		if clientErr != nil || serverErr != nil {
+			t.Fatalf("should get errors nil but got %v, %v", clientErr, serverErr)
+		}
+		if client.Methods[0] != socks5.MethodPassword {
+			if result.Method != socks5.MethodNoAcceptable {
+				t.Fatalf("should get MethodNoAcceptable but got %d", result.Method)
+			}
+			return
+		}
+		if result.Reply == nil || result.Reply.Reply != socks5.ReplySuccess || result.Reply.Port != 1080 {
+			t.Fatalf("unexpected reply %+v", result.Reply)
+		}
+		if server.Transcript.Request.Cmd != client.Cmd {
+			t.Fatalf("server should see cmd %d but got %d", client.Cmd, server.Transcript.Request.Cmd)
+		}
+		if server.Transcript.Request.TargetIP != client.Host {
+			t.Fatalf("server should see host %s but got %s", client.Host, server.Transcript.Request.TargetIP)
+		}
+	})
+}
+
+func TestClientVersionOverride(t *testing.T) {
+	server := Server{Method: socks5.MethodNoAuth}
+	client := Client{Version: 0x04, Methods: []socks5.Method{socks5.MethodNoAuth}}
+	_, _, serverErr := Pipe(server.Serve, &client)
+	if serverErr != socks5.ErrVersionNotSupported {
+		t.Fatalf("should get error %s but got %v", socks5.ErrVersionNotSupported, serverErr)
+	}
+}
+
+func TestServeConnMatrix(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	server := &socks5.SOCKS5Server{Config: &socks5.Config{AuthMethod: socks5.MethodNoAuth}}
+	clients := Matrix([]socks5.Method{socks5.MethodNoAuth}, []string{"127.0.0.1", "localhost"}, []socks5.Command{socks5.CmdConnect, socks5.CmdBind})
+	for i := range clients {
+		clients[i].Port = uint16(listener.Addr().(*net.TCPAddr).Port)
+	}
+	newHandler := func() Handler { return server.ServeConn }
+
+	RunMatrix(t, newHandler, clients, func(t *testing.T, client Client, result Result, clientErr, serverErr error) {
+		if clientErr != nil {
+			t.Fatalf("should get client error nil but got %s", clientErr)
+		}
+		want := socks5.ReplySuccess
+		if client.Cmd != socks5.CmdConnect {
+			want = socks5.ReplyCommandNotSupported
+		}
+		if result.Reply.Reply != want {
+			t.Fatalf("should get reply %d but got %d", want, result.Reply.Reply)
+		}
+	})
+}
+
+// zeroReader reads zeros forever.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+func TestSetClockAndRand(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	var sessionID string
+	server := &socks5.SOCKS5Server{Config: &socks5.Config{
+		AuthMethod: socks5.MethodNoAuth,
+		Rules:      []socks5.Rule{{Windows: []socks5.TimeWindow{{From: "09:00", To: "17:00"}}, Location: time.UTC}},
+		ReplyHook:  func(info *socks5.ReplyInfo) { sessionID = info.Auth.SessionID },
+	}}
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	SetClock(server, clock)
+	SetRand(server, zeroReader{})
+	client := Client{
+		Methods: []socks5.Method{socks5.MethodNoAuth},
+		Cmd:     socks5.CmdConnect,
+		Host:    "127.0.0.1",
+		Port:    uint16(listener.Addr().(*net.TCPAddr).Port),
+	}
+
+	// Midnight on the fake clock is outside the window
+	result, clientErr, _ := Pipe(server.ServeConn, &client)
+	if clientErr != nil || result.Reply.Reply != socks5.ReplyConnectionNotAllowed {
+		t.Fatalf("should get reply %d but got %+v, %v", socks5.ReplyConnectionNotAllowed, result.Reply, clientErr)
+	}
+	if sessionID != "0000000000000000" {
+		t.Fatalf("should get a session ID from the random source but got %s", sessionID)
+	}
+
+	clock.Advance(12 * time.Hour)
+	result, clientErr, _ = Pipe(server.ServeConn, &client)
+	if clientErr != nil || result.Reply.Reply != socks5.ReplySuccess {
+		t.Fatalf("should get reply %d at noon but got %+v, %v", socks5.ReplySuccess, result.Reply, clientErr)
+	}
+}
@@ -0,0 +1,288 @@
+// Package socks5wire encodes and decodes SOCKS5 (RFC 1928) and
+// username/password (RFC 1929) messages from byte slices, without a
+// connection, for packet inspection and fuzzing tools.
+//
+// Parse functions return the message and the number of bytes it took, or
+// ErrShortBuffer when b holds only the beginning of a message. Append
+// functions append the encoded message to dst.
+package socks5wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+var (
+	ErrShortBuffer     = errors.New("socks5wire: message incomplete")
+	ErrVersion         = errors.New("socks5wire: unexpected version")
+	ErrAddressType     = errors.New("socks5wire: address type not supported")
+	ErrInvalidAddress  = errors.New("socks5wire: invalid address")
+	ErrFieldTooLong    = errors.New("socks5wire: field longer than 255 bytes")
+	ErrNoMethods       = errors.New("socks5wire: no methods")
+	ErrNonZeroReserved = errors.New("socks5wire: reserved field not zero")
+)
+
+const (
+	Version         = 0x05
+	PasswordVersion = 0x01
+)
+
+const (
+	AddrIPv4   = 0x01
+	AddrDomain = 0x03
+	AddrIPv6   = 0x04
+)
+
+// Addr is a SOCKS5 address: an IPv4 or IPv6 literal, or a domain name.
+type Addr struct {
+	Type byte
+	Host string
+	Port uint16
+}
+
+// ParseAddr decodes ATYP, ADDR and PORT.
+func ParseAddr(b []byte) (Addr, int, error) {
+	if len(b) < 1 {
+		return Addr{}, 0, ErrShortBuffer
+	}
+	addr := Addr{Type: b[0]}
+	n := 1
+	switch addr.Type {
+	case AddrIPv4, AddrIPv6:
+		length := net.IPv4len
+		if addr.Type == AddrIPv6 {
+			length = net.IPv6len
+		}
+		if len(b) < n+length {
+			return Addr{}, 0, ErrShortBuffer
+		}
+		addr.Host = net.IP(b[n : n+length]).String()
+		n += length
+	case AddrDomain:
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return Addr{}, 0, ErrShortBuffer
+		}
+		addr.Host = string(b[2 : 2+b[1]])
+		n += 1 + int(b[1])
+	default:
+		return Addr{}, 0, ErrAddressType
+	}
+	if len(b) < n+2 {
+		return Addr{}, 0, ErrShortBuffer
+	}
+	addr.Port = binary.BigEndian.Uint16(b[n:])
+	return addr, n + 2, nil
+}
+
+// AppendAddr encodes addr. An IPv4 or IPv6 Type needs a matching literal
+// Host. On error dst is returned unchanged.
+func AppendAddr(dst []byte, addr Addr) ([]byte, error) {
+	switch addr.Type {
+	case AddrIPv4:
+		ip := net.ParseIP(addr.Host).To4()
+		if ip == nil {
+			return dst, ErrInvalidAddress
+		}
+		dst = append(append(dst, AddrIPv4), ip...)
+	case AddrIPv6:
+		ip := net.ParseIP(addr.Host)
+		if ip == nil {
+			return dst, ErrInvalidAddress
+		}
+		dst = append(append(dst, AddrIPv6), ip.To16()...)
+	case AddrDomain:
+		if len(addr.Host) > 255 {
+			return dst, ErrFieldTooLong
+		}
+		dst = append(append(dst, AddrDomain, byte(len(addr.Host))), addr.Host...)
+	default:
+		return dst, ErrAddressType
+	}
+	return binary.BigEndian.AppendUint16(dst, addr.Port), nil
+}
+
+// Greeting is the client's method selection message.
+type Greeting struct {
+	Methods []byte
+}
+
+func ParseGreeting(b []byte) (Greeting, int, error) {
+	if len(b) < 2 {
+		return Greeting{}, 0, ErrShortBuffer
+	}
+	if b[0] != Version {
+		return Greeting{}, 0, ErrVersion
+	}
+	n := 2 + int(b[1])
+	if len(b) < n {
+		return Greeting{}, 0, ErrShortBuffer
+	}
+	return Greeting{Methods: append([]byte(nil), b[2:n]...)}, n, nil
+}
+
+func AppendGreeting(dst []byte, g Greeting) ([]byte, error) {
+	if len(g.Methods) == 0 {
+		return dst, ErrNoMethods
+	}
+	if len(g.Methods) > 255 {
+		return dst, ErrFieldTooLong
+	}
+	return append(append(dst, Version, byte(len(g.Methods))), g.Methods...), nil
+}
+
+// MethodSelection is the server's choice of auth method.
+type MethodSelection struct {
+	Method byte
+}
+
+func ParseMethodSelection(b []byte) (MethodSelection, int, error) {
+	if len(b) < 2 {
+		return MethodSelection{}, 0, ErrShortBuffer
+	}
+	if b[0] != Version {
+		return MethodSelection{}, 0, ErrVersion
+	}
+	return MethodSelection{Method: b[1]}, 2, nil
+}
+
+func AppendMethodSelection(dst []byte, m MethodSelection) []byte {
+	return append(dst, Version, m.Method)
+}
+
+// PasswordRequest is the RFC 1929 username/password request.
+type PasswordRequest struct {
+	Username string
+	Password string
+}
+
+func ParsePasswordRequest(b []byte) (PasswordRequest, int, error) {
+	if len(b) < 2 {
+		return PasswordRequest{}, 0, ErrShortBuffer
+	}
+	if b[0] != PasswordVersion {
+		return PasswordRequest{}, 0, ErrVersion
+	}
+	ulen := int(b[1])
+	if len(b) < 2+ulen+1 {
+		return PasswordRequest{}, 0, ErrShortBuffer
+	}
+	plen := int(b[2+ulen])
+	n := 2 + ulen + 1 + plen
+	if len(b) < n {
+		return PasswordRequest{}, 0, ErrShortBuffer
+	}
+	return PasswordRequest{Username: string(b[2 : 2+ulen]), Password: string(b[3+ulen : n])}, n, nil
+}
+
+func AppendPasswordRequest(dst []byte, p PasswordRequest) ([]byte, error) {
+	if len(p.Username) > 255 || len(p.Password) > 255 {
+		return dst, ErrFieldTooLong
+	}
+	dst = append(append(dst, PasswordVersion, byte(len(p.Username))), p.Username...)
+	return append(append(dst, byte(len(p.Password))), p.Password...), nil
+}
+
+// PasswordReply is the RFC 1929 status; zero means success.
+type PasswordReply struct {
+	Status byte
+}
+
+func ParsePasswordReply(b []byte) (PasswordReply, int, error) {
+	if len(b) < 2 {
+		return PasswordReply{}, 0, ErrShortBuffer
+	}
+	if b[0] != PasswordVersion {
+		return PasswordReply{}, 0, ErrVersion
+	}
+	return PasswordReply{Status: b[1]}, 2, nil
+}
+
+func AppendPasswordReply(dst []byte, r PasswordReply) []byte {
+	return append(dst, PasswordVersion, r.Status)
+}
+
+// Request is the client's request: CONNECT, BIND or UDP ASSOCIATE.
+type Request struct {
+	Cmd  byte
+	Addr Addr
+}
+
+func ParseRequest(b []byte) (Request, int, error) {
+	cmd, addr, n, err := parseCommandMessage(b)
+	return Request{Cmd: cmd, Addr: addr}, n, err
+}
+
+func AppendRequest(dst []byte, r Request) ([]byte, error) {
+	return appendWithAddr(dst, []byte{Version, r.Cmd, 0x00}, r.Addr, nil)
+}
+
+// Reply is the server's reply to a request.
+type Reply struct {
+	Reply byte
+	Addr  Addr
+}
+
+func ParseReply(b []byte) (Reply, int, error) {
+	reply, addr, n, err := parseCommandMessage(b)
+	return Reply{Reply: reply, Addr: addr}, n, err
+}
+
+func AppendReply(dst []byte, r Reply) ([]byte, error) {
+	return appendWithAddr(dst, []byte{Version, r.Reply, 0x00}, r.Addr, nil)
+}
+
+// parseCommandMessage decodes the shared layout of requests and replies:
+// VER, CMD or REP, RSV and an address.
+func parseCommandMessage(b []byte) (byte, Addr, int, error) {
+	if len(b) < 3 {
+		return 0, Addr{}, 0, ErrShortBuffer
+	}
+	if b[0] != Version {
+		return 0, Addr{}, 0, ErrVersion
+	}
+	if b[2] != 0x00 {
+		return 0, Addr{}, 0, ErrNonZeroReserved
+	}
+	addr, n, err := ParseAddr(b[3:])
+	if err != nil {
+		return 0, Addr{}, 0, err
+	}
+	return b[1], addr, 3 + n, nil
+}
+
+// Datagram is a UDP ASSOCIATE datagram with its header.
+type Datagram struct {
+	Frag byte
+	Addr Addr
+	// Data aliases the parsed buffer.
+	Data []byte
+}
+
+// ParseDatagram decodes a whole UDP datagram; n is always len(b).
+func ParseDatagram(b []byte) (Datagram, int, error) {
+	if len(b) < 4 {
+		return Datagram{}, 0, ErrShortBuffer
+	}
+	if b[0] != 0x00 || b[1] != 0x00 {
+		return Datagram{}, 0, ErrNonZeroReserved
+	}
+	addr, n, err := ParseAddr(b[3:])
+	if err != nil {
+		return Datagram{}, 0, err
+	}
+	return Datagram{Frag: b[2], Addr: addr, Data: b[3+n:]}, len(b), nil
+}
+
+func AppendDatagram(dst []byte, d Datagram) ([]byte, error) {
+	return appendWithAddr(dst, []byte{0x00, 0x00, d.Frag}, d.Addr, d.Data)
+}
+
+// appendWithAddr appends header, addr and trailer, leaving dst as it was on error.
+func appendWithAddr(dst, header []byte, addr Addr, trailer []byte) ([]byte, error) {
+	out, err := AppendAddr(append(dst, header...), addr)
+	if err != nil {
+		return dst, err
+	}
+	return append(out, trailer...), nil
+}
@@ -0,0 +1,128 @@
+package socks5wire
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Append func([]byte) ([]byte, error)
+		Parse  func([]byte) (any, int, error)
+		Want   any
+		Wire   []byte
+	}{
+		{
+			"greeting",
+			func(b []byte) ([]byte, error) { return AppendGreeting(b, Greeting{Methods: []byte{0x00, 0x02}}) },
+			func(b []byte) (any, int, error) { return ParseGreeting(b) },
+			Greeting{Methods: []byte{0x00, 0x02}},
+			[]byte{Version, 2, 0x00, 0x02},
+		},
+		{
+			"method selection",
+			func(b []byte) ([]byte, error) { return AppendMethodSelection(b, MethodSelection{Method: 0x02}), nil },
+			func(b []byte) (any, int, error) { return ParseMethodSelection(b) },
+			MethodSelection{Method: 0x02},
+			[]byte{Version, 0x02},
+		},
+		{
+			"password request",
+			func(b []byte) ([]byte, error) {
+				return AppendPasswordRequest(b, PasswordRequest{Username: "ab", Password: "c"})
+			},
+			func(b []byte) (any, int, error) { return ParsePasswordRequest(b) },
+			PasswordRequest{Username: "ab", Password: "c"},
+			[]byte{PasswordVersion, 2, 'a', 'b', 1, 'c'},
+		},
+		{
+			"password reply",
+			func(b []byte) ([]byte, error) { return AppendPasswordReply(b, PasswordReply{Status: 1}), nil },
+			func(b []byte) (any, int, error) { return ParsePasswordReply(b) },
+			PasswordReply{Status: 1},
+			[]byte{PasswordVersion, 1},
+		},
+		{
+			"request domain",
+			func(b []byte) ([]byte, error) {
+				return AppendRequest(b, Request{Cmd: 0x01, Addr: Addr{Type: AddrDomain, Host: "a.io", Port: 443}})
+			},
+			func(b []byte) (any, int, error) { return ParseRequest(b) },
+			Request{Cmd: 0x01, Addr: Addr{Type: AddrDomain, Host: "a.io", Port: 443}},
+			[]byte{Version, 0x01, 0x00, AddrDomain, 4, 'a', '.', 'i', 'o', 0x01, 0xbb},
+		},
+		{
+			"reply IPv6",
+			func(b []byte) ([]byte, error) {
+				return AppendReply(b, Reply{Reply: 0x00, Addr: Addr{Type: AddrIPv6, Host: "::1", Port: 80}})
+			},
+			func(b []byte) (any, int, error) { return ParseReply(b) },
+			Reply{Reply: 0x00, Addr: Addr{Type: AddrIPv6, Host: "::1", Port: 80}},
+			[]byte{Version, 0x00, 0x00, AddrIPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 80},
+		},
+		{
+			"datagram",
+			func(b []byte) ([]byte, error) {
+				return AppendDatagram(b, Datagram{Addr: Addr{Type: AddrIPv4, Host: "10.0.0.1", Port: 53}, Data: []byte("q")})
+			},
+			func(b []byte) (any, int, error) { return ParseDatagram(b) },
+			Datagram{Addr: Addr{Type: AddrIPv4, Host: "10.0.0.1", Port: 53}, Data: []byte("q")},
+			[]byte{0, 0, 0, AddrIPv4, 10, 0, 0, 1, 0, 53, 'q'},
+		},
+	}
+	for _, test := range tests {
+		wire, err := test.Append(nil)
+		if err != nil || !bytes.Equal(wire, test.Wire) {
+			t.Fatalf("%s: should encode %v but got %v, %v", test.Name, test.Wire, wire, err)
+		}
+		got, n, err := test.Parse(append(wire, 0xff))
+		if test.Name == "datagram" {
+			got, n, err = test.Parse(wire)
+		}
+		if err != nil || n != len(wire) || !reflect.DeepEqual(got, test.Want) {
+			t.Fatalf("%s: should decode %+v (%d bytes) but got %+v (%d bytes), %v", test.Name, test.Want, len(wire), got, n, err)
+		}
+		// Every proper prefix is incomplete
+		for i := 0; i < len(wire) && test.Name != "datagram"; i++ {
+			if _, _, err := test.Parse(wire[:i]); err != ErrShortBuffer {
+				t.Fatalf("%s: prefix of %d bytes should get error %s but got %v", test.Name, i, ErrShortBuffer, err)
+			}
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	if _, _, err := ParseRequest([]byte{0x04, 0x01, 0x00, AddrIPv4}); err != ErrVersion {
+		t.Fatalf("should get error %s but got %v", ErrVersion, err)
+	}
+	if _, _, err := ParseRequest([]byte{Version, 0x01, 0x01, AddrIPv4}); err != ErrNonZeroReserved {
+		t.Fatalf("should get error %s but got %v", ErrNonZeroReserved, err)
+	}
+	if _, _, err := ParseRequest([]byte{Version, 0x01, 0x00, 0x02}); err != ErrAddressType {
+		t.Fatalf("should get error %s but got %v", ErrAddressType, err)
+	}
+	dst := []byte{0xaa}
+	if got, err := AppendRequest(dst, Request{Addr: Addr{Type: AddrIPv4, Host: "::1"}}); err != ErrInvalidAddress || !bytes.Equal(got, dst) {
+		t.Fatalf("should leave dst unchanged on error but got %v, %v", got, err)
+	}
+}
+
+func FuzzParseRequest(f *testing.F) {
+	f.Add([]byte{Version, 0x01, 0x00, AddrDomain, 4, 'a', '.', 'i', 'o', 0x01, 0xbb})
+	f.Add([]byte{Version, 0x03, 0x00, AddrIPv4, 0, 0, 0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		request, n, err := ParseRequest(b)
+		if err != nil {
+			return
+		}
+		wire, err := AppendRequest(nil, request)
+		if err != nil {
+			t.Fatalf("parsed request %+v should encode but got %s", request, err)
+		}
+		if request.Addr.Type != AddrIPv6 && !bytes.Equal(wire, b[:n]) {
+			t.Fatalf("should re-encode %v but got %v", b[:n], wire)
+		}
+	})
+}
@@ -0,0 +1,84 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+var (
+	ErrSourceFiltered       = errors.New("source address not allowed")
+	ErrInvalidSourceNetwork = errors.New("invalid network in source filter")
+)
+
+// SourceFilter accepts or drops client connections by source IP as soon as
+// they are accepted, before anything is read, so unwanted networks cost no
+// handshake work. Replace it with ApplyConfig to reload the lists.
+type SourceFilter struct {
+	// Allow, if not empty, lists the only networks accepted, in CIDR
+	// notation or as single IPs.
+	Allow []string
+	// Deny lists networks that are dropped even if allowed.
+	Deny []string
+
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// parseNetwork parses a CIDR network or a single IP.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		return ipNet, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, ErrInvalidSourceNetwork
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func (f *SourceFilter) compile() error {
+	f.allow, f.deny = f.allow[:0], f.deny[:0]
+	for _, s := range f.Allow {
+		ipNet, err := parseNetwork(s)
+		if err != nil {
+			return ErrInvalidSourceNetwork
+		}
+		f.allow = append(f.allow, ipNet)
+	}
+	for _, s := range f.Deny {
+		ipNet, err := parseNetwork(s)
+		if err != nil {
+			return ErrInvalidSourceNetwork
+		}
+		f.deny = append(f.deny, ipNet)
+	}
+	return nil
+}
+
+// allowed reports whether connections from ip are accepted. Connections
+// without an IP source, e.g. over Unix sockets, are only dropped by an
+// Allow list.
+func (f *SourceFilter) allowed(ip net.IP) bool {
+	if ip == nil {
+		return len(f.allow) == 0
+	}
+	for _, ipNet := range f.deny {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, ipNet := range f.allow {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSourceFilterAllowed(t *testing.T) {
+	filter := SourceFilter{
+		Allow: []string{"10.0.0.0/8", "192.0.2.7", "2001:db8::/32"},
+		Deny:  []string{"10.1.0.0/16"},
+	}
+	if err := filter.compile(); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	tests := map[string]bool{
+		"10.2.3.4":        true,
+		"10.1.2.3":        false,
+		"192.0.2.7":       true,
+		"192.0.2.8":       false,
+		"::ffff:10.2.3.4": true,
+		"2001:db8::1":     true,
+		"2001:db9::1":     false,
+		"not an ip":       false,
+		"::ffff:10.1.0.1": false,
+	}
+	for ip, want := range tests {
+		if got := filter.allowed(net.ParseIP(ip)); got != want {
+			t.Fatalf("%s: should get %v but got %v", ip, want, got)
+		}
+	}
+
+	denyOnly := SourceFilter{Deny: []string{"192.0.2.0/24"}}
+	denyOnly.compile()
+	if !denyOnly.allowed(nil) || !denyOnly.allowed(net.ParseIP("198.51.100.1")) || denyOnly.allowed(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("deny-only filter should only drop denied networks")
+	}
+
+	if err := (&SourceFilter{Allow: []string{"10.0.0.0/33"}}).compile(); err != ErrInvalidSourceNetwork {
+		t.Fatalf("should get error %s but got %v", ErrInvalidSourceNetwork, err)
+	}
+}
+
+func TestSourceFilterBeforeHandshake(t *testing.T) {
+	server := SOCKS5Server{Config: &Config{
+		AuthMethod:   MethodNoAuth,
+		SourceFilter: &SourceFilter{Deny: []string{"127.0.0.0/8"}},
+	}}
+	clientConn, serverConn := tcpPair(t)
+	defer clientConn.Close()
+
+	// Nothing is read, so the client's greeting is never needed
+	if err := server.ServeConn(serverConn); err != ErrSourceFiltered {
+		t.Fatalf("should get error %s but got %v", ErrSourceFiltered, err)
+	}
+	if got := server.Stats().FilteredConnections; got != 1 {
+		t.Fatalf("should count 1 filtered connection but got %d", got)
+	}
+
+	// A reloaded filter applies to new connections
+	if err := server.ApplyConfig(&Config{AuthMethod: MethodNoAuth, SourceFilter: &SourceFilter{Allow: []string{"127.0.0.1"}}}); err != nil {
+		t.Fatal(err)
+	}
+	clientConn, serverConn = tcpPair(t)
+	defer clientConn.Close()
+	go server.ServeConn(serverConn)
+	clientConn.Write([]byte{SOCKS5Version, 1, byte(MethodNoAuth)})
+	reply := make([]byte, 2)
+	if _, err := clientConn.Read(reply); err != nil || reply[1] != byte(MethodNoAuth) {
+		t.Fatalf("should get method reply but got %v, %v", reply, err)
+	}
+}
@@ -0,0 +1,76 @@
+package socks5
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// SQLRecorder is a SessionRecorder writing to a "sessions" table through
+// database/sql. The statements are plain SQL as understood by SQLite, so an
+// embedded database opened with any SQLite driver gives small deployments a
+// queryable history without external infrastructure.
+type SQLRecorder struct {
+	DB *sql.DB
+	// Retention deletes records that ended longer ago than this. Zero keeps everything.
+	Retention time.Duration
+	// Redaction, if set, redacts the records before they are stored.
+	Redaction *Redaction
+
+	mu        sync.Mutex
+	lastPrune time.Time
+	clock     clock
+}
+
+// pruneInterval is how often Record deletes expired records.
+const pruneInterval = time.Minute
+
+// NewSQLRecorder creates the sessions table in db if needed.
+func NewSQLRecorder(db *sql.DB, retention time.Duration) (*SQLRecorder, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS sessions (
+	id TEXT PRIMARY KEY,
+	client TEXT NOT NULL,
+	username TEXT NOT NULL,
+	target TEXT NOT NULL,
+	start_time INTEGER NOT NULL,
+	end_time INTEGER NOT NULL,
+	sent INTEGER NOT NULL,
+	received INTEGER NOT NULL
+)`)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS sessions_end_time ON sessions (end_time)`); err != nil {
+		return nil, err
+	}
+	return &SQLRecorder{DB: db, Retention: retention}, nil
+}
+
+// Record inserts record, with times as Unix milliseconds, and prunes expired
+// records at most once per minute. Errors are logged.
+func (r *SQLRecorder) Record(record SessionRecord) {
+	record = r.Redaction.Record(record)
+	_, err := r.DB.Exec(`INSERT INTO sessions (id, client, username, target, start_time, end_time, sent, received) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		record.SessionID, record.ClientAddr, record.Username, record.Target,
+		record.Start.UnixMilli(), record.End.UnixMilli(), record.Sent, record.Received)
+	if err != nil {
+		logSession(record.SessionID, "record session error", err)
+	}
+	if r.Retention > 0 {
+		r.prune()
+	}
+}
+
+func (r *SQLRecorder) prune() {
+	now := timeNow(r.clock)
+	r.mu.Lock()
+	if now.Sub(r.lastPrune) < pruneInterval {
+		r.mu.Unlock()
+		return
+	}
+	r.lastPrune = now
+	r.mu.Unlock()
+	if _, err := r.DB.Exec(`DELETE FROM sessions WHERE end_time < ?`, now.Add(-r.Retention).UnixMilli()); err != nil {
+		logPrintln("prune session records error", err)
+	}
+}
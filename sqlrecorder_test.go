@@ -0,0 +1,104 @@
+package socks5
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// execLog is a database/sql driver that records executed statements.
+type execLog struct {
+	mu    sync.Mutex
+	execs []string
+	args  [][]driver.Value
+}
+
+func (l *execLog) Open(name string) (driver.Conn, error) { return execConn{l}, nil }
+
+type execConn struct{ log *execLog }
+
+func (c execConn) Prepare(query string) (driver.Stmt, error) { return execStmt{c.log, query}, nil }
+func (c execConn) Close() error                              { return nil }
+func (c execConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+type execStmt struct {
+	log   *execLog
+	query string
+}
+
+func (s execStmt) Close() error  { return nil }
+func (s execStmt) NumInput() int { return -1 }
+func (s execStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.log.mu.Lock()
+	defer s.log.mu.Unlock()
+	s.log.execs = append(s.log.execs, s.query)
+	s.log.args = append(s.log.args, args)
+	return driver.RowsAffected(1), nil
+}
+func (s execStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+var recorderDriver = &execLog{}
+
+func init() {
+	sql.Register("socks5-execlog", recorderDriver)
+}
+
+func TestSQLRecorder(t *testing.T) {
+	db, err := sql.Open("socks5-execlog", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	recorder, err := NewSQLRecorder(db, time.Hour)
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	clock := newFakeClock()
+	recorder.clock = clock
+
+	server := SOCKS5Server{Config: &Config{Recorder: recorder}}
+	host, portStr, _ := net.SplitHostPort(echoServer(t))
+	port, _ := strconv.Atoi(portStr)
+	clientConn, serverConn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		defer serverConn.Close()
+		done <- server.request(serverConn, &AuthContext{SessionID: "s1", Username: "alice"})
+	}()
+	WriteClientRequestMessage(clientConn, CmdConnect, host, uint16(port))
+	if _, err := NewServerReplyMessage(clientConn); err != nil {
+		t.Fatalf("should read reply but got %s", err)
+	}
+	clientConn.Write([]byte("ping"))
+	io.ReadFull(clientConn, make([]byte, 4))
+	clientConn.Close()
+	<-done
+
+	recorderDriver.mu.Lock()
+	defer recorderDriver.mu.Unlock()
+	var inserted []driver.Value
+	var pruned bool
+	for i, query := range recorderDriver.execs {
+		switch {
+		case strings.HasPrefix(query, "INSERT INTO sessions"):
+			inserted = recorderDriver.args[i]
+		case strings.HasPrefix(query, "DELETE FROM sessions"):
+			pruned = recorderDriver.args[i][0] == clock.Now().Add(-time.Hour).UnixMilli()
+		}
+	}
+	if len(inserted) != 8 || inserted[0] != "s1" || inserted[2] != "alice" || inserted[6] != int64(4) || inserted[7] != int64(4) {
+		t.Fatalf("unexpected inserted record %v", inserted)
+	}
+	if !pruned {
+		t.Fatalf("records older than the retention should be pruned, executed %v", recorderDriver.execs)
+	}
+}
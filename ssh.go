@@ -0,0 +1,25 @@
+package socks5
+
+import (
+	"context"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DialSSH connects to the SSH server at address through the proxy server
+// and completes the SSH handshake, as ssh.Dial does directly. ctx bounds
+// both the CONNECT and the SSH handshake. To instead reach the proxy
+// server through an SSH server, see ProxyDialer.
+func (c *Client) DialSSH(ctx context.Context, address string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := c.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	stop := watchContext(ctx, conn)
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, address, config)
+	if err = stop(err); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
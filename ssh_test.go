@@ -0,0 +1,130 @@
+package socks5
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshServer starts an SSH server accepting any client that forwards
+// direct-tcpip channels, as used by ssh -J, and returns its address.
+func sshServer(t *testing.T) string {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newChannel := range chans {
+					go forwardSSHChannel(newChannel)
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func forwardSSHChannel(newChannel ssh.NewChannel) {
+	var target struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	if newChannel.ChannelType() != "direct-tcpip" || ssh.Unmarshal(newChannel.ExtraData(), &target) != nil {
+		newChannel.Reject(ssh.UnknownChannelType, "only direct-tcpip")
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		io.Copy(conn, channel)
+		conn.Close()
+	}()
+	io.Copy(channel, conn)
+	channel.Close()
+}
+
+func sshPing(t *testing.T, conn net.Conn) {
+	t.Helper()
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("should echo ping but got %q, %v", buf, err)
+	}
+}
+
+func TestClientProxyDialerSSH(t *testing.T) {
+	echo := echoServer(t)
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth}}
+	address, _ := startServer(t, &server)
+	defer server.Shutdown(context.Background())
+
+	jump, err := ssh.Dial("tcp", sshServer(t), &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jump.Close()
+	client := Client{ProxyAddress: address, ProxyDialer: jump.DialContext}
+	conn, err := client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	sshPing(t, conn)
+}
+
+func TestClientDialSSH(t *testing.T) {
+	echo := echoServer(t)
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth}}
+	address, _ := startServer(t, &server)
+	defer server.Shutdown(context.Background())
+
+	client := Client{ProxyAddress: address}
+	sshClient, err := client.DialSSH(context.Background(), sshServer(t), &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	defer sshClient.Close()
+	conn, err := sshClient.Dial("tcp", echo)
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	sshPing(t, conn)
+}
@@ -0,0 +1,443 @@
+package socks5
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of server counters. It shares no memory with the
+// server, so it can be kept and compared with later snapshots.
+type Stats struct {
+	// Uptime is the time since the server started serving.
+	Uptime time.Duration
+	// Connections counts accepted client connections, ActiveConnections
+	// those still open.
+	Connections       int64
+	ActiveConnections int64
+	// Sessions counts established TCP sessions (CONNECT and BIND),
+	// ActiveSessions those still relaying.
+	Sessions       int64
+	ActiveSessions int64
+	// AuthFailures counts rejected credentials.
+	AuthFailures int64
+	// DialFailures counts failed connections to targets.
+	DialFailures int64
+	// BytesSent counts relayed bytes from clients to targets, BytesReceived
+	// the other way.
+	BytesSent     int64
+	BytesReceived int64
+	// TopDestinations lists the most requested destination hosts, busiest
+	// first, at most 10.
+	TopDestinations []DestinationStats
+	// Users holds counters per authenticated user. To bound memory, users
+	// beyond the first 1000 seen are counted together under OtherUsers.
+	Users map[string]UserStats
+	// Labels holds counters per session label (see AuthContext.Labels). A
+	// session counts once for each of its labels. Labels beyond the first
+	// 1000 seen are counted together under OtherLabels.
+	Labels map[string]LabelStats
+	// Rules holds counters per Config.Rules entry, keyed by Rule.Name. Rules
+	// beyond the first 1000 seen are counted together under OtherRules.
+	Rules map[string]RuleStats
+	// Terminations counts ended sessions by why they ended.
+	Terminations map[TerminationReason]int64
+
+	// HostLimitRejections counts requests refused because their destination
+	// host reached Config.MaxConnsPerHost.
+	HostLimitRejections int64
+	// MalformedHandshakes counts connections that sent an invalid handshake.
+	MalformedHandshakes int64
+	// EmptyConnections counts connections closed before sending a handshake.
+	EmptyConnections int64
+	// BannedConnections counts connections refused by Config.ScanGuard.
+	BannedConnections int64
+	// FilteredConnections counts connections dropped by Config.SourceFilter.
+	FilteredConnections int64
+	// DialQueueRejections counts requests refused because the dial queue of
+	// Config.MaxConcurrentDials was full or they waited too long.
+	DialQueueRejections int64
+	// SNIMismatches counts sessions closed by Config.RequireSNIMatch.
+	SNIMismatches int64
+	// CircuitOpenRejections counts requests refused by Config.CircuitBreaker.
+	CircuitOpenRejections int64
+	// UDPAmplificationDrops counts UDP replies dropped by Config.UDPAmplificationRatio.
+	UDPAmplificationDrops int64
+	// TargetTypeRejections counts requests refused by Config.RejectIPTargets
+	// or Config.RejectDomainTargets, and UDP datagrams dropped by the latter.
+	TargetTypeRejections int64
+	// BlocklistRejections counts requests refused and UDP datagrams dropped
+	// by Config.DomainBlocklist.
+	BlocklistRejections int64
+	// ReputationHits counts connections to destination IPs Config.Reputation
+	// rated malicious, refused or, with MonitorOnly, flagged.
+	ReputationHits int64
+	// UDPLimitRejections counts UDP ASSOCIATE requests refused by
+	// Config.MaxUDPAssociationsPerUser.
+	UDPLimitRejections int64
+	// UpstreamFailovers counts connections dialed directly because
+	// Config.Upstream was unreachable, see Rule.FailoverDirect.
+	UpstreamFailovers int64
+	// RequestTimeouts counts requests not answered within
+	// Config.RequestTimeout.
+	RequestTimeouts int64
+	// MemoryInUse is the approximate memory held by session buffers, as
+	// charged against Config.MaxMemory.
+	MemoryInUse int64
+	// MemoryRejections counts connections refused by Config.MaxMemory,
+	// MemoryShedSessions idle sessions closed by Config.MemoryShedIdle.
+	MemoryRejections   int64
+	MemoryShedSessions int64
+	// UDPTargetErrors counts errors relaying UDP datagrams to and from
+	// targets by kind: "port_unreachable", "host_unreachable",
+	// "network_unreachable" or "error".
+	UDPTargetErrors map[string]int64
+}
+
+// DestinationStats counts the requests for a destination host.
+type DestinationStats struct {
+	Host     string
+	Requests int64
+}
+
+// UserStats counts the sessions and relayed bytes of a user.
+type UserStats struct {
+	Sessions      int64
+	BytesSent     int64
+	BytesReceived int64
+}
+
+// LabelStats counts the sessions and relayed bytes of a label.
+type LabelStats struct {
+	Sessions      int64
+	BytesSent     int64
+	BytesReceived int64
+}
+
+// RuleStats counts the requests a rule matched and the sessions it carried,
+// to find rules that no longer match anything.
+type RuleStats struct {
+	// Hits counts matched requests, including those the rule refused.
+	Hits int64
+	// Sessions counts the TCP sessions relayed under the rule.
+	Sessions      int64
+	BytesSent     int64
+	BytesReceived int64
+	// LastMatch is when the rule last matched a request.
+	LastMatch time.Time
+}
+
+// OtherUsers, OtherLabels and OtherRules are the Stats.Users, Stats.Labels
+// and Stats.Rules keys of users, labels and rules past the tracking limit.
+const (
+	OtherUsers  = "*"
+	OtherLabels = "*"
+	OtherRules  = "*"
+)
+
+const (
+	maxTrackedUsers        = 1000
+	maxTrackedLabels       = 1000
+	maxTrackedRules        = 1000
+	maxTrackedDestinations = 1000
+	topDestinations        = 10
+)
+
+type serverStats struct {
+	started atomic.Int64
+
+	connections           atomic.Int64
+	sessions              atomic.Int64
+	activeSessions        atomic.Int64
+	authFailures          atomic.Int64
+	dialFailures          atomic.Int64
+	bytesSent             atomic.Int64
+	bytesReceived         atomic.Int64
+	hostLimitRejections   atomic.Int64
+	malformedHandshakes   atomic.Int64
+	emptyConnections      atomic.Int64
+	bannedConnections     atomic.Int64
+	filteredConnections   atomic.Int64
+	dialQueueRejections   atomic.Int64
+	sniMismatches         atomic.Int64
+	circuitOpenRejections atomic.Int64
+	udpAmplificationDrops atomic.Int64
+	udpLimitRejections    atomic.Int64
+	targetTypeRejections  atomic.Int64
+	reputationHits        atomic.Int64
+	blocklistRejections   atomic.Int64
+	upstreamFailovers     atomic.Int64
+	requestTimeouts       atomic.Int64
+	memoryRejections      atomic.Int64
+	memoryShedSessions    atomic.Int64
+	terminations          [numTerminationReasons]atomic.Int64
+	udpTargetErrors       [numUDPTargetErrors]atomic.Int64
+
+	mu           sync.Mutex
+	destinations map[string]int64
+	users        map[string]*UserStats
+	labels       map[string]*LabelStats
+	rules        map[string]*RuleStats
+	// today counts the bytes relayed for each user on day, including open
+	// sessions, for rule expressions. Relays add to the counters without
+	// holding mu.
+	day   string
+	today map[string]*atomic.Int64
+}
+
+// relayTally counts the bytes of one relayed session and records why it
+// ended, the key and priority of the rule it matched, if any, and its
+// PortClass.
+type relayTally struct {
+	sent     atomic.Int64
+	received atomic.Int64
+	reason   TerminationReason
+	rule     string
+	priority int
+	class    PortClass
+	// today is the user whose daily bytes the relay counts, see todayUser.
+	today string
+}
+
+// todayUser returns the user of authCtx if a rule of config reads
+// bytesToday, so that the relay counts the user's bytes as they flow.
+func todayUser(config *Config, authCtx *AuthContext) string {
+	for i := range config.Rules {
+		if config.Rules[i].bytesToday {
+			return authCtx.Username
+		}
+	}
+	return ""
+}
+
+// todayWriter adds the bytes written to the user's count for the day. It
+// looks the counter up again only once the day it counts for is over.
+type todayWriter struct {
+	w        io.Writer
+	server   *SOCKS5Server
+	username string
+	counter  *atomic.Int64
+	until    time.Time
+}
+
+func (w *todayWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	if now := timeNow(w.server.clock); !now.Before(w.until) {
+		w.counter, w.until = w.server.stats.todayCounter(w.username, now.Local())
+	}
+	if w.counter != nil {
+		w.counter.Add(int64(n))
+	}
+	return n, err
+}
+
+// request counts a request for host. Hosts past the tracking limit are not
+// counted, so long-running servers keep their first busy destinations.
+func (st *serverStats) request(host string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.destinations == nil {
+		st.destinations = make(map[string]int64)
+	}
+	if _, ok := st.destinations[host]; ok || len(st.destinations) < maxTrackedDestinations {
+		st.destinations[host]++
+	}
+}
+
+// todayCounter returns the counter of the bytes relayed for username on the
+// day of now, nil past the tracking limit, and the end of that day.
+func (st *serverStats) todayCounter(username string, now time.Time) (*atomic.Int64, time.Time) {
+	year, month, day := now.Date()
+	end := time.Date(year, month, day+1, 0, 0, 0, 0, now.Location())
+	if username == "" {
+		return nil, end
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if day := now.Format("2006-01-02"); day != st.day || st.today == nil {
+		st.day = day
+		st.today = make(map[string]*atomic.Int64)
+	}
+	counter, ok := st.today[username]
+	if !ok && len(st.today) < maxTrackedUsers {
+		counter = new(atomic.Int64)
+		st.today[username] = counter
+	}
+	return counter, end
+}
+
+// bytesToday returns the bytes counted for username on the day of now.
+func (st *serverStats) bytesToday(username string, now time.Time) int64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if now.Format("2006-01-02") != st.day {
+		return 0
+	}
+	if counter := st.today[username]; counter != nil {
+		return counter.Load()
+	}
+	return 0
+}
+
+// ruleHit counts a request matched by the rule with key.
+func (st *serverStats) ruleHit(key string, now time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	rule := st.rule(key)
+	rule.Hits++
+	rule.LastMatch = now
+}
+
+// rule returns the counters of the rule with key. st.mu must be held.
+func (st *serverStats) rule(key string) *RuleStats {
+	if st.rules == nil {
+		st.rules = make(map[string]*RuleStats)
+	}
+	rule, ok := st.rules[key]
+	if !ok {
+		if len(st.rules) >= maxTrackedRules {
+			key = OtherRules
+		}
+		if rule, ok = st.rules[key]; !ok {
+			rule = &RuleStats{}
+			st.rules[key] = rule
+		}
+	}
+	return rule
+}
+
+// sessionStarted counts an established session and returns the function
+// recording its end, by which time authCtx holds all of its labels.
+func (st *serverStats) sessionStarted(authCtx *AuthContext) func(tally *relayTally) {
+	st.sessions.Add(1)
+	st.activeSessions.Add(1)
+	return func(tally *relayTally) {
+		st.activeSessions.Add(-1)
+		st.terminations[tally.reason].Add(1)
+		sent, received := tally.sent.Load(), tally.received.Load()
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		if authCtx.Username != "" {
+			if st.users == nil {
+				st.users = make(map[string]*UserStats)
+			}
+			user, ok := st.users[authCtx.Username]
+			if !ok {
+				name := authCtx.Username
+				if len(st.users) >= maxTrackedUsers {
+					name = OtherUsers
+				}
+				if user, ok = st.users[name]; !ok {
+					user = &UserStats{}
+					st.users[name] = user
+				}
+			}
+			user.Sessions++
+			user.BytesSent += sent
+			user.BytesReceived += received
+		}
+		for _, name := range authCtx.Labels {
+			if st.labels == nil {
+				st.labels = make(map[string]*LabelStats)
+			}
+			label, ok := st.labels[name]
+			if !ok {
+				if len(st.labels) >= maxTrackedLabels {
+					name = OtherLabels
+				}
+				if label, ok = st.labels[name]; !ok {
+					label = &LabelStats{}
+					st.labels[name] = label
+				}
+			}
+			label.Sessions++
+			label.BytesSent += sent
+			label.BytesReceived += received
+		}
+		if tally.rule != "" {
+			rule := st.rule(tally.rule)
+			rule.Sessions++
+			rule.BytesSent += sent
+			rule.BytesReceived += received
+		}
+	}
+}
+
+// Stats returns a snapshot of the server counters.
+func (s *SOCKS5Server) Stats() Stats {
+	stats := Stats{
+		Connections:           s.stats.connections.Load(),
+		Sessions:              s.stats.sessions.Load(),
+		ActiveSessions:        s.stats.activeSessions.Load(),
+		AuthFailures:          s.stats.authFailures.Load(),
+		DialFailures:          s.stats.dialFailures.Load(),
+		BytesSent:             s.stats.bytesSent.Load(),
+		BytesReceived:         s.stats.bytesReceived.Load(),
+		HostLimitRejections:   s.stats.hostLimitRejections.Load(),
+		MalformedHandshakes:   s.stats.malformedHandshakes.Load(),
+		EmptyConnections:      s.stats.emptyConnections.Load(),
+		BannedConnections:     s.stats.bannedConnections.Load(),
+		FilteredConnections:   s.stats.filteredConnections.Load(),
+		DialQueueRejections:   s.stats.dialQueueRejections.Load(),
+		SNIMismatches:         s.stats.sniMismatches.Load(),
+		CircuitOpenRejections: s.stats.circuitOpenRejections.Load(),
+		UDPAmplificationDrops: s.stats.udpAmplificationDrops.Load(),
+		UDPLimitRejections:    s.stats.udpLimitRejections.Load(),
+		TargetTypeRejections:  s.stats.targetTypeRejections.Load(),
+		ReputationHits:        s.stats.reputationHits.Load(),
+		BlocklistRejections:   s.stats.blocklistRejections.Load(),
+		UpstreamFailovers:     s.stats.upstreamFailovers.Load(),
+		RequestTimeouts:       s.stats.requestTimeouts.Load(),
+		MemoryInUse:           s.memory.inUse(),
+		MemoryRejections:      s.stats.memoryRejections.Load(),
+		MemoryShedSessions:    s.stats.memoryShedSessions.Load(),
+		Users:                 make(map[string]UserStats),
+		Labels:                make(map[string]LabelStats),
+		Rules:                 make(map[string]RuleStats),
+		Terminations:          make(map[TerminationReason]int64),
+		UDPTargetErrors:       make(map[string]int64),
+	}
+	for reason := range s.stats.terminations {
+		if n := s.stats.terminations[reason].Load(); n > 0 {
+			stats.Terminations[TerminationReason(reason)] = n
+		}
+	}
+	for kind := range s.stats.udpTargetErrors {
+		if n := s.stats.udpTargetErrors[kind].Load(); n > 0 {
+			stats.UDPTargetErrors[udpTargetErrorNames[kind]] = n
+		}
+	}
+	if started := s.stats.started.Load(); started != 0 {
+		stats.Uptime = timeNow(s.clock).Sub(time.Unix(0, started))
+	}
+
+	s.mu.Lock()
+	stats.ActiveConnections = int64(len(s.conns))
+	s.mu.Unlock()
+
+	s.stats.mu.Lock()
+	for host, requests := range s.stats.destinations {
+		stats.TopDestinations = append(stats.TopDestinations, DestinationStats{Host: host, Requests: requests})
+	}
+	for name, user := range s.stats.users {
+		stats.Users[name] = *user
+	}
+	for name, label := range s.stats.labels {
+		stats.Labels[name] = *label
+	}
+	for key, rule := range s.stats.rules {
+		stats.Rules[key] = *rule
+	}
+	s.stats.mu.Unlock()
+
+	sort.Slice(stats.TopDestinations, func(i, j int) bool {
+		a, b := stats.TopDestinations[i], stats.TopDestinations[j]
+		return a.Requests > b.Requests || a.Requests == b.Requests && a.Host < b.Host
+	})
+	if len(stats.TopDestinations) > topDestinations {
+		stats.TopDestinations = stats.TopDestinations[:topDestinations]
+	}
+	return stats
+}
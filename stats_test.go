@@ -0,0 +1,247 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatsTopDestinations(t *testing.T) {
+	var server SOCKS5Server
+	for i := 0; i < 12; i++ {
+		for j := 0; j <= i; j++ {
+			server.stats.request(fmt.Sprintf("host%02d.example", i))
+		}
+	}
+	server.stats.request("a.example")
+
+	top := server.Stats().TopDestinations
+	if len(top) != topDestinations {
+		t.Fatalf("should get %d destinations but got %d", topDestinations, len(top))
+	}
+	if want := (DestinationStats{Host: "host11.example", Requests: 12}); top[0] != want {
+		t.Fatalf("should get %v first but got %v", want, top[0])
+	}
+	if want := (DestinationStats{Host: "host02.example", Requests: 3}); top[9] != want {
+		t.Fatalf("should get %v last but got %v", want, top[9])
+	}
+}
+
+func TestStatsUserLimit(t *testing.T) {
+	var server SOCKS5Server
+	for i := 0; i < maxTrackedUsers+2; i++ {
+		tally := &relayTally{}
+		tally.sent.Add(1)
+		server.stats.sessionStarted(&AuthContext{Username: fmt.Sprintf("user%d", i)})(tally)
+	}
+	server.stats.sessionStarted(&AuthContext{Username: "user0"})(&relayTally{})
+	server.stats.sessionStarted(&AuthContext{})(&relayTally{})
+
+	users := server.Stats().Users
+	if len(users) != maxTrackedUsers+1 {
+		t.Fatalf("should track %d users but got %d", maxTrackedUsers+1, len(users))
+	}
+	if want := (UserStats{Sessions: 2, BytesSent: 1}); users["user0"] != want {
+		t.Fatalf("should get %v for user0 but got %v", want, users["user0"])
+	}
+	if want := (UserStats{Sessions: 2, BytesSent: 2}); users[OtherUsers] != want {
+		t.Fatalf("should get %v for other users but got %v", want, users[OtherUsers])
+	}
+}
+
+func TestStatsSession(t *testing.T) {
+	clock := newFakeClock()
+	server := SOCKS5Server{
+		Config: &Config{
+			AuthMethod: MethodPassword,
+			PasswordChecker: func(username, password string) bool {
+				return username == "admin" && password == "123456"
+			},
+		},
+		clock: clock,
+	}
+	address, _ := startServer(t, &server)
+	defer server.Shutdown(context.Background())
+	target := echoServer(t)
+
+	client := Client{ProxyAddress: address, Username: "admin", Password: "wrong"}
+	if _, err := client.Dial("tcp", target); err == nil {
+		t.Fatalf("should fail with a wrong password")
+	}
+
+	client.Password = "123456"
+	conn, err := client.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	clock.Advance(time.Minute)
+
+	var stats Stats
+	for i := 0; i < 100; i++ {
+		if stats = server.Stats(); stats.ActiveSessions == 0 && stats.ActiveConnections == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	host, _, _ := net.SplitHostPort(target)
+	want := Stats{
+		Uptime:          time.Minute,
+		Connections:     2,
+		Sessions:        1,
+		AuthFailures:    1,
+		BytesSent:       4,
+		BytesReceived:   4,
+		TopDestinations: []DestinationStats{{Host: host, Requests: 1}},
+		Users:           map[string]UserStats{"admin": {Sessions: 1, BytesSent: 4, BytesReceived: 4}},
+		Labels:          map[string]LabelStats{},
+		Rules:           map[string]RuleStats{},
+		Terminations:    map[TerminationReason]int64{TerminationClientEOF: 1},
+		UDPTargetErrors: map[string]int64{},
+	}
+	if !reflect.DeepEqual(want, stats) {
+		t.Fatalf("should get stats %+v but got %+v", want, stats)
+	}
+}
+
+func TestStatsLabels(t *testing.T) {
+	var mu sync.Mutex
+	var final Progress
+	server := SOCKS5Server{Config: &Config{
+		Rules: []Rule{{Labels: []string{"purpose=crawler"}}},
+		ReplyHook: func(info *ReplyInfo) {
+			info.Auth.AddLabels("team=qa", "purpose=crawler")
+		},
+		ProgressHook: func(progress Progress) {
+			mu.Lock()
+			final = progress
+			mu.Unlock()
+		},
+	}}
+	server.init()
+	host, portStr, _ := net.SplitHostPort(echoServer(t))
+	port, _ := strconv.Atoi(portStr)
+
+	clientConn, serverConn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		defer serverConn.Close()
+		done <- server.request(serverConn, &AuthContext{SessionID: "s1"})
+	}()
+	if err := WriteClientRequestMessage(clientConn, CmdConnect, host, uint16(port)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewServerReplyMessage(clientConn); err != nil {
+		t.Fatalf("should read reply but got %s", err)
+	}
+	clientConn.Write([]byte("ping"))
+	io.ReadFull(clientConn, make([]byte, 4))
+	clientConn.Close()
+	<-done
+
+	labels := []string{"purpose=crawler", "team=qa"}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(labels, final.Labels) {
+		t.Fatalf("should report labels %v but got %v", labels, final.Labels)
+	}
+	want := map[string]LabelStats{
+		"purpose=crawler": {Sessions: 1, BytesSent: 4, BytesReceived: 4},
+		"team=qa":         {Sessions: 1, BytesSent: 4, BytesReceived: 4},
+	}
+	if got := server.Stats().Labels; !reflect.DeepEqual(want, got) {
+		t.Fatalf("should get label stats %v but got %v", want, got)
+	}
+}
+
+func TestStatsRules(t *testing.T) {
+	clock := newFakeClock()
+	server := SOCKS5Server{
+		Config: &Config{Rules: []Rule{
+			{Name: "no-bind", Commands: Commands{CmdConnect}, Ports: []uint16{21}},
+			{Hosts: []string{"unused.example"}},
+			{},
+		}},
+		clock: clock,
+	}
+	server.init()
+	host, portStr, _ := net.SplitHostPort(echoServer(t))
+	port, _ := strconv.Atoi(portStr)
+
+	clientConn, serverConn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		defer serverConn.Close()
+		done <- server.request(serverConn, &AuthContext{SessionID: "s1"})
+	}()
+	if err := WriteClientRequestMessage(clientConn, CmdConnect, host, uint16(port)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewServerReplyMessage(clientConn); err != nil {
+		t.Fatalf("should read reply but got %s", err)
+	}
+	clientConn.Write([]byte("ping"))
+	io.ReadFull(clientConn, make([]byte, 4))
+	clientConn.Close()
+	<-done
+
+	// A refused request still counts as a hit
+	clock.Advance(time.Minute)
+	var buf bytes.Buffer
+	buf.Write([]byte{SOCKS5Version, CmdBind, ReservedField, TypeIPv4, 127, 0, 0, 1, 0, 21})
+	if err := server.request(&buf, &AuthContext{SessionID: "s2"}); err != ErrCommandNotAllowed {
+		t.Fatalf("should get error %s but got %v", ErrCommandNotAllowed, err)
+	}
+
+	want := map[string]RuleStats{
+		"no-bind": {Hits: 1, LastMatch: clock.Now()},
+		"#2":      {Hits: 1, Sessions: 1, BytesSent: 4, BytesReceived: 4, LastMatch: clock.Now().Add(-time.Minute)},
+	}
+	if got := server.Stats().Rules; !reflect.DeepEqual(want, got) {
+		t.Fatalf("should get rule stats %v but got %v", want, got)
+	}
+}
+
+func TestStatsStore(t *testing.T) {
+	store := &FileStatsStore{Path: filepath.Join(t.TempDir(), "stats.json")}
+	saved := PersistedStats{
+		Sessions:  5,
+		BytesSent: 100,
+		Users:     map[string]UserStats{"alice": {Sessions: 5, BytesSent: 100}},
+	}
+	if err := store.Save(&saved); err != nil {
+		t.Fatal(err)
+	}
+
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth, StatsStore: store}}
+	relaySession(t, &server).Close()
+	if stats := server.Stats(); stats.Users["alice"].BytesSent != 100 {
+		t.Fatalf("should restore the counters of alice but got %+v", stats.Users)
+	}
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The restored counters add up with the session relayed since
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Sessions != 6 || loaded.BytesSent != 104 || loaded.Users["alice"].Sessions != 5 {
+		t.Fatalf("should save 6 sessions and 104 bytes sent but got %+v", *loaded)
+	}
+}
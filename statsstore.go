@@ -0,0 +1,155 @@
+package socks5
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+)
+
+// PersistedStats are the cumulative counters a StatsStore keeps across
+// restarts, so accounting survives them.
+type PersistedStats struct {
+	Connections   int64                `json:"connections"`
+	Sessions      int64                `json:"sessions"`
+	AuthFailures  int64                `json:"auth_failures"`
+	DialFailures  int64                `json:"dial_failures"`
+	BytesSent     int64                `json:"bytes_sent"`
+	BytesReceived int64                `json:"bytes_received"`
+	Users         map[string]UserStats `json:"users"`
+}
+
+// StatsStore persists the server counters. See Config.StatsStore.
+type StatsStore interface {
+	// Load returns the saved counters, or nil if there are none yet.
+	Load() (*PersistedStats, error)
+	Save(stats *PersistedStats) error
+}
+
+// FileStatsStore keeps the counters in a JSON file.
+type FileStatsStore struct {
+	Path string
+}
+
+// Load returns the counters in the file, or nil if it doesn't exist yet.
+func (f *FileStatsStore) Load() (*PersistedStats, error) {
+	data, err := os.ReadFile(f.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stats PersistedStats
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// Save replaces the file atomically, readable by the owner only.
+func (f *FileStatsStore) Save(stats *PersistedStats) error {
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.Path, data)
+}
+
+// restoreStats adds the counters saved in store to the server's.
+func (s *SOCKS5Server) restoreStats(store StatsStore) error {
+	saved, err := store.Load()
+	if err != nil || saved == nil {
+		return err
+	}
+	st := &s.stats
+	st.connections.Add(saved.Connections)
+	st.sessions.Add(saved.Sessions)
+	st.authFailures.Add(saved.AuthFailures)
+	st.dialFailures.Add(saved.DialFailures)
+	st.bytesSent.Add(saved.BytesSent)
+	st.bytesReceived.Add(saved.BytesReceived)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.users == nil {
+		st.users = make(map[string]*UserStats)
+	}
+	for name, saved := range saved.Users {
+		user, ok := st.users[name]
+		if !ok {
+			if len(st.users) >= maxTrackedUsers {
+				name = OtherUsers
+			}
+			if user, ok = st.users[name]; !ok {
+				user = &UserStats{}
+				st.users[name] = user
+			}
+		}
+		user.Sessions += saved.Sessions
+		user.BytesSent += saved.BytesSent
+		user.BytesReceived += saved.BytesReceived
+	}
+	return nil
+}
+
+// persistedStats returns the counters to save.
+func (s *SOCKS5Server) persistedStats() *PersistedStats {
+	stats := s.Stats()
+	return &PersistedStats{
+		Connections:   stats.Connections,
+		Sessions:      stats.Sessions,
+		AuthFailures:  stats.AuthFailures,
+		DialFailures:  stats.DialFailures,
+		BytesSent:     stats.BytesSent,
+		BytesReceived: stats.BytesReceived,
+		Users:         stats.Users,
+	}
+}
+
+// flushStats saves the counters to store every interval, and once more
+// when stop is closed, then closes done.
+func (s *SOCKS5Server) flushStats(store StatsStore, interval time.Duration, stop, done chan struct{}) {
+	defer close(done)
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		stopped := false
+		select {
+		case <-stop:
+			stopped = true
+		case <-ticker.C:
+		}
+		if err := store.Save(s.persistedStats()); err != nil {
+			logPrintln("save stats failure:", err)
+		}
+		if stopped {
+			return
+		}
+	}
+}
+
+// startStatsFlush starts saving the counters to Config.StatsStore.
+func (s *SOCKS5Server) startStatsFlush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statsStop, s.statsDone = make(chan struct{}), make(chan struct{})
+	go s.flushStats(s.Config.StatsStore, s.Config.StatsFlushInterval, s.statsStop, s.statsDone)
+}
+
+// stopStatsFlush saves the counters a last time and stops flushing them,
+// reporting whether they were being flushed.
+func (s *SOCKS5Server) stopStatsFlush() bool {
+	s.mu.Lock()
+	stop, done := s.statsStop, s.statsDone
+	s.statsStop = nil
+	s.mu.Unlock()
+	if stop == nil {
+		return false
+	}
+	close(stop)
+	<-done
+	return true
+}
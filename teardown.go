@@ -0,0 +1,118 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Teardown is how the server ends the connections of a session it closes
+// on purpose, see Config.Teardown. The zero Teardown closes them with a
+// FIN, sending what is still buffered in the background.
+type Teardown struct {
+	// Reset ends the connections with an RST (SO_LINGER 0), discarding
+	// unsent data, so that peers notice at once and no socket lingers in
+	// FIN_WAIT or TIME_WAIT.
+	Reset bool `json:"reset"`
+	// Linger, unless Reset is set, makes closing wait up to this long,
+	// rounded up to whole seconds, for unsent data to be delivered before
+	// the connection is reset (SO_LINGER).
+	Linger time.Duration `json:"linger"`
+}
+
+// apply sets the linger option of the policy on conn, looking through TLS
+// and the server's own wrappers to the TCP socket. Connections without
+// one, such as an Upstream reached through a Client.ProxyDialer tunnel,
+// are closed as usual.
+func (t Teardown) apply(conn net.Conn) {
+	lingerer, ok := lingerConn(conn)
+	if !ok {
+		return
+	}
+	switch {
+	case t.Reset:
+		lingerer.SetLinger(0)
+	case t.Linger > 0:
+		lingerer.SetLinger(int(math.Ceil(t.Linger.Seconds())))
+	}
+}
+
+func lingerConn(conn net.Conn) (interface{ SetLinger(sec int) error }, bool) {
+	for {
+		switch c := conn.(type) {
+		case *httpTunnel:
+			conn = c.sniffConn
+		case *sniffConn:
+			conn = c.Conn
+		case *tls.Conn:
+			conn = c.NetConn()
+		case interface{ SetLinger(sec int) error }:
+			return c, true
+		default:
+			return nil, false
+		}
+	}
+}
+
+// endingConn is a connection to close once s.mu is released, since a
+// lingering close may block.
+type endingConn struct {
+	conn     net.Conn
+	teardown Teardown
+}
+
+// endSessionLocked records reason for session id and returns its client
+// connection conn and its target connection, if any, to close with
+// closeEnding, under the Teardown of the session's config. s.mu must be
+// held.
+func (s *SOCKS5Server) endSessionLocked(id string, conn net.Conn, reason TerminationReason, ending []endingConn) []endingConn {
+	s.setEnding(id, reason)
+	config := s.config()
+	if session, ok := s.conns[conn]; ok {
+		config = session.config
+		session.end()
+	}
+	teardown := config.Teardown[reason]
+	ending = append(ending, endingConn{conn: conn, teardown: teardown})
+	if target, ok := s.targets[id]; ok {
+		ending = append(ending, endingConn{conn: target, teardown: teardown})
+	}
+	return ending
+}
+
+// closeEnding closes the connections at once, since each lingering close
+// may block for up to its Teardown.Linger. The options are all set first,
+// as closing one side of a session makes its relay close the other.
+func closeEnding(ending []endingConn) {
+	for _, c := range ending {
+		c.teardown.apply(c.conn)
+	}
+	var wg sync.WaitGroup
+	for _, c := range ending {
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+			conn.Close()
+		}(c.conn)
+	}
+	wg.Wait()
+}
+
+// trackTarget registers the target connection of session id, so that
+// Config.Teardown applies to it too. It returns the function to call when
+// the session ends.
+func (s *SOCKS5Server) trackTarget(id string, target net.Conn) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.targets == nil {
+		s.targets = make(map[string]net.Conn)
+	}
+	s.targets[id] = target
+	return func() {
+		s.mu.Lock()
+		delete(s.targets, id)
+		s.mu.Unlock()
+	}
+}
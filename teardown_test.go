@@ -0,0 +1,84 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTeardown(t *testing.T) {
+	server := SOCKS5Server{Config: &Config{
+		AuthMethod: MethodNoAuth,
+		Teardown:   map[TerminationReason]Teardown{TerminationQuotaExceeded: {Reset: true}},
+	}}
+	end := func(reason TerminationReason) error {
+		clientConn := relaySession(t, &server)
+		defer clientConn.Close()
+		sessions := server.Sessions()
+		if len(sessions) != 1 || !server.CloseSession(sessions[0].ID, reason) {
+			t.Fatalf("should close the running session but got %+v", sessions)
+		}
+		clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := clientConn.Read(make([]byte, 1))
+		for len(server.Sessions()) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+		return err
+	}
+
+	if err := end(TerminationQuotaExceeded); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("should reset the client but got %v", err)
+	}
+	if err := end(TerminationKilled); err != io.EOF {
+		t.Fatalf("should end with a FIN but got %v", err)
+	}
+}
+
+// slowCloseConn takes a while to close, like a lingering socket.
+type slowCloseConn struct{ net.Conn }
+
+func (c slowCloseConn) Close() error {
+	time.Sleep(100 * time.Millisecond)
+	return nil
+}
+
+func TestCloseEndingConcurrently(t *testing.T) {
+	ending := make([]endingConn, 5)
+	for i := range ending {
+		ending[i] = endingConn{conn: slowCloseConn{}}
+	}
+	start := time.Now()
+	closeEnding(ending)
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Fatalf("should close the connections at once but took %s", elapsed)
+	}
+}
+
+func TestLingerConnThroughTLS(t *testing.T) {
+	clientConn, _ := tcpPair(t)
+	if c, ok := lingerConn(tls.Client(clientConn, &tls.Config{})); !ok || c != clientConn.(*net.TCPConn) {
+		t.Fatalf("should find the TCP socket under TLS but got %v", c)
+	}
+	if _, ok := lingerConn(slowCloseConn{}); ok {
+		t.Fatal("should find no socket to linger")
+	}
+}
+
+func TestTerminationReasonText(t *testing.T) {
+	var teardown map[TerminationReason]Teardown
+	if err := json.Unmarshal([]byte(`{"quota_exceeded": {"reset": true}}`), &teardown); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if !teardown[TerminationQuotaExceeded].Reset {
+		t.Fatalf("should reset on quota_exceeded but got %+v", teardown)
+	}
+	var reason TerminationReason
+	if err := reason.UnmarshalText([]byte("bored")); err != ErrInvalidTerminationReason {
+		t.Fatalf("should get error %s but got %v", ErrInvalidTerminationReason, err)
+	}
+}
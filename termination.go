@@ -0,0 +1,139 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+)
+
+var ErrInvalidTerminationReason = errors.New("invalid termination reason")
+
+// TerminationReason tells why a relayed TCP session ended. It is reported in
+// Stats, the final Progress and SessionRecord.
+type TerminationReason int
+
+const (
+	// TerminationNone is the reason of sessions that never relayed.
+	TerminationNone TerminationReason = iota
+	// TerminationClientEOF and TerminationTargetEOF mean the client or the
+	// target closed or reset its connection first.
+	TerminationClientEOF
+	TerminationTargetEOF
+	// TerminationIdleTimeout means nothing was relayed for the idle timeout.
+	TerminationIdleTimeout
+	// TerminationQuotaExceeded, TerminationKilled and TerminationShutdown
+	// are set by CloseSession, and the latter also by a Shutdown whose
+	// context expired.
+	TerminationQuotaExceeded
+	TerminationKilled
+	TerminationShutdown
+	// TerminationRelayError means reading or writing failed otherwise.
+	TerminationRelayError
+	// TerminationMemoryShed means the session was closed while idle to make
+	// room under Config.MaxMemory.
+	TerminationMemoryShed
+	// TerminationWindowClosed means the session was closed when the time
+	// window of its rule closed, see Rule.EndAtWindowClose.
+	TerminationWindowClosed
+
+	numTerminationReasons
+)
+
+var terminationNames = [numTerminationReasons]string{
+	TerminationNone:          "none",
+	TerminationClientEOF:     "client_eof",
+	TerminationTargetEOF:     "target_eof",
+	TerminationIdleTimeout:   "idle_timeout",
+	TerminationQuotaExceeded: "quota_exceeded",
+	TerminationKilled:        "killed",
+	TerminationShutdown:      "shutdown",
+	TerminationRelayError:    "relay_error",
+	TerminationMemoryShed:    "memory_shed",
+	TerminationWindowClosed:  "window_closed",
+}
+
+func (r TerminationReason) String() string {
+	if r < 0 || r >= numTerminationReasons {
+		return "unknown"
+	}
+	return terminationNames[r]
+}
+
+func (r TerminationReason) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText parses a reason by name, e.g. "quota_exceeded", so that
+// reasons can key JSON objects such as Config.Teardown.
+func (r *TerminationReason) UnmarshalText(text []byte) error {
+	for reason, name := range terminationNames {
+		if name == string(text) {
+			*r = TerminationReason(reason)
+			return nil
+		}
+	}
+	return ErrInvalidTerminationReason
+}
+
+// relayTermination classifies err, returned by relaying from the client if
+// fromClient and from the target otherwise. Errors of the connection
+// written to count for its side, see relayError.
+func relayTermination(err error, fromClient bool) TerminationReason {
+	var netErr net.Error
+	var targetErr *targetError
+	var opErr *net.OpError
+	if errors.As(err, &targetErr) {
+		err, fromClient = targetErr.err, false
+	} else if errors.As(err, &opErr) {
+		fromClient = true
+	}
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return TerminationIdleTimeout
+	case err != nil && !closedByPeer(err):
+		return TerminationRelayError
+	case fromClient:
+		return TerminationClientEOF
+	default:
+		return TerminationTargetEOF
+	}
+}
+
+// CloseSession closes the connection of session id and records reason as
+// why it ended, e.g. TerminationKilled for an administrator's action or
+// TerminationQuotaExceeded from a ProgressHook enforcing quotas, with the
+// teardown Config.Teardown sets for reason. It reports false if the session
+// is not being served.
+func (s *SOCKS5Server) CloseSession(id string, reason TerminationReason) bool {
+	var ending []endingConn
+	s.mu.Lock()
+	for conn, session := range s.conns {
+		if session.ID == id {
+			ending = s.endSessionLocked(id, conn, reason, ending)
+			break
+		}
+	}
+	s.mu.Unlock()
+	closeEnding(ending)
+	return len(ending) > 0
+}
+
+// setEnding records the reason a session is being closed for. s.mu must be held.
+func (s *SOCKS5Server) setEnding(id string, reason TerminationReason) {
+	if s.ending == nil {
+		s.ending = make(map[string]TerminationReason)
+	}
+	if _, ok := s.ending[id]; !ok {
+		s.ending[id] = reason
+	}
+}
+
+// relayEnded settles why the relay of a session ended: the reason it was
+// closed for, if any, or the one the relay found.
+func (s *SOCKS5Server) relayEnded(authCtx *AuthContext, tally *relayTally) {
+	s.mu.Lock()
+	if reason, ok := s.ending[authCtx.SessionID]; ok {
+		tally.reason = reason
+	}
+	s.mu.Unlock()
+	logSession(authCtx.SessionID, "relay ended:", tally.reason)
+}
@@ -0,0 +1,133 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRelayTermination(t *testing.T) {
+	tests := []struct {
+		err        error
+		fromClient bool
+		want       TerminationReason
+	}{
+		{nil, true, TerminationClientEOF},
+		{nil, false, TerminationTargetEOF},
+		{syscall.ECONNRESET, true, TerminationClientEOF},
+		{io.EOF, false, TerminationTargetEOF},
+		{os.ErrDeadlineExceeded, true, TerminationIdleTimeout},
+		{errors.New("disk on fire"), false, TerminationRelayError},
+	}
+	for _, test := range tests {
+		if got := relayTermination(test.err, test.fromClient); got != test.want {
+			t.Fatalf("%v from client %v: should get %s but got %s", test.err, test.fromClient, test.want, got)
+		}
+	}
+
+	// Errors count for the side they came from, whichever direction
+	reset := &net.OpError{Op: "write", Net: "tcp", Err: syscall.ECONNRESET}
+	if err := relayError(reset, true); closedByPeer(err) || relayTermination(err, true) != TerminationTargetEOF {
+		t.Fatalf("should blame a reset writing to the target on the target but got %v", relayTermination(err, true))
+	}
+	if err := relayError(reset, false); !closedByPeer(err) || relayTermination(err, false) != TerminationClientEOF {
+		t.Fatalf("should blame a reset writing to the client on the client but got %v", relayTermination(err, false))
+	}
+	read := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	if err := relayError(read, false); closedByPeer(err) || relayTermination(err, false) != TerminationTargetEOF {
+		t.Fatalf("should blame a reset reading from the target on the target but got %v", relayTermination(err, false))
+	}
+	if closedByPeer(net.ErrClosed) {
+		t.Fatal("should not take a connection closed here for a hang-up")
+	}
+
+	if text, _ := TerminationQuotaExceeded.MarshalText(); string(text) != "quota_exceeded" {
+		t.Fatalf("should marshal as quota_exceeded but got %s", text)
+	}
+}
+
+type recorderChan chan SessionRecord
+
+func (c recorderChan) Record(record SessionRecord) { c <- record }
+
+// relaySession connects through server to an echo server and returns the
+// client connection once the session is relaying.
+func relaySession(t *testing.T, server *SOCKS5Server) net.Conn {
+	host, portStr, _ := net.SplitHostPort(echoServer(t))
+	port, _ := strconv.Atoi(portStr)
+	clientConn, serverConn := tcpPair(t)
+	go server.ServeConn(serverConn)
+	clientConn.Write([]byte{SOCKS5Version, 1, byte(MethodNoAuth)})
+	if _, err := io.ReadFull(clientConn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteClientRequestMessage(clientConn, CmdConnect, host, uint16(port)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewServerReplyMessage(clientConn); err != nil {
+		t.Fatalf("should read reply but got %s", err)
+	}
+	clientConn.Write([]byte("ping"))
+	if _, err := io.ReadFull(clientConn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	return clientConn
+}
+
+func TestSessionTermination(t *testing.T) {
+	records := make(recorderChan, 1)
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth, Recorder: records}}
+	next := func() SessionRecord {
+		select {
+		case record := <-records:
+			return record
+		case <-time.After(5 * time.Second):
+			t.Fatalf("session should be recorded")
+			return SessionRecord{}
+		}
+	}
+
+	clientConn := relaySession(t, &server)
+	clientConn.Close()
+	if record := next(); record.Termination != TerminationClientEOF {
+		t.Fatalf("should end with %s but got %s", TerminationClientEOF, record.Termination)
+	}
+
+	clientConn = relaySession(t, &server)
+	defer clientConn.Close()
+	sessions := server.Sessions()
+	if len(sessions) != 1 || !server.CloseSession(sessions[0].ID, TerminationKilled) {
+		t.Fatalf("should close the running session but got %+v", sessions)
+	}
+	if record := next(); record.Termination != TerminationKilled || record.SessionID != sessions[0].ID {
+		t.Fatalf("should end with %s but got %+v", TerminationKilled, record)
+	}
+	if server.CloseSession(sessions[0].ID, TerminationKilled) {
+		t.Fatalf("should not close an ended session")
+	}
+
+	stats := server.Stats()
+	if stats.Terminations[TerminationClientEOF] != 1 || stats.Terminations[TerminationKilled] != 1 {
+		t.Fatalf("unexpected termination counts %v", stats.Terminations)
+	}
+}
+
+func TestSessionTerminationIdle(t *testing.T) {
+	records := make(recorderChan, 1)
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth, Recorder: records, IdleTimeout: 50 * time.Millisecond}}
+	clientConn := relaySession(t, &server)
+	defer clientConn.Close()
+	select {
+	case record := <-records:
+		if record.Termination != TerminationIdleTimeout {
+			t.Fatalf("should end with %s but got %s", TerminationIdleTimeout, record.Termination)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("idle session should end")
+	}
+}
@@ -0,0 +1,612 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrInvalidUDPDatagram  = errors.New("invalid UDP datagram")
+	ErrUDPAssociationLimit = errors.New("too many UDP associations for user")
+)
+
+// UDPDatagram is a datagram relayed through a UDP association.
+type UDPDatagram struct {
+	Frag     byte
+	AddrType AddressType
+	TargetIP string
+	Port     uint16
+	Data     []byte
+}
+
+func NewUDPDatagram(b []byte) (*UDPDatagram, error) {
+	// +----+------+------+----------+----------+----------+
+	// |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+	// +----+------+------+----------+----------+----------+
+	// | 2  |  1   |  1   | Variable |    2     | Variable |
+	// +----+------+------+----------+----------+----------+
+	// FRAG 当前分片序号，不支持分片时为0x00
+	if len(b) < 4 {
+		return nil, ErrInvalidUDPDatagram
+	}
+	return parseUDPDatagram(b[2:])
+}
+
+// parseUDPDatagram parses a UDP request header from FRAG on, and the data.
+func parseUDPDatagram(b []byte) (*UDPDatagram, error) {
+	if len(b) < 2 {
+		return nil, ErrInvalidUDPDatagram
+	}
+	datagram := UDPDatagram{Frag: b[0], AddrType: b[1]}
+	b = b[2:]
+	switch datagram.AddrType {
+	case TypeIPv4, TypeIPv6:
+		length := IPv4Length
+		if datagram.AddrType == TypeIPv6 {
+			length = IPv6Length
+		}
+		if len(b) < length {
+			return nil, ErrInvalidUDPDatagram
+		}
+		datagram.TargetIP = net.IP(b[:length]).String()
+		b = b[length:]
+	case TypeDomain:
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return nil, ErrInvalidUDPDatagram
+		}
+		datagram.TargetIP = string(b[1 : 1+b[0]])
+		b = b[1+b[0]:]
+	default:
+		return nil, ErrAddressTypeNotSupported
+	}
+	if len(b) < PortLength {
+		return nil, ErrInvalidUDPDatagram
+	}
+	datagram.Port = readPort(b)
+	datagram.Data = b[PortLength:]
+	return &datagram, nil
+}
+
+// Bytes encodes the datagram with its SOCKS5 UDP request header.
+func (d *UDPDatagram) Bytes() []byte {
+	buf := make([]byte, 0, 4+1+len(d.TargetIP)+PortLength+len(d.Data))
+	buf = append(buf, ReservedField, ReservedField, d.Frag, d.AddrType)
+	switch d.AddrType {
+	case TypeIPv4:
+		buf = append(buf, net.ParseIP(d.TargetIP).To4()...)
+	case TypeIPv6:
+		buf = append(buf, net.ParseIP(d.TargetIP).To16()...)
+	default:
+		buf = append(buf, byte(len(d.TargetIP)))
+		buf = append(buf, d.TargetIP...)
+	}
+	buf = appendPort(buf, d.Port)
+	return append(buf, d.Data...)
+}
+
+// handleUDP serves UDP ASSOCIATE. The association lives as long as the TCP
+// control connection stays open.
+func (s *SOCKS5Server) handleUDP(conn io.ReadWriter, message *ClientRequestMessage, authCtx *AuthContext) error {
+	config := s.sessionConfig(authCtx)
+	var localIP, clientIP net.IP
+	if c, ok := conn.(net.Conn); ok {
+		if addr, ok := c.LocalAddr().(*net.TCPAddr); ok {
+			localIP = addr.IP
+		}
+		if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+			clientIP = addr.IP
+		}
+	}
+
+	if max := config.MaxUDPAssociationsPerUser; max > 0 {
+		owner, logged := s.udpOwner(config, authCtx.Username, clientIP)
+		if !s.udpAssociations.acquire(owner, max) {
+			s.stats.udpLimitRejections.Add(1)
+			s.writeFailure(conn, message, authCtx, ReplyConnectionNotAllowed)
+			logSession(authCtx.SessionID, "UDP association limit reached for", logged)
+			return ErrUDPAssociationLimit
+		}
+		defer s.udpAssociations.release(owner)
+	}
+
+	bindIP := config.UDPBindIP
+	if bindIP == nil {
+		bindIP = localIP
+	}
+	relayConn, closeRelay, err := s.listenUDPRelay(config, bindIP)
+	if err != nil {
+		s.writeFailure(conn, message, authCtx, ReplyServerFailure)
+		logSession(authCtx.SessionID, "listen UDP relay failure", err)
+		return err
+	}
+	defer closeRelay()
+
+	// Advertise an address the client can reach
+	advertisedIP := config.UDPAdvertisedIP
+	if advertisedIP == nil {
+		advertisedIP = bindIP
+		if advertisedIP == nil || advertisedIP.IsUnspecified() {
+			advertisedIP = localIP
+		}
+	}
+	if advertisedIP == nil {
+		advertisedIP = net.IPv4zero
+	}
+	if ip4 := advertisedIP.To4(); ip4 != nil {
+		advertisedIP = ip4
+	}
+	info := ReplyInfo{
+		Request:  message,
+		Auth:     authCtx,
+		Reply:    ReplySuccess,
+		BindIP:   advertisedIP,
+		BindPort: uint16(relayConn.LocalAddr().(*net.UDPAddr).Port),
+	}
+	if err := s.writeReply(conn, &info); err != nil {
+		return err
+	}
+	if c, ok := conn.(net.Conn); ok {
+		c.SetDeadline(time.Time{})
+	}
+	// Read buffers of the client and reply directions
+	buffers := int64(2)
+	if batch := config.UDPBatchSize; batch > 1 {
+		buffers *= int64(batch)
+	}
+	s.memory.grow(authCtx.SessionID, buffers*udpBufferMemory)
+
+	// Only accept datagrams from the client address given in the request,
+	// or from the control connection's IP when the request left it zero
+	expected := &net.UDPAddr{IP: net.ParseIP(message.TargetIP), Port: int(message.Port)}
+	if expected.IP == nil || expected.IP.IsUnspecified() {
+		expected.IP = clientIP
+	}
+	guard := amplificationGuard{ratio: int64(config.UDPAmplificationRatio)}
+	if clientIP != nil && expected.IP.Equal(clientIP) {
+		// The TCP handshake proved the client owns this IP
+		guard.ratio = 0
+	}
+	association := udpAssociation{
+		server:    s,
+		config:    config,
+		authCtx:   authCtx,
+		relayConn: relayConn,
+		expected:  expected,
+		guard:     &guard,
+		sessionID: authCtx.SessionID,
+		teardown:  func() {},
+		batchSize: config.UDPBatchSize,
+
+		maxDatagrams: config.UDPMaxDatagrams,
+		username:     authCtx.Username,
+		start:        timeNow(s.clock),
+	}
+	if c, ok := conn.(io.Closer); ok {
+		association.teardown = func() { c.Close() }
+	}
+	if c, ok := conn.(net.Conn); ok {
+		association.control = c
+	}
+	s.runUDPAssociation(conn, &association)
+	return nil
+}
+
+// udpOwner returns whom Config.MaxUDPAssociationsPerUser counts an
+// association of username from clientIP against, and how to log it under
+// config.
+func (s *SOCKS5Server) udpOwner(config *Config, username string, clientIP net.IP) (owner, logged string) {
+	owner, logged = username, config.LogRedaction.Username(username)
+	if owner == "" && clientIP != nil {
+		owner = clientIP.String()
+		logged = config.LogRedaction.Host(owner)
+	}
+	return owner, logged
+}
+
+// runUDPAssociation relays the datagrams of association until its control
+// connection conn closes or ExportUDPAssociations hands it off.
+func (s *SOCKS5Server) runUDPAssociation(conn io.Reader, association *udpAssociation) {
+	if lifetime := association.config.UDPMaxLifetime; lifetime > 0 {
+		stop := timeAfterFunc(s.clock, lifetime, func() {
+			logSession(association.sessionID, "closing UDP association: lifetime", lifetime, "reached")
+			association.teardown()
+		})
+		defer stop()
+	}
+	association.done = make(chan struct{})
+	defer close(association.done)
+	s.addUDPAssociation(association)
+	defer s.removeUDPAssociation(association)
+	relayed := make(chan struct{})
+	go func() {
+		association.relay()
+		close(relayed)
+	}()
+
+	io.Copy(io.Discard, conn)
+	if association.handedOff.Load() {
+		// The relay socket stays open for the new owner, so wait for the
+		// relay to see the deadline set by ExportUDPAssociations
+		<-relayed
+	}
+}
+
+// udpAssociation relays the datagrams of a UDP ASSOCIATE session.
+type udpAssociation struct {
+	server *SOCKS5Server
+	// config is the config of the session, and authCtx its auth context,
+	// which the policy checks datagrams for.
+	config    *Config
+	authCtx   *AuthContext
+	relayConn *net.UDPConn
+	expected  *net.UDPAddr
+	guard     *amplificationGuard
+	sessionID string
+	// teardown ends the association by closing its control connection.
+	teardown func()
+	// batchSize is Config.UDPBatchSize.
+	batchSize int
+
+	// client is set by relay from the first datagram of the expected
+	// address, before any target socket is connected.
+	client *net.UDPAddr
+	// multi is set once the client sent to more than one target.
+	multi atomic.Bool
+	// withoutRSV is set once the client sent a header lacking RSV, with
+	// Quirks.UDPWithoutRSV.
+	withoutRSV atomic.Bool
+
+	// maxDatagrams is Config.UDPMaxDatagrams; datagrams counts the
+	// datagrams relayed so far.
+	maxDatagrams int64
+	datagrams    atomic.Int64
+
+	// control is the control connection, if a net.Conn, and username and
+	// start describe the session, for ExportUDPAssociations. handedOff is
+	// set once the association was exported; done is closed when it stops.
+	control   net.Conn
+	username  string
+	start     time.Time
+	handedOff atomic.Bool
+	done      chan struct{}
+	// connected is the connected target socket, set by relay or by
+	// ImportUDPAssociations, and connectedFile its copy relay leaves for
+	// ExportUDPAssociations.
+	connected     *net.UDPConn
+	connectedFile *os.File
+	// targets caches the addresses of domain targets by domain, see
+	// resolveTarget. Only relay uses it.
+	targets map[string]udpTarget
+}
+
+const (
+	// udpTargetTTL is how long an association reuses the address of a
+	// domain target, and udpTargetFailureTTL how long it drops datagrams
+	// for a domain that failed to resolve.
+	udpTargetTTL        = time.Minute
+	udpTargetFailureTTL = 5 * time.Second
+	// maxUDPTargets bounds the domains an association caches.
+	maxUDPTargets = 256
+	// defaultUDPResolveTimeout bounds resolving a domain target when
+	// Config.DialTimeout is not set.
+	defaultUDPResolveTimeout = 5 * time.Second
+)
+
+// udpTarget is the cached address of a domain target, or why it did not
+// resolve.
+type udpTarget struct {
+	ip      net.IP
+	err     error
+	expires time.Time
+}
+
+// resolveTarget returns the address of the target of datagram. Domains are
+// resolved with Config.Resolver within Config.DialTimeout, and the outcome
+// is cached per domain, so that a slow or failing name holds up the
+// datagrams of the association at most once per udpTargetTTL.
+func (a *udpAssociation) resolveTarget(datagram *UDPDatagram) (*net.UDPAddr, error) {
+	if datagram.AddrType != TypeDomain {
+		return &net.UDPAddr{IP: net.ParseIP(datagram.TargetIP), Port: int(datagram.Port)}, nil
+	}
+	now := timeNow(a.server.clock)
+	domain := strings.ToLower(datagram.TargetIP)
+	target, ok := a.targets[domain]
+	if !ok || !now.Before(target.expires) {
+		target = a.lookupTarget(domain, now)
+		if a.targets == nil || len(a.targets) >= maxUDPTargets {
+			a.targets = make(map[string]udpTarget)
+		}
+		a.targets[domain] = target
+	}
+	if target.err != nil {
+		return nil, target.err
+	}
+	return &net.UDPAddr{IP: target.ip, Port: int(datagram.Port)}, nil
+}
+
+// lookupTarget resolves domain, preferring an IPv4 address as
+// net.ResolveUDPAddr does.
+func (a *udpAssociation) lookupTarget(domain string, now time.Time) udpTarget {
+	resolver := a.config.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	timeout := a.config.DialTimeout
+	if timeout <= 0 {
+		timeout = defaultUDPResolveTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	addrs, err := resolver.LookupIPAddr(ctx, domain)
+	if err == nil && len(addrs) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+	}
+	if err != nil {
+		return udpTarget{err: err, expires: now.Add(udpTargetFailureTTL)}
+	}
+	ip := addrs[0].IP
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			ip = addr.IP
+			break
+		}
+	}
+	return udpTarget{ip: ip, expires: now.Add(udpTargetTTL)}
+}
+
+// parse parses a datagram from the client. With Quirks.UDPWithoutRSV, a
+// header lacking RSV is told apart by its ATYP where RSV has a zero byte.
+func (a *udpAssociation) parse(b []byte) (*UDPDatagram, error) {
+	if a.config.Quirks.UDPWithoutRSV && len(b) >= 2 && b[1] != ReservedField {
+		a.withoutRSV.Store(true)
+		return parseUDPDatagram(b)
+	}
+	return NewUDPDatagram(b)
+}
+
+// count counts a relayed datagram, reporting false and ending the
+// association once Config.UDPMaxDatagrams were relayed.
+func (a *udpAssociation) count() bool {
+	if a.maxDatagrams <= 0 {
+		return true
+	}
+	n := a.datagrams.Add(1)
+	if n > a.maxDatagrams {
+		if n == a.maxDatagrams+1 {
+			logSession(a.sessionID, "closing UDP association: relayed", a.maxDatagrams, "datagrams")
+			a.teardown()
+		}
+		return false
+	}
+	return true
+}
+
+// targetAllowed applies the policy of the request phase to the target of a
+// datagram, which is dropped if the policy refuses or sinkholes it.
+func (a *udpAssociation) targetAllowed(datagram *UDPDatagram) bool {
+	message := ClientRequestMessage{Cmd: CmdUDP, AddrType: datagram.AddrType, TargetIP: datagram.TargetIP, Port: datagram.Port}
+	message.normalizeMapped(a.config.KeepIPv4Mapped)
+	rule, _, refusal := a.server.checkPolicy(&message, a.authCtx, true)
+	return refusal == nil && (rule == nil || rule.Action != RuleSinkhole)
+}
+
+// relay relays datagrams between the client and targets until relayConn is
+// closed. The first target gets a connected socket, so the kernel drops
+// datagrams from anyone else and reports ICMP errors; while it is the only
+// target, datagrams reaching relayConn from other addresses are dropped too.
+// Once the client sends to a second target, replies are accepted from any
+// address on relayConn, which sends to the others.
+func (a *udpAssociation) relay() {
+	in := newUDPBatchConn(a.relayConn, a.batchSize)
+	ms := makeUDPMessages(a.batchSize)
+	// An imported association resumes with the connected socket it had
+	connected := a.connected
+	var connectedOut udpBatchConn
+	if connected != nil {
+		connectedOut = newUDPBatchConn(connected, a.batchSize)
+		go a.relayReplies(connected)
+	}
+	defer func() {
+		if connected == nil {
+			return
+		}
+		if a.handedOff.Load() {
+			// Keep the socket, and so the source port targets know the
+			// client by, for the new owner
+			file, err := connected.File()
+			if err != nil {
+				logSession(a.sessionID, "hand off UDP target socket failure", err)
+			}
+			a.connectedFile = file
+		}
+		connected.Close()
+	}()
+	// Datagrams to send through relayConn and the connected socket
+	var out, toConnected []udpMessage
+	for {
+		n, err := in.readBatch(ms)
+		if err != nil {
+			return
+		}
+		out, toConnected = out[:0], toConnected[:0]
+		for _, m := range ms[:n] {
+			from := m.Addr
+			if a.client == nil && udpAddrMatches(a.expected, from) {
+				a.client = from
+			}
+
+			if a.client != nil && udpAddrEqual(from, a.client) {
+				datagram, err := a.parse(m.Buf[:m.N])
+				if err != nil || datagram.Frag != 0 || !a.count() || !a.targetAllowed(datagram) {
+					continue
+				}
+				a.guard.receive(m.N)
+				target, err := a.resolveTarget(datagram)
+				if err != nil {
+					address := net.JoinHostPort(datagram.TargetIP, strconv.Itoa(int(datagram.Port)))
+					logSession(a.sessionID, "resolve UDP target failure", a.config.LogRedaction.Address(address), a.config.LogRedaction.Error(err, address, datagram.TargetIP))
+					continue
+				}
+				if prefix := a.config.NAT64Prefix; prefix != nil && target.IP.To4() != nil {
+					target.IP = embedIPv4(prefix, target.IP)
+				}
+				if connected == nil && !a.multi.Load() {
+					if connected, err = dialUDPTarget(a.relayConn, target); err != nil {
+						connected = nil
+						a.multi.Store(true)
+					} else {
+						a.connected = connected
+						connectedOut = newUDPBatchConn(connected, a.batchSize)
+						go a.relayReplies(connected)
+					}
+				}
+				if connected != nil && udpAddrEqual(connected.RemoteAddr().(*net.UDPAddr), target) {
+					toConnected = append(toConnected, udpMessage{Buf: datagram.Data})
+				} else {
+					a.multi.Store(true)
+					out = append(out, udpMessage{Buf: datagram.Data, Addr: target})
+				}
+				continue
+			}
+			if a.client == nil || !a.multi.Load() {
+				continue
+			}
+			if reply := a.reply(from, m.Buf[:m.N]); reply != nil {
+				out = append(out, udpMessage{Buf: reply, Addr: a.client})
+			}
+		}
+
+		writeUDPBatch(out, in, func(m *udpMessage, err error) {
+			if m.Addr != a.client {
+				a.targetError(m.Addr, err)
+			}
+		})
+		if len(toConnected) > 0 {
+			target := connected.RemoteAddr().(*net.UDPAddr)
+			writeUDPBatch(toConnected, connectedOut, func(m *udpMessage, err error) {
+				a.targetError(target, err)
+			})
+		}
+	}
+}
+
+// dialUDPTarget connects a UDP socket to target from the relay socket's IP,
+// if of the same family.
+func dialUDPTarget(relayConn *net.UDPConn, target *net.UDPAddr) (*net.UDPConn, error) {
+	var local *net.UDPAddr
+	if ip := relayConn.LocalAddr().(*net.UDPAddr).IP; !ip.IsUnspecified() && (ip.To4() == nil) == (target.IP.To4() == nil) {
+		local = &net.UDPAddr{IP: ip}
+	}
+	return net.DialUDP("udp", local, target)
+}
+
+// relayReplies relays the replies arriving on a connected target socket
+// until it is closed.
+func (a *udpAssociation) relayReplies(connected *net.UDPConn) {
+	in := newUDPBatchConn(connected, a.batchSize)
+	out := newUDPBatchConn(a.relayConn, a.batchSize)
+	ms := makeUDPMessages(a.batchSize)
+	from := connected.RemoteAddr().(*net.UDPAddr)
+	var replies []udpMessage
+	for {
+		n, err := in.readBatch(ms)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// An ICMP error for an earlier datagram
+			a.targetError(from, err)
+			continue
+		}
+		replies = replies[:0]
+		for _, m := range ms[:n] {
+			if reply := a.reply(from, m.Buf[:m.N]); reply != nil {
+				replies = append(replies, udpMessage{Buf: reply, Addr: a.client})
+			}
+		}
+		writeUDPBatch(replies, out, func(*udpMessage, error) {})
+	}
+}
+
+// reply encodes data received from a target for the client, or returns nil
+// if the amplification guard drops it.
+func (a *udpAssociation) reply(from *net.UDPAddr, data []byte) []byte {
+	if prefix := a.config.NAT64Prefix; prefix != nil {
+		if ip4 := extractIPv4(prefix, from.IP); ip4 != nil {
+			from = &net.UDPAddr{IP: ip4, Port: from.Port}
+		}
+	}
+	keepMapped := a.config.KeepIPv4Mapped
+	datagram := UDPDatagram{
+		AddrType: TypeIPv6,
+		TargetIP: ipString(from.IP, keepMapped),
+		Port:     uint16(from.Port),
+		Data:     data,
+	}
+	if from.IP.To4() != nil && !(keepMapped && isIPv4Mapped(from.IP)) {
+		datagram.AddrType = TypeIPv4
+	}
+	reply := datagram.Bytes()
+	if a.withoutRSV.Load() {
+		reply = reply[2:]
+	}
+	if !a.guard.allow(len(reply)) {
+		a.server.stats.udpAmplificationDrops.Add(1)
+		return nil
+	}
+	if !a.count() {
+		return nil
+	}
+	return reply
+}
+
+// amplificationGuard caps the bytes relayed to an unconfirmed UDP client at
+// ratio times the bytes it sent, so a spoofed client address cannot turn
+// the relay into a reflection amplifier.
+type amplificationGuard struct {
+	// ratio is zero for confirmed associations.
+	ratio int64
+
+	mu       sync.Mutex
+	received int64
+	sent     int64
+}
+
+// receive counts n bytes sent by the client.
+func (g *amplificationGuard) receive(n int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.received += int64(n)
+}
+
+// allow reports whether a reply of n bytes may be sent, and counts it.
+func (g *amplificationGuard) allow(n int) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.ratio > 0 && g.sent+int64(n) > g.ratio*g.received {
+		return false
+	}
+	g.sent += int64(n)
+	return true
+}
+
+// udpAddrMatches reports whether from matches the expected client address,
+// where a nil IP or zero port matches anything.
+func udpAddrMatches(expected, from *net.UDPAddr) bool {
+	if expected.IP != nil && !expected.IP.IsUnspecified() && !expected.IP.Equal(from.IP) {
+		return false
+	}
+	return expected.Port == 0 || expected.Port == from.Port
+}
+
+func udpAddrEqual(a, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
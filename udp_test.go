@@ -0,0 +1,558 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUDPDatagram(t *testing.T) {
+	tests := []UDPDatagram{
+		{AddrType: TypeIPv4, TargetIP: "8.8.8.8", Port: 53, Data: []byte("query")},
+		{AddrType: TypeIPv6, TargetIP: "2001:db8::1", Port: 443, Data: []byte{}},
+		{AddrType: TypeDomain, TargetIP: "example.com", Port: 123, Data: []byte{1, 2, 3}},
+	}
+	for _, want := range tests {
+		got, err := NewUDPDatagram(want.Bytes())
+		if err != nil {
+			t.Fatalf("should get error nil but got %s", err)
+		}
+		if !reflect.DeepEqual(*got, want) {
+			t.Fatalf("should get datagram %+v but got %+v", want, *got)
+		}
+	}
+
+	if _, err := NewUDPDatagram([]byte{0, 0, 0, TypeIPv4, 1, 2}); err != ErrInvalidUDPDatagram {
+		t.Fatalf("should get error %s but got %v", ErrInvalidUDPDatagram, err)
+	}
+}
+
+// udpEchoServer returns the address of a loopback UDP server echoing datagrams back.
+func udpEchoServer(t *testing.T) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestUDPAssociate(t *testing.T) {
+	echo := udpEchoServer(t)
+	server := SOCKS5Server{Config: &Config{
+		EnableUDP:       true,
+		UDPBindIP:       net.IP{127, 0, 0, 1},
+		UDPAdvertisedIP: net.IP{203, 0, 113, 9},
+	}}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	done := make(chan error, 1)
+	go func() {
+		defer serverConn.Close()
+		done <- server.request(serverConn, &AuthContext{})
+	}()
+
+	clientConn.Write([]byte{SOCKS5Version, CmdUDP, ReservedField, TypeIPv4, 0, 0, 0, 0, 0, 0})
+	reply, err := NewServerReplyMessage(clientConn)
+	if err != nil {
+		t.Fatalf("should read reply but got %s", err)
+	}
+	if reply.Reply != ReplySuccess || reply.BindIP != "203.0.113.9" || reply.Port == 0 {
+		t.Fatalf("should advertise 203.0.113.9 but got %+v", *reply)
+	}
+
+	udpConn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: int(reply.Port)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	request := UDPDatagram{AddrType: TypeIPv4, TargetIP: "127.0.0.1", Port: uint16(echo.Port), Data: []byte("ping")}
+	udpConn.Write(request.Bytes())
+
+	udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := udpConn.Read(buf)
+	if err != nil {
+		t.Fatalf("should receive echo but got %s", err)
+	}
+	response, err := NewUDPDatagram(buf[:n])
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if response.TargetIP != "127.0.0.1" || response.Port != uint16(echo.Port) || !bytes.Equal(response.Data, []byte("ping")) {
+		t.Fatalf("unexpected response %+v", *response)
+	}
+
+	// Closing the control connection ends the association
+	clientConn.Close()
+	if err := <-done; err != nil && err != io.EOF {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+}
+
+func TestUDPPortAllocator(t *testing.T) {
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	min := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+
+	server := SOCKS5Server{Config: &Config{UDPPortMin: min, UDPPortMax: min + 1}, rand: zeroRand{}}
+	ip := net.IP{127, 0, 0, 1}
+	first, closeFirst, err := server.listenUDPRelay(server.Config, ip)
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	second, closeSecond, err := server.listenUDPRelay(server.Config, ip)
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	defer closeSecond()
+	if port := first.LocalAddr().(*net.UDPAddr).Port; port != min {
+		t.Fatalf("zero randomness should start at port %d but got %d", min, port)
+	}
+	for _, conn := range []*net.UDPConn{first, second} {
+		if port := conn.LocalAddr().(*net.UDPAddr).Port; port < min || port > min+1 {
+			t.Fatalf("port %d outside range %d-%d", port, min, min+1)
+		}
+	}
+	if _, _, err := server.listenUDPRelay(server.Config, ip); err != ErrNoUDPPortAvailable {
+		t.Fatalf("should get error %s but got %v", ErrNoUDPPortAvailable, err)
+	}
+
+	firstPort := first.LocalAddr().(*net.UDPAddr).Port
+	closeFirst()
+	reused, closeReused, err := server.listenUDPRelay(server.Config, ip)
+	if err != nil {
+		t.Fatalf("released port should be reused but got %s", err)
+	}
+	defer closeReused()
+	if port := reused.LocalAddr().(*net.UDPAddr).Port; port != firstPort {
+		t.Fatalf("should reuse port %d but got %d", firstPort, port)
+	}
+}
+
+func TestUDPAmplificationGuard(t *testing.T) {
+	// amplifier answers every datagram with 50 bytes
+	amplifier, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer amplifier.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			_, from, err := amplifier.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			amplifier.WriteToUDP(bytes.Repeat([]byte{'x'}, 50), from)
+		}
+	}()
+
+	server := SOCKS5Server{Config: &Config{
+		EnableUDP:             true,
+		UDPBindIP:             net.IP{127, 0, 0, 1},
+		UDPAmplificationRatio: 3,
+	}}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		defer serverConn.Close()
+		server.request(serverConn, &AuthContext{})
+	}()
+	clientConn.Write([]byte{SOCKS5Version, CmdUDP, ReservedField, TypeIPv4, 0, 0, 0, 0, 0, 0})
+	reply, err := NewServerReplyMessage(clientConn)
+	if err != nil || reply.Reply != ReplySuccess {
+		t.Fatalf("should associate but got %v, %v", reply, err)
+	}
+	udpConn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: int(reply.Port)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	target := amplifier.LocalAddr().(*net.UDPAddr)
+	buf := make([]byte, 1024)
+
+	// A 14-byte datagram allows 42 bytes back, less than the 60-byte reply
+	small := UDPDatagram{AddrType: TypeIPv4, TargetIP: "127.0.0.1", Port: uint16(target.Port), Data: []byte("ping")}
+	udpConn.Write(small.Bytes())
+	udpConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := udpConn.Read(buf); err == nil {
+		t.Fatalf("should drop the amplified reply")
+	}
+	if got := server.Stats().UDPAmplificationDrops; got != 1 {
+		t.Fatalf("should count 1 drop but got %d", got)
+	}
+
+	// 54 bytes sent in total allow the next reply
+	large := UDPDatagram{AddrType: TypeIPv4, TargetIP: "127.0.0.1", Port: uint16(target.Port), Data: bytes.Repeat([]byte{'y'}, 30)}
+	udpConn.Write(large.Bytes())
+	udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := udpConn.Read(buf); err != nil {
+		t.Fatalf("should relay the reply within the ratio but got %s", err)
+	}
+}
+
+// udpAssociate opens an association with server for the calling test and
+// returns a socket connected to its relay.
+func udpAssociate(t *testing.T, server *SOCKS5Server) *net.UDPConn {
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+	go func() {
+		defer serverConn.Close()
+		server.request(serverConn, &AuthContext{})
+	}()
+	clientConn.Write([]byte{SOCKS5Version, CmdUDP, ReservedField, TypeIPv4, 0, 0, 0, 0, 0, 0})
+	reply, err := NewServerReplyMessage(clientConn)
+	if err != nil || reply.Reply != ReplySuccess {
+		t.Fatalf("should associate but got %v, %v", reply, err)
+	}
+	udpConn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: int(reply.Port)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { udpConn.Close() })
+	return udpConn
+}
+
+func TestUDPConnectedTarget(t *testing.T) {
+	first, second := udpEchoServer(t), udpEchoServer(t)
+	server := SOCKS5Server{Config: &Config{EnableUDP: true, UDPBindIP: net.IP{127, 0, 0, 1}}}
+	udpConn := udpAssociate(t, &server)
+	relay := udpConn.RemoteAddr().(*net.UDPAddr)
+	stranger, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	buf := make([]byte, 1024)
+	exchange := func(target *net.UDPAddr) *UDPDatagram {
+		request := UDPDatagram{AddrType: TypeIPv4, TargetIP: "127.0.0.1", Port: uint16(target.Port), Data: []byte("ping")}
+		udpConn.Write(request.Bytes())
+		udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := udpConn.Read(buf)
+		if err != nil {
+			t.Fatalf("should receive echo but got %s", err)
+		}
+		response, err := NewUDPDatagram(buf[:n])
+		if err != nil {
+			t.Fatalf("should get error nil but got %s", err)
+		}
+		return response
+	}
+
+	if response := exchange(first); response.Port != uint16(first.Port) {
+		t.Fatalf("should relay the reply of port %d but got %+v", first.Port, *response)
+	}
+	// With a single target, datagrams from others are dropped
+	stranger.WriteToUDP([]byte("spoofed"), relay)
+	udpConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := udpConn.Read(buf); err == nil {
+		t.Fatalf("should drop the stranger's datagram but got %q", buf[:n])
+	}
+
+	// A second target falls back to the unconnected relay socket
+	if response := exchange(second); response.Port != uint16(second.Port) {
+		t.Fatalf("should relay the reply of port %d but got %+v", second.Port, *response)
+	}
+	if response := exchange(first); response.Port != uint16(first.Port) {
+		t.Fatalf("should keep relaying port %d but got %+v", first.Port, *response)
+	}
+	stranger.WriteToUDP([]byte("hello"), relay)
+	udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := udpConn.Read(buf); err != nil {
+		t.Fatalf("should relay datagrams from others once there are several targets but got %s", err)
+	}
+}
+
+func TestUDPTargetUnreachable(t *testing.T) {
+	closed, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := closed.LocalAddr().(*net.UDPAddr)
+	closed.Close()
+
+	server := SOCKS5Server{Config: &Config{
+		EnableUDP:             true,
+		UDPBindIP:             net.IP{127, 0, 0, 1},
+		UDPCloseOnUnreachable: true,
+	}}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		defer serverConn.Close()
+		server.request(serverConn, &AuthContext{})
+	}()
+	clientConn.Write([]byte{SOCKS5Version, CmdUDP, ReservedField, TypeIPv4, 0, 0, 0, 0, 0, 0})
+	reply, err := NewServerReplyMessage(clientConn)
+	if err != nil || reply.Reply != ReplySuccess {
+		t.Fatalf("should associate but got %v, %v", reply, err)
+	}
+	udpConn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: int(reply.Port)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	request := UDPDatagram{AddrType: TypeIPv4, TargetIP: "127.0.0.1", Port: uint16(target.Port), Data: []byte("ping")}
+	udpConn.Write(request.Bytes())
+
+	// The port unreachable error closes the control connection
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := clientConn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("should get error %s but got %v", io.EOF, err)
+	}
+	if got := server.Stats().UDPTargetErrors["port_unreachable"]; got != 1 {
+		t.Fatalf("should count 1 port unreachable error but got %d", got)
+	}
+}
+
+func TestUDPAssociationLimits(t *testing.T) {
+	echo := udpEchoServer(t)
+	server := SOCKS5Server{Config: &Config{
+		EnableUDP:                 true,
+		UDPBindIP:                 net.IP{127, 0, 0, 1},
+		MaxUDPAssociationsPerUser: 1,
+		UDPMaxDatagrams:           2,
+	}}
+	associate := func() (net.Conn, *ServerReplyMessage, chan error) {
+		clientConn, serverConn := net.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			defer serverConn.Close()
+			done <- server.request(serverConn, &AuthContext{Username: "alice"})
+		}()
+		clientConn.Write([]byte{SOCKS5Version, CmdUDP, ReservedField, TypeIPv4, 0, 0, 0, 0, 0, 0})
+		reply, err := NewServerReplyMessage(clientConn)
+		if err != nil {
+			t.Fatalf("should read reply but got %s", err)
+		}
+		return clientConn, reply, done
+	}
+
+	clientConn, reply, done := associate()
+	defer clientConn.Close()
+	if reply.Reply != ReplySuccess {
+		t.Fatalf("should get reply %d but got %d", ReplySuccess, reply.Reply)
+	}
+	second, secondReply, secondDone := associate()
+	second.Close()
+	if secondReply.Reply != ReplyConnectionNotAllowed || <-secondDone != ErrUDPAssociationLimit {
+		t.Fatalf("should refuse a second association but got reply %d", secondReply.Reply)
+	}
+	if got := server.Stats().UDPLimitRejections; got != 1 {
+		t.Fatalf("should count 1 UDP limit rejection but got %d", got)
+	}
+
+	udpConn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: int(reply.Port)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	request := UDPDatagram{AddrType: TypeIPv4, TargetIP: "127.0.0.1", Port: uint16(echo.Port), Data: []byte("ping")}
+	udpConn.Write(request.Bytes())
+	udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := udpConn.Read(make([]byte, 1024)); err != nil {
+		t.Fatalf("should receive echo but got %s", err)
+	}
+
+	// The ping and its echo used up UDPMaxDatagrams
+	udpConn.Write(request.Bytes())
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := clientConn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("should get error %s but got %v", io.EOF, err)
+	}
+	<-done
+
+	// The ended association no longer counts against the limit
+	third, thirdReply, _ := associate()
+	defer third.Close()
+	if thirdReply.Reply != ReplySuccess {
+		t.Fatalf("should get reply %d but got %d", ReplySuccess, thirdReply.Reply)
+	}
+}
+
+func TestUDPMaxLifetime(t *testing.T) {
+	clock := newFakeClock()
+	server := SOCKS5Server{clock: clock, Config: &Config{
+		EnableUDP:      true,
+		UDPBindIP:      net.IP{127, 0, 0, 1},
+		UDPMaxLifetime: 50 * time.Millisecond,
+	}}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		defer serverConn.Close()
+		server.request(serverConn, &AuthContext{})
+	}()
+	clientConn.Write([]byte{SOCKS5Version, CmdUDP, ReservedField, TypeIPv4, 0, 0, 0, 0, 0, 0})
+	if _, err := NewServerReplyMessage(clientConn); err != nil {
+		t.Fatalf("should read reply but got %s", err)
+	}
+	clock.awaitTimers(t, 1)
+	clock.Advance(50 * time.Millisecond)
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := clientConn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("should get error %s but got %v", io.EOF, err)
+	}
+}
+
+func TestUDPTargetPolicy(t *testing.T) {
+	echo := udpEchoServer(t)
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := os.WriteFile(path, []byte("blocked.example\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	blocklist, err := LoadDomainBlocklist(0, path)
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	var refused atomic.Int64
+	policy := func(domain string) bool {
+		refused.Add(1)
+		return false
+	}
+	tests := []struct {
+		config  Config
+		host    string
+		dropped func(stats Stats) int64
+	}{
+		{Config{RejectDomainTargets: true}, "localhost", func(stats Stats) int64 { return stats.TargetTypeRejections }},
+		{Config{DomainBlocklist: blocklist}, "blocked.example", func(stats Stats) int64 { return stats.BlocklistRejections }},
+		{Config{DomainPolicy: policy}, "localhost", func(Stats) int64 { return refused.Load() }},
+	}
+	for _, test := range tests {
+		config := test.config
+		config.EnableUDP, config.UDPBindIP = true, net.IP{127, 0, 0, 1}
+		server := SOCKS5Server{Config: &config}
+		udpConn := udpAssociate(t, &server)
+		buf := make([]byte, 1024)
+		send := func(addrType AddressType, host string) error {
+			request := UDPDatagram{AddrType: addrType, TargetIP: host, Port: uint16(echo.Port), Data: []byte("ping")}
+			udpConn.Write(request.Bytes())
+			udpConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			_, err := udpConn.Read(buf)
+			return err
+		}
+
+		if err := send(TypeDomain, test.host); err == nil {
+			t.Fatalf("should drop a datagram for %s", test.host)
+		}
+		if got := test.dropped(server.Stats()); got != 1 {
+			t.Fatalf("%s: should count 1 dropped datagram but got %d", test.host, got)
+		}
+		if err := send(TypeIPv4, "127.0.0.1"); err != nil {
+			t.Fatalf("should relay a datagram for an IP target but got %s", err)
+		}
+	}
+}
+
+func TestUDPRejectIPTargets(t *testing.T) {
+	echo := udpEchoServer(t)
+	server := SOCKS5Server{Config: &Config{EnableUDP: true, UDPBindIP: net.IP{127, 0, 0, 1}, RejectIPTargets: true}}
+	// The zero client address of the request is not a target
+	udpConn := udpAssociate(t, &server)
+	buf := make([]byte, 1024)
+	send := func(addrType AddressType, host string) error {
+		request := UDPDatagram{AddrType: addrType, TargetIP: host, Port: uint16(echo.Port), Data: []byte("ping")}
+		udpConn.Write(request.Bytes())
+		udpConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err := udpConn.Read(buf)
+		return err
+	}
+
+	if err := send(TypeIPv4, "127.0.0.1"); err == nil {
+		t.Fatalf("should drop a datagram for an IP target")
+	}
+	if got := server.Stats().TargetTypeRejections; got != 1 {
+		t.Fatalf("should count 1 dropped datagram but got %d", got)
+	}
+	if err := send(TypeDomain, "localhost"); err != nil {
+		t.Fatalf("should relay a datagram for a domain target but got %s", err)
+	}
+}
+
+func TestUDPRules(t *testing.T) {
+	echo := udpEchoServer(t)
+	config := Config{
+		EnableUDP: true,
+		UDPBindIP: net.IP{127, 0, 0, 1},
+		Rules:     []Rule{{Networks: []string{"127.0.0.0/8"}, Action: RuleReject}},
+	}
+	if err := initConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	server := SOCKS5Server{Config: &config}
+	udpConn := udpAssociate(t, &server)
+	buf := make([]byte, 1024)
+	send := func(addrType AddressType, host string) error {
+		request := UDPDatagram{AddrType: addrType, TargetIP: host, Port: uint16(echo.Port), Data: []byte("ping")}
+		udpConn.Write(request.Bytes())
+		udpConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err := udpConn.Read(buf)
+		return err
+	}
+
+	if err := send(TypeIPv4, "127.0.0.1"); err == nil {
+		t.Fatalf("should drop a datagram for a target the rule rejects")
+	}
+	if err := send(TypeIPv6, "::ffff:127.0.0.1"); err == nil {
+		t.Fatalf("should drop a datagram for the IPv4-mapped form of a target the rule rejects")
+	}
+	if err := send(TypeDomain, "localhost"); err != nil {
+		t.Fatalf("should relay a datagram for a target the rule does not match but got %s", err)
+	}
+}
+
+func TestUDPDomainTargetResolver(t *testing.T) {
+	echo := udpEchoServer(t)
+	dns := dnsServer(t, [4]byte{127, 0, 0, 1})
+	var down atomic.Bool
+	resolver := &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		if down.Load() {
+			return nil, errors.New("resolver down")
+		}
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "udp", dns)
+	}}
+	server := SOCKS5Server{Config: &Config{EnableUDP: true, UDPBindIP: net.IP{127, 0, 0, 1}, Resolver: resolver}}
+	udpConn := udpAssociate(t, &server)
+	buf := make([]byte, 1024)
+	send := func() error {
+		request := UDPDatagram{AddrType: TypeDomain, TargetIP: "echo.test", Port: uint16(echo.Port), Data: []byte("ping")}
+		udpConn.Write(request.Bytes())
+		udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := udpConn.Read(buf)
+		return err
+	}
+
+	if err := send(); err != nil {
+		t.Fatalf("should relay through the configured resolver but got %s", err)
+	}
+	// The address is cached for the association
+	down.Store(true)
+	if err := send(); err != nil {
+		t.Fatalf("should relay to the cached address but got %s", err)
+	}
+}
@@ -0,0 +1,88 @@
+package socks5
+
+import "net"
+
+// udpMessage is a datagram of a batch. Reads fill Buf up to N bytes; writes
+// send all of Buf. Addr is the sender or destination, nil when writing to a
+// connected socket.
+type udpMessage struct {
+	Buf  []byte
+	N    int
+	Addr *net.UDPAddr
+}
+
+// udpBatchConn reads and writes batches of datagrams. It is not safe for
+// concurrent use.
+type udpBatchConn interface {
+	// readBatch reads at least one datagram into ms and returns how many.
+	readBatch(ms []udpMessage) (int, error)
+	// writeBatch writes ms in order and returns how many were written
+	// before the error, if any.
+	writeBatch(ms []udpMessage) (int, error)
+}
+
+// newUDPBatchConn returns conn reading and writing up to batchSize datagrams
+// per system call where the platform supports it.
+func newUDPBatchConn(conn *net.UDPConn, batchSize int) udpBatchConn {
+	if batchSize <= 1 {
+		return udpSingleConn{conn}
+	}
+	return newMMsgConn(conn, batchSize)
+}
+
+// makeUDPMessages allocates read buffers for a batch of batchSize datagrams.
+func makeUDPMessages(batchSize int) []udpMessage {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	ms := make([]udpMessage, batchSize)
+	for i := range ms {
+		ms[i].Buf = make([]byte, 65535)
+	}
+	return ms
+}
+
+// writeUDPBatch writes ms through conn, calling failed for each datagram
+// that could not be written.
+func writeUDPBatch(ms []udpMessage, conn udpBatchConn, failed func(m *udpMessage, err error)) {
+	for len(ms) > 0 {
+		n, err := conn.writeBatch(ms)
+		if err == nil && n == 0 {
+			return
+		}
+		if err != nil && n < len(ms) {
+			failed(&ms[n], err)
+			n++
+		}
+		ms = ms[n:]
+	}
+}
+
+// udpSingleConn moves one datagram per system call.
+type udpSingleConn struct {
+	conn *net.UDPConn
+}
+
+func (c udpSingleConn) readBatch(ms []udpMessage) (int, error) {
+	n, addr, err := c.conn.ReadFromUDP(ms[0].Buf)
+	if err != nil {
+		return 0, err
+	}
+	ms[0].N, ms[0].Addr = n, addr
+	return 1, nil
+}
+
+func (c udpSingleConn) writeBatch(ms []udpMessage) (int, error) {
+	for i, m := range ms {
+		var err error
+		if m.Addr == nil {
+			_, err = c.conn.Write(m.Buf)
+		} else {
+			_, err = c.conn.WriteToUDP(m.Buf, m.Addr)
+		}
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(ms), nil
+}
@@ -0,0 +1,60 @@
+//go:build linux
+
+package socks5
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// mmsgConn batches datagrams with recvmmsg and sendmmsg.
+type mmsgConn struct {
+	conn interface {
+		ReadBatch(ms []ipv4.Message, flags int) (int, error)
+		WriteBatch(ms []ipv4.Message, flags int) (int, error)
+	}
+	msgs []ipv4.Message
+}
+
+func newMMsgConn(conn *net.UDPConn, batchSize int) udpBatchConn {
+	c := &mmsgConn{conn: ipv4.NewPacketConn(conn), msgs: make([]ipv4.Message, batchSize)}
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		c.conn = ipv6.NewPacketConn(conn)
+	}
+	for i := range c.msgs {
+		c.msgs[i].Buffers = make([][]byte, 1)
+	}
+	return c
+}
+
+// prepare points the first len(ms) messages at ms.
+func (c *mmsgConn) prepare(ms []udpMessage) []ipv4.Message {
+	if len(ms) > len(c.msgs) {
+		ms = ms[:len(c.msgs)]
+	}
+	msgs := c.msgs[:len(ms)]
+	for i := range ms {
+		msgs[i].Buffers[0] = ms[i].Buf
+		msgs[i].Addr = nil
+		if ms[i].Addr != nil {
+			msgs[i].Addr = ms[i].Addr
+		}
+	}
+	return msgs
+}
+
+func (c *mmsgConn) readBatch(ms []udpMessage) (int, error) {
+	msgs := c.prepare(ms)
+	n, err := c.conn.ReadBatch(msgs, 0)
+	for i := 0; i < n; i++ {
+		ms[i].N = msgs[i].N
+		ms[i].Addr, _ = msgs[i].Addr.(*net.UDPAddr)
+	}
+	return n, err
+}
+
+func (c *mmsgConn) writeBatch(ms []udpMessage) (int, error) {
+	return c.conn.WriteBatch(c.prepare(ms), 0)
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package socks5
+
+import "net"
+
+func newMMsgConn(conn *net.UDPConn, batchSize int) udpBatchConn {
+	return udpSingleConn{conn}
+}
@@ -0,0 +1,73 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUDPBatch(t *testing.T) {
+	echo := udpEchoServer(t)
+	server := SOCKS5Server{Config: &Config{EnableUDP: true, UDPBindIP: net.IP{127, 0, 0, 1}, UDPBatchSize: 8}}
+	udpConn := udpAssociate(t, &server)
+
+	const count = 50
+	for i := 0; i < count; i++ {
+		request := UDPDatagram{AddrType: TypeIPv4, TargetIP: "127.0.0.1", Port: uint16(echo.Port), Data: []byte(strconv.Itoa(i))}
+		udpConn.Write(request.Bytes())
+	}
+	received := make(map[string]bool)
+	buf := make([]byte, 1024)
+	udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(received) < count {
+		n, err := udpConn.Read(buf)
+		if err != nil {
+			t.Fatalf("should receive %d echoes but got %d and %s", count, len(received), err)
+		}
+		response, err := NewUDPDatagram(buf[:n])
+		if err != nil {
+			t.Fatalf("should get error nil but got %s", err)
+		}
+		received[string(response.Data)] = true
+	}
+}
+
+func TestWriteUDPBatch(t *testing.T) {
+	target := &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 1}
+	ms := []udpMessage{{Buf: []byte("a"), Addr: target}, {Buf: []byte("b"), Addr: target}, {Buf: []byte("c"), Addr: target}}
+	conn := &fakeBatchConn{fail: 1}
+	var failed []string
+	writeUDPBatch(ms, conn, func(m *udpMessage, err error) {
+		failed = append(failed, string(m.Buf))
+	})
+	if !bytes.Equal(bytes.Join(conn.written, nil), []byte("ac")) {
+		t.Fatalf("should write a and c but wrote %q", conn.written)
+	}
+	if len(failed) != 1 || failed[0] != "b" {
+		t.Fatalf("should report b as failed but got %q", failed)
+	}
+}
+
+// fakeBatchConn writes one datagram per call, failing the one at index fail
+// of all written.
+type fakeBatchConn struct {
+	fail    int
+	calls   int
+	written [][]byte
+}
+
+func (c *fakeBatchConn) readBatch(ms []udpMessage) (int, error) {
+	return 0, errors.New("not implemented")
+}
+
+func (c *fakeBatchConn) writeBatch(ms []udpMessage) (int, error) {
+	c.calls++
+	if c.calls-1 == c.fail {
+		return 0, errors.New("unreachable")
+	}
+	c.written = append(c.written, ms[0].Buf)
+	return 1, nil
+}
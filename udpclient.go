@@ -0,0 +1,290 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrUDPAssociationLost = errors.New("UDP association lost and could not be re-established")
+
+// defaultUDPMaxBackoff caps the wait between re-association attempts when
+// UDPRetryPolicy.MaxBackoff is not set.
+const defaultUDPMaxBackoff = 30 * time.Second
+
+// UDPRetryPolicy controls how a UDPAssociation is re-established when its
+// control connection to the proxy server drops, e.g. on a proxy restart.
+type UDPRetryPolicy struct {
+	// MaxAttempts is the number of handshakes tried before giving up. Zero
+	// disables re-establishment.
+	MaxAttempts int
+	// Backoff is the wait before the first attempt, doubled after each
+	// failure up to MaxBackoff, which defaults to 30 seconds.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// OnAttempt, if set, is called after each attempt with its number,
+	// counting from 1, and its error, nil once the association is resumed.
+	OnAttempt func(attempt int, err error)
+}
+
+// UDPAssociation is the client side of a UDP ASSOCIATE request, a
+// net.PacketConn relaying datagrams through the proxy server. Datagrams
+// written while the association is being re-established are lost, as they
+// may be on any UDP path. Once re-establishment fails, reads and writes
+// return ErrUDPAssociationLost.
+type UDPAssociation struct {
+	client *Client
+	conn   *net.UDPConn
+	done   chan struct{}
+
+	mu      sync.Mutex
+	control net.Conn
+	relay   *net.UDPAddr
+	err     error
+	closed  bool
+
+	readMu  sync.Mutex
+	readBuf []byte
+}
+
+// ListenPacket connects to the proxy server and sends a UDP ASSOCIATE
+// request. ctx bounds connecting and the handshake; cancelling it once the
+// association is returned has no effect. The association lives
+// until Close or until its control connection drops and Client.UDPRetry
+// fails to re-establish it.
+func (c *Client) ListenPacket(ctx context.Context) (*UDPAssociation, error) {
+	control, err := c.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var localIP net.IP
+	if addr, ok := control.LocalAddr().(*net.TCPAddr); ok {
+		localIP = addr.IP
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	a := UDPAssociation{client: c, conn: conn, done: make(chan struct{})}
+	relay, err := a.associate(ctx, control)
+	if err != nil {
+		control.Close()
+		conn.Close()
+		return nil, err
+	}
+	a.control, a.relay = control, relay
+	go a.watch(control)
+	return &a, nil
+}
+
+// associate sends the UDP ASSOCIATE request over control, bounded by ctx,
+// and returns the relay address.
+func (a *UDPAssociation) associate(ctx context.Context, control net.Conn) (*net.UDPAddr, error) {
+	stop := watchContext(ctx, control)
+	reply, err := a.client.handshake(ctx, control, CmdUDP, a.conn.LocalAddr().String())
+	if err = stop(err); err != nil {
+		return nil, err
+	}
+	relay := &net.UDPAddr{IP: net.ParseIP(reply.BindIP), Port: int(reply.Port)}
+	if relay.IP == nil || relay.IP.IsUnspecified() {
+		// The relay listens on all addresses, so use the one we reached
+		if addr, ok := control.RemoteAddr().(*net.TCPAddr); ok {
+			relay.IP = addr.IP
+		}
+	}
+	return relay, nil
+}
+
+// watch waits for the control connection to drop and then re-establishes
+// the association, for as long as it is not closed.
+func (a *UDPAssociation) watch(control net.Conn) {
+	for control != nil {
+		control.Read(make([]byte, 1))
+		control.Close()
+		control = a.retry()
+	}
+}
+
+// retry re-establishes the association under the client's UDPRetry policy
+// and returns the new control connection, or nil when the association is
+// closed or lost.
+func (a *UDPAssociation) retry() net.Conn {
+	policy := a.client.UDPRetry
+	backoff := policy.Backoff
+	maxBackoff := policy.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultUDPMaxBackoff
+	}
+	for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
+		timer := time.NewTimer(backoff)
+		select {
+		case <-a.done:
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+
+		control, relay, err := a.reassociate()
+		if policy.OnAttempt != nil {
+			policy.OnAttempt(attempt, err)
+		}
+		if err != nil {
+			continue
+		}
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if a.closed {
+			control.Close()
+			return nil
+		}
+		a.control, a.relay = control, relay
+		return control
+	}
+
+	a.mu.Lock()
+	a.err = ErrUDPAssociationLost
+	a.mu.Unlock()
+	// Unblock pending reads
+	a.conn.Close()
+	return nil
+}
+
+func (a *UDPAssociation) reassociate() (net.Conn, *net.UDPAddr, error) {
+	// Close cancels an attempt in progress
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-a.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if a.client.Timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, a.client.Timeout)
+		defer cancelTimeout()
+	}
+	control, err := a.client.dialProxy(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	relay, err := a.associate(ctx, control)
+	if err != nil {
+		control.Close()
+		return nil, nil, err
+	}
+	return control, relay, nil
+}
+
+// state returns the current relay address, or the error ending the association.
+func (a *UDPAssociation) state() (*net.UDPAddr, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil, net.ErrClosed
+	}
+	return a.relay, a.err
+}
+
+// ReadFrom reads a datagram relayed from a target, returning the target's
+// address. Datagrams not from the relay are discarded.
+func (a *UDPAssociation) ReadFrom(b []byte) (int, net.Addr, error) {
+	a.readMu.Lock()
+	defer a.readMu.Unlock()
+	if a.readBuf == nil {
+		a.readBuf = make([]byte, 65535)
+	}
+	for {
+		n, from, err := a.conn.ReadFromUDP(a.readBuf)
+		relay, stateErr := a.state()
+		if stateErr != nil {
+			return 0, nil, stateErr
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		if !from.IP.Equal(relay.IP) || from.Port != relay.Port {
+			continue
+		}
+		datagram, err := NewUDPDatagram(a.readBuf[:n])
+		if err != nil || datagram.Frag != 0 {
+			continue
+		}
+		// Servers reply with the IP address the datagram came from
+		ip := net.ParseIP(datagram.TargetIP)
+		if ip == nil {
+			continue
+		}
+		return copy(b, datagram.Data), &net.UDPAddr{IP: ip, Port: int(datagram.Port)}, nil
+	}
+}
+
+// WriteTo sends b to addr through the relay. addr may be a *net.UDPAddr
+// or any net.Addr whose String is a host:port, to be resolved by the proxy.
+func (a *UDPAssociation) WriteTo(b []byte, addr net.Addr) (int, error) {
+	relay, err := a.state()
+	if err != nil {
+		return 0, err
+	}
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return 0, err
+	}
+	datagram := UDPDatagram{AddrType: TypeDomain, TargetIP: host, Port: uint16(port), Data: b}
+	if ip := net.ParseIP(host); ip != nil {
+		datagram.AddrType = TypeIPv6
+		if ip.To4() != nil {
+			datagram.AddrType = TypeIPv4
+		}
+	} else if len(host) > 255 {
+		return 0, ErrDomainTooLong
+	}
+	if _, err := a.conn.WriteToUDP(datagram.Bytes(), relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close ends the association and closes its sockets.
+func (a *UDPAssociation) Close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	control := a.control
+	a.mu.Unlock()
+	close(a.done)
+	control.Close()
+	return a.conn.Close()
+}
+
+// LocalAddr returns the local address datagrams are sent from.
+func (a *UDPAssociation) LocalAddr() net.Addr {
+	return a.conn.LocalAddr()
+}
+
+func (a *UDPAssociation) SetDeadline(t time.Time) error {
+	return a.conn.SetDeadline(t)
+}
+
+func (a *UDPAssociation) SetReadDeadline(t time.Time) error {
+	return a.conn.SetReadDeadline(t)
+}
+
+func (a *UDPAssociation) SetWriteDeadline(t time.Time) error {
+	return a.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,80 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// roundTrip sends ping to target through a and waits for its echo.
+func roundTrip(t *testing.T, a *UDPAssociation, target *net.UDPAddr) {
+	t.Helper()
+	a.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := a.WriteTo([]byte("ping"), target); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	buf := make([]byte, 16)
+	n, from, err := a.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "ping" || from.String() != target.String() {
+		t.Fatalf("should get ping from %s but got %q from %v, %v", target, buf[:n], from, err)
+	}
+}
+
+func TestClientListenPacket(t *testing.T) {
+	echo := udpEchoServer(t)
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth, EnableUDP: true}}
+	address, _ := startServer(t, &server)
+	defer server.Shutdown(context.Background())
+
+	attempts := make(chan error, 1)
+	client := Client{ProxyAddress: address, UDPRetry: UDPRetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     10 * time.Millisecond,
+		OnAttempt:   func(attempt int, err error) { attempts <- err },
+	}}
+	a, err := client.ListenPacket(context.Background())
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	defer a.Close()
+	roundTrip(t, a, echo)
+
+	// Drop the control connection as a proxy restart would
+	a.mu.Lock()
+	a.control.Close()
+	a.mu.Unlock()
+	select {
+	case err := <-attempts:
+		if err != nil {
+			t.Fatalf("should re-associate but got %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("should re-associate")
+	}
+	roundTrip(t, a, echo)
+}
+
+func TestClientListenPacketLost(t *testing.T) {
+	server := SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth, EnableUDP: true}}
+	address, _ := startServer(t, &server)
+
+	client := Client{ProxyAddress: address}
+	a, err := client.ListenPacket(context.Background())
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	defer a.Close()
+
+	// Shutdown closes the sessions it cannot wait for
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	server.Shutdown(ctx)
+	a.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := a.ReadFrom(make([]byte, 16)); err != ErrUDPAssociationLost {
+		t.Fatalf("should get error %s but got %v", ErrUDPAssociationLost, err)
+	}
+	if _, err := a.WriteTo([]byte("ping"), &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 9}); err != ErrUDPAssociationLost {
+		t.Fatalf("should get error %s but got %v", ErrUDPAssociationLost, err)
+	}
+}
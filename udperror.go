@@ -0,0 +1,60 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// udpTargetError classifies the errors sending to or receiving from a UDP
+// target, mostly ICMP errors the kernel reports on connected sockets.
+type udpTargetError int
+
+const (
+	udpPortUnreachable udpTargetError = iota
+	udpHostUnreachable
+	udpNetworkUnreachable
+	udpOtherError
+
+	numUDPTargetErrors
+)
+
+// udpTargetErrorNames are the Stats.UDPTargetErrors keys.
+var udpTargetErrorNames = [numUDPTargetErrors]string{
+	udpPortUnreachable:    "port_unreachable",
+	udpHostUnreachable:    "host_unreachable",
+	udpNetworkUnreachable: "network_unreachable",
+	udpOtherError:         "error",
+}
+
+func classifyUDPTargetError(err error) udpTargetError {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return udpPortUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return udpHostUnreachable
+	case errors.Is(err, syscall.ENETUNREACH):
+		return udpNetworkUnreachable
+	default:
+		return udpOtherError
+	}
+}
+
+// targetError counts and logs err, if any, from relaying to or from target.
+// With Config.UDPCloseOnUnreachable, an unreachable only target ends the
+// association, so the client sees its control connection close instead of
+// waiting for replies that will not come.
+func (a *udpAssociation) targetError(target *net.UDPAddr, err error) {
+	if err == nil {
+		return
+	}
+	s := a.server
+	kind := classifyUDPTargetError(err)
+	s.stats.udpTargetErrors[kind].Add(1)
+	address := a.config.LogRedaction.Address(target.String())
+	logSession(a.sessionID, "UDP target", address, "failure:", udpTargetErrorNames[kind])
+	if kind != udpOtherError && a.config.UDPCloseOnUnreachable && !a.multi.Load() {
+		logSession(a.sessionID, "closing UDP association: target", address, "is unreachable")
+		a.teardown()
+	}
+}
@@ -0,0 +1,262 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+var ErrUDPHandoffNotSupported = errors.New("control connection cannot be handed off")
+
+// UDPHandoff is a UDP association moved to another server, usually in a
+// new process started by Restart, so that long-lived UDP sessions such as
+// VoIP calls or games survive an upgrade. Its client keeps both the TCP
+// control connection and the relay address it was given.
+type UDPHandoff struct {
+	SessionID string    `json:"session_id"`
+	Username  string    `json:"username"`
+	Start     time.Time `json:"start"`
+	// Control is the TCP control connection and Relay the UDP relay socket.
+	Control *os.File `json:"-"`
+	Relay   *os.File `json:"-"`
+	// Connected is the socket connected to ConnectedTarget, the first
+	// target of the client, if any. It keeps the source address that
+	// target knows the client by.
+	Connected       *os.File `json:"-"`
+	ConnectedTarget string   `json:"connected_target"`
+	// Expected is the client address the association accepts datagrams
+	// from and Client the address it learned from the first of them, if
+	// any.
+	Expected string `json:"expected"`
+	Client   string `json:"client"`
+	// Multi is set once the client sent to several targets, WithoutRSV
+	// once it sent headers lacking RSV (Quirks.UDPWithoutRSV).
+	Multi      bool `json:"multi"`
+	WithoutRSV bool `json:"without_rsv"`
+	// AmplificationRatio is the Config.UDPAmplificationRatio in force for
+	// the client, zero once the client was confirmed.
+	AmplificationRatio int64 `json:"amplification_ratio"`
+	// Datagrams counts the datagrams relayed so far, for
+	// Config.UDPMaxDatagrams.
+	Datagrams int64 `json:"datagrams"`
+}
+
+// ExportUDPAssociations stops relaying the running UDP associations and
+// returns them for ImportUDPAssociations, which may be called by another
+// process. Their sockets stay open for as long as the files of the
+// handoffs do, so datagrams wait in the socket buffers meanwhile.
+// Associations whose control connection is not a plain TCP connection,
+// e.g. over TLS or after sniffing for HTTPConnect, cannot be moved: they
+// are logged with ErrUDPHandoffNotSupported and keep running.
+func (s *SOCKS5Server) ExportUDPAssociations() []UDPHandoff {
+	s.mu.Lock()
+	associations := make([]*udpAssociation, 0, len(s.udpRelays))
+	for association := range s.udpRelays {
+		associations = append(associations, association)
+	}
+	s.mu.Unlock()
+
+	var handoffs []UDPHandoff
+	for _, association := range associations {
+		handoff, err := association.export()
+		if err != nil {
+			logSession(association.sessionID, "hand off UDP association failure", err)
+			continue
+		}
+		handoffs = append(handoffs, handoff)
+	}
+	return handoffs
+}
+
+// ImportUDPAssociations resumes relaying UDP associations exported by
+// ExportUDPAssociations, under the config of s. It takes over the files of
+// handoffs and closes them. Config.UDPMaxLifetime counts from the import.
+func (s *SOCKS5Server) ImportUDPAssociations(handoffs []UDPHandoff) error {
+	defer closeUDPHandoffs(handoffs)
+	if err := s.init(); err != nil {
+		return err
+	}
+	for i := range handoffs {
+		if err := s.importUDPAssociation(&handoffs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SOCKS5Server) importUDPAssociation(handoff *UDPHandoff) error {
+	expected, err := net.ResolveUDPAddr("udp", handoff.Expected)
+	if err != nil {
+		return err
+	}
+	var client *net.UDPAddr
+	if handoff.Client != "" {
+		if client, err = net.ResolveUDPAddr("udp", handoff.Client); err != nil {
+			return err
+		}
+	}
+	control, err := net.FileConn(handoff.Control)
+	if err != nil {
+		return err
+	}
+	relayConn, err := fileUDPConn(handoff.Relay)
+	if err != nil {
+		control.Close()
+		return err
+	}
+	var connected *net.UDPConn
+	if handoff.Connected != nil {
+		if connected, err = fileUDPConn(handoff.Connected); err != nil {
+			control.Close()
+			relayConn.Close()
+			return err
+		}
+	}
+	closeSockets := func() {
+		control.Close()
+		relayConn.Close()
+		if connected != nil {
+			connected.Close()
+		}
+	}
+	config := s.config()
+	session := &Session{ID: handoff.SessionID, ClientAddr: control.RemoteAddr(), Start: handoff.Start, config: config}
+	if !s.trackConn(control, session) {
+		closeSockets()
+		return ErrServerClosed
+	}
+	// The association counts against its owner as if it started here
+	release := func() {}
+	if max := config.MaxUDPAssociationsPerUser; max > 0 {
+		var clientIP net.IP
+		if addr, ok := control.RemoteAddr().(*net.TCPAddr); ok {
+			clientIP = addr.IP
+		}
+		owner, _ := s.udpOwner(config, handoff.Username, clientIP)
+		s.udpAssociations.hold(owner)
+		release = func() { s.udpAssociations.release(owner) }
+	}
+
+	// Datagrams are checked against the account as it is configured here
+	authCtx := &AuthContext{SessionID: handoff.SessionID, Username: handoff.Username, ClientAddr: control.RemoteAddr(), config: config}
+	if users := config.Users; users != nil && handoff.Username != "" {
+		if user, ok := users.User(handoff.Username); ok {
+			authCtx.User = &user
+		}
+	}
+	association := &udpAssociation{
+		server:    s,
+		config:    config,
+		authCtx:   authCtx,
+		relayConn: relayConn,
+		expected:  expected,
+		guard:     &amplificationGuard{ratio: handoff.AmplificationRatio},
+		sessionID: handoff.SessionID,
+		teardown:  func() { control.Close() },
+		batchSize: config.UDPBatchSize,
+		client:    client,
+
+		maxDatagrams: config.UDPMaxDatagrams,
+		control:      control,
+		username:     handoff.Username,
+		start:        handoff.Start,
+		connected:    connected,
+	}
+	association.multi.Store(handoff.Multi)
+	association.withoutRSV.Store(handoff.WithoutRSV)
+	association.datagrams.Store(handoff.Datagrams)
+	logSession(handoff.SessionID, "resumed UDP association of", config.LogRedaction.Address(control.RemoteAddr().String()))
+	go func() {
+		defer s.untrackConn(control)
+		defer release()
+		defer control.Close()
+		defer relayConn.Close()
+		s.runUDPAssociation(control, association)
+	}()
+	return nil
+}
+
+// fileUDPConn returns the UDP socket of a file from a handoff.
+func fileUDPConn(file *os.File) (*net.UDPConn, error) {
+	packetConn, err := net.FilePacketConn(file)
+	if err != nil {
+		return nil, err
+	}
+	conn, ok := packetConn.(*net.UDPConn)
+	if !ok {
+		packetConn.Close()
+		return nil, ErrNetworkNotSupported
+	}
+	return conn, nil
+}
+
+// export hands off a running association: it duplicates its sockets, then
+// stops its relay and control reader with deadlines, which leaves the
+// sockets open, and waits for runUDPAssociation to return.
+func (a *udpAssociation) export() (UDPHandoff, error) {
+	handoff := UDPHandoff{
+		SessionID: a.sessionID,
+		Username:  a.username,
+		Start:     a.start,
+		Expected:  a.expected.String(),
+
+		AmplificationRatio: a.guard.ratio,
+	}
+	// Wrappers such as TLS or the sniffing of HTTPConnect hold state of
+	// their own, so only the bare socket can move
+	filer, ok := a.control.(interface{ File() (*os.File, error) })
+	if !ok {
+		return handoff, ErrUDPHandoffNotSupported
+	}
+	var err error
+	if handoff.Control, err = filer.File(); err != nil {
+		return handoff, err
+	}
+	if handoff.Relay, err = a.relayConn.File(); err != nil {
+		handoff.Control.Close()
+		return handoff, err
+	}
+
+	a.handedOff.Store(true)
+	past := time.Unix(1, 0)
+	a.relayConn.SetReadDeadline(past)
+	a.control.SetReadDeadline(past)
+	<-a.done
+	// The relay stopped, so what it learned is settled
+	if a.client != nil {
+		handoff.Client = a.client.String()
+	}
+	handoff.Multi, handoff.WithoutRSV = a.multi.Load(), a.withoutRSV.Load()
+	handoff.Datagrams = a.datagrams.Load()
+	if handoff.Connected = a.connectedFile; handoff.Connected != nil {
+		handoff.ConnectedTarget = a.connected.RemoteAddr().String()
+	}
+	logSession(a.sessionID, "handed off UDP association")
+	return handoff, nil
+}
+
+func (s *SOCKS5Server) addUDPAssociation(association *udpAssociation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.udpRelays == nil {
+		s.udpRelays = make(map[*udpAssociation]struct{})
+	}
+	s.udpRelays[association] = struct{}{}
+}
+
+func (s *SOCKS5Server) removeUDPAssociation(association *udpAssociation) {
+	s.mu.Lock()
+	delete(s.udpRelays, association)
+	s.mu.Unlock()
+}
+
+// closeUDPHandoffs closes the files of handoffs.
+func closeUDPHandoffs(handoffs []UDPHandoff) {
+	for _, handoff := range handoffs {
+		// Closing a nil *os.File only returns an error
+		handoff.Control.Close()
+		handoff.Relay.Close()
+		handoff.Connected.Close()
+	}
+}
@@ -0,0 +1,73 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+var ErrNoUDPPortAvailable = errors.New("no UDP relay port available in range")
+
+// udpPortAllocator hands out relay ports from Config.UDPPortMin..UDPPortMax,
+// tracking which are in use so released ports are reused. The search starts
+// at a random port so restarts don't all collide on the first ones.
+type udpPortAllocator struct {
+	mu     sync.Mutex
+	inUse  map[int]bool
+	cursor int
+}
+
+// listen binds a UDP socket on ip to a free port in [min, max].
+func (a *udpPortAllocator) listen(ip net.IP, min, max int, r randSource) (*net.UDPConn, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	size := max - min + 1
+	if a.inUse == nil {
+		a.inUse = make(map[int]bool)
+		a.cursor = randIntn(r, size)
+	}
+	for i := 0; i < size; i++ {
+		port := min + (a.cursor+i)%size
+		if a.inUse[port] {
+			continue
+		}
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port})
+		if err != nil {
+			// Taken by another process
+			continue
+		}
+		a.inUse[port] = true
+		a.cursor = (a.cursor + i + 1) % size
+		return conn, nil
+	}
+	return nil, ErrNoUDPPortAvailable
+}
+
+func (a *udpPortAllocator) release(port int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.inUse, port)
+}
+
+// listenUDPRelay binds a relay socket, within the port range of config if
+// any.
+func (s *SOCKS5Server) listenUDPRelay(config *Config, ip net.IP) (*net.UDPConn, func(), error) {
+	min, max := config.UDPPortMin, config.UDPPortMax
+	if min <= 0 || max < min {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, func() { conn.Close() }, nil
+	}
+
+	conn, err := s.udpPorts.listen(ip, min, max, s.rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	return conn, func() {
+		conn.Close()
+		s.udpPorts.release(port)
+	}, nil
+}
@@ -0,0 +1,374 @@
+package socks5
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrUserExists   = errors.New("user already exists")
+	ErrUserNotFound = errors.New("user not found")
+)
+
+// HashAlgorithm selects how Users hashes new passwords. Existing hashes of
+// either kind are always verified.
+type HashAlgorithm int
+
+const (
+	HashArgon2id HashAlgorithm = iota
+	HashBcrypt
+)
+
+// User is an account managed by Users. Only the password hash is kept.
+type User struct {
+	Name         string `json:"name"`
+	PasswordHash string `json:"password_hash"`
+	// Disabled accounts fail authentication.
+	Disabled bool `json:"disabled,omitempty"`
+	// Commands restricts the SOCKS commands the user may issue. Empty allows all.
+	Commands Commands `json:"commands,omitempty"`
+	// RateClass is a free-form class that rules can match on.
+	RateClass string `json:"rate_class,omitempty"`
+	// Labels are added to the user's sessions, see AuthContext.Labels.
+	Labels []string `json:"labels,omitempty"`
+}
+
+// Commands is a set of SOCKS commands, stored in JSON by name ("connect",
+// "bind", "udp").
+type Commands []Command
+
+var commandNames = map[Command]string{CmdConnect: "connect", CmdBind: "bind", CmdUDP: "udp"}
+
+func (c Commands) contains(cmd Command) bool {
+	for _, allowed := range c {
+		if allowed == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Commands) MarshalJSON() ([]byte, error) {
+	names := make([]string, len(c))
+	for i, cmd := range c {
+		name, ok := commandNames[cmd]
+		if !ok {
+			return nil, fmt.Errorf("%w: %#x", ErrCommandNotSupported, cmd)
+		}
+		names[i] = name
+	}
+	return json.Marshal(names)
+}
+
+func (c *Commands) UnmarshalJSON(data []byte) error {
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return err
+	}
+	*c = (*c)[:0]
+next:
+	for _, name := range names {
+		for cmd, cmdName := range commandNames {
+			if strings.EqualFold(name, cmdName) {
+				*c = append(*c, cmd)
+				continue next
+			}
+		}
+		return fmt.Errorf("%w: %q", ErrCommandNotSupported, name)
+	}
+	return nil
+}
+
+// UserStore persists user accounts.
+type UserStore interface {
+	Load() ([]User, error)
+	Save(users []User) error
+}
+
+// FileUserStore keeps users in a JSON file.
+type FileUserStore struct {
+	Path string
+}
+
+// Load returns the users in the file, or none if it doesn't exist yet.
+func (f *FileUserStore) Load() ([]User, error) {
+	data, err := os.ReadFile(f.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var users []User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// Save replaces the file atomically, readable by the owner only.
+func (f *FileUserStore) Save(users []User) error {
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.Path, data)
+}
+
+// writeFileAtomic replaces the file at path with data, readable by the
+// owner only, so readers never see it half written.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Users is a set of password accounts. Set it as Config.Users to
+// authenticate MethodPassword and HTTP CONNECT clients against it.
+// Every change is saved to Store, if set.
+type Users struct {
+	Store     UserStore
+	Algorithm HashAlgorithm
+
+	mu    sync.RWMutex
+	users map[string]*User
+}
+
+// NewUsers returns the users loaded from store.
+func NewUsers(store UserStore) (*Users, error) {
+	u := Users{Store: store, users: make(map[string]*User)}
+	if store == nil {
+		return &u, nil
+	}
+	users, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	for i := range users {
+		u.users[users[i].Name] = &users[i]
+	}
+	return &u, nil
+}
+
+// AddUser creates an account. The attributes of user other than Name and
+// PasswordHash are kept as given.
+func (u *Users) AddUser(user User, password string) error {
+	hash, err := u.hash(password)
+	if err != nil {
+		return err
+	}
+	user.PasswordHash = hash
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.users[user.Name]; ok {
+		return ErrUserExists
+	}
+	if u.users == nil {
+		u.users = make(map[string]*User)
+	}
+	u.users[user.Name] = &user
+	return u.save()
+}
+
+func (u *Users) RemoveUser(name string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.users[name]; !ok {
+		return ErrUserNotFound
+	}
+	delete(u.users, name)
+	return u.save()
+}
+
+func (u *Users) SetPassword(name, password string) error {
+	hash, err := u.hash(password)
+	if err != nil {
+		return err
+	}
+	return u.UpdateUser(name, func(user *User) { user.PasswordHash = hash })
+}
+
+// UpdateUser changes the attributes of an account with update.
+func (u *Users) UpdateUser(name string, update func(user *User)) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	user, ok := u.users[name]
+	if !ok {
+		return ErrUserNotFound
+	}
+	updated := *user
+	update(&updated)
+	updated.Name = name
+	u.users[name] = &updated
+	return u.save()
+}
+
+// User returns the account called name.
+func (u *Users) User(name string) (User, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	user, ok := u.users[name]
+	if !ok {
+		return User{}, false
+	}
+	return *user, true
+}
+
+// List returns all accounts sorted by name.
+func (u *Users) List() []User {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	users := make([]User, 0, len(u.users))
+	for _, user := range u.users {
+		users = append(users, *user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users
+}
+
+// CheckPassword reports whether name is an enabled account with password.
+func (u *Users) CheckPassword(name, password string) bool {
+	_, ok := u.authenticate(name, password)
+	return ok
+}
+
+func (u *Users) authenticate(name, password string) (*User, bool) {
+	u.mu.RLock()
+	user, ok := u.users[name]
+	u.mu.RUnlock()
+	if !ok {
+		// Spend the same time as for an existing user
+		dummyHashOnce.Do(func() { dummyHash = hashArgon2id("", make([]byte, 16)) })
+		verifyPassword(dummyHash, password)
+		return nil, false
+	}
+	if !verifyPassword(user.PasswordHash, password) || user.Disabled {
+		return nil, false
+	}
+	return user, true
+}
+
+// save writes the accounts to Store. u.mu must be held.
+func (u *Users) save() error {
+	if u.Store == nil {
+		return nil
+	}
+	users := make([]User, 0, len(u.users))
+	for _, user := range u.users {
+		users = append(users, *user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return u.Store.Save(users)
+}
+
+// Argon2id parameters, the RFC 9106 second recommended option.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+)
+
+var (
+	dummyHash     string
+	dummyHashOnce sync.Once
+)
+
+func (u *Users) hash(password string) (string, error) {
+	if u.Algorithm == HashBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(hash), err
+	}
+	salt := make([]byte, 16)
+	randRead(nil, salt)
+	return hashArgon2id(password, salt), nil
+}
+
+// hashArgon2id encodes in the PHC string format used by the reference implementation.
+func hashArgon2id(password string, salt []byte) string {
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func verifyPassword(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		var version, memory, time int
+		var threads uint8
+		parts := strings.Split(hash, "$")
+		if len(parts) != 6 {
+			return false
+		}
+		if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+			return false
+		}
+		if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+			return false
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+		if err != nil {
+			return false
+		}
+		key, err := base64.RawStdEncoding.DecodeString(parts[5])
+		if err != nil {
+			return false
+		}
+		got := argon2.IDKey([]byte(password), salt, uint32(time), uint32(memory), threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(got, key) == 1
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	default:
+		return false
+	}
+}
+
+// checkPassword authenticates against Config.Users or Config.PasswordChecker,
+// recording the account in authCtx.
+func (s *SOCKS5Server) checkPassword(authCtx *AuthContext, username, password string) bool {
+	config := s.sessionConfig(authCtx)
+	users := config.Users
+	if users == nil {
+		// A MethodSelector may pick MethodPassword without a checker set
+		checker := config.PasswordChecker
+		if checker == nil || !checker(username, password) {
+			s.stats.authFailures.Add(1)
+			return false
+		}
+		return true
+	}
+	user, ok := users.authenticate(username, password)
+	if !ok {
+		s.stats.authFailures.Add(1)
+		return false
+	}
+	copied := *user
+	authCtx.User = &copied
+	authCtx.AddLabels(user.Labels...)
+	return true
+}
@@ -0,0 +1,95 @@
+package socks5
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUsers(t *testing.T) {
+	store := &FileUserStore{Path: filepath.Join(t.TempDir(), "users.json")}
+	users, err := NewUsers(store)
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if err := users.AddUser(User{Name: "alice", RateClass: "gold"}, "secret"); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if err := users.AddUser(User{Name: "alice"}, "other"); err != ErrUserExists {
+		t.Fatalf("should get error %s but got %v", ErrUserExists, err)
+	}
+	if !users.CheckPassword("alice", "secret") || users.CheckPassword("alice", "wrong") || users.CheckPassword("bob", "secret") {
+		t.Fatalf("unexpected password check results")
+	}
+
+	data, _ := os.ReadFile(store.Path)
+	if bytes.Contains(data, []byte("secret")) || !bytes.Contains(data, []byte("$argon2id$")) {
+		t.Fatalf("store should only contain the argon2id hash but got %s", data)
+	}
+
+	// A reload sees the saved accounts
+	users, err = NewUsers(store)
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if user, ok := users.User("alice"); !ok || user.RateClass != "gold" {
+		t.Fatalf("should load alice but got %+v", user)
+	}
+	if err := users.SetPassword("alice", "changed"); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if users.CheckPassword("alice", "secret") || !users.CheckPassword("alice", "changed") {
+		t.Fatalf("password should be changed")
+	}
+	users.UpdateUser("alice", func(user *User) { user.Disabled = true })
+	if users.CheckPassword("alice", "changed") {
+		t.Fatalf("disabled user should not authenticate")
+	}
+	if err := users.RemoveUser("alice"); err != nil || len(users.List()) != 0 {
+		t.Fatalf("should remove alice but got %v, %v", err, users.List())
+	}
+	if err := users.RemoveUser("alice"); err != ErrUserNotFound {
+		t.Fatalf("should get error %s but got %v", ErrUserNotFound, err)
+	}
+}
+
+func TestUsersBcrypt(t *testing.T) {
+	users := Users{Algorithm: HashBcrypt}
+	users.AddUser(User{Name: "bob"}, "hunter2")
+	if user, _ := users.User("bob"); !strings.HasPrefix(user.PasswordHash, "$2a$") {
+		t.Fatalf("should store a bcrypt hash but got %s", user.PasswordHash)
+	}
+	if !users.CheckPassword("bob", "hunter2") || users.CheckPassword("bob", "hunter3") {
+		t.Fatalf("unexpected password check results")
+	}
+}
+
+func TestUsersAuth(t *testing.T) {
+	users := Users{}
+	users.AddUser(User{Name: "alice", RateClass: "gold"}, "secret")
+	server := SOCKS5Server{Config: &Config{
+		AuthMethod: MethodPassword,
+		Users:      &users,
+		Rules:      []Rule{{RateClasses: []string{"gold"}, CacheHTTP: true}},
+		HTTPCache:  &HTTPCache{MaxSize: 1 << 20, TTL: 1},
+	}}
+	if err := server.init(); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{SOCKS5Version, 1, MethodPassword})
+	buf.Write([]byte{PasswordMethodVersion, 5, 'a', 'l', 'i', 'c', 'e', 6, 's', 'e', 'c', 'r', 'e', 't'})
+	authCtx, err := server.auth(&buf, &Session{config: server.Config})
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if authCtx.User == nil || authCtx.User.RateClass != "gold" {
+		t.Fatalf("should record the account but got %+v", authCtx.User)
+	}
+	if rule := server.matchRule(&ClientRequestMessage{AddrType: TypeDomain, TargetIP: "example.com"}, authCtx); rule == nil {
+		t.Fatalf("rule should match the rate class")
+	}
+}
@@ -0,0 +1,290 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ConfigError lists every problem Config.Validate found.
+type ConfigError struct {
+	Errors []error
+}
+
+func (e *ConfigError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Error()
+	}
+	return "invalid config: " + strings.Join(messages, "; ")
+}
+
+// Is reports whether any of the problems is target, so errors.Is works on
+// the individual errors, e.g. ErrPasswordCheckerNotSet.
+func (e *ConfigError) Is(target error) bool {
+	for _, err := range e.Errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks config for invalid values and conflicting options and
+// returns a *ConfigError listing all of them, or nil. Run, ServeConn and
+// ApplyConfig call it before using a config.
+func (config *Config) Validate() error {
+	var errs []error
+	add := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	switch config.AuthMethod {
+	case MethodNoAuth:
+	case MethodPassword:
+		if config.PasswordChecker == nil && config.Users == nil {
+			errs = append(errs, ErrPasswordCheckerNotSet)
+		}
+	case MethodHMAC:
+		if config.HMACSecret == nil {
+			errs = append(errs, ErrHMACSecretNotSet)
+		}
+		if config.HTTPConnect {
+			add("HTTPConnect cannot authenticate with MethodHMAC")
+		}
+	default:
+		add("AuthMethod %#x is not supported", config.AuthMethod)
+	}
+	if config.CertAuth != nil && config.TLSConfig == nil {
+		add("CertAuth requires TLSConfig")
+	}
+	if config.CertAuth != nil && config.CertAuth.RequirePassword && config.PasswordChecker == nil && config.Users == nil {
+		add("CertAuth.RequirePassword: %w", ErrPasswordCheckerNotSet)
+	}
+
+	for _, timeout := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"TCPTimeout", config.TCPTimeout},
+		{"DialTimeout", config.DialTimeout},
+		{"HandshakeTimeout", config.HandshakeTimeout},
+		{"RequestTimeout", config.RequestTimeout},
+		{"IdleTimeout", config.IdleTimeout},
+	} {
+		if timeout.d < 0 {
+			add("%s %s is negative", timeout.name, timeout.d)
+		}
+	}
+	if !markSupported {
+		if config.Mark != 0 {
+			errs = append(errs, ErrMarkNotSupported)
+		}
+		for i, rule := range config.Rules {
+			if rule.Mark != 0 {
+				add("Rules[%d]: %w", i, ErrMarkNotSupported)
+			}
+		}
+	}
+	for reason, teardown := range config.Teardown {
+		if teardown.Linger < 0 {
+			add("Teardown[%s].Linger %s is negative", reason, teardown.Linger)
+		}
+	}
+	switch config.ListenNetwork {
+	case "", "tcp", "tcp4", "tcp6":
+	default:
+		add("ListenNetwork %q is not tcp, tcp4 or tcp6", config.ListenNetwork)
+	}
+	if config.IPv6Only && !ipv6OnlySupported {
+		errs = append(errs, ErrIPv6OnlyNotSupported)
+	}
+	if config.IPv6Only && config.ListenNetwork == "tcp4" {
+		add("IPv6Only cannot be combined with ListenNetwork tcp4")
+	}
+	if config.RejectIPTargets && config.RejectDomainTargets {
+		add("RejectDomainTargets cannot be combined with RejectIPTargets")
+	}
+	if config.MaxConnsPerHost < 0 {
+		add("MaxConnsPerHost %d is negative", config.MaxConnsPerHost)
+	}
+	if config.MaxConcurrentDials < 0 || config.DialQueueSize < 0 || config.DialQueueTimeout < 0 {
+		add("MaxConcurrentDials, DialQueueSize and DialQueueTimeout must not be negative")
+	}
+	if config.ProgressInterval < 0 || config.ProgressBytes < 0 {
+		add("ProgressInterval and ProgressBytes must not be negative")
+	}
+	if config.RelayBufferSize < 0 {
+		add("RelayBufferSize %d is negative", config.RelayBufferSize)
+	}
+	if config.BandwidthLimit < 0 {
+		add("BandwidthLimit %d is negative", config.BandwidthLimit)
+	}
+	if l := config.PortClassLimits; l.Interactive < 0 || l.Web < 0 || l.Bulk < 0 {
+		add("PortClassLimits must not be negative")
+	}
+	if config.MaxMemory < 0 || config.MemoryShedIdle < 0 {
+		add("MaxMemory and MemoryShedIdle must not be negative")
+	}
+	if config.MaxAuthMethods < 0 || config.MaxAuthMethods > 255 {
+		add("MaxAuthMethods %d is out of range 0-255", config.MaxAuthMethods)
+	}
+	if config.UDPAmplificationRatio < 0 {
+		add("UDPAmplificationRatio %d is negative", config.UDPAmplificationRatio)
+	}
+	if prefix := config.NAT64Prefix; prefix != nil {
+		ones, bits := prefix.Mask.Size()
+		if bits != 8*net.IPv6len || prefix.IP.To4() != nil || !validNAT64PrefixLength(ones) {
+			add("NAT64Prefix %s is not an IPv6 prefix of length 32, 40, 48, 56, 64 or 96", prefix)
+		}
+	}
+	if config.UDPBatchSize < 0 {
+		add("UDPBatchSize %d is negative", config.UDPBatchSize)
+	}
+	if config.Reputation != nil && config.Reputation.Provider == nil {
+		add("Reputation has no Provider")
+	}
+	if config.StatsFlushInterval < 0 {
+		add("StatsFlushInterval %s is negative", config.StatsFlushInterval)
+	}
+	if config.ParallelDial < 0 {
+		add("ParallelDial %d is negative", config.ParallelDial)
+	}
+	if config.MaxUDPAssociationsPerUser < 0 {
+		add("MaxUDPAssociationsPerUser %d is negative", config.MaxUDPAssociationsPerUser)
+	}
+	if config.UDPMaxLifetime < 0 {
+		add("UDPMaxLifetime %s is negative", config.UDPMaxLifetime)
+	}
+	if config.UDPMaxDatagrams < 0 {
+		add("UDPMaxDatagrams %d is negative", config.UDPMaxDatagrams)
+	}
+
+	if config.UDPPortMin != 0 || config.UDPPortMax != 0 {
+		if config.UDPPortMin <= 0 || config.UDPPortMax > 65535 || config.UDPPortMin > config.UDPPortMax {
+			add("UDP port range %d-%d is invalid", config.UDPPortMin, config.UDPPortMax)
+		}
+	}
+
+	if filter := config.SourceFilter; filter != nil {
+		for _, network := range append(append([]string(nil), filter.Allow...), filter.Deny...) {
+			if _, err := parseNetwork(network); err != nil {
+				add("SourceFilter: %w %q", ErrInvalidSourceNetwork, network)
+			}
+		}
+	}
+
+	for i, rule := range config.Rules {
+		for _, cidr := range rule.Networks {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				add("Rules[%d]: %w %q", i, ErrInvalidRuleNetwork, cidr)
+			}
+		}
+		if rule.DSCP > 63 {
+			add("Rules[%d]: DSCP %d is out of range 0-63", i, rule.DSCP)
+		} else if rule.DSCP != 0 && !dscpSupported {
+			add("Rules[%d]: %w", i, ErrDSCPNotSupported)
+		}
+		if rule.Expr != "" {
+			if _, err := compileExpr(rule.Expr); err != nil {
+				add("Rules[%d]: %w", i, err)
+			}
+		}
+		if rule.Priority < 0 {
+			add("Rules[%d]: Priority %d is negative", i, rule.Priority)
+		}
+		if rule.DialTimeout < 0 || rule.IdleTimeout < 0 {
+			add("Rules[%d]: negative timeout", i)
+		}
+		if rule.CacheHTTP && config.HTTPCache == nil {
+			add("Rules[%d]: CacheHTTP set without HTTPCache", i)
+		}
+		if rule.Capture && config.Capture == nil {
+			add("Rules[%d]: Capture set without Capture config", i)
+		}
+		for j := range rule.Windows {
+			if _, err := rule.Windows[j].compile(); err != nil {
+				add("Rules[%d]: %w", i, err)
+			}
+		}
+		if !rule.Action.valid() {
+			add("Rules[%d]: %w %q", i, ErrInvalidRuleAction, rule.Action)
+		} else if rule.Action == RuleSinkhole && config.Sinkhole == nil {
+			add("Rules[%d]: sinkhole action without Sinkhole", i)
+		}
+	}
+
+	if cache := config.HTTPCache; cache != nil {
+		if cache.MaxSize <= 0 {
+			add("HTTPCache.MaxSize must be positive")
+		}
+		if cache.TTL <= 0 {
+			add("HTTPCache.TTL must be positive")
+		}
+	}
+	if capture := config.Capture; capture != nil {
+		if capture.Dir == "" {
+			add("Capture.Dir is not set")
+		}
+		if capture.Format != CaptureRaw && capture.Format != CapturePCAP {
+			add("Capture.Format %d is not supported", capture.Format)
+		}
+	}
+	if tlsConfig := config.TLSConfig; tlsConfig != nil {
+		if len(tlsConfig.Certificates) == 0 && tlsConfig.GetCertificate == nil && tlsConfig.GetConfigForClient == nil {
+			add("TLSConfig has no certificate")
+		}
+	}
+	if guard := config.ScanGuard; guard != nil && guard.Threshold > 0 {
+		if guard.Window <= 0 || guard.BanDuration <= 0 {
+			add("ScanGuard.Window and BanDuration must be positive")
+		}
+	}
+	if breaker := config.CircuitBreaker; breaker != nil && breaker.Threshold > 0 {
+		if breaker.Window <= 0 || breaker.Cooldown <= 0 {
+			add("CircuitBreaker.Window and Cooldown must be positive")
+		}
+	}
+	if upstream := config.Upstream; upstream != nil {
+		if _, _, err := net.SplitHostPort(upstream.Address); err != nil {
+			add("Upstream.Address %q: %w", upstream.Address, err)
+		}
+	}
+	if egress := config.Egress; egress != nil {
+		if len(egress.Links) == 0 {
+			add("Egress has no links")
+		}
+		if config.Upstream != nil {
+			add("Egress cannot be combined with Upstream")
+		}
+		if egress.Policy < EgressRoundRobin || egress.Policy > EgressLatency {
+			add("Egress.Policy %d is not supported", egress.Policy)
+		}
+		for i, link := range egress.Links {
+			if link.LocalIP == nil && link.Interface == "" {
+				add("Egress.Links[%d] has neither LocalIP nor Interface", i)
+			}
+			if link.Interface != "" && !bindDeviceSupported {
+				add("Egress.Links[%d]: %w", i, ErrBindDeviceNotSupported)
+			}
+			if link.Weight < 0 {
+				add("Egress.Links[%d]: Weight %d is negative", i, link.Weight)
+			}
+		}
+		if egress.HealthCheck != "" {
+			if _, _, err := net.SplitHostPort(egress.HealthCheck); err != nil {
+				add("Egress.HealthCheck %q: %w", egress.HealthCheck, err)
+			}
+		}
+		if egress.HealthInterval < 0 || egress.HealthTimeout < 0 {
+			add("Egress.HealthInterval and HealthTimeout must not be negative")
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return &ConfigError{Errors: errs}
+}
@@ -0,0 +1,40 @@
+package socks5
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	if err := (&Config{AuthMethod: MethodNoAuth}).Validate(); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+
+	config := Config{
+		AuthMethod:  MethodPassword,
+		DialTimeout: -time.Second,
+		UDPPortMin:  2000,
+		UDPPortMax:  1000,
+		Rules:       []Rule{{Networks: []string{"10.0.0.0/33"}, CacheHTTP: true}},
+		Upstream:    &Upstream{Address: "proxy.example"},
+		CertAuth:    &CertAuth{Field: CertFieldCommonName},
+	}
+	err := config.Validate()
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) {
+		t.Fatalf("should get a *ConfigError but got %v", err)
+	}
+	if len(configErr.Errors) != 7 {
+		t.Fatalf("should report 7 problems but got %d: %s", len(configErr.Errors), err)
+	}
+	if !errors.Is(err, ErrPasswordCheckerNotSet) || !errors.Is(err, ErrInvalidRuleNetwork) {
+		t.Fatalf("should match the individual errors but got %s", err)
+	}
+	for _, want := range []string{"DialTimeout", "UDP port range", "Rules[0]", "Upstream.Address", "CertAuth"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("error should mention %s but got %s", want, err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidTimeWindow = errors.New("invalid time window")
+	ErrOutsideTimeWindow = errors.New("request outside the time windows of its rule")
+)
+
+// TimeWindow is a weekly period in which a Rule's requests are allowed,
+// e.g. Monday to Friday from 09:00 to 17:00.
+type TimeWindow struct {
+	// Days the window opens on. Empty means every day.
+	Days []time.Weekday
+	// From and To are times of day, "15:04". Empty From means "00:00" and
+	// empty To "24:00". A To before From ends the window the next day.
+	From, To string
+}
+
+// compiledWindow is a TimeWindow in minutes of the day.
+type compiledWindow struct {
+	days     [7]bool
+	from, to int
+}
+
+func (w *TimeWindow) compile() (compiledWindow, error) {
+	c := compiledWindow{to: 24 * 60}
+	for _, day := range w.Days {
+		if day < time.Sunday || day > time.Saturday {
+			return c, fmt.Errorf("%w: day %d", ErrInvalidTimeWindow, day)
+		}
+		c.days[day] = true
+	}
+	if len(w.Days) == 0 {
+		c.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	var err error
+	if w.From != "" {
+		if c.from, err = parseMinuteOfDay(w.From); err != nil {
+			return c, err
+		}
+	}
+	if w.To != "" {
+		if c.to, err = parseMinuteOfDay(w.To); err != nil {
+			return c, err
+		}
+	}
+	if c.from == c.to {
+		return c, fmt.Errorf("%w: empty window %s-%s", ErrInvalidTimeWindow, w.From, w.To)
+	}
+	return c, nil
+}
+
+// parseMinuteOfDay parses "15:04", or "24:00" for the end of the day.
+func parseMinuteOfDay(s string) (int, error) {
+	hour, minute, ok := strings.Cut(s, ":")
+	h, err1 := strconv.Atoi(hour)
+	m, err2 := strconv.Atoi(minute)
+	if !ok || err1 != nil || err2 != nil || len(hour) != 2 || len(minute) != 2 || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("%w: time of day %q", ErrInvalidTimeWindow, s)
+	}
+	return h*60 + m, nil
+}
+
+// end returns when w, opened on the day of midnight, closes if it is open
+// at now.
+func (w *compiledWindow) end(midnight, now time.Time) (time.Time, bool) {
+	day := midnight.Weekday()
+	minute := now.Hour()*60 + now.Minute()
+	closeAt := func(dayOffset, minute int) time.Time {
+		return time.Date(midnight.Year(), midnight.Month(), midnight.Day()+dayOffset, 0, minute, 0, 0, midnight.Location())
+	}
+	if w.from < w.to {
+		if w.days[day] && minute >= w.from && minute < w.to {
+			return closeAt(0, w.to), true
+		}
+		return time.Time{}, false
+	}
+	// The window spans midnight: opened today or yesterday
+	if w.days[day] && minute >= w.from {
+		return closeAt(1, w.to), true
+	}
+	if w.days[(day+6)%7] && minute < w.to {
+		return closeAt(0, w.to), true
+	}
+	return time.Time{}, false
+}
+
+// windowEnd reports whether the rule's windows are open at now and when
+// they close, following windows that adjoin.
+func (r *Rule) windowEnd(now time.Time) (time.Time, bool) {
+	loc := r.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	var end time.Time
+	open := false
+	// Bounded, as windows covering the whole week never close
+	for i := 0; i <= 7*len(r.windows); i++ {
+		t := now.In(loc)
+		midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		extended := false
+		for j := range r.windows {
+			if e, ok := r.windows[j].end(midnight, t); ok && e.After(now) {
+				if !extended || e.After(end) {
+					end = e
+				}
+				extended = true
+			}
+		}
+		if !extended {
+			break
+		}
+		open = true
+		now = end
+	}
+	return end, open
+}
+
+// endSessionAt closes session id with TerminationWindowClosed at end. The
+// returned function cancels it.
+func (s *SOCKS5Server) endSessionAt(id string, end time.Time) func() {
+	stop := timeAfterFunc(s.clock, end.Sub(timeNow(s.clock)), func() {
+		logSession(id, "access window closed")
+		s.CloseSession(id, TerminationWindowClosed)
+	})
+	return func() { stop() }
+}
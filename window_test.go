@@ -0,0 +1,101 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRuleWindowEnd(t *testing.T) {
+	utc := func(day, hour, minute int) time.Time {
+		// January 2024 starts on a Monday
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+	weekdays := []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+	tests := []struct {
+		name    string
+		windows []TimeWindow
+		now     time.Time
+		end     time.Time
+		open    bool
+	}{
+		{"business hours", []TimeWindow{{Days: weekdays, From: "09:00", To: "17:00"}}, utc(1, 10, 30), utc(1, 17, 0), true},
+		{"before opening", []TimeWindow{{Days: weekdays, From: "09:00", To: "17:00"}}, utc(1, 8, 59), time.Time{}, false},
+		{"at closing", []TimeWindow{{Days: weekdays, From: "09:00", To: "17:00"}}, utc(1, 17, 0), time.Time{}, false},
+		{"weekend", []TimeWindow{{Days: weekdays, From: "09:00", To: "17:00"}}, utc(6, 10, 0), time.Time{}, false},
+		{"overnight", []TimeWindow{{Days: []time.Weekday{time.Friday}, From: "22:00", To: "06:00"}}, utc(6, 2, 0), utc(6, 6, 0), true},
+		{"to midnight", []TimeWindow{{From: "20:00"}}, utc(3, 23, 0), utc(4, 0, 0), true},
+		{"adjoining", []TimeWindow{{From: "09:00", To: "12:00"}, {From: "12:00", To: "13:00"}}, utc(2, 11, 0), utc(2, 13, 0), true},
+	}
+	for _, tt := range tests {
+		rule := Rule{Windows: tt.windows, Location: time.UTC}
+		if err := rule.compile(0); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		end, open := rule.windowEnd(tt.now)
+		if open != tt.open || !end.Equal(tt.end) {
+			t.Fatalf("%s: should get %v, %v but got %v, %v", tt.name, tt.end, tt.open, end, open)
+		}
+	}
+
+	for _, window := range []TimeWindow{{From: "9:00"}, {To: "24:01"}, {From: "10:00", To: "10:00"}, {Days: []time.Weekday{7}}} {
+		rule := Rule{Windows: []TimeWindow{window}}
+		if err := rule.compile(0); !errors.Is(err, ErrInvalidTimeWindow) {
+			t.Fatalf("%+v: should get error %s but got %v", window, ErrInvalidTimeWindow, err)
+		}
+	}
+}
+
+func TestRuleWindowSessions(t *testing.T) {
+	clock := newFakeClock()
+	records := make(recorderChan, 1)
+	server := SOCKS5Server{clock: clock, Config: &Config{
+		AuthMethod: MethodNoAuth,
+		Recorder:   records,
+		Rules: []Rule{{
+			Windows:          []TimeWindow{{From: "09:00", To: "17:00"}},
+			Location:         time.UTC,
+			EndAtWindowClose: true,
+		}},
+	}}
+	host, portStr, _ := net.SplitHostPort(echoServer(t))
+	port, _ := strconv.Atoi(portStr)
+	request := func() (net.Conn, *ServerReplyMessage) {
+		clientConn, serverConn := tcpPair(t)
+		go server.ServeConn(serverConn)
+		clientConn.Write([]byte{SOCKS5Version, 1, byte(MethodNoAuth)})
+		io.ReadFull(clientConn, make([]byte, 2))
+		WriteClientRequestMessage(clientConn, CmdConnect, host, uint16(port))
+		reply, err := NewServerReplyMessage(clientConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return clientConn, reply
+	}
+
+	// The fake clock starts at midnight
+	clientConn, reply := request()
+	clientConn.Close()
+	if reply.Reply != ReplyConnectionNotAllowed {
+		t.Fatalf("should refuse a request at night but got reply %d", reply.Reply)
+	}
+
+	clock.Advance(17*time.Hour - 50*time.Millisecond)
+	clientConn, reply = request()
+	defer clientConn.Close()
+	if reply.Reply != ReplySuccess {
+		t.Fatalf("should allow a request before 17:00 but got reply %d", reply.Reply)
+	}
+	clock.Advance(50 * time.Millisecond)
+	select {
+	case record := <-records:
+		if record.Termination != TerminationWindowClosed {
+			t.Fatalf("should end with %s but got %s", TerminationWindowClosed, record.Termination)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session should end when the window closes")
+	}
+}